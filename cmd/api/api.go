@@ -1,11 +1,32 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/channel"
+	"github.com/PatrickA727/mikrotik-db-sys/services/currency"
+	"github.com/PatrickA727/mikrotik-db-sys/services/events"
+	"github.com/PatrickA727/mikrotik-db-sys/services/idempotency"
 	"github.com/PatrickA727/mikrotik-db-sys/services/item"
+	"github.com/PatrickA727/mikrotik-db-sys/services/journal"
+	"github.com/PatrickA727/mikrotik-db-sys/services/mailer"
+	"github.com/PatrickA727/mikrotik-db-sys/services/marketplace"
+	"github.com/PatrickA727/mikrotik-db-sys/services/oidc"
+	"github.com/PatrickA727/mikrotik-db-sys/services/packing"
+	"github.com/PatrickA727/mikrotik-db-sys/services/payment"
+	"github.com/PatrickA727/mikrotik-db-sys/services/payout"
+	"github.com/PatrickA727/mikrotik-db-sys/services/reservation"
+	"github.com/PatrickA727/mikrotik-db-sys/services/salesorder"
+	"github.com/PatrickA727/mikrotik-db-sys/services/shipment"
+	"github.com/PatrickA727/mikrotik-db-sys/services/tax"
+	"github.com/PatrickA727/mikrotik-db-sys/services/tracking"
 	"github.com/PatrickA727/mikrotik-db-sys/services/user"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -27,7 +48,8 @@ func (s *APIServer) Run() error {
 	c := cors.New(cors.Options{
         AllowedOrigins:   []string{"http://localhost:5173","http://moengoet-inventory.my.id","https://app.moengoet-inventory.my.id", "http://localhost:3000","https://localhost:443","https://localhost"},
         AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"Origin", "Content-Type", "Authorization", "ngrok-skip-browser-warning"},
+        AllowedHeaders:   []string{"Origin", "Content-Type", "Authorization", "ngrok-skip-browser-warning", idempotency.Header, auth.CSRFHeader},
+        ExposedHeaders:   []string{idempotency.ReplayedHeader, auth.CSRFHeader},
         AllowCredentials: true,  // Important for cookie authentication
     })
 
@@ -36,15 +58,124 @@ func (s *APIServer) Run() error {
 	// Init stores
 	item_store := item.NewStore(s.db)
 	user_store := user.NewStore(s.db)
+	pack_store := packing.NewStore(s.db)
+	shipment_store := shipment.NewStore(s.db)
+	marketplace_store := marketplace.NewStore(s.db)
+	channel_store := channel.NewStore(s.db)
+	payout_store := payout.NewStore(s.db)
+	payment_store := payment.NewStore(s.db)
+	journal_store := journal.NewStore(s.db)
+	tax_store := tax.NewStore(s.db)
+	currency_store := currency.NewStore(s.db)
+	reservation_store := reservation.NewStore(s.db)
+	sales_order_store := salesorder.NewStore(s.db)
+	idempotency_store := idempotency.NewStore(s.db)
+	connectors := marketplace.ConnectorsFromEnv()
+	event_broker := events.NewBroker()
 
 	subrouter_item := router.PathPrefix("/api/item").Subrouter()
-	item_handler := item.NewHandler(item_store, user_store)
+	item_handler := item.NewHandler(item_store, user_store, pack_store, shipment_store, channel_store, journal_store, idempotency_store, event_broker)
 	item_handler.RegisterRoutes(subrouter_item)	
 
+	subrouter_pack := router.PathPrefix("/api/pack").Subrouter()
+	pack_handler := packing.NewHandler(pack_store, item_store, user_store)
+	pack_handler.RegisterRoutes(subrouter_pack)
+
+	subrouter_shipment := router.PathPrefix("/api/shipment").Subrouter()
+	shipment_handler := shipment.NewHandler(shipment_store, user_store, event_broker)
+	shipment_handler.RegisterRoutes(subrouter_shipment)
+
+	subrouter_channel := router.PathPrefix("/api/channel").Subrouter()
+	channel_handler := channel.NewHandler(channel_store, user_store)
+	channel_handler.RegisterRoutes(subrouter_channel)
+
+	subrouter_marketplace := router.PathPrefix("/api/marketplace").Subrouter()
+	marketplace_handler := marketplace.NewHandler(marketplace_store, item_store, user_store, event_broker, connectors)
+	marketplace_handler.RegisterRoutes(subrouter_marketplace)
+
+	subrouter_payout := router.PathPrefix("/api/payout").Subrouter()
+	payout_handler := payout.NewHandler(payout_store, user_store, connectors)
+	payout_handler.RegisterRoutes(subrouter_payout)
+
+	subrouter_payment := router.PathPrefix("/api/payment").Subrouter()
+	payment_handler := payment.NewHandler(payment_store, user_store)
+	payment_handler.RegisterRoutes(subrouter_payment)
+
+	subrouter_journal := router.PathPrefix("/api/journal").Subrouter()
+	journal_handler := journal.NewHandler(journal_store, user_store)
+	journal_handler.RegisterRoutes(subrouter_journal)
+
+	subrouter_tax := router.PathPrefix("/api/tax").Subrouter()
+	tax_handler := tax.NewHandler(tax_store, user_store)
+	tax_handler.RegisterRoutes(subrouter_tax)
+
+	subrouter_currency := router.PathPrefix("/api/currency").Subrouter()
+	currency_handler := currency.NewHandler(currency_store, user_store)
+	currency_handler.RegisterRoutes(subrouter_currency)
+
+	hold_hours, err := strconv.Atoi(os.Getenv("RESERVATION_HOLD_HOURS"))
+	if err != nil || hold_hours <= 0 {
+		hold_hours = 72
+	}
+
+	subrouter_reservation := router.PathPrefix("/api/reservation").Subrouter()
+	reservation_handler := reservation.NewHandler(reservation_store, item_store, channel_store, user_store, event_broker, time.Duration(hold_hours) * time.Hour)
+	reservation_handler.RegisterRoutes(subrouter_reservation)
+
+	order_hold_hours, err := strconv.Atoi(os.Getenv("SALES_ORDER_HOLD_HOURS"))
+	if err != nil || order_hold_hours <= 0 {
+		order_hold_hours = 72
+	}
+
+	subrouter_sales_order := router.PathPrefix("/api/sales-order").Subrouter()
+	sales_order_handler := salesorder.NewHandler(sales_order_store, item_store, channel_store, user_store, event_broker, time.Duration(order_hold_hours) * time.Hour)
+	sales_order_handler.RegisterRoutes(subrouter_sales_order)
+
+	subrouter_events := router.PathPrefix("/api/events").Subrouter()
+	events_handler := events.NewHandler(event_broker, user_store)
+	events_handler.RegisterRoutes(subrouter_events)
+
+	user_mailer, err := mailer.NewMailerFromEnv()
+	if err != nil {
+		return err
+	}
+
+	oidc_provider, err := oidc.NewProviderFromEnv()
+	if err != nil {
+		return err
+	}
+	if oidc_provider != nil {
+		log.Printf("Single sign-on with %s", oidc_provider.Issuer())
+	}
+
 	subrouter_user := router.PathPrefix("/api/user").Subrouter()
-	user_handler := user.NewHandler(user_store)
+	user_handler := user.NewHandler(user_store, user_mailer, oidc_provider)
 	user_handler.RegisterRoutes(subrouter_user)
 
+	// Background jobs
+	tracking_provider, err := tracking.NewProviderFromEnv()
+	if err != nil {
+		return err
+	}
+	if tracking_provider != nil {
+		interval, err := time.ParseDuration(os.Getenv("TRACKING_POLL_INTERVAL"))
+		if err != nil || interval <= 0 {
+			interval = 30 * time.Minute
+		}
+
+		tracking.NewPoller(shipment_store, tracking_provider, event_broker, interval).Start(context.Background())
+		log.Printf("Tracking shipments with %s every %v", tracking_provider.Name(), interval)
+	}
+
+	sweep_interval, err := time.ParseDuration(os.Getenv("RESERVATION_SWEEP_INTERVAL"))
+	if err != nil || sweep_interval <= 0 {
+		sweep_interval = 5 * time.Minute
+	}
+
+	reservation.NewExpirer(reservation_store, event_broker, sweep_interval).Start(context.Background())
+	salesorder.NewExpirer(sales_order_store, event_broker, sweep_interval).Start(context.Background())
+	idempotency.StartPurger(context.Background(), idempotency_store, time.Hour)
+
 	log.Println("Listening on port: ", s.ListenAddr)
 
 	return http.ListenAndServe(s.ListenAddr, c.Handler(router))
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pack_scans;
+DROP TABLE IF EXISTS pack_sessions;
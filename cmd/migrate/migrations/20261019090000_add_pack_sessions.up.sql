@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS pack_sessions (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'open',
+    override_by INT,
+    override_reason TEXT,
+    override_at TIMESTAMP,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (override_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_pack_sessions_invoice ON pack_sessions(invoice_id);
+
+CREATE TABLE IF NOT EXISTS pack_scans (
+    id SERIAL PRIMARY KEY,
+    session_id INT NOT NULL,
+    rfid_tag VARCHAR(255) NOT NULL,
+    result VARCHAR(50) NOT NULL,
+    scannedat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (session_id) REFERENCES pack_sessions(id) ON DELETE CASCADE
+);
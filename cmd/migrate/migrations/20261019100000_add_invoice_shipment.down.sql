@@ -0,0 +1,10 @@
+ALTER TABLE invoice
+DROP COLUMN courier,
+DROP COLUMN courier_service,
+DROP COLUMN tracking_number,
+DROP COLUMN shipped_at,
+DROP COLUMN package_weight,
+DROP COLUMN shipping_cost,
+DROP COLUMN tracking_status,
+DROP COLUMN tracking_checked_at,
+DROP COLUMN delivered_at;
@@ -0,0 +1,10 @@
+ALTER TABLE invoice
+ADD COLUMN courier VARCHAR(100),
+ADD COLUMN courier_service VARCHAR(100),
+ADD COLUMN tracking_number VARCHAR(255),
+ADD COLUMN shipped_at TIMESTAMP,
+ADD COLUMN package_weight INT,
+ADD COLUMN shipping_cost BIGINT,
+ADD COLUMN tracking_status VARCHAR(255),
+ADD COLUMN tracking_checked_at TIMESTAMP,
+ADD COLUMN delivered_at TIMESTAMP;
@@ -0,0 +1,23 @@
+ALTER TABLE invoice
+ADD COLUMN courier VARCHAR(100),
+ADD COLUMN courier_service VARCHAR(100),
+ADD COLUMN tracking_number VARCHAR(255),
+ADD COLUMN package_weight INT,
+ADD COLUMN shipping_cost BIGINT,
+ADD COLUMN tracking_status VARCHAR(255),
+ADD COLUMN tracking_checked_at TIMESTAMP;
+
+-- Keeps the latest shipment of each invoice
+UPDATE invoice i
+SET courier = sh.courier, courier_service = sh.courier_service, tracking_number = sh.tracking_number,
+    package_weight = sh.package_weight, shipping_cost = sh.shipping_cost,
+    tracking_status = sh.tracking_status, tracking_checked_at = sh.tracking_checked_at
+FROM (SELECT DISTINCT ON (invoice_id) * FROM shipments ORDER BY invoice_id, id DESC) sh
+WHERE sh.invoice_id = i.id;
+
+UPDATE invoice SET status = 'shipped' WHERE status = 'partially-shipped';
+
+ALTER TABLE sold_items
+DROP COLUMN shipment_id;
+
+DROP TABLE IF EXISTS shipments;
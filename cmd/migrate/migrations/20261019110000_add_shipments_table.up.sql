@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS shipments (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'shipped',
+    courier VARCHAR(100),
+    courier_service VARCHAR(100),
+    tracking_number VARCHAR(255),
+    package_weight INT,
+    shipping_cost BIGINT,
+    tracking_status VARCHAR(255),
+    tracking_checked_at TIMESTAMP,
+    shipped_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_shipments_invoice ON shipments(invoice_id);
+
+ALTER TABLE sold_items
+ADD COLUMN shipment_id INT REFERENCES shipments(id) ON DELETE SET NULL;
+
+-- Invoices shipped before partial shipments become a single shipment holding all of their items
+INSERT INTO shipments (invoice_id, status, courier, courier_service, tracking_number, package_weight,
+                       shipping_cost, tracking_status, tracking_checked_at, shipped_at, delivered_at)
+SELECT id, CASE WHEN status = 'delivered' THEN 'delivered' ELSE 'shipped' END, courier, courier_service,
+       tracking_number, package_weight, shipping_cost, tracking_status, tracking_checked_at,
+       COALESCE(shipped_at, CURRENT_TIMESTAMP), delivered_at
+FROM invoice
+WHERE status IN ('shipped', 'delivered');
+
+UPDATE sold_items s
+SET shipment_id = sh.id
+FROM shipments sh
+WHERE sh.invoice_id = s.invoice_id;
+
+ALTER TABLE invoice
+DROP COLUMN courier,
+DROP COLUMN courier_service,
+DROP COLUMN tracking_number,
+DROP COLUMN package_weight,
+DROP COLUMN shipping_cost,
+DROP COLUMN tracking_status,
+DROP COLUMN tracking_checked_at;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS marketplace_skus;
+DROP TABLE IF EXISTS marketplace_order_lines;
+DROP TABLE IF EXISTS marketplace_orders;
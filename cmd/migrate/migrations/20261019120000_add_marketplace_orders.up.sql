@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS marketplace_orders (
+    id SERIAL PRIMARY KEY,
+    marketplace VARCHAR(50) NOT NULL,
+    external_id VARCHAR(255) NOT NULL,
+    invoice_id INT NOT NULL,
+    buyer_name VARCHAR(255),
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    ordered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (marketplace, external_id),
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS marketplace_order_lines (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL,
+    sku VARCHAR(255) NOT NULL,
+    product_name VARCHAR(255),
+    type_ref VARCHAR(255),
+    quantity INT NOT NULL,
+    unit_price BIGINT NOT NULL DEFAULT 0,
+    allocated INT NOT NULL DEFAULT 0,
+    FOREIGN KEY (order_id) REFERENCES marketplace_orders(id) ON DELETE CASCADE,
+    FOREIGN KEY (type_ref) REFERENCES item_type(item_type) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS marketplace_skus (
+    id SERIAL PRIMARY KEY,
+    marketplace VARCHAR(50) NOT NULL,
+    sku VARCHAR(255) NOT NULL,
+    type_ref VARCHAR(255) NOT NULL,
+    UNIQUE (marketplace, sku),
+    FOREIGN KEY (type_ref) REFERENCES item_type(item_type) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+ALTER TABLE sold_items
+DROP CONSTRAINT IF EXISTS fk_sold_items_channel;
+
+ALTER TABLE invoice
+DROP CONSTRAINT IF EXISTS fk_invoice_channel;
+
+DROP TABLE IF EXISTS channels;
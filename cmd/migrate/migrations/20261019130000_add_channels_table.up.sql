@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS channels (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    fee_percent NUMERIC(5, 2) NOT NULL DEFAULT 0,
+    settings JSONB NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT true,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_channels_name_lower ON channels(LOWER(name));
+
+INSERT INTO channels (name) VALUES ('Tokopedia'), ('Shopee'), ('Offline');
+
+-- Spellings seen in the free-text columns, matched after trimming and lower-casing
+CREATE TEMP TABLE channel_aliases (alias VARCHAR(50) PRIMARY KEY, name VARCHAR(50) NOT NULL);
+INSERT INTO channel_aliases (alias, name) VALUES
+    ('tokopedia', 'Tokopedia'), ('tokped', 'Tokopedia'), ('toped', 'Tokopedia'), ('tokopedia.com', 'Tokopedia'),
+    ('shopee', 'Shopee'), ('shoppe', 'Shopee'), ('shopee.co.id', 'Shopee'),
+    ('offline', 'Offline'), ('toko', 'Offline'), ('store', 'Offline'), ('langsung', 'Offline');
+
+UPDATE invoice SET online_shop = NULLIF(TRIM(online_shop), '');
+UPDATE sold_items SET ol_shop = NULLIF(TRIM(ol_shop), '');
+
+UPDATE invoice i SET online_shop = a.name FROM channel_aliases a WHERE LOWER(i.online_shop) = a.alias;
+UPDATE sold_items s SET ol_shop = a.name FROM channel_aliases a WHERE LOWER(s.ol_shop) = a.alias;
+
+-- Anything else becomes its own channel, spellings differing only in case share the first one seen
+INSERT INTO channels (name)
+SELECT DISTINCT ON (LOWER(shop)) shop
+FROM (
+    SELECT online_shop AS shop, id FROM invoice WHERE online_shop IS NOT NULL
+    UNION ALL
+    SELECT ol_shop, invoice_id FROM sold_items WHERE ol_shop IS NOT NULL
+) shops
+ORDER BY LOWER(shop), id
+ON CONFLICT DO NOTHING;
+
+UPDATE invoice i SET online_shop = c.name FROM channels c WHERE LOWER(i.online_shop) = LOWER(c.name);
+UPDATE sold_items s SET ol_shop = c.name FROM channels c WHERE LOWER(s.ol_shop) = LOWER(c.name);
+
+-- The invoice is the source of truth for its items
+UPDATE sold_items s SET ol_shop = i.online_shop FROM invoice i WHERE s.invoice_id = i.id AND i.online_shop IS NOT NULL;
+
+DROP TABLE channel_aliases;
+
+ALTER TABLE invoice
+ADD CONSTRAINT fk_invoice_channel
+FOREIGN KEY (online_shop) REFERENCES channels(name) ON UPDATE CASCADE;
+
+ALTER TABLE sold_items
+ADD CONSTRAINT fk_sold_items_channel
+FOREIGN KEY (ol_shop) REFERENCES channels(name) ON UPDATE CASCADE;
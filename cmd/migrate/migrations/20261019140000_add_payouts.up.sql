@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS payouts (
+    id SERIAL PRIMARY KEY,
+    marketplace VARCHAR(50) NOT NULL,
+    reference VARCHAR(64) NOT NULL,
+    importedat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (marketplace, reference)
+);
+
+CREATE TABLE IF NOT EXISTS payout_lines (
+    id SERIAL PRIMARY KEY,
+    payout_id INT NOT NULL,
+    invoice_id INT,
+    invoice_str VARCHAR(255) NOT NULL,
+    gross BIGINT NOT NULL DEFAULT 0,
+    fees BIGINT NOT NULL DEFAULT 0,
+    net BIGINT NOT NULL DEFAULT 0,
+    settled_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (payout_id) REFERENCES payouts(id) ON DELETE CASCADE,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_payout_lines_invoice ON payout_lines(invoice_id);
+CREATE INDEX idx_payout_lines_invoice_str ON payout_lines(invoice_str);
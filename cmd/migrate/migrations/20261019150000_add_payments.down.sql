@@ -0,0 +1,2 @@
+DROP VIEW IF EXISTS invoice_balances;
+DROP TABLE IF EXISTS payments;
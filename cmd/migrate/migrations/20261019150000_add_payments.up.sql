@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    kind VARCHAR(20) NOT NULL DEFAULT 'payment',
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    method VARCHAR(50) NOT NULL,
+    paid_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reference VARCHAR(255),
+    payout_line_id INT UNIQUE,
+    recorded_by INT,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE,
+    FOREIGN KEY (payout_line_id) REFERENCES payout_lines(id) ON DELETE CASCADE,
+    FOREIGN KEY (recorded_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_payments_invoice ON payments(invoice_id);
+
+-- Payouts reconciled before payments existed count as paid at their gross amount
+INSERT INTO payments (invoice_id, kind, amount, method, paid_at, reference, payout_line_id)
+SELECT invoice_id, 'payment', gross, 'marketplace', settled_at, 'payout ' || payout_id, id
+FROM payout_lines
+WHERE invoice_id IS NOT NULL AND gross > 0;
+
+-- Amount due is the list price of the invoice's items
+CREATE VIEW invoice_balances AS
+SELECT i.id AS invoice_id,
+       COALESCE(d.amount_due, 0) AS amount_due,
+       COALESCE(p.paid, 0) AS paid,
+       COALESCE(p.refunded, 0) AS refunded,
+       CASE
+           WHEN COALESCE(p.refunded, 0) > 0 AND COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'refunded'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'unpaid'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) < COALESCE(d.amount_due, 0) THEN 'partial'
+           ELSE 'paid'
+       END AS payment_status,
+       d.sold_at
+FROM invoice i
+LEFT JOIN (
+    SELECT s.invoice_id, SUM(t.price) AS amount_due, MIN(s.datetime_sold) AS sold_at
+    FROM sold_items s
+    JOIN items it ON s.item_id = it.id
+    JOIN item_type t ON it.type_ref = t.item_type
+    GROUP BY s.invoice_id
+) d ON d.invoice_id = i.id
+LEFT JOIN (
+    SELECT invoice_id,
+           SUM(amount) FILTER (WHERE kind = 'payment') AS paid,
+           SUM(amount) FILTER (WHERE kind = 'refund') AS refunded
+    FROM payments
+    GROUP BY invoice_id
+) p ON p.invoice_id = i.id;
@@ -0,0 +1,6 @@
+ALTER TABLE invoice
+DROP COLUMN IF EXISTS journaled_at;
+
+DROP TABLE IF EXISTS journal_lines;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS journal_accounts;
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS journal_accounts (
+    key VARCHAR(50) PRIMARY KEY,
+    code VARCHAR(50) NOT NULL,
+    name VARCHAR(255) NOT NULL
+);
+
+INSERT INTO journal_accounts (key, code, name) VALUES
+    ('receivable', '1-1300', 'Piutang Usaha'),
+    ('inventory', '1-1400', 'Persediaan Barang Dagang'),
+    ('revenue', '4-1000', 'Penjualan'),
+    ('cogs', '5-1000', 'Harga Pokok Penjualan'),
+    ('marketplace_fees', '6-1500', 'Biaya Marketplace');
+
+-- invoice_id has no foreign key, entries outlive deleted invoices and carry their reversal
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    invoice_str VARCHAR(255) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    entry_date DATE NOT NULL,
+    description TEXT NOT NULL,
+    reverses_id INT UNIQUE REFERENCES journal_entries(id),
+    exported_at TIMESTAMP,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_journal_entries_invoice ON journal_entries(invoice_id);
+CREATE INDEX idx_journal_entries_date ON journal_entries(entry_date);
+
+CREATE TABLE IF NOT EXISTS journal_lines (
+    id SERIAL PRIMARY KEY,
+    entry_id INT NOT NULL,
+    account VARCHAR(50) NOT NULL,
+    debit BIGINT NOT NULL DEFAULT 0,
+    credit BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (entry_id) REFERENCES journal_entries(id) ON DELETE CASCADE,
+    FOREIGN KEY (account) REFERENCES journal_accounts(key)
+);
+
+ALTER TABLE invoice
+ADD COLUMN journaled_at TIMESTAMP;
@@ -0,0 +1,47 @@
+DELETE FROM journal_lines WHERE account = 'tax_payable';
+DELETE FROM journal_accounts WHERE key = 'tax_payable';
+
+DROP VIEW IF EXISTS invoice_balances;
+DROP VIEW IF EXISTS sold_item_amounts;
+
+CREATE VIEW invoice_balances AS
+SELECT i.id AS invoice_id,
+       COALESCE(d.amount_due, 0) AS amount_due,
+       COALESCE(p.paid, 0) AS paid,
+       COALESCE(p.refunded, 0) AS refunded,
+       CASE
+           WHEN COALESCE(p.refunded, 0) > 0 AND COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'refunded'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'unpaid'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) < COALESCE(d.amount_due, 0) THEN 'partial'
+           ELSE 'paid'
+       END AS payment_status,
+       d.sold_at
+FROM invoice i
+LEFT JOIN (
+    SELECT s.invoice_id, SUM(t.price) AS amount_due, MIN(s.datetime_sold) AS sold_at
+    FROM sold_items s
+    JOIN items it ON s.item_id = it.id
+    JOIN item_type t ON it.type_ref = t.item_type
+    GROUP BY s.invoice_id
+) d ON d.invoice_id = i.id
+LEFT JOIN (
+    SELECT invoice_id,
+           SUM(amount) FILTER (WHERE kind = 'payment') AS paid,
+           SUM(amount) FILTER (WHERE kind = 'refund') AS refunded
+    FROM payments
+    GROUP BY invoice_id
+) p ON p.invoice_id = i.id;
+
+ALTER TABLE sold_items
+DROP COLUMN price_includes_tax,
+DROP COLUMN tax_rate,
+DROP COLUMN unit_price;
+
+ALTER TABLE channels
+DROP COLUMN price_includes_tax;
+
+ALTER TABLE item_type
+DROP COLUMN price_includes_tax,
+DROP COLUMN tax_rate_id;
+
+DROP TABLE IF EXISTS tax_rates;
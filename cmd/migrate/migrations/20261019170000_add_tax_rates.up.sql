@@ -0,0 +1,77 @@
+CREATE TABLE IF NOT EXISTS tax_rates (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    rate NUMERIC(5, 2) NOT NULL CHECK (rate >= 0 AND rate < 100),
+    is_default BOOLEAN NOT NULL DEFAULT false,
+    active BOOLEAN NOT NULL DEFAULT true,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_tax_rates_default ON tax_rates(is_default) WHERE is_default;
+
+INSERT INTO tax_rates (name, rate, is_default) VALUES ('PPN 11%', 11, true), ('Non-PPN', 0, false);
+
+-- NULL falls back to the default rate and to the channel's pricing
+ALTER TABLE item_type
+ADD COLUMN tax_rate_id INT REFERENCES tax_rates(id) ON DELETE SET NULL,
+ADD COLUMN price_includes_tax BOOLEAN;
+
+-- Marketplace and shop prices are shown to buyers with PPN included
+ALTER TABLE channels
+ADD COLUMN price_includes_tax BOOLEAN NOT NULL DEFAULT true;
+
+-- Price and tax are fixed when the item is sold so rate changes do not rewrite filed periods
+ALTER TABLE sold_items
+ADD COLUMN unit_price BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN tax_rate NUMERIC(5, 2) NOT NULL DEFAULT 0,
+ADD COLUMN price_includes_tax BOOLEAN NOT NULL DEFAULT true;
+
+-- Sales before this migration had no tax setup, they keep tax_rate 0 so the tax summary reports no output
+-- tax for those periods. If some of them were filed with PPN, set their tax_rate by hand for those dates.
+-- The price is the current list price, the best record there is of what they sold for
+UPDATE sold_items s
+SET unit_price = t.price, tax_rate = 0
+FROM items i JOIN item_type t ON i.type_ref = t.item_type
+WHERE s.item_id = i.id;
+
+CREATE VIEW sold_item_amounts AS
+SELECT s.id AS sold_item_id, s.invoice_id, s.datetime_sold, s.tax_rate, s.price_includes_tax,
+       a.tax, a.gross - a.tax AS base, a.gross
+FROM sold_items s
+CROSS JOIN LATERAL (
+    SELECT CASE WHEN s.price_includes_tax THEN ROUND(s.unit_price * s.tax_rate / (100 + s.tax_rate))
+                ELSE ROUND(s.unit_price * s.tax_rate / 100) END::BIGINT AS tax,
+           CASE WHEN s.price_includes_tax THEN s.unit_price
+                ELSE s.unit_price + ROUND(s.unit_price * s.tax_rate / 100)::BIGINT END AS gross
+) a;
+
+-- Amount due now includes tax on tax-exclusive sales
+DROP VIEW invoice_balances;
+CREATE VIEW invoice_balances AS
+SELECT i.id AS invoice_id,
+       COALESCE(d.amount_due, 0) AS amount_due,
+       COALESCE(d.tax, 0) AS tax,
+       COALESCE(p.paid, 0) AS paid,
+       COALESCE(p.refunded, 0) AS refunded,
+       CASE
+           WHEN COALESCE(p.refunded, 0) > 0 AND COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'refunded'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'unpaid'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) < COALESCE(d.amount_due, 0) THEN 'partial'
+           ELSE 'paid'
+       END AS payment_status,
+       d.sold_at
+FROM invoice i
+LEFT JOIN (
+    SELECT invoice_id, SUM(gross) AS amount_due, SUM(tax) AS tax, MIN(datetime_sold) AS sold_at
+    FROM sold_item_amounts
+    GROUP BY invoice_id
+) d ON d.invoice_id = i.id
+LEFT JOIN (
+    SELECT invoice_id,
+           SUM(amount) FILTER (WHERE kind = 'payment') AS paid,
+           SUM(amount) FILTER (WHERE kind = 'refund') AS refunded
+    FROM payments
+    GROUP BY invoice_id
+) p ON p.invoice_id = i.id;
+
+INSERT INTO journal_accounts (key, code, name) VALUES ('tax_payable', '2-1300', 'PPN Keluaran');
@@ -0,0 +1,23 @@
+UPDATE journal_lines SET debit = debit / 100, credit = credit / 100;
+UPDATE payments SET amount = amount / 100;
+UPDATE payout_lines SET gross = gross / 100, fees = fees / 100, net = net / 100;
+UPDATE marketplace_order_lines SET unit_price = unit_price / 100;
+UPDATE shipments SET shipping_cost = shipping_cost / 100;
+UPDATE sold_items SET unit_price = unit_price / 100;
+
+UPDATE items SET modal = modal / 100, keuntungan = keuntungan / 100;
+
+ALTER TABLE items
+DROP COLUMN modal_currency,
+ALTER COLUMN modal SET DEFAULT 700000,
+ALTER COLUMN keuntungan SET DEFAULT 700000;
+
+UPDATE item_type SET price = price / 100;
+
+ALTER TABLE item_type
+DROP COLUMN price_currency,
+ALTER COLUMN price TYPE INT;
+
+DROP FUNCTION IF EXISTS to_base_minor(BIGINT, CHAR(3), TIMESTAMP);
+DROP TABLE IF EXISTS exchange_rates;
+DROP TABLE IF EXISTS currencies;
@@ -0,0 +1,65 @@
+CREATE TABLE IF NOT EXISTS currencies (
+    code CHAR(3) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    exponent INT NOT NULL,
+    is_base BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX idx_currencies_base ON currencies(is_base) WHERE is_base;
+
+INSERT INTO currencies (code, name, exponent, is_base) VALUES
+    ('IDR', 'Indonesian Rupiah', 2, true),
+    ('USD', 'US Dollar', 2, false),
+    ('EUR', 'Euro', 2, false),
+    ('SGD', 'Singapore Dollar', 2, false),
+    ('MYR', 'Malaysian Ringgit', 2, false),
+    ('CNY', 'Chinese Yuan', 2, false),
+    ('JPY', 'Japanese Yen', 0, false);
+
+-- rate is base currency per one whole unit of the currency, valid from effective_date until the next rate
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    id SERIAL PRIMARY KEY,
+    currency CHAR(3) NOT NULL REFERENCES currencies(code),
+    rate NUMERIC(20, 8) NOT NULL CHECK (rate > 0),
+    effective_date DATE NOT NULL,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (currency, effective_date)
+);
+
+-- Converts minor units of any currency to minor units of the base currency at the rate in force on the
+-- given date, NULL when no rate is known yet
+CREATE FUNCTION to_base_minor(amount BIGINT, currency CHAR(3), at TIMESTAMP) RETURNS BIGINT AS $$
+    SELECT CASE
+        WHEN c.is_base THEN $1
+        ELSE ROUND($1::NUMERIC / 10 ^ c.exponent * r.rate * 10 ^ b.exponent)::BIGINT
+    END
+    FROM currencies c
+    CROSS JOIN currencies b
+    LEFT JOIN LATERAL (
+        SELECT rate FROM exchange_rates
+        WHERE exchange_rates.currency = c.code AND effective_date <= $3
+        ORDER BY effective_date DESC LIMIT 1
+    ) r ON true
+    WHERE c.code = $2 AND b.is_base
+$$ LANGUAGE SQL STABLE;
+
+-- Every amount becomes minor units, the rupiah has two decimals in ISO 4217
+ALTER TABLE item_type
+ALTER COLUMN price TYPE BIGINT,
+ADD COLUMN price_currency CHAR(3) NOT NULL DEFAULT 'IDR' REFERENCES currencies(code);
+
+UPDATE item_type SET price = price * 100;
+
+ALTER TABLE items
+ALTER COLUMN modal SET DEFAULT 70000000,
+ALTER COLUMN keuntungan SET DEFAULT 70000000,
+ADD COLUMN modal_currency CHAR(3) NOT NULL DEFAULT 'IDR' REFERENCES currencies(code);
+
+UPDATE items SET modal = modal * 100, keuntungan = keuntungan * 100;
+
+UPDATE sold_items SET unit_price = unit_price * 100;
+UPDATE shipments SET shipping_cost = shipping_cost * 100;
+UPDATE marketplace_order_lines SET unit_price = unit_price * 100;
+UPDATE payout_lines SET gross = gross * 100, fees = fees * 100, net = net * 100;
+UPDATE payments SET amount = amount * 100;
+UPDATE journal_lines SET debit = debit * 100, credit = credit * 100;
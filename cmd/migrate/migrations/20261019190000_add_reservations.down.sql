@@ -0,0 +1,4 @@
+UPDATE items SET status = 'not sold' WHERE status = 'reserved';
+
+DROP TABLE IF EXISTS reservation_items;
+DROP TABLE IF EXISTS reservations;
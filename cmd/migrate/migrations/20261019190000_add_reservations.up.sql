@@ -0,0 +1,29 @@
+-- A reservation holds specific items for a prospective buyer, the items are 'reserved' while it is active
+CREATE TABLE IF NOT EXISTS reservations (
+    id SERIAL PRIMARY KEY,
+    customer_name VARCHAR(255) NOT NULL,
+    customer_contact VARCHAR(255),
+    ol_shop VARCHAR(255),
+    notes TEXT,
+    status VARCHAR(50) NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMP NOT NULL,
+    invoice_id INT,
+    created_by INT,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP,
+    FOREIGN KEY (ol_shop) REFERENCES channels(name) ON UPDATE CASCADE,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE SET NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_reservations_active_expiry ON reservations(expires_at) WHERE status = 'active';
+
+CREATE TABLE IF NOT EXISTS reservation_items (
+    reservation_id INT NOT NULL,
+    item_id INT NOT NULL,
+    PRIMARY KEY (reservation_id, item_id),
+    FOREIGN KEY (reservation_id) REFERENCES reservations(id) ON DELETE CASCADE,
+    FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_reservation_items_item ON reservation_items(item_id);
@@ -0,0 +1,6 @@
+UPDATE items SET status = 'not sold' WHERE status = 'allocated';
+
+DROP INDEX IF EXISTS idx_items_fifo;
+DROP TABLE IF EXISTS sales_order_items;
+DROP TABLE IF EXISTS sales_order_lines;
+DROP TABLE IF EXISTS sales_orders;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS sales_orders (
+    id SERIAL PRIMARY KEY,
+    invoice_str VARCHAR(255) NOT NULL,
+    ol_shop VARCHAR(255) NOT NULL,
+    customer_name VARCHAR(255),
+    status VARCHAR(50) NOT NULL DEFAULT 'open',
+    invoice_id INT,
+    created_by INT,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP,
+    FOREIGN KEY (ol_shop) REFERENCES channels(name) ON UPDATE CASCADE,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE SET NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS sales_order_lines (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL,
+    type_ref VARCHAR(255) NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    FOREIGN KEY (order_id) REFERENCES sales_orders(id) ON DELETE CASCADE,
+    FOREIGN KEY (type_ref) REFERENCES item_type(item_type) ON UPDATE CASCADE
+);
+
+-- The items picked for a line, confirmed once scanned
+CREATE TABLE IF NOT EXISTS sales_order_items (
+    line_id INT NOT NULL,
+    item_id INT NOT NULL,
+    confirmed BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (line_id, item_id),
+    FOREIGN KEY (line_id) REFERENCES sales_order_lines(id) ON DELETE CASCADE,
+    FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_sales_order_items_item ON sales_order_items(item_id);
+
+-- Oldest stock first
+CREATE INDEX idx_items_fifo ON items(type_ref, batch, createdat) WHERE status = 'not sold';
@@ -0,0 +1,16 @@
+-- Requests signed by a device rather than made by a logged in user have user_id 0 and the device's ID, and
+-- device_id is 0 otherwise
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INT NOT NULL,
+    device_id INT NOT NULL DEFAULT 0,
+    idem_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT,
+    content_type VARCHAR(255),
+    body BYTEA,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+    PRIMARY KEY (user_id, device_id, idem_key)
+);
+
+CREATE INDEX idx_idempotency_keys_createdat ON idempotency_keys(createdat);
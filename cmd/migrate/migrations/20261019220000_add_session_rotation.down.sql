@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_sessions_family;
+
+ALTER TABLE sessions
+DROP COLUMN rotated_at,
+DROP COLUMN replaced_by,
+DROP COLUMN family_id;
@@ -0,0 +1,12 @@
+-- Every refresh replaces the session row, the rows of one login share a family so reuse of a replaced
+-- token can revoke all of them
+ALTER TABLE sessions
+ADD COLUMN family_id VARCHAR(64),
+ADD COLUMN replaced_by INT REFERENCES sessions(id) ON DELETE SET NULL,
+ADD COLUMN rotated_at TIMESTAMP;
+
+UPDATE sessions SET family_id = 'legacy-' || id;
+
+ALTER TABLE sessions ALTER COLUMN family_id SET NOT NULL;
+
+CREATE INDEX idx_sessions_family ON sessions(family_id);
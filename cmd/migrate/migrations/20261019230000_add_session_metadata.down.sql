@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_sessions_userid_active;
+
+ALTER TABLE sessions
+DROP COLUMN last_used_at,
+DROP COLUMN ip_address,
+DROP COLUMN user_agent;
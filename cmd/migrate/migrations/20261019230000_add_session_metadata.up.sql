@@ -0,0 +1,9 @@
+-- What the user sees of each login on the sessions page, a rotation records the device that refreshed
+ALTER TABLE sessions
+ADD COLUMN user_agent VARCHAR(512),
+ADD COLUMN ip_address VARCHAR(64),
+ADD COLUMN last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE sessions SET last_used_at = COALESCE(rotated_at, createdat);
+
+CREATE INDEX idx_sessions_userid_active ON sessions(userid) WHERE is_revoked = FALSE;
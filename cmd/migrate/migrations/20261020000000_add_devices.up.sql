@@ -0,0 +1,11 @@
+-- Each handheld and desk reader signs with its own key, the secret has to stay readable to check HMACs
+CREATE TABLE IF NOT EXISTS devices (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_id VARCHAR(64) NOT NULL UNIQUE,
+    secret VARCHAR(128) NOT NULL,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
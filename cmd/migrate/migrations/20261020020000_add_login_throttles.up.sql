@@ -0,0 +1,23 @@
+-- Failed logins counted per account (the email typed, known or not) and per client IP
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, subject)
+);
+
+CREATE TABLE IF NOT EXISTS auth_events (
+    id BIGSERIAL PRIMARY KEY,
+    userid INT REFERENCES users(id) ON DELETE SET NULL,
+    email VARCHAR(255),
+    event VARCHAR(32) NOT NULL,
+    ip_address VARCHAR(64),
+    user_agent VARCHAR(512),
+    detail TEXT,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_auth_events_user ON auth_events(userid, createdat);
+CREATE INDEX idx_auth_events_createdat ON auth_events(createdat);
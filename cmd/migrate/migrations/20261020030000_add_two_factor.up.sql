@@ -0,0 +1,20 @@
+-- totp_secret is set at enrollment and only counts once totp_enabled_at is, totp_last_step stops a code
+-- being used twice
+ALTER TABLE users
+ADD COLUMN totp_secret VARCHAR(64),
+ADD COLUMN totp_enabled_at TIMESTAMP,
+ADD COLUMN totp_last_step BIGINT;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    userid INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (userid, code_hash)
+);
+
+-- Roles that may not log in without two-factor authentication
+CREATE TABLE IF NOT EXISTS mfa_required_roles (
+    role VARCHAR(255) PRIMARY KEY
+);
@@ -0,0 +1,2 @@
+-- Deactivated users keep their row so invoices, journals and the audit log still point at them
+ALTER TABLE users ADD COLUMN deactivated_at TIMESTAMP;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_users_oidc;
+
+ALTER TABLE users
+DROP COLUMN oidc_subject,
+DROP COLUMN oidc_issuer;
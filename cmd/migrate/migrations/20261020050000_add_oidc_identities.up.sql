@@ -0,0 +1,6 @@
+-- The identity provider account a user logs in with, the subject is stable where emails may change
+ALTER TABLE users
+ADD COLUMN oidc_issuer VARCHAR(255),
+ADD COLUMN oidc_subject VARCHAR(255);
+
+CREATE UNIQUE INDEX idx_users_oidc ON users(oidc_issuer, oidc_subject) WHERE oidc_subject IS NOT NULL;
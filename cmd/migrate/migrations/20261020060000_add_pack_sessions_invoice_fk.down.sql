@@ -0,0 +1,2 @@
+ALTER TABLE pack_sessions
+DROP CONSTRAINT IF EXISTS pack_sessions_invoice_id_fkey;
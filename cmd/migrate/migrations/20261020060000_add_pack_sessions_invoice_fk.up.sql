@@ -0,0 +1,5 @@
+-- Sessions of invoices deleted before the key existed have nothing left to pack
+DELETE FROM pack_sessions WHERE invoice_id NOT IN (SELECT id FROM invoice);
+
+ALTER TABLE pack_sessions
+ADD CONSTRAINT pack_sessions_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE;
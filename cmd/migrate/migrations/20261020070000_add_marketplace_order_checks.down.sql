@@ -0,0 +1,8 @@
+ALTER TABLE marketplace_orders
+DROP CONSTRAINT IF EXISTS marketplace_orders_invoice_id_fkey;
+
+ALTER TABLE marketplace_orders
+ADD CONSTRAINT marketplace_orders_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE;
+
+ALTER TABLE marketplace_order_lines
+DROP CONSTRAINT IF EXISTS marketplace_order_lines_quantity_check;
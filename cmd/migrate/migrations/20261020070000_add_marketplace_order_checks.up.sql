@@ -0,0 +1,10 @@
+-- NOT VALID keeps lines imported before the check from blocking the migration, new and edited lines are checked
+ALTER TABLE marketplace_order_lines
+ADD CONSTRAINT marketplace_order_lines_quantity_check CHECK (quantity > 0) NOT VALID;
+
+-- An invoice with a marketplace order behind it cannot be deleted from under the order
+ALTER TABLE marketplace_orders
+DROP CONSTRAINT IF EXISTS marketplace_orders_invoice_id_fkey;
+
+ALTER TABLE marketplace_orders
+ADD CONSTRAINT marketplace_orders_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE RESTRICT;
@@ -0,0 +1,39 @@
+CREATE OR REPLACE VIEW invoice_balances AS
+SELECT i.id AS invoice_id,
+       COALESCE(d.amount_due, 0) AS amount_due,
+       COALESCE(d.tax, 0) AS tax,
+       COALESCE(p.paid, 0) AS paid,
+       COALESCE(p.refunded, 0) AS refunded,
+       CASE
+           WHEN COALESCE(p.refunded, 0) > 0 AND COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'refunded'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) <= 0 THEN 'unpaid'
+           WHEN COALESCE(p.paid, 0) - COALESCE(p.refunded, 0) < COALESCE(d.amount_due, 0) THEN 'partial'
+           ELSE 'paid'
+       END AS payment_status,
+       d.sold_at
+FROM invoice i
+LEFT JOIN (
+    SELECT invoice_id, SUM(gross) AS amount_due, SUM(tax) AS tax, MIN(datetime_sold) AS sold_at
+    FROM sold_item_amounts
+    GROUP BY invoice_id
+) d ON d.invoice_id = i.id
+LEFT JOIN (
+    SELECT invoice_id,
+           SUM(amount) FILTER (WHERE kind = 'payment') AS paid,
+           SUM(amount) FILTER (WHERE kind = 'refund') AS refunded
+    FROM payments
+    GROUP BY invoice_id
+) p ON p.invoice_id = i.id;
+
+-- Before voids these entries were deleted
+DELETE FROM payments WHERE voided_at IS NOT NULL;
+
+ALTER TABLE payments
+DROP CONSTRAINT IF EXISTS payments_invoice_id_fkey;
+
+ALTER TABLE payments
+ADD CONSTRAINT payments_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES invoice(id) ON DELETE CASCADE;
+
+ALTER TABLE payments
+DROP COLUMN voided_by,
+DROP COLUMN voided_at;
@@ -0,0 +1,2 @@
+ALTER TABLE payments
+DROP COLUMN journal_entry_id;
@@ -0,0 +1,3 @@
+-- A refund on a posted invoice is booked by its own journal entry, the column says which
+ALTER TABLE payments
+ADD COLUMN journal_entry_id INT REFERENCES journal_entries(id);
@@ -0,0 +1,4 @@
+UPDATE sales_orders SET status = 'cancelled' WHERE status = 'expired';
+
+DROP INDEX IF EXISTS idx_sales_orders_open_expiry;
+ALTER TABLE sales_orders DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,6 @@
+-- Orders nobody finishes scanning give their stock back, open orders get the default hold from now
+ALTER TABLE sales_orders ADD COLUMN expires_at TIMESTAMP;
+UPDATE sales_orders SET expires_at = COALESCE(closed_at, CURRENT_TIMESTAMP + INTERVAL '72 hours');
+ALTER TABLE sales_orders ALTER COLUMN expires_at SET NOT NULL;
+
+CREATE INDEX idx_sales_orders_open_expiry ON sales_orders(expires_at) WHERE status = 'open';
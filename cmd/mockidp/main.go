@@ -0,0 +1,34 @@
+package main
+
+// Mock OpenID Connect provider for trying single sign-on locally. It signs ID tokens for whoever is typed
+// into its login form, or for -auto without asking.
+//
+//	go run ./cmd/mockidp -addr :9000 -client-id inventory -client-secret dev
+//	OIDC_ISSUER=http://localhost:9000 OIDC_CLIENT_ID=inventory OIDC_CLIENT_SECRET=dev \
+//	OIDC_REDIRECT_URL=http://localhost:8080/api/user/oidc/callback go run ./cmd
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/oidc"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, must be how the API reaches this server")
+	clientID := flag.String("client-id", "inventory", "client ID the API uses")
+	clientSecret := flag.String("client-secret", "", "client secret the API uses, empty accepts a public client")
+	auto := flag.String("auto", "", "log everyone in as this email without showing the form")
+	flag.Parse()
+
+	p, err := oidc.NewMockIdP(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.Auto = *auto
+
+	log.Printf("Mock identity provider %s listening on %s", p.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
@@ -0,0 +1,180 @@
+package main
+
+// Desk reader bridge: reads tags from a USB/serial RFID reader (or a keyboard wedge reader on stdin)
+// and forwards them to the API signed the same way as the mobile app.
+//
+//	go run ./cmd/reader -device /dev/ttyUSB0 -baud 9600 -path "/api/item/get-sold-by-rfid/{tag}"
+//	go run ./cmd/reader -format prefixed < /dev/input/by-id/usb-reader
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/joho/godotenv"
+)
+
+type bridge struct {
+	client   *http.Client
+	apiURL   string
+	deviceID string
+	secret   []byte
+	method   string
+	path     string
+	body     string
+	debounce time.Duration
+	lastTag  string
+	lastSeen time.Time
+}
+
+func main() {
+	_ = godotenv.Load()	// .env is optional for the bridge, flags and the environment work too
+
+	device := flag.String("device", "", "serial device to read from, reads stdin (keyboard wedge) when empty")
+	baud := flag.Int("baud", 0, "baud rate to configure on the serial device with stty, 0 leaves the port as is")
+	format := flag.String("format", "auto", "reader output format: auto, plain, prefixed, csv or em4100")
+	apiURL := flag.String("api", os.Getenv("API_URL"), "base URL of the API, defaults to $API_URL")
+	method := flag.String("method", http.MethodGet, "HTTP method used to forward each tag")
+	path := flag.String("path", "/api/item/get-sold-by-rfid/{tag}", "API path to forward each tag to, {tag} is replaced with the tag")
+	body := flag.String("body", "", "optional JSON body template, {tag} is replaced with the tag")
+	debounce := flag.Duration("debounce", 2*time.Second, "ignore repeated reads of the same tag within this window")
+	flag.Parse()
+
+	if *apiURL == "" {
+		log.Fatal("missing API URL, set -api or API_URL")
+	}
+
+	// Issued by an admin under /api/user/admin/devices, every reader gets its own
+	deviceID := os.Getenv("DEVICE_ID")
+	secret := os.Getenv("DEVICE_SECRET")
+	if deviceID == "" || secret == "" {
+		log.Fatal("missing DEVICE_ID or DEVICE_SECRET")
+	}
+
+	input, err := openInput(*device, *baud)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer input.Close()
+
+	b := &bridge{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		apiURL:   strings.TrimRight(*apiURL, "/"),
+		deviceID: deviceID,
+		secret:   []byte(secret),
+		method:   strings.ToUpper(*method),
+		path:     *path,
+		body:     *body,
+		debounce: *debounce,
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Split(splitFrames)
+
+	log.Println("Waiting for tags...")
+
+	for scanner.Scan() {
+		tag, err := parseTag(scanner.Text(), *format)
+		if err != nil {
+			log.Println("skipping frame: ", err)
+			continue
+		}
+
+		if tag == "" || b.isRepeat(tag) {
+			continue
+		}
+
+		if err := b.forward(tag); err != nil {
+			log.Printf("error forwarding tag %s: %v", tag, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func openInput(device string, baud int) (io.ReadCloser, error) {
+	if device == "" {
+		return os.Stdin, nil
+	}
+
+	if baud > 0 {
+		// Raw mode so the tty does not buffer until newline or echo frames back to the reader
+		cmd := exec.Command("stty", "-F", device, strconv.Itoa(baud), "raw", "-echo")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("error configuring %s: %v: %s", device, err, out)
+		}
+	}
+
+	return os.OpenFile(device, os.O_RDONLY, 0)
+}
+
+// isRepeat reports whether the tag was just read, readers fire several times while a tag sits on the antenna
+func (b *bridge) isRepeat(tag string) bool {
+	now := time.Now()
+	repeat := tag == b.lastTag && now.Sub(b.lastSeen) < b.debounce
+
+	b.lastTag = tag
+	b.lastSeen = now
+
+	return repeat
+}
+
+func (b *bridge) forward(tag string) error {
+	path := strings.ReplaceAll(b.path, "{tag}", tag)
+
+	var body []byte
+	if b.body != "" {
+		body = []byte(strings.ReplaceAll(b.body, "{tag}", tag))
+	}
+
+	req, err := http.NewRequest(b.method, b.apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	nonce, err := auth.NewTokenID()
+	if err != nil {
+		return err
+	}
+
+	// Same headers the mobile app sends, checked by auth.MobileAuth
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(auth.DeviceHeader, b.deviceID)
+	req.Header.Set(auth.TimestampHeader, timestamp)
+	req.Header.Set(auth.NonceHeader, nonce)
+	req.Header.Set(auth.SignatureHeader, auth.SignRequest(b.secret, req.Method, req.URL.Path, req.URL.RawQuery, timestamp, nonce, body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s -> %s %s", tag, res.Status, strings.TrimSpace(string(resBody)))
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("api returned %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	hexPattern    = regexp.MustCompile(`^[0-9A-F]+$`)	// Also matches the decimal card numbers keyboard wedge readers type
+	prefixPattern = regexp.MustCompile(`(?i)^(tag|id|uid|epc|card)\s*(no\.?)?\s*[:=#]\s*`)
+)
+
+// splitFrames is a bufio.SplitFunc that cuts reader output on CR, LF or ETX, so it handles keyboard wedge lines and STX/ETX framed serial output
+func splitFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n\x03"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// parseTag turns one raw frame from a reader into a normalised tag string, empty frames return "" with no error
+func parseTag(raw string, format string) (string, error) {
+	raw = strings.Trim(raw, "\x02\x03\x00 \t")
+	if raw == "" {
+		return "", nil
+	}
+
+	switch format {
+	case "auto":
+		return parseAuto(raw)
+	case "plain":
+		return normaliseTag(raw)
+	case "prefixed":
+		return normaliseTag(prefixPattern.ReplaceAllString(raw, ""))
+	case "csv":
+		return parseCSV(raw)
+	case "em4100":
+		return parseEM4100(raw)
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func parseAuto(raw string) (string, error) {
+	// "Tag: 3000E280..." / "EPC=..." style readers
+	if prefixPattern.MatchString(raw) {
+		raw = prefixPattern.ReplaceAllString(raw, "")
+	}
+
+	// UHF readers that print "EPC,RSSI,antenna"
+	if strings.ContainsAny(raw, ",;\t") {
+		return parseCSV(raw)
+	}
+
+	// 125kHz readers print 10 hex data chars followed by a 2 char XOR checksum
+	if len(raw) == 12 && hexPattern.MatchString(strings.ToUpper(raw)) {
+		if tag, err := parseEM4100(raw); err == nil {
+			return tag, nil
+		}
+	}
+
+	return normaliseTag(raw)
+}
+
+func parseCSV(raw string) (string, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\t'
+	})
+
+	// The tag is the first field that looks like an ID, RSSI/antenna columns are short or signed
+	for _, field := range fields {
+		field = prefixPattern.ReplaceAllString(strings.TrimSpace(field), "")
+		tag, err := normaliseTag(field)
+		if err == nil && len(tag) >= 8 {
+			return tag, nil
+		}
+	}
+
+	return "", fmt.Errorf("no tag found in %q", raw)
+}
+
+func parseEM4100(raw string) (string, error) {
+	raw = strings.ToUpper(strings.TrimSpace(raw))
+	if len(raw) != 12 || !hexPattern.MatchString(raw) {
+		return "", fmt.Errorf("em4100 frame must be 12 hex characters, got %q", raw)
+	}
+
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return "", err
+	}
+
+	var checksum byte
+	for _, b := range data[:5] {
+		checksum ^= b
+	}
+
+	if checksum != data[5] {
+		return "", fmt.Errorf("em4100 checksum mismatch for %q", raw)
+	}
+
+	return raw[:10], nil
+}
+
+// normaliseTag uppercases hex tags and strips the separators some readers print between bytes
+func normaliseTag(raw string) (string, error) {
+	tag := strings.ToUpper(strings.TrimSpace(raw))
+	tag = strings.NewReplacer(" ", "", "-", "", ":", "").Replace(tag)
+
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+
+	if !hexPattern.MatchString(tag) {
+		return "", fmt.Errorf("unrecognised tag %q", raw)
+	}
+
+	return tag, nil
+}
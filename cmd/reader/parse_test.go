@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		// Well-formed frames
+		{"plain hex", "e2801160600002", "plain", "E2801160600002", false},
+		{"plain with byte separators", "E2-80-11:60 60", "plain", "E280116060", false},
+		{"prefixed", "Tag: 3000e2801160", "prefixed", "3000E2801160", false},
+		{"csv epc first", "E28011606000020D,-61,1", "csv", "E28011606000020D", false},
+		{"csv epc after short columns", "1;-58;EPC=E2801160600002", "csv", "E2801160600002", false},
+		{"em4100 with checksum", "010203040501", "em4100", "0102030405", false},
+		{"stx etx framed", "\x02010203040501\x03", "em4100", "0102030405", false},
+		{"auto em4100", "010203040501", "auto", "0102030405", false},
+		{"auto prefixed", "EPC=e2801160", "auto", "E2801160", false},
+		{"auto csv", "E2801160600002,-61,2", "auto", "E2801160600002", false},
+		{"auto decimal wedge", "0004123456", "auto", "0004123456", false},
+		{"empty frame", "\x02\x03", "auto", "", false},
+
+		// Truncated frames
+		{"em4100 short", "01020304050", "em4100", "", true},
+		{"em4100 bad checksum", "010203040500", "em4100", "", true},
+		{"csv without a full tag", "E280,-61,1", "csv", "", true},
+		{"prefix only", "Tag:", "prefixed", "", true},
+
+		// Garbage
+		{"not hex", "hello world", "plain", "", true},
+		{"binary noise", "\x02\xff\xfe!!\x03", "auto", "", true},
+		{"em4100 not hex", "01020304050Z", "em4100", "", true},
+		{"csv noise", "??,;;,--", "csv", "", true},
+		{"unknown format", "E2801160", "wiegand", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTag(tt.raw, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTag(%q, %s) error = %v, want error %v", tt.raw, tt.format, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("parseTag(%q, %s) = %q, want %q", tt.raw, tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	input := "\x02010203040501\x03E2801160\r\nTag: 3000E280\n0A0B0C"
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Split(splitFrames)
+
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+
+	// CRLF leaves an empty frame between the two, parseTag skips those
+	want := []string{"\x02010203040501", "E2801160", "", "Tag: 3000E280", "0A0B0C"}
+	if strings.Join(frames, "|") != strings.Join(want, "|") {
+		t.Fatalf("frames = %q, want %q", frames, want)
+	}
+}
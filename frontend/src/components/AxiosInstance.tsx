@@ -1,15 +1,78 @@
-import axios, { AxiosError } from "axios"
+import axios, { AxiosError, AxiosResponse, InternalAxiosRequestConfig } from "axios"
 
 const api = axios.create({
-    baseURL: 'http://localhost:5000',        
-    withCredentials: true, 
+    baseURL: 'http://localhost:5000',
+    withCredentials: true,
     headers: {
         'Content-Type': 'application/json',
       },
 });
 
-api.interceptors.response.use(  
-    (response) => response, // Successful API's are ignored
+// Every write has to send the API's CSRF token in the X-CSRF-Token header. Login and refresh hand out a new
+// one in that header, after a page reload it is asked for at /api/user/csrf
+const CSRF_HEADER = 'X-CSRF-Token';
+let csrfToken: string | null = null;
+
+export const fetchCsrfToken = async () => {
+    const response = await axios.get<{ csrf_token: string }>('/api/user/csrf', { withCredentials: true });
+    csrfToken = response.data.csrf_token;
+
+    return csrfToken;
+}
+
+const rememberCsrfToken = (response: AxiosResponse) => {
+    const token = response.headers[CSRF_HEADER.toLowerCase()];  // Axios lowercases response headers
+    if (token) {
+        csrfToken = token;
+    }
+
+    return response;
+}
+
+const attachCsrfToken = async (config: InternalAxiosRequestConfig) => {
+    const method = (config.method ?? 'get').toLowerCase();
+    if (method === 'get' || method === 'head' || method === 'options') {
+        return config;
+    }
+
+    if (!csrfToken) {
+        try {
+            await fetchCsrfToken();
+        } catch (error) {
+            console.error('Could not get a CSRF token: ', error);
+        }
+    }
+
+    if (csrfToken) {
+        config.headers.set(CSRF_HEADER, csrfToken);
+    }
+
+    return config;
+}
+
+// On the plain axios too, the login page and the refresh below use it
+api.interceptors.request.use(attachCsrfToken);
+axios.interceptors.request.use(attachCsrfToken);
+axios.interceptors.response.use(rememberCsrfToken);
+
+// One refresh at a time, requests failing while it runs wait for it. The server revokes the login when a
+// rotated refresh token comes back late, so parallel refreshes with the same cookie would log the user out
+let refreshing: Promise<void> | null = null;
+
+const refreshSession = () => {
+    if (!refreshing) {
+        // The token held may be stale, a 403 is also what a CSRF mismatch gets
+        refreshing = fetchCsrfToken()
+            .then(() => axios.post('/api/user/refresh', null, { withCredentials: true }))
+            .then(() => undefined)  // The new token comes back in the header, see rememberCsrfToken
+            .finally(() => { refreshing = null });
+    }
+
+    return refreshing;
+}
+
+api.interceptors.response.use(
+    rememberCsrfToken, // Successful API's are otherwise ignored
 
     async (error: AxiosError) => {
         const originalRequest = error.config;   // Gets the data/config for the request that failed/error
@@ -18,9 +81,9 @@ api.interceptors.response.use(
             originalRequest._retry = true;
 
             try {
-                await axios.post('/api/user/refresh', { withCredentials: true });
-        
-                return api(originalRequest);  // Retry the original request
+                await refreshSession();
+
+                return api(originalRequest);  // Retry the original request, attachCsrfToken puts the new token on it
             } catch (refreshError) {
                 console.error('Refresh token failed, logging out...');
                 window.location.href = '/';     // Navigate to login page
@@ -28,8 +91,8 @@ api.interceptors.response.use(
               }
         }
 
-        return Promise.reject(error); 
+        return Promise.reject(error);
     }
 )
 
-export default api
\ No newline at end of file
+export default api
@@ -2,6 +2,7 @@ import { useMutation } from '@tanstack/react-query';
 import axios from 'axios';
 import { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
+import { fetchCsrfToken } from '../components/AxiosInstance';
 
 interface User {
   email: string
@@ -49,6 +50,7 @@ const LoginScreen = () => {
         user
       );
       console.log("res: ", response)
+      await fetchCsrfToken()  // The login rotated the CSRF token
       navigate("/home") 
     } catch (error) {
       console.log("error logging in: ", error)
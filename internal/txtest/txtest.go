@@ -0,0 +1,57 @@
+// Package txtest gives handler tests a *sql.DB whose transactions do nothing, so fake stores can be handed
+// a real *sql.Tx without a database
+package txtest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+// ErrCommit is what Commit returns on a DB opened with FailCommit
+var ErrCommit = errors.New("commit failed")
+
+type txDriver struct{}
+type txConn struct{ failCommit bool }
+type noopTx struct{ failCommit bool }
+
+func (txDriver) Open(name string) (driver.Conn, error) { return txConn{failCommit: name == "fail-commit"}, nil }
+func (txConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (txConn) Close() error { return nil }
+func (c txConn) Begin() (driver.Tx, error) { return noopTx{c.failCommit}, nil }
+
+func (tx noopTx) Commit() error {
+	if tx.failCommit {
+		return ErrCommit
+	}
+	return nil
+}
+
+func (noopTx) Rollback() error { return nil }
+
+func init() {
+	sql.Register("txtest", txDriver{})
+}
+
+// Open returns a DB for the test, closed when it ends
+func Open(t *testing.T) *sql.DB {
+	return open(t, "")
+}
+
+// FailCommit returns a DB whose commits fail with ErrCommit
+func FailCommit(t *testing.T) *sql.DB {
+	return open(t, "fail-commit")
+}
+
+func open(t *testing.T, name string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("txtest", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+)
+
+// Double-submit CSRF token. The auth cookies are SameSite=None so a form on another site would carry them,
+// but it cannot read the csrf_token cookie or our responses to copy the token into the header
+const (
+	CSRFCookie	= "csrf_token"
+	CSRFHeader	= "X-CSRF-Token"
+)
+
+// csrfTTL matches the refresh cookie, the token is rotated on every login and refresh anyway
+const csrfTTL = 24 * time.Hour
+
+// IssueCSRFToken sets a new csrf_token cookie and also returns it in the X-CSRF-Token response header for
+// frontends on another domain, which cannot read our cookies
+func IssueCSRFToken(w http.ResponseWriter) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    token,
+		Expires:  time.Now().Add(csrfTTL),
+		HttpOnly: false,	// Readable by the web app on the same site, it is only worth anything next to the auth cookies
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	w.Header().Set(CSRFHeader, token)
+
+	return token, nil
+}
+
+// ClearCSRFCookie expires the csrf_token cookie, for logouts
+func ClearCSRFCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,	// Must match the set cookie or browsers on another site keep the old one
+	})
+}
+
+// CheckCSRF passes safe methods and otherwise wants the X-CSRF-Token header to equal the csrf_token cookie
+func CheckCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return fmt.Errorf("missing CSRF cookie")
+	}
+
+	header := r.Header.Get(CSRFHeader)
+	if header == "" {
+		return fmt.Errorf("missing %s header", CSRFHeader)
+	}
+
+	if !hmac.Equal([]byte(header), []byte(cookie.Value)) {
+		return fmt.Errorf("CSRF token mismatch")
+	}
+
+	return nil
+}
+
+// WithCSRF guards handlers that act on the auth cookies without going through WithJWTAuth, such as refresh
+func WithCSRF(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := CheckCSRF(r); err != nil {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied, %v", err))
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// deviceStore knows one device, calling anything else panics on the nil interface
+type deviceStore struct {
+	types.UserStore
+	device	types.Device
+}
+
+func (s *deviceStore) GetActiveDevice(key_id string) (*types.Device, error) {
+	if key_id != s.device.KeyID {
+		return nil, errors.New("device not found")
+	}
+
+	device := s.device
+	return &device, nil
+}
+
+func (s *deviceStore) TouchDevice(id int) error {
+	return nil
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestWithCSRF(t *testing.T) {
+	tests := []struct {
+		name	string
+		method	string
+		cookie	string
+		header	string
+		status	int
+	}{
+		{"safe method", "GET", "", "", http.StatusOK},
+		{"no cookie", "POST", "", "token-1", http.StatusForbidden},
+		{"no header", "POST", "token-1", "", http.StatusForbidden},
+		{"mismatched token", "POST", "token-1", "token-2", http.StatusForbidden},
+		{"matching token", "POST", "token-1", "token-1", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/user/refresh", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(CSRFHeader, tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			WithCSRF(ok)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("request = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestSignedRequestSkipsCSRF(t *testing.T) {
+	store := &deviceStore{device: types.Device{ID: 1, KeyID: "reader-1", Secret: "device-secret"}}
+
+	body := `{"serial_number": "SN-1"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := "nonce-0123456789"
+
+	r := httptest.NewRequest("POST", "/api/item/scan", strings.NewReader(body))
+	r.Header.Set(DeviceHeader, "reader-1")
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, SignRequest([]byte("device-secret"), "POST", "/api/item/scan", "", timestamp, nonce, []byte(body)))
+
+	var device types.Device
+	w := httptest.NewRecorder()
+	MobileAuth(func(w http.ResponseWriter, r *http.Request) {
+		device, _ = r.Context().Value(DeviceKey).(types.Device)
+	}, store)(w, r)
+
+	if w.Code != http.StatusOK || device.KeyID != "reader-1" {
+		t.Fatalf("signed request = %d %s, want it through without a CSRF token", w.Code, w.Body.String())
+	}
+
+	// The same route over the cookie still wants the token
+	r = httptest.NewRequest("POST", "/api/item/scan", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	MobileAuth(ok, store)(w, r)
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "CSRF") {
+		t.Fatalf("cookie request = %d %s, want it refused for the missing CSRF token", w.Code, w.Body.String())
+	}
+}
+
+func TestClearCSRFCookie(t *testing.T) {
+	w := httptest.NewRecorder()
+	IssueCSRFToken(w)
+	ClearCSRFCookie(w)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[1].MaxAge >= 0 {
+		t.Fatalf("cookies = %+v, want the token set then expired", cookies)
+	}
+	if cookies[1].SameSite != cookies[0].SameSite || cookies[1].Path != cookies[0].Path {
+		t.Fatalf("cleared cookie is SameSite %v on %s, set was %v on %s", cookies[1].SameSite, cookies[1].Path, cookies[0].SameSite, cookies[0].Path)
+	}
+}
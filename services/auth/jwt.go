@@ -1,49 +1,83 @@
 package auth
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 	"context"
 	"github.com/PatrickA727/mikrotik-db-sys/types"
 	"github.com/PatrickA727/mikrotik-db-sys/utils"
 	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 const UserKey contextKey = "userID"
+const RoleKey contextKey = "role"
+const DeviceKey contextKey = "device"	// types.Device of a signed request
 
-func CreateJWT(secret []byte, userID int) (string, error) {
-	expiration := time.Duration(900) * time.Second	// 15 minutes
+const (
+	TokenAccess		= "access"
+	TokenRefresh	= "refresh"
+	TokenMFA		= "mfa"	// Proof of the password while the second factor is asked for
+)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{	// Create new JWt token, with claims(key value pairs embedded in the token)
-		"userID": strconv.Itoa(userID),									// Uses the HS256 signing method, its  fast method for single server systems with low complexity
-		"expiredAt": time.Now().Add(expiration).Unix(),
-	})
+// Claims are the registered claims plus what the token is for, so a refresh token is not taken as an
+// access token
+type Claims struct {
+	Use	string	`json:"use"`
+	jwt.RegisteredClaims
+}
 
-	tokenString, err := token.SignedString(secret)	// The final token signed with the secret key
-	if err != nil {
-		return "", err
-	}
+func CreateJWT(userID int) (string, error) {
+	return createToken(userID, TokenAccess, AccessTokenTTL())
+}
 
-	return tokenString, nil
+func CreateRefreshJWT(userID int) (string, error) {
+	return createToken(userID, TokenRefresh, RefreshTokenTTL())
+}
+
+// CreateMFAToken is handed out instead of cookies when the user still has to pass two-factor, it lasts
+// JWT_MFA_TTL, 5 minutes by default
+func CreateMFAToken(userID int) (string, error) {
+	return createToken(userID, TokenMFA, envDuration("JWT_MFA_TTL", 5*time.Minute))
 }
 
-func CreateRefreshJWT(secret []byte, userID int) (string, error) {
-	expiration := time.Duration(3600 * 24 * 30) * time.Second // 30 days
+// createToken signs with the first key of signingKeys and names it in the kid header
+func createToken(userID int, use string, ttl time.Duration) (string, error) {
+	keys := signingKeys()
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no JWT signing key configured")
+	}
+
+	// Refresh tokens are rotated on every use, the ID keeps two tokens issued in the same second apart
+	jti, err := NewTokenID()
+	if err != nil {
+		return "", err
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{	// Create new JWt token, with claims(key value pairs embedded in the token)
-		"userID": strconv.Itoa(userID),									// Uses the HS256 signing method, its  fast method for single server systems with low complexity
-		"expiredAt": time.Now().Add(expiration).Unix(),
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{	// HS256 is fast and fine for a single service signing its own tokens
+		Use: use,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: issuer(),
+			Subject: strconv.Itoa(userID),
+			Audience: jwt.ClaimStrings{audience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt: jwt.NewNumericDate(now),
+			ID: jti,
+		},
 	})
+	token.Header["kid"] = keys[0].id
 
-	tokenString, err := token.SignedString(secret)	// The final token signed with the secret key
+	tokenString, err := token.SignedString(keys[0].secret)	// The final token signed with the secret key
 	if err != nil {
 		return "", err
 	}
@@ -51,36 +85,26 @@ func CreateRefreshJWT(secret []byte, userID int) (string, error) {
 	return tokenString, nil
 }
 
+// WithJWTAuth authenticates by the access_token cookie, so state-changing requests also need the CSRF token,
+// see CheckCSRF. Device signed requests never get here, MobileAuth checks those itself
 func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if err := CheckCSRF(r); err != nil {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied, %v", err))
+			return
+		}
+
 		// Get token from cookies
 		tokenString := utils.GetTokenFromCookie(r)
 
-		// Validate JWT
-		token, err := ValidateJWT(tokenString)
+		// Validate JWT and get userID from its subject
+		userID, err := TokenUser(tokenString, TokenAccess)
 		if err != nil {
 			log.Println("token not valid: ", err)
 			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied4: %v", err))
 			return
 		}
 
-		if !token.Valid {
-			log.Println("invalid token")
-			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied5: %v", err))
-			return
-		}
-
-		// Get userID from JWT claims
-		claims := token.Claims.(jwt.MapClaims)
-		str := claims["userID"].(string)
-
-		userID, err := strconv.Atoi(str)
-		if err != nil {
-			log.Printf("failed to convert userID to int: %v", err)
-			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied6: %v", err))
-			return
-		}
-
 		// Fetch user by id from database
 		u, err := store.GetUserById(userID)
 		if err != nil {
@@ -89,9 +113,16 @@ func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserStore) http.Handl
 			return
 		}
 
+		// Deactivated users are out even with an unexpired access token
+		if !u.Active {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied, account deactivated"))
+			return
+		}
+
 		// Set the userId to the ctx(context) so the handler functions have access to current user id in the ctx
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, UserKey, u.ID) // Creates a new context that contains UserKey("userid") as the key and user.id as the value
+		ctx = context.WithValue(ctx, RoleKey, u.Role)
 		r = r.WithContext(ctx)	// Attaches the new context to the original request containing the userID
 
 		// Run the handler func with validated user JWT cookie
@@ -99,59 +130,156 @@ func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserStore) http.Handl
 	}
 }
 
-func ValidateJWT(tokenString string) (*jwt.Token, error) {	// Validates JWT by checking its signing method
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {	// JWT Parse method takes tokenString and a callback func to check/validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {	// Accesses and checks the token signing method (has to be HMAC)
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])	// Shows the signing method of the incorrect jwt token
+// WithRole runs WithJWTAuth and then only lets users with one of the given roles through
+func WithRole(handlerFunc http.HandlerFunc, store types.UserStore, roles ...string) http.HandlerFunc {
+	return WithJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(RoleKey).(string)
+
+		if !slices.Contains(roles, role) {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied, requires role: %s", strings.Join(roles, " or ")))
+			return
 		}
 
-		return []byte(os.Getenv("JWT_SECRET")), nil	// The CALLBACK FUNC returns the secret key to be used by the jwt.parse func
-	})
+		handlerFunc(w, r)
+	}, store)
+}
+
+// ValidateJWT checks the signature with the key named by kid, then exp, nbf and iat within the clock skew and
+// the issuer and audience. The claims are *Claims
+func ValidateJWT(tokenString string) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := verifyingKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		return secret, nil	// The CALLBACK FUNC returns the secret key to be used by the jwt.parse func
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew()),
+		jwt.WithIssuer(issuer()),
+		jwt.WithAudience(audience()),
+	)
+}
+
+// TokenUser validates a token meant for use and returns the user in its subject
+func TokenUser(tokenString string, use string) (int, error) {
+	token, err := ValidateJWT(tokenString)
+	if err != nil {
+		return 0, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return 0, fmt.Errorf("invalid token")
+	}
+
+	if claims.Use != use {
+		return 0, fmt.Errorf("token is for %q, not %s", claims.Use, use)
+	}
+
+	if claims.ID == "" {
+		return 0, fmt.Errorf("token has no jti")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, fmt.Errorf("invalid token subject")
+	}
+
+	return userID, nil
 }
 
 // For validateJWT the if statement and checking signing method IS THE CALLBACK PARAM for the jwt.parse function
 
+// signatureWindow is how far a signed request's timestamp may be from the server clock either way
+const signatureWindow = 5 * time.Minute
+
+// maxSignedBody caps what MobileAuth reads to hash the body
+const maxSignedBody = 10 << 20
+
+// Nonces live for two windows, a request stamped at the edge of the window stays valid that long
+var nonces = newNonceCache(2 * signatureWindow)
+
+// MobileAuth lets the web app in with its JWT cookie and devices in with a request signed by their own key,
+// see SignRequest. The device is put in the request context under DeviceKey. Signed requests carry no cookies
+// a browser could attach, so they skip the CSRF check WithJWTAuth does
 func MobileAuth(handlerFunc http.HandlerFunc, store types.UserStore) http.HandlerFunc {
 	return func (w http.ResponseWriter, r *http.Request) {
-		sigHeader := r.Header.Get("Signature")
-		timeHeader := r.Header.Get("Timestamp")
-		apiUrl := r.URL
+		sigHeader := r.Header.Get(SignatureHeader)
+		timeHeader := r.Header.Get(TimestampHeader)
 
-		if sigHeader == "" || timeHeader == "" {
+		if sigHeader == "" && timeHeader == "" {
 			JWTAuth := WithJWTAuth(handlerFunc, store)
 			JWTAuth(w, r)
 			return
 		}
 
+		deviceHeader := r.Header.Get(DeviceHeader)
+		nonceHeader := r.Header.Get(NonceHeader)
+
+		if sigHeader == "" || timeHeader == "" || deviceHeader == "" || nonceHeader == "" {
+			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("signed requests need %s, %s, %s and %s headers",
+				DeviceHeader, TimestampHeader, NonceHeader, SignatureHeader))
+			return
+		}
+
+		if len(nonceHeader) < 16 || len(nonceHeader) > 64 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("nonce must be 16 to 64 characters"))
+			return
+		}
+
 		timeNow := time.Now()
 	
 		// Convert the string timestamp to an integer (assuming it's in Unix seconds)
 		timeInt, err := strconv.ParseInt(timeHeader, 10, 64)
 		if err != nil {
-			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("invalid timestamp format: %v", err))
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid timestamp format: %v", err))
 			return 
 		}
 	
-		// Convert the Unix timestamp to a time.Time object
-		requestTime := time.Unix(timeInt, 0)
-	
-		// Check if the request time is older than 5 minutes
-		if timeNow.Sub(requestTime) > 5*time.Minute {
-			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("request time expired: %v", err))
+		// Reject requests more than 5 minutes away from now, in either direction
+		skew := timeNow.Sub(time.Unix(timeInt, 0))
+		if skew > signatureWindow || skew < -signatureWindow {
+			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("request time expired"))
 			return 
 		}
-	
-		signData := timeHeader + apiUrl.Path
-		key := os.Getenv("SIGN_SECRET")
 
-		h := hmac.New(sha256.New, []byte(key))
-		h.Write([]byte(signData))
-		sigBackend := hex.EncodeToString(h.Sum(nil))
+		device, err := store.GetActiveDevice(deviceHeader)
+		if err != nil {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("unknown or revoked device"))
+			return
+		}
 
-		if sigHeader != sigBackend {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading body: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	
+		sigBackend := SignRequest([]byte(device.Secret), r.Method, r.URL.Path, r.URL.RawQuery, timeHeader, nonceHeader, body)
+
+		if !hmac.Equal([]byte(sigHeader), []byte(sigBackend)) {
 			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("invalid signature"))
 			return	
 		}
+
+		// Checked after the signature so unsigned junk cannot fill the cache
+		if !nonces.Use(device.KeyID+":"+nonceHeader, timeNow) {
+			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("nonce already used"))
+			return
+		}
+
+		if err := store.TouchDevice(device.ID); err != nil {
+			log.Printf("failed to update last seen of device %d: %v", device.ID, err)
+		}
+
+		device.Secret = ""
+		r = r.WithContext(context.WithValue(r.Context(), DeviceKey, *device))
 	
 		handlerFunc(w, r)
 	}
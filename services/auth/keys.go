@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+type signingKey struct {
+	id		string
+	secret	[]byte
+}
+
+// signingKeys reads JWT_SECRETS, comma separated "kid:secret" pairs with the signing key first. The rest only
+// verify, so tokens signed before a rotation keep working until they expire. Without it JWT_SECRET is the
+// one key, under kid "default"
+func signingKeys() []signingKey {
+	var keys []signingKey
+
+	for _, pair := range strings.Split(os.Getenv("JWT_SECRETS"), ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			continue
+		}
+		keys = append(keys, signingKey{id: id, secret: []byte(secret)})
+	}
+
+	if len(keys) == 0 && os.Getenv("JWT_SECRET") != "" {
+		keys = append(keys, signingKey{id: "default", secret: []byte(os.Getenv("JWT_SECRET"))})
+	}
+
+	return keys
+}
+
+func verifyingKey(id string) ([]byte, bool) {
+	for _, key := range signingKeys() {
+		if key.id == id {
+			return key.secret, true
+		}
+	}
+	return nil, false
+}
+
+// AccessTokenTTL is JWT_ACCESS_TTL, 15 minutes by default, the access cookie lasts as long
+func AccessTokenTTL() time.Duration {
+	return envDuration("JWT_ACCESS_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is JWT_REFRESH_TTL, 30 days by default like the session rows
+func RefreshTokenTTL() time.Duration {
+	return envDuration("JWT_REFRESH_TTL", 30*24*time.Hour)
+}
+
+// RefreshReuseGrace is JWT_REFRESH_GRACE, 10 seconds by default. A refresh token presented again this soon after
+// it was rotated is taken as a second tab refreshing at the same time rather than a copy
+func RefreshReuseGrace() time.Duration {
+	return envDuration("JWT_REFRESH_GRACE", 10*time.Second)
+}
+
+// clockSkew is JWT_CLOCK_SKEW, how far exp, nbf and iat may be off between servers
+func clockSkew() time.Duration {
+	return envDuration("JWT_CLOCK_SKEW", 30*time.Second)
+}
+
+func issuer() string {
+	return envString("JWT_ISSUER", "mikrotik-db-sys")
+}
+
+func audience() string {
+	return envString("JWT_AUDIENCE", "mikrotik-db-sys-api")
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || d < 0 {
+		return fallback
+	}
+	return d
+}
+
+func envString(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCache remembers the nonces of signed requests while their timestamp is still accepted, so a captured
+// request cannot be sent again. It is per process, which is fine while the API runs as one instance
+type nonceCache struct {
+	mu			sync.Mutex
+	seen		map[string]time.Time
+	ttl			time.Duration
+	lastSweep	time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		seen: make(map[string]time.Time),
+		ttl: ttl,
+	}
+}
+
+// Use records the nonce and reports whether it was fresh
+func (c *nonceCache) Use(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if expires, ok := c.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+
+	c.seen[key] = now.Add(c.ttl)
+	return true
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// Headers of a device signed request, see MobileAuth
+const (
+	DeviceHeader	= "Device-Id"
+	TimestampHeader	= "Timestamp"
+	NonceHeader		= "Nonce"
+	SignatureHeader	= "Signature"
+)
+
+// SignRequest builds the HMAC signature MobileAuth expects, the mobile app and the desk reader bridge both sign
+// with this. It covers the method, path, sorted query, timestamp, nonce and a SHA-256 of the body, one field
+// per line
+func SignRequest(secret []byte, method string, path string, query string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		CanonicalQuery(query),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CanonicalQuery sorts the query by key so clients do not have to send parameters in a set order
+func CanonicalQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+
+	return values.Encode()
+}
+
+// NewTokenID returns 128 random bits as hex, used for token IDs, session families, device IDs and nonces
+func NewTokenID() (string, error) {
+	return randomHex(16)
+}
+
+// NewDeviceSecret returns the 256 bit key a device signs with
+func NewDeviceSecret() (string, error) {
+	return randomHex(32)
+}
+
+// NewUserToken returns the 256 bit token mailed in reset and verification links, only HashToken of it is stored
+func NewUserToken() (string, error) {
+	return randomHex(32)
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
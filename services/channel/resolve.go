@@ -0,0 +1,25 @@
+package channel
+
+import (
+	"fmt"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Resolve returns the registered spelling of a channel name, unknown and inactive channels are rejected
+func Resolve(store types.ChannelStore, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("no channel given for the sale")
+	}
+
+	channel, err := store.GetChannelByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown channel: %s", name)
+	}
+
+	if !channel.Active {
+		return "", fmt.Errorf("channel %s is inactive", channel.Name)
+	}
+
+	return channel.Name, nil
+}
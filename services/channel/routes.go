@@ -0,0 +1,135 @@
+package channel
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.ChannelStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.ChannelStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/get-channels", auth.MobileAuth(h.handleGetChannels, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/create", auth.WithRole(h.handleCreateChannel, h.userStore, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/edit/{id}", auth.WithRole(h.handleEditChannel, h.userStore, types.RoleAdmin)).Methods("PATCH")
+	router.HandleFunc("/report", auth.WithJWTAuth(h.handleGetChannelReport, h.userStore)).Methods("GET")
+}
+
+func (h *Handler) handleGetChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := h.store.GetChannels()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting channels: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"channels": channels,
+	})
+}
+
+func (h *Handler) handleCreateChannel(w http.ResponseWriter, r *http.Request) {
+	var payload types.ChannelPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if _, err := h.store.GetChannelByName(payload.Name); err == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("channel %s already exists", payload.Name))
+		return
+	}
+
+	if err := h.store.CreateChannel(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating channel: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, "Channel created")
+}
+
+func (h *Handler) handleEditChannel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.EditChannelPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.EditChannel(id, payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Channel updated")
+}
+
+// handleGetChannelReport takes from and to as YYYY-MM-DD, both inclusive, and defaults to the current month
+func (h *Handler) handleGetChannelReport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", fromStr, time.Local)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid from date: %v", err))
+			return
+		}
+		from = parsed
+	}
+
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", toStr, time.Local)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid to date: %v", err))
+			return
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+
+	reports, err := h.store.GetChannelReport(from, to)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting report: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"from": from.Format("2006-01-02"),
+		"to": to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"channels": reports,
+	})
+}
@@ -0,0 +1,183 @@
+package channel
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) GetChannels() ([]types.Channel, error) {
+	var channels []types.Channel
+
+	rows, err := s.db.Query("SELECT id, name, fee_percent, settings, active, price_includes_tax FROM channels ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var channel types.Channel
+
+		if err := rows.Scan(&channel.ID, &channel.Name, &channel.FeePercent, &channel.Settings, &channel.Active, &channel.PriceIncludesTax); err != nil {
+			return nil, err
+		}
+
+		channels = append(channels, channel)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+// GetChannelByName ignores case and surrounding spaces so "tokopedia " still finds Tokopedia
+func (s *Store) GetChannelByName(name string) (*types.Channel, error) {
+	var channel types.Channel
+
+	err := s.db.QueryRow("SELECT id, name, fee_percent, settings, active, price_includes_tax FROM channels WHERE LOWER(name) = LOWER($1)",
+		strings.TrimSpace(name),
+	).Scan(&channel.ID, &channel.Name, &channel.FeePercent, &channel.Settings, &channel.Active, &channel.PriceIncludesTax)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channel, nil
+}
+
+func (s *Store) CreateChannel(payload types.ChannelPayload) error {
+	settings := string(payload.Settings)
+	if settings == "" {
+		settings = "{}"
+	}
+
+	price_includes_tax := true
+	if payload.PriceIncludesTax != nil {
+		price_includes_tax = *payload.PriceIncludesTax
+	}
+
+	_, err := s.db.Exec("INSERT INTO channels (name, fee_percent, settings, price_includes_tax) VALUES ($1, $2, $3, $4)",
+		strings.TrimSpace(payload.Name), payload.FeePercent, settings, price_includes_tax,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EditChannel renames cascade to invoices and sold items through the foreign keys
+func (s *Store) EditChannel(id int, payload types.EditChannelPayload) error {
+	var setClauses []string
+	var args []interface{}
+
+	argIndex := 1
+
+	if strings.TrimSpace(payload.Name) != "" {
+		setClauses = append(setClauses, fmt.Sprintf("name = $%d", argIndex))
+		args = append(args, strings.TrimSpace(payload.Name))
+		argIndex++
+	}
+
+	if payload.FeePercent != nil {
+		setClauses = append(setClauses, fmt.Sprintf("fee_percent = $%d", argIndex))
+		args = append(args, *payload.FeePercent)
+		argIndex++
+	}
+
+	if len(payload.Settings) > 0 {
+		setClauses = append(setClauses, fmt.Sprintf("settings = $%d", argIndex))
+		args = append(args, string(payload.Settings))
+		argIndex++
+	}
+
+	if payload.Active != nil {
+		setClauses = append(setClauses, fmt.Sprintf("active = $%d", argIndex))
+		args = append(args, *payload.Active)
+		argIndex++
+	}
+
+	if payload.PriceIncludesTax != nil {
+		setClauses = append(setClauses, fmt.Sprintf("price_includes_tax = $%d", argIndex))
+		args = append(args, *payload.PriceIncludesTax)
+		argIndex++
+	}
+
+	if len(setClauses) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE channels SET %s WHERE id = $%d",
+		strings.Join(setClauses, ", "), argIndex)
+
+	args = append(args, id)
+
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("channel not found")
+	}
+
+	return nil
+}
+
+// GetChannelReport counts items sold in [from, to) per channel, revenue is the gross price snapshotted at
+// the sale so foreign list prices are already in the base currency
+func (s *Store) GetChannelReport(from time.Time, to time.Time) ([]types.ChannelReport, error) {
+	var reports []types.ChannelReport
+
+	rows, err := s.db.Query(`SELECT c.name, COUNT(DISTINCT s.invoice_id), COUNT(s.id), COALESCE(SUM(a.gross), 0), c.fee_percent
+							 FROM channels c
+							 LEFT JOIN sold_items s ON s.ol_shop = c.name AND s.datetime_sold >= $1 AND s.datetime_sold < $2
+							 LEFT JOIN sold_item_amounts a ON a.sold_item_id = s.id
+							 GROUP BY c.id, c.name, c.fee_percent
+							 ORDER BY 4 DESC, c.name`, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var report types.ChannelReport
+		var fee_percent float64
+
+		if err := rows.Scan(&report.Channel, &report.Invoices, &report.ItemsSold, &report.Revenue, &fee_percent); err != nil {
+			return nil, err
+		}
+
+		report.Fees = report.Revenue.Percent(fee_percent)
+		report.Net = report.Revenue.Sub(report.Fees)
+
+		reports = append(reports, report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
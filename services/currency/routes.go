@@ -0,0 +1,130 @@
+package currency
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.CurrencyStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.CurrencyStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/currencies", auth.WithJWTAuth(h.handleGetCurrencies, h.userStore)).Methods("GET")
+	router.HandleFunc("/rates", auth.WithJWTAuth(h.handleGetRates, h.userStore)).Methods("GET")
+	router.HandleFunc("/rates", auth.WithRole(h.handleSetRate, h.userStore, types.RoleAdmin)).Methods("PUT")
+	router.HandleFunc("/cost-report", auth.WithJWTAuth(h.handleGetCostReport, h.userStore)).Methods("GET")
+}
+
+func (h *Handler) handleGetCurrencies(w http.ResponseWriter, r *http.Request) {
+	currencies, err := h.store.GetCurrencies()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting currencies: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"currencies": currencies,
+		"base": types.BaseCurrency,
+	})
+}
+
+// handleGetRates returns the rate history, ?currency= narrows it to one currency
+func (h *Handler) handleGetRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.store.GetExchangeRates(r.URL.Query().Get("currency"))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting rates: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"rates": rates,
+	})
+}
+
+func (h *Handler) handleSetRate(w http.ResponseWriter, r *http.Request) {
+	var payload types.ExchangeRatePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.SetExchangeRate(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error setting rate: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Rate set")
+}
+
+// handleGetCostReport takes from and to as YYYY-MM-DD, both inclusive, and defaults to the current month.
+// The base currency total leaves out groups that could not be converted, they are listed in missing_rates
+func (h *Handler) handleGetCostReport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", fromStr, time.Local)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid from date: %v", err))
+			return
+		}
+		from = parsed
+	}
+
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", toStr, time.Local)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid to date: %v", err))
+			return
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+
+	reports, err := h.store.GetCostReport(from, to)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting report: %v", err))
+		return
+	}
+
+	total := types.BaseMoney(0)
+	missing := []string{}
+
+	for _, report := range reports {
+		if report.Converted == nil {
+			missing = append(missing, fmt.Sprintf("%s (%s)", report.ItemType, report.Currency))
+			continue
+		}
+		total = total.Add(*report.Converted)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"from": from.Format("2006-01-02"),
+		"to": to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"types": reports,
+		"total": total,
+		"missing_rates": missing,
+	})
+}
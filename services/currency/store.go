@@ -0,0 +1,142 @@
+package currency
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) GetCurrencies() ([]types.Currency, error) {
+	var currencies []types.Currency
+
+	rows, err := s.db.Query("SELECT code, name, exponent, is_base FROM currencies ORDER BY is_base DESC, code")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var currency types.Currency
+
+		if err := rows.Scan(&currency.Code, &currency.Name, &currency.Exponent, &currency.IsBase); err != nil {
+			return nil, err
+		}
+
+		currencies = append(currencies, currency)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return currencies, nil
+}
+
+// GetExchangeRates returns the rate history newest first, an empty currency returns every currency's
+func (s *Store) GetExchangeRates(currency string) ([]types.ExchangeRate, error) {
+	rates := []types.ExchangeRate{}
+
+	rows, err := s.db.Query(`SELECT id, currency, rate::TEXT, effective_date, createdat FROM exchange_rates
+							 WHERE $1 = '' OR currency = $1
+							 ORDER BY currency, effective_date DESC`, strings.ToUpper(currency))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rate types.ExchangeRate
+
+		if err := rows.Scan(&rate.ID, &rate.Currency, &rate.Rate, &rate.EffectiveDate, &rate.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		rates = append(rates, rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// SetExchangeRate replaces the rate already set for that day, which is how a mistyped rate is corrected
+func (s *Store) SetExchangeRate(payload types.ExchangeRatePayload) error {
+	res, err := s.db.Exec(`INSERT INTO exchange_rates (currency, rate, effective_date)
+						   SELECT code, $2::NUMERIC, $3::DATE FROM currencies WHERE code = $1 AND NOT is_base
+						   ON CONFLICT (currency, effective_date) DO UPDATE SET rate = EXCLUDED.rate, createdat = CURRENT_TIMESTAMP`,
+		strings.ToUpper(payload.Currency), payload.Rate, payload.EffectiveDate,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("unknown currency or the base currency")
+	}
+
+	return nil
+}
+
+// GetCostReport sums the cost of items registered in [from, to), converting each item at the rate on its
+// registration date
+func (s *Store) GetCostReport(from time.Time, to time.Time) ([]types.CostReport, error) {
+	var reports []types.CostReport
+
+	rows, err := s.db.Query(`SELECT i.type_ref, i.modal_currency, COUNT(*), COALESCE(SUM(i.modal), 0),
+							 CASE WHEN COUNT(*) = COUNT(c.amount) THEN SUM(c.amount) END
+							 FROM items i
+							 CROSS JOIN LATERAL (SELECT to_base_minor(i.modal, i.modal_currency, i.createdat) AS amount) c
+							 WHERE i.createdat >= $1 AND i.createdat < $2 AND i.modal IS NOT NULL
+							 GROUP BY i.type_ref, i.modal_currency
+							 ORDER BY i.type_ref, i.modal_currency`, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var report types.CostReport
+		var converted sql.NullInt64
+
+		if err := rows.Scan(&report.ItemType, &report.Currency, &report.Items, &report.Cost.Amount, &converted); err != nil {
+			return nil, err
+		}
+
+		report.Cost.Currency = report.Currency
+		if converted.Valid {
+			amount := types.NewMoney(converted.Int64, types.BaseCurrency)
+			report.Converted = &amount
+		}
+
+		reports = append(reports, report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+const (
+	backlogSize		= 500	// Events kept in memory for clients that reconnect
+	subscriberBuffer	= 64
+)
+
+type subscriber struct {
+	topics	map[string]bool
+	ch		chan types.Event
+}
+
+// Broker fans events out to connected dashboard streams and keeps a short backlog so a reconnecting
+// client can replay what it missed, it lives in memory so the backlog resets when the server restarts.
+// IDs start from the start time in microseconds, so unless the old process averaged more than one event per
+// microsecond an ID from before a restart is older than the new backlog and the client is told to refetch
+type Broker struct {
+	mu			sync.Mutex
+	firstID		int64
+	nextID		int64
+	backlog		[]types.Event
+	subscribers	map[*subscriber]struct{}
+}
+
+func NewBroker() *Broker {
+	firstID := time.Now().UnixMicro()
+
+	return &Broker{
+		firstID: firstID,
+		nextID: firstID,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func (b *Broker) Publish(topic string, eventType string, data any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := types.Event{
+		ID: b.nextID,
+		Topic: topic,
+		Type: eventType,
+		Data: data,
+		Time: time.Now(),
+	}
+	b.nextID++
+
+	b.backlog = append(b.backlog, event)
+	if len(b.backlog) > backlogSize {
+		b.backlog = b.backlog[len(b.backlog)-backlogSize:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.wants(topic) {
+			continue
+		}
+
+		// A stream that cannot keep up is dropped instead of blocking the request that published,
+		// the client reconnects with Last-Event-ID and replays from the backlog
+		select {
+		case sub.ch <- event:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe registers a stream for the given topics (all topics when empty) and returns the backlog
+// after lastID, complete is false when events after lastID already fell out of the backlog or lastID was
+// not handed out by this process
+func (b *Broker) Subscribe(topics []string, lastID int64) (sub *subscriber, replay []types.Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &subscriber{
+		topics: make(map[string]bool),
+		ch: make(chan types.Event, subscriberBuffer),
+	}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+
+	complete = true
+	if lastID > 0 {
+		complete = lastID >= b.firstID && lastID < b.nextID &&
+			(len(b.backlog) == 0 || b.backlog[0].ID <= lastID+1)
+
+		for _, event := range b.backlog {
+			if event.ID > lastID && sub.wants(event.Topic) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	b.subscribers[sub] = struct{}{}
+
+	return sub, replay, complete
+}
+
+func (b *Broker) Unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (s *subscriber) wants(topic string) bool {
+	return len(s.topics) == 0 || s.topics[topic]
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+func TestSubscribeReplaysAfterLastID(t *testing.T) {
+	b := NewBroker()
+	b.Publish(types.TopicItems, "item.created", nil)
+	b.Publish(types.TopicSales, "sale.created", nil)
+	b.Publish(types.TopicItems, "item.updated", nil)
+
+	first := b.backlog[0].ID
+
+	sub, replay, complete := b.Subscribe([]string{types.TopicItems}, first)
+	defer b.Unsubscribe(sub)
+
+	if !complete {
+		t.Fatal("replay from the backlog should be complete")
+	}
+	if len(replay) != 1 || replay[0].Type != "item.updated" {
+		t.Fatalf("replay = %+v, want only item.updated", replay)
+	}
+}
+
+func TestSubscribeAfterRestartIsIncomplete(t *testing.T) {
+	before := NewBroker()
+	for i := 0; i < 900; i++ {
+		before.Publish(types.TopicItems, "item.created", nil)
+	}
+	lastID := before.backlog[len(before.backlog)-1].ID
+
+	// A new process, the client reconnects with an ID the old one handed out. This test publishes far faster
+	// than the server ever does, give the clock time to pass the old IDs
+	time.Sleep(time.Millisecond)
+	after := NewBroker()
+
+	sub, replay, complete := after.Subscribe(nil, lastID)
+	after.Unsubscribe(sub)
+	if complete || len(replay) != 0 {
+		t.Fatalf("empty backlog after restart: complete = %v, replay = %d events", complete, len(replay))
+	}
+
+	after.Publish(types.TopicItems, "item.created", nil)
+	if after.backlog[0].ID <= lastID {
+		t.Fatalf("IDs went backwards across the restart: %d after %d", after.backlog[0].ID, lastID)
+	}
+
+	sub, _, complete = after.Subscribe(nil, lastID)
+	after.Unsubscribe(sub)
+	if complete {
+		t.Fatal("events published before the restart are gone, replay must not be complete")
+	}
+}
+
+func TestSubscribeUnknownIDIsIncomplete(t *testing.T) {
+	b := NewBroker()
+	b.Publish(types.TopicItems, "item.created", nil)
+
+	sub, _, complete := b.Subscribe(nil, b.nextID+100)
+	b.Unsubscribe(sub)
+	if complete {
+		t.Fatal("an ID this broker never handed out must not count as complete")
+	}
+}
+
+func TestBacklogOverflowIsIncomplete(t *testing.T) {
+	b := NewBroker()
+	b.Publish(types.TopicItems, "item.created", nil)
+	lastID := b.backlog[0].ID
+
+	for i := 0; i < backlogSize+1; i++ {
+		b.Publish(types.TopicItems, "item.created", nil)
+	}
+
+	sub, replay, complete := b.Subscribe(nil, lastID)
+	b.Unsubscribe(sub)
+	if complete {
+		t.Fatal("events after lastID fell out of the backlog, replay must not be complete")
+	}
+	if len(replay) != backlogSize {
+		t.Fatalf("replay = %d events, want %d", len(replay), backlogSize)
+	}
+}
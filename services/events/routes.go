@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/gorilla/mux"
+)
+
+const heartbeatInterval = 25 * time.Second	// Keeps proxies from closing an idle stream
+
+type Handler struct {
+	broker *Broker
+	userStore types.UserStore
+}
+
+func NewHandler(broker *Broker, userStore types.UserStore) *Handler {
+	return &Handler{
+		broker: broker,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/stream", auth.WithJWTAuth(h.handleStream, h.userStore)).Methods("GET")
+}
+
+// handleStream is a Server-Sent Events stream, subscribe with ?topics=items,sales,shipments (all topics when empty).
+// EventSource sends Last-Event-ID on reconnect, the events missed in between are replayed first
+func (h *Handler) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	var topics []string
+	if topicsQuery := r.URL.Query().Get("topics"); topicsQuery != "" {
+		for _, topic := range strings.Split(topicsQuery, ",") {
+			topic = strings.TrimSpace(topic)
+			if topic != types.TopicItems && topic != types.TopicSales && topic != types.TopicShipments {
+				utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("unknown topic: %s", topic))
+				return
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	lastIDStr := r.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = r.URL.Query().Get("last_event_id")
+	}
+	lastID, _ := strconv.ParseInt(lastIDStr, 10, 64)
+
+	sub, replay, complete := h.broker.Subscribe(topics, lastID)
+	defer h.broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// The backlog no longer reaches back to lastID, tell the client to refetch instead of trusting the replay
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-sub.ch:
+			if !ok {
+				return	// Dropped by the broker for falling behind, the client reconnects and replays
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event types.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
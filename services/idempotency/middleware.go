@@ -0,0 +1,166 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+)
+
+const (
+	Header			= "Idempotency-Key"
+	ReplayedHeader	= "Idempotent-Replayed"
+
+	maxKeyLength	= 255
+	staleAfter		= 5 * time.Minute	// An in-progress key older than this belongs to a request that died
+)
+
+// Retention is how long a response is replayed for, IDEMPOTENCY_RETENTION overrides the 24 hour default
+func Retention() time.Duration {
+	retention, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_RETENTION"))
+	if err != nil || retention <= 0 {
+		return 24 * time.Hour
+	}
+
+	return retention
+}
+
+// WithKey runs the handler once per Idempotency-Key and replays its response to retries of the same
+// request, requests without the header run as usual. It goes inside the auth wrapper so keys are per user, or
+// per device for signed requests. Server errors are not kept so the retry gets another attempt, which is why
+// wrapped handlers commit before writing a success and answer a failed commit with a 500
+func WithKey(handlerFunc http.HandlerFunc, store types.IdempotencyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			handlerFunc(w, r)
+			return
+		}
+
+		if len(key) > maxKeyLength {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("%s is longer than %d characters", Header, maxKeyLength))
+			return
+		}
+
+		userID, _ := r.Context().Value(auth.UserKey).(int)	// 0 for signed device requests
+		deviceID := 0
+		if device, ok := r.Context().Value(auth.DeviceKey).(types.Device); ok {
+			deviceID = device.ID
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading body: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		h.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+		h.Write(body)
+		fingerprint := hex.EncodeToString(h.Sum(nil))
+
+		now := time.Now()
+		claimed, err := store.ClaimKey(userID, deviceID, key, fingerprint, now.Add(-Retention()), now.Add(-staleAfter))
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking %s: %v", Header, err))
+			return
+		}
+
+		if !claimed {
+			replay(w, store, userID, deviceID, key, fingerprint)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handlerFunc(recorder, r)
+
+		if recorder.status >= http.StatusInternalServerError {
+			if err := store.ReleaseKey(userID, deviceID, key); err != nil {
+				log.Printf("idempotency: error releasing key %s: %v", key, err)
+			}
+			return
+		}
+
+		if err := store.CompleteKey(userID, deviceID, key, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes()); err != nil {
+			log.Printf("idempotency: error storing response for key %s: %v", key, err)
+		}
+	}
+}
+
+func replay(w http.ResponseWriter, store types.IdempotencyStore, userID int, deviceID int, key string, fingerprint string) {
+	record, err := store.GetKey(userID, deviceID, key)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking %s: %v", Header, err))
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		utils.WriteError(w, http.StatusUnprocessableEntity, fmt.Errorf("%s was already used for a different request", Header))
+		return
+	}
+
+	if record.StatusCode == 0 {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("a request with this %s is still being processed", Header))
+		return
+	}
+
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+// responseRecorder passes the response through while keeping a copy to store
+type responseRecorder struct {
+	http.ResponseWriter
+	status		int
+	body		bytes.Buffer
+	wroteHeader	bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// StartPurger deletes keys past the retention window every interval
+func StartPurger(ctx context.Context, store types.IdempotencyStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := store.PurgeKeys(time.Now().Add(-Retention())); err != nil {
+				log.Printf("idempotency: error purging keys: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
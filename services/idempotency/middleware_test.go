@@ -0,0 +1,100 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// memoryStore keeps keys the way the idempotency_keys table does, one row per user, device and key
+type memoryStore struct {
+	records map[string]*types.IdempotencyRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make(map[string]*types.IdempotencyRecord)}
+}
+
+func recordKey(user_id int, device_id int, key string) string {
+	return fmt.Sprintf("%d:%d:%s", user_id, device_id, key)
+}
+
+func (s *memoryStore) ClaimKey(user_id int, device_id int, key string, fingerprint string, expired_before time.Time, stale_before time.Time) (bool, error) {
+	if _, ok := s.records[recordKey(user_id, device_id, key)]; ok {
+		return false, nil
+	}
+
+	s.records[recordKey(user_id, device_id, key)] = &types.IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+	return true, nil
+}
+
+func (s *memoryStore) GetKey(user_id int, device_id int, key string) (*types.IdempotencyRecord, error) {
+	record := *s.records[recordKey(user_id, device_id, key)]
+	return &record, nil
+}
+
+func (s *memoryStore) CompleteKey(user_id int, device_id int, key string, status_code int, content_type string, body []byte) error {
+	record := s.records[recordKey(user_id, device_id, key)]
+	record.StatusCode = status_code
+	record.ContentType = content_type
+	record.Body = body
+	return nil
+}
+
+func (s *memoryStore) ReleaseKey(user_id int, device_id int, key string) error {
+	delete(s.records, recordKey(user_id, device_id, key))
+	return nil
+}
+
+func (s *memoryStore) PurgeKeys(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// deviceRequest is a request as MobileAuth hands it on after checking the device's signature
+func deviceRequest(device_id int, target string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(`{"rfid_tag": "TAG-1"}`))
+	r.Header.Set(Header, "register-1")
+	return r.WithContext(context.WithValue(r.Context(), auth.DeviceKey, types.Device{ID: device_id}))
+}
+
+func TestWithKeyScopesDevices(t *testing.T) {
+	runs := 0
+	handler := WithKey(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "run %d", runs)
+	}, newMemoryStore())
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := serve(deviceRequest(1, "/api/item/register-item")); w.Code != http.StatusCreated || runs != 1 {
+		t.Fatalf("first request = %d, %d runs", w.Code, runs)
+	}
+
+	// Another device picking the same key is a different request
+	if w := serve(deviceRequest(2, "/api/item/register-item")); w.Code != http.StatusCreated || runs != 2 {
+		t.Fatalf("second device = %d %s, %d runs, want its own run", w.Code, w.Body.String(), runs)
+	}
+
+	// The first device's retry is replayed
+	w := serve(deviceRequest(1, "/api/item/register-item"))
+	if w.Code != http.StatusCreated || w.Body.String() != "run 1" || w.Header().Get(ReplayedHeader) != "true" || runs != 2 {
+		t.Fatalf("retry = %d %s, %d runs, want run 1 replayed", w.Code, w.Body.String(), runs)
+	}
+
+	// The query is part of the request
+	if w := serve(deviceRequest(1, "/api/item/register-item?force=true")); w.Code != http.StatusUnprocessableEntity || runs != 2 {
+		t.Fatalf("key reused with another query = %d, %d runs, want 422", w.Code, runs)
+	}
+}
@@ -0,0 +1,83 @@
+package idempotency
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+// ClaimKey records the key as in progress and reports whether this request owns it. A key past the
+// retention window, or left in progress by a request that never finished, is taken over
+func (s *Store) ClaimKey(user_id int, device_id int, key string, fingerprint string, expired_before time.Time, stale_before time.Time) (bool, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO idempotency_keys (user_id, device_id, idem_key, fingerprint) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_id, idem_key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, content_type = NULL, body = NULL,
+			createdat = CURRENT_TIMESTAMP, completed_at = NULL
+		WHERE idempotency_keys.createdat < $5
+		OR (idempotency_keys.completed_at IS NULL AND idempotency_keys.createdat < $6)`,
+		user_id, device_id, key, fingerprint, expired_before, stale_before,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (s *Store) GetKey(user_id int, device_id int, key string) (*types.IdempotencyRecord, error) {
+	var record types.IdempotencyRecord
+	var status_code sql.NullInt64
+	var content_type sql.NullString
+
+	err := s.db.QueryRow(`SELECT idem_key, fingerprint, status_code, content_type, body, createdat
+						  FROM idempotency_keys WHERE user_id = $1 AND device_id = $2 AND idem_key = $3`, user_id, device_id, key,
+	).Scan(&record.Key, &record.Fingerprint, &status_code, &content_type, &record.Body, &record.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	record.StatusCode = int(status_code.Int64)
+	record.ContentType = content_type.String
+
+	return &record, nil
+}
+
+func (s *Store) CompleteKey(user_id int, device_id int, key string, status_code int, content_type string, body []byte) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = $1, content_type = $2, body = $3, completed_at = CURRENT_TIMESTAMP
+						 WHERE user_id = $4 AND device_id = $5 AND idem_key = $6`,
+		status_code, content_type, body, user_id, device_id, key,
+	)
+	return err
+}
+
+// ReleaseKey forgets a key whose request failed on our side, so the client's retry runs again
+func (s *Store) ReleaseKey(user_id int, device_id int, key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE user_id = $1 AND device_id = $2 AND idem_key = $3", user_id, device_id, key)
+	return err
+}
+
+func (s *Store) PurgeKeys(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM idempotency_keys WHERE createdat < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -1,12 +1,17 @@
 package item
 
 import (
+	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/channel"
+	"github.com/PatrickA727/mikrotik-db-sys/services/idempotency"
+	"github.com/PatrickA727/mikrotik-db-sys/services/packing"
 	"github.com/PatrickA727/mikrotik-db-sys/types"
 	"github.com/PatrickA727/mikrotik-db-sys/utils"
 	"github.com/go-playground/validator/v10"
@@ -16,34 +21,47 @@ import (
 type Handler struct {
 	store types.ItemStore
 	userStore types.UserStore
+	packStore types.PackStore
+	shipmentStore types.ShipmentStore
+	channelStore types.ChannelStore
+	journalStore types.JournalStore
+	idempotencyStore types.IdempotencyStore
+	events types.EventPublisher
 }
 
-func NewHandler (store types.ItemStore, userStore types.UserStore) *Handler {
+func NewHandler (store types.ItemStore, userStore types.UserStore, packStore types.PackStore, shipmentStore types.ShipmentStore, channelStore types.ChannelStore, journalStore types.JournalStore, idempotencyStore types.IdempotencyStore, events types.EventPublisher) *Handler {
 	return &Handler{
 		store: store,
 		userStore: userStore,
+		packStore: packStore,
+		shipmentStore: shipmentStore,
+		channelStore: channelStore,
+		journalStore: journalStore,
+		idempotencyStore: idempotencyStore,
+		events: events,
 	}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/register-item", auth.MobileAuth(h.handleRegisterItem, h.userStore)).Methods("POST")	// Mobile App
-	router.HandleFunc("/delete/{rfid_tag}", auth.WithJWTAuth(h.handleDeleteItem, h.userStore)).Methods("DELETE")
+	router.HandleFunc("/register-item", auth.MobileAuth(idempotency.WithKey(h.handleRegisterItem, h.idempotencyStore), h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/delete/{rfid_tag}", auth.WithJWTAuth(idempotency.WithKey(h.handleDeleteItem, h.idempotencyStore), h.userStore)).Methods("DELETE")
 	// router.HandleFunc("/item-sold/{rfid_tag}", auth.WithJWTAuth(h.handleItemSold, h.userStore)).Methods("POST")	// Unused
 	router.HandleFunc("/get-items", auth.WithJWTAuth(h.handleGetItems, h.userStore)).Methods("GET")
 	router.HandleFunc("/get-types", auth.MobileAuth(h.handleGetItemTypes, h.userStore)).Methods("GET")	// Mobile App
 	router.HandleFunc("/get-sold-items", auth.WithJWTAuth(h.handleGetAllSoldItem, h.userStore)).Methods("GET")
-	router.HandleFunc("/item-sold-bulk", auth.WithJWTAuth(h.handleItemSoldBulk, h.userStore)).Methods("POST")
-	router.HandleFunc("/ship-items/{invoice_id}", auth.MobileAuth(h.handleShipItems, h.userStore)).Methods("PATCH")	// Mobile App
+	router.HandleFunc("/item-sold-bulk", auth.WithJWTAuth(idempotency.WithKey(h.handleItemSoldBulk, h.idempotencyStore), h.userStore)).Methods("POST")
+	router.HandleFunc("/ship-items/{invoice_id}", auth.MobileAuth(idempotency.WithKey(h.handleShipItems, h.idempotencyStore), h.userStore)).Methods("PATCH")	// Mobile App
 	// router.HandleFunc("/edit-item-sold", auth.WithJWTAuth(h.handleUpdateSoldItem, h.userStore)).Methods("PATCH")
 	router.HandleFunc("/get-item-rfid/{rfid_tag}", auth.WithJWTAuth(h.handleGetItemByRFID, h.userStore)).Methods("GET")	// Unused
 	router.HandleFunc("/get-sold-by-rfid/{rfid_tag}", auth.MobileAuth(h.handleGetSoldItem, h.userStore)).Methods("GET")	// Mobile App
-	router.HandleFunc("/register-item-type", auth.WithJWTAuth(h.handleCreateItemType, h.userStore)).Methods("POST")
+	router.HandleFunc("/register-item-type", auth.WithJWTAuth(idempotency.WithKey(h.handleCreateItemType, h.idempotencyStore), h.userStore)).Methods("POST")
 	router.HandleFunc("/get-avail-item", auth.WithJWTAuth(h.handleGetAvailItemBySN, h.userStore)).Methods("GET")
 	router.HandleFunc("/get-invoice-items/{id}", auth.MobileAuth(h.handleGetItemsByInvoice, h.userStore)).Methods("GET") // Mobile App
 	router.HandleFunc("/get-invoices", auth.MobileAuth(h.handleGetInvoices, h.userStore)).Methods("GET") // Mobile App
 	router.HandleFunc("/get-all-invoices", auth.WithJWTAuth(h.handleGetAllInvoice, h.userStore)).Methods("GET")
-	router.HandleFunc("/edit-invoice/{id}", auth.WithJWTAuth(h.handleEditInvoice, h.userStore)).Methods("PATCH")
-	router.HandleFunc("/delete-invoice/{id}", auth.WithJWTAuth(h.handleDeleteInvoice, h.userStore)).Methods("DELETE")
+	router.HandleFunc("/edit-invoice/{id}", auth.WithJWTAuth(idempotency.WithKey(h.handleEditInvoice, h.idempotencyStore), h.userStore)).Methods("PATCH")
+	router.HandleFunc("/delete-invoice/{id}", auth.WithJWTAuth(idempotency.WithKey(h.handleDeleteInvoice, h.idempotencyStore), h.userStore)).Methods("DELETE")
+	router.HandleFunc("/split-invoice/{id}", auth.WithJWTAuth(idempotency.WithKey(h.handleSplitInvoice, h.idempotencyStore), h.userStore)).Methods("POST")
 	router.HandleFunc("/get-status-count", auth.WithJWTAuth(h.handleGetItemStatusCount, h.userStore)).Methods("GET")
 	router.HandleFunc("/get-type-count", auth.WithJWTAuth(h.handleGetItemTypeCount, h.userStore)).Methods("GET")
 }
@@ -70,12 +88,15 @@ func (h *Handler) handleRegisterItem(w http.ResponseWriter, r *http.Request) {
 		RFIDTag: payload.RFIDTag,
 		Batch: payload.Batch,
 		TypeRef: payload.TypeRef,
+		Cost: payload.Cost,
 	})
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating item %v", err))
 		return
 	}
 
+	h.events.Publish(types.TopicItems, "item.registered", payload)
+
 	utils.WriteJSON(w, http.StatusCreated, "Item Created")
 }
 
@@ -97,11 +118,17 @@ func (h *Handler) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
 
 	// Delete item
 	err = h.store.DeleteItemByRFID(rfid_tag)
+	if err == types.ErrItemJournaled {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error deleting item: %v", err))
 		return
 	}
 
+	h.events.Publish(types.TopicItems, "item.deleted", map[string]string{"rfid_tag": rfid_tag})
+
 	utils.WriteJSON(w, http.StatusOK, "item deleted")
 }
 
@@ -249,17 +276,9 @@ func (h *Handler) handleItemSoldBulk (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer func() {	
-		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				log.Printf("failed to rollback transaction: %v", rbErr)
-				return
-			}
-			return
-		}
-		if commitErr := tx.Commit(); commitErr != nil {
-			log.Printf("failed to commit transaction: %v", commitErr)
-			return
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", rbErr)
 		}
 	}()
 
@@ -282,6 +301,12 @@ func (h *Handler) handleItemSoldBulk (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	payload.OnlineShop, err = channel.Resolve(h.channelStore, payload.OnlineShop)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	// Create Invoice
 	invoice_id, err := h.store.CreateInvoice(payload.Invoice, payload.OnlineShop, tx, ctx)
 	if err != nil {
@@ -297,6 +322,13 @@ func (h *Handler) handleItemSoldBulk (w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Reserved items can only be sold by converting their reservation
+		if i.Status != "not sold" {
+			err = fmt.Errorf("item %s is %s", SerialNum, i.Status)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
 		err = h.store.NewItemSold(types.SoldItem{
 			ItemID: i.ID,
 			InvoiceID: invoice_id,
@@ -308,6 +340,18 @@ func (h *Handler) handleItemSoldBulk (w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err = tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving sale: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicSales, "sale.created", map[string]interface{}{
+		"invoice_id": invoice_id,
+		"invoice": payload.Invoice,
+		"ol_shop": payload.OnlineShop,
+		"serial_numbers": payload.SerialNums,
+	})
+
 	utils.WriteJSON(w, http.StatusCreated, "Sold items registered in bulk")
 }
 
@@ -320,54 +364,142 @@ func (h *Handler) handleShipItems(w http.ResponseWriter, r *http.Request) {
 		return
     }
 
-	ctx := r.Context()
-	tx, err := h.store.BeginTransaction(ctx)
+	// Courier details and the item subset are optional, the mobile app can ship everything with an empty body.
+	// A chunked body has no length, so an empty one only shows up as EOF
+	var shipment types.ShipmentPayload
+	if r.Body != nil {
+		if parseErr := utils.ParseJSON(r, &shipment); parseErr != nil && parseErr != io.EOF {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", parseErr))
+			return
+		}
+	}
+
+	if err = utils.Validate.Struct(shipment); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	// shipments.shipping_cost is a base currency column, a foreign cost is refused rather than converted at a guessed rate
+	if shipment.ShippingCost.Currency != "" && shipment.ShippingCost.Currency != types.BaseCurrency {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("shipping cost must be in %s", types.BaseCurrency))
+		return
+	}
+
+	soldItems, err := h.store.GetItemsByInvoice(invoice_id)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error1: %v", err))
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error2: %v", err))
 		return
 	}
 
-	defer func() {	
-		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				log.Printf("failed to rollback transaction: %v", rbErr)
+	unshipped := packing.Unshipped(soldItems)
+	if len(unshipped) == 0 {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("invoice %d has no items left to ship", invoice_id))
+		return
+	}
+
+	// Pick the items going into this parcel
+	toShip := unshipped
+	if len(shipment.RFIDTags) > 0 {
+		byTag := make(map[string]types.SoldItem)
+		for _, item := range unshipped {
+			byTag[item.ItemTag] = item
+		}
+
+		toShip = nil
+		for _, tag := range shipment.RFIDTags {
+			item, ok := byTag[tag]
+			if !ok {
+				utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("item %s is not an unshipped item of invoice %d", tag, invoice_id))
 				return
 			}
-			return
+			delete(byTag, tag)
+			toShip = append(toShip, item)
 		}
-		if commitErr := tx.Commit(); commitErr != nil {
-			log.Printf("failed to commit transaction: %v", commitErr)
-			return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error1: %v", err))
+		return
+	}
+
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", rbErr)
 		}
 	}()
 
-	err = h.store.ShipInvoice(invoice_id, tx, ctx)
+	// Only ship once the units were scanned into the box, or a supervisor overrode the check. The session is
+	// locked so an unscan or override cannot slip in between the check and the shipment
+	session, err := h.packStore.LockOpenPackSession(invoice_id, tx, ctx)
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error1: %v", err))
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("invoice %d has no pack session, scan the items before shipping", invoice_id))
 		return
 	}
 
-	soldItems, err := h.store.GetItemsByInvoice(invoice_id)
+	scans, err := h.packStore.GetPackScansTx(session.ID, tx, ctx)
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error2: %v", err))
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting scans: %v", err))
 		return
 	}
 
-	// Get and register items
-	for _, itemRFIDTag := range soldItems {
-		i, err := h.store.GetItemByRFIDTag(itemRFIDTag.ItemTag)
+	packStatus := packing.BuildStatus(session, unshipped, scans)
+	if !packStatus.CanShip && !packing.CanShipSubset(packStatus, toShip) {
+		err = fmt.Errorf("scanned items do not match the shipment")
+		utils.WriteJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": err.Error(),
+			"pack_status": packStatus,
+		})
+		return
+	}
+
+	shipment_id, err := h.shipmentStore.CreateShipment(invoice_id, shipment, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating shipment: %v", err))
+		return
+	}
+
+	for _, item := range toShip {
+		err = h.store.ShipItem(item.ID, tx, ctx)
 		if err != nil {
-			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error getting items: %v", err))
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error shipping items: %v", err))
 			return
 		}
 
-		err = h.store.ShipItem(i.ID, tx, ctx)
+		err = h.shipmentStore.AssignShipment(shipment_id, item.ID, tx, ctx)
 		if err != nil {
 			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error shipping items: %v", err))
 			return
 		}
 	}
 
+	invoiceStatus, err := h.shipmentStore.RefreshInvoiceShipStatus(invoice_id, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error updating invoice: %v", err))
+		return
+	}
+
+	// Each parcel is packed in its own session, the rest of the invoice starts a new one
+	err = h.packStore.ClosePackSession(session.ID, types.PackShipped, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error closing pack session: %v", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving shipment: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicShipments, "invoice.shipped", map[string]interface{}{
+		"invoice_id": invoice_id,
+		"shipment_id": shipment_id,
+		"status": invoiceStatus,
+		"items": len(toShip),
+	})
+
 	utils.WriteJSON(w, http.StatusOK, "Item Shipped")
 }
 
@@ -455,7 +587,7 @@ func (h *Handler) handleCreateItemType(w http.ResponseWriter, r *http.Request) {
 	// Create item
 	err = h.store.CreateItemType(types.ItemType{
 		TypeName: payload.ItemType,
-		Price: payload.Price,
+		ListPrice: payload.Price,
 	})
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error creating type: %v", err))
@@ -534,6 +666,7 @@ func (h *Handler) handleGetAllInvoice (w http.ResponseWriter, r *http.Request) {
 	pageStr := r.URL.Query().Get("page")
 	invoice := r.URL.Query().Get("invoice")
 	status := r.URL.Query().Get("status")
+	payment_status := r.URL.Query().Get("payment_status")
 	limit := 10
 
 	page, err := strconv.Atoi(pageStr)
@@ -543,7 +676,7 @@ func (h *Handler) handleGetAllInvoice (w http.ResponseWriter, r *http.Request) {
 
 	offset := (page - 1) * limit
 
-	invoices, count, err := h.store.GetAllInvoice(limit, offset, invoice, status)
+	invoices, count, err := h.store.GetAllInvoice(limit, offset, invoice, status, payment_status)
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
 		return
@@ -603,6 +736,14 @@ func (h *Handler) handleEditInvoice (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if payload.OnlineShop != "" {
+		payload.OnlineShop, err = channel.Resolve(h.channelStore, payload.OnlineShop)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
 	err = h.store.EditInvoice(rfid_tag, payload)
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
@@ -640,21 +781,24 @@ func (h *Handler) handleDeleteInvoice (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer func() {	
-		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				log.Printf("failed to rollback transaction: %v", rbErr)
-				return
-			}
-			return
-		}
-		if commitErr := tx.Commit(); commitErr != nil {
-			log.Printf("failed to commit transaction: %v", commitErr)
-			return
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", rbErr)
 		}
 	}()
 
+	// Posted sales are reversed, the journal keeps its entries after the invoice is gone
+	_, err = h.journalStore.ReverseInvoice(invoice_id, "invoice deleted", tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error reversing journal: %v", err))
+		return
+	}
+
 	err = h.store.DeleteInvoice(invoice_id, tx, ctx)
+	if err == types.ErrInvoiceInUse {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error2: %v", err))
 		return
@@ -666,5 +810,113 @@ func (h *Handler) handleDeleteInvoice (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error deleting invoice: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicSales, "invoice.deleted", map[string]interface{}{
+		"invoice_id": invoice_id,
+		"items": len(items),
+	})
+
 	utils.WriteJSON(w, http.StatusOK, "Invoice deleted")
 }
+
+// handleSplitInvoice moves unshipped items to a new invoice, e.g. when part of an order is billed separately
+func (h *Handler) handleSplitInvoice (w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	invoice_id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.SplitInvoicePayload
+	if err = utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err = utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	invoice, err := h.store.GetInvoiceByID(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("invoice %d not found", invoice_id))
+		return
+	}
+
+	if invoice.JournaledAt != nil {
+		utils.WriteError(w, http.StatusConflict, types.ErrInvoiceJournaled)
+		return
+	}
+
+	items, err := h.store.GetItemsByInvoice(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	byTag := make(map[string]types.SoldItem)
+	for _, item := range packing.Unshipped(items) {
+		byTag[item.ItemTag] = item
+	}
+
+	var item_ids []int
+	for _, tag := range payload.RFIDTags {
+		item, ok := byTag[tag]
+		if !ok {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("item %s is not an unshipped item of invoice %d", tag, invoice_id))
+			return
+		}
+		delete(byTag, tag)
+		item_ids = append(item_ids, item.ID)
+	}
+
+	if len(item_ids) == len(items) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("cannot move every item, edit the invoice instead"))
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", rbErr)
+		}
+	}()
+
+	new_invoice_id, err := h.store.SplitInvoice(invoice_id, payload.Invoice, item_ids, tx, ctx)
+	if err == types.ErrInvoiceJournaled {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error splitting invoice: %v", err))
+		return
+	}
+
+	// The items left behind may all be shipped already
+	if len(byTag) == 0 {
+		if _, err = h.shipmentStore.RefreshInvoiceShipStatus(invoice_id, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error updating invoice: %v", err))
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error splitting invoice: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]int{"invoice_id": new_invoice_id})
+}
@@ -0,0 +1,203 @@
+package item
+
+import (
+	"context"
+	"io"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/internal/txtest"
+	"github.com/PatrickA727/mikrotik-db-sys/services/idempotency"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// splitStore is the part of ItemStore splitting uses, calling anything else panics on the nil interface
+type splitStore struct {
+	types.ItemStore
+	db			*sql.DB
+	invoice		types.Invoice
+	items		[]types.SoldItem
+	moved		[]int
+}
+
+func (s *splitStore) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+func (s *splitStore) GetInvoiceByID(id int) (*types.Invoice, error) {
+	invoice := s.invoice
+	return &invoice, nil
+}
+
+func (s *splitStore) GetItemsByInvoice(invoice_id int) ([]types.SoldItem, error) {
+	return s.items, nil
+}
+
+func (s *splitStore) SplitInvoice(invoice_id int, new_invoice string, item_ids []int, tx *sql.Tx, ctx context.Context) (int, error) {
+	if s.invoice.JournaledAt != nil {
+		return 0, types.ErrInvoiceJournaled
+	}
+
+	s.moved = item_ids
+	return invoice_id + 1, nil
+}
+
+func newSplitStore(t *testing.T, journaledAt *time.Time) *splitStore {
+	return &splitStore{
+		db: txtest.Open(t),
+		invoice: types.Invoice{ID: 7, InvoiceStr: "INV/7", JournaledAt: journaledAt},
+		items: []types.SoldItem{
+			{ID: 1, ItemID: 11, ItemTag: "TAG-1", InvoiceID: 7},
+			{ID: 2, ItemID: 12, ItemTag: "TAG-2", InvoiceID: 7},
+		},
+	}
+}
+
+func split(h *Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/item/split-invoice/7", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": "7"})
+
+	w := httptest.NewRecorder()
+	h.handleSplitInvoice(w, r)
+
+	return w
+}
+
+func TestSplitInvoice(t *testing.T) {
+	store := newSplitStore(t, nil)
+	h := NewHandler(store, nil, nil, nil, nil, nil, nil, nil)
+
+	w := split(h, `{"invoice": "INV/7-B", "rfid_tags": ["TAG-2"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("split = %d %s", w.Code, w.Body.String())
+	}
+
+	if len(store.moved) != 1 || store.moved[0] != 2 {
+		t.Fatalf("moved %v, want sold item 2", store.moved)
+	}
+}
+
+func TestSplitInvoiceAfterPosting(t *testing.T) {
+	posted := time.Date(2026, 10, 18, 23, 0, 0, 0, time.Local)
+	store := newSplitStore(t, &posted)
+	h := NewHandler(store, nil, nil, nil, nil, nil, nil, nil)
+
+	w := split(h, `{"invoice": "INV/7-B", "rfid_tags": ["TAG-2"]}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "journal") {
+		t.Fatalf("split of a posted invoice = %d %s, want 409", w.Code, w.Body.String())
+	}
+
+	if store.moved != nil {
+		t.Fatalf("items %v were moved out of a posted invoice", store.moved)
+	}
+}
+
+// keyStore holds Idempotency-Keys in memory, calling anything else panics on the nil interface
+type keyStore struct {
+	types.IdempotencyStore
+	records map[string]*types.IdempotencyRecord
+}
+
+func (s *keyStore) ClaimKey(user_id int, device_id int, key string, fingerprint string, expired_before time.Time, stale_before time.Time) (bool, error) {
+	if _, ok := s.records[key]; ok {
+		return false, nil
+	}
+
+	s.records[key] = &types.IdempotencyRecord{Key: key, Fingerprint: fingerprint}
+	return true, nil
+}
+
+func (s *keyStore) GetKey(user_id int, device_id int, key string) (*types.IdempotencyRecord, error) {
+	record := *s.records[key]
+	return &record, nil
+}
+
+func (s *keyStore) CompleteKey(user_id int, device_id int, key string, status_code int, content_type string, body []byte) error {
+	s.records[key].StatusCode = status_code
+	s.records[key].Body = body
+	return nil
+}
+
+func (s *keyStore) ReleaseKey(user_id int, device_id int, key string) error {
+	delete(s.records, key)
+	return nil
+}
+
+func TestSplitInvoiceFailedCommit(t *testing.T) {
+	store := newSplitStore(t, nil)
+	store.db = txtest.FailCommit(t)
+	keys := &keyStore{records: make(map[string]*types.IdempotencyRecord)}
+	h := NewHandler(store, nil, nil, nil, nil, nil, keys, nil)
+
+	handler := idempotency.WithKey(h.handleSplitInvoice, keys)
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/item/split-invoice/7", strings.NewReader(`{"invoice": "INV/7-B", "rfid_tags": ["TAG-2"]}`))
+		r.Header.Set(idempotency.Header, "split-1")
+		r = mux.SetURLVars(r, map[string]string{"id": "7"})
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	w := send()
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("split = %d %s, want a 500 when the commit fails", w.Code, w.Body.String())
+	}
+	if _, kept := keys.records["split-1"]; kept {
+		t.Fatalf("key kept after the commit failed, the retry would replay a split that never happened")
+	}
+
+	// The retry runs the split again instead of replaying anything
+	store.db = txtest.Open(t)
+	w = send()
+	if w.Code != http.StatusCreated || w.Header().Get(idempotency.ReplayedHeader) != "" {
+		t.Fatalf("retry = %d %s, want a fresh 201", w.Code, w.Body.String())
+	}
+	if keys.records["split-1"].StatusCode != http.StatusCreated {
+		t.Fatalf("key stored %d, want the 201", keys.records["split-1"].StatusCode)
+	}
+}
+
+// TestShipItemsBody stops at the shipped invoice, what matters is whether the body got past parsing
+func TestShipItemsBody(t *testing.T) {
+	store := newSplitStore(t, nil)
+	shipment_id := 3
+	for i := range store.items {
+		store.items[i].ShipmentID = &shipment_id
+	}
+	h := NewHandler(store, nil, nil, nil, nil, nil, nil, nil)
+
+	tests := []struct {
+		name	string
+		body	string
+		status	int
+	}{
+		{"empty", "", http.StatusConflict},
+		{"courier details", `{"courier": "jne", "shipping_cost": 18000}`, http.StatusConflict},
+		{"not JSON", `courier=jne`, http.StatusBadRequest},
+		{"negative weight", `{"package_weight": -5}`, http.StatusBadRequest},
+		{"foreign shipping cost", `{"shipping_cost": {"amount": "12.50", "currency": "USD"}}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Chunked, so the request has no ContentLength to go by
+			r := httptest.NewRequest("PATCH", "/api/item/ship-items/7", io.NopCloser(strings.NewReader(tt.body)))
+			r.ContentLength = -1
+			r = mux.SetURLVars(r, map[string]string{"invoice_id": "7"})
+
+			w := httptest.NewRecorder()
+			h.handleShipItems(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("ship = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
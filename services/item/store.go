@@ -29,6 +29,13 @@ func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
 }
 
 func (s *Store) CreateItem(item types.Item) error {
+	if item.Cost != nil {
+		_, err := s.db.Exec("INSERT INTO items (serial_number, rfid_tag, batch, type_ref, modal, modal_currency) VALUES ($1, $2, $3, $4, $5, $6)",
+							item.SerialNumber, item.RFIDTag, item.Batch, item.TypeRef, item.Cost.Amount, item.Cost.Currency,
+						)
+		return err
+	}
+
 	_, err := s.db.Exec("INSERT INTO items (serial_number, rfid_tag, batch, type_ref) VALUES ($1, $2, $3, $4)", 
 						item.SerialNumber, item.RFIDTag, item.Batch, item.TypeRef,
 					);
@@ -40,7 +47,9 @@ func (s *Store) CreateItem(item types.Item) error {
 }
 
 func (s *Store) CreateItemType(item_type types.ItemType) error {
-	_, err := s.db.Exec("INSERT INTO item_type (item_type, price) VALUES ($1, $2)", item_type.TypeName, item_type.Price)
+	_, err := s.db.Exec("INSERT INTO item_type (item_type, price, price_currency) VALUES ($1, $2, $3)",
+		item_type.TypeName, item_type.ListPrice.Amount, item_type.ListPrice.Currency,
+	)
 	if err != nil {
 		return err
 	}
@@ -51,7 +60,8 @@ func (s *Store) CreateItemType(item_type types.ItemType) error {
 func (s *Store) GetItemTypes() ([]types.ItemType, error) {
 	var item_types []types.ItemType
 
-	rows, err := s.db.QueryContext(context.Background(), "SELECT * FROM item_type");
+	rows, err := s.db.QueryContext(context.Background(), `SELECT id, item_type, price, price_currency, tax_rate_id, price_includes_tax,
+														   to_base_minor(price, price_currency, CURRENT_TIMESTAMP::TIMESTAMP) FROM item_type`);
 	if err != nil {
 		return nil, err
 	}
@@ -60,11 +70,18 @@ func (s *Store) GetItemTypes() ([]types.ItemType, error) {
 
 	for rows.Next() {
 		var item_type types.ItemType
+		var base_price sql.NullInt64
 
-		if err := rows.Scan(&item_type.ID, &item_type.TypeName, &item_type.Price); err != nil {
+		if err := rows.Scan(&item_type.ID, &item_type.TypeName, &item_type.ListPrice.Amount, &item_type.ListPrice.Currency,
+			&item_type.TaxRateID, &item_type.PriceIncludesTax, &base_price); err != nil {
 			return nil, err
 		}
 
+		if base_price.Valid {
+			price := types.NewMoney(base_price.Int64, types.BaseCurrency).Whole()
+			item_type.Price = &price
+		}
+
 		item_types = append(item_types, item_type)
 	}
 	 
@@ -91,8 +108,8 @@ func (s *Store) GetItemByRFIDTag(rfid_tag string) (*types.Item, error) {
 func (s *Store) GetItemBySN(serial_num string, tx *sql.Tx, ctx context.Context) (*types.Item, error) {
 	var item types.Item
 
-	err := tx.QueryRowContext(ctx, "SELECT id, serial_number, rfid_tag, batch, type_ref FROM items WHERE serial_number = $1", serial_num).Scan(
-		&item.ID, &item.SerialNumber, &item.RFIDTag, &item.Batch, &item.TypeRef,
+	err := tx.QueryRowContext(ctx, "SELECT id, serial_number, rfid_tag, batch, type_ref, status FROM items WHERE serial_number = $1", serial_num).Scan(
+		&item.ID, &item.SerialNumber, &item.RFIDTag, &item.Batch, &item.TypeRef, &item.Status,
 	)
 	if err != nil {
 		return nil, err
@@ -240,12 +257,24 @@ func (s *Store) GetItemCount(search string, status string) (int, error) {
 	return itemCount, nil
 }
 
+// DeleteItemByRFID also takes the item off its invoice, which is refused once the invoice is posted
 func (s *Store) DeleteItemByRFID(rfid_tag string) error {
-	_, err := s.db.Exec("DELETE FROM items WHERE rfid_tag = $1", rfid_tag)
+	res, err := s.db.Exec(`DELETE FROM items i WHERE i.rfid_tag = $1 AND NOT EXISTS (
+						   SELECT 1 FROM sold_items s JOIN invoice v ON v.id = s.invoice_id
+						   WHERE s.item_id = i.id AND v.journaled_at IS NOT NULL)`, rfid_tag)
 	if err != nil {
 		return err
 	}
 
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrItemJournaled
+	}
+
 	return nil
 }
 
@@ -271,18 +300,48 @@ func (s *Store) NewItemSold(sold_item types.SoldItem, tx *sql.Tx, ctx context.Co
 		err error
 	)
 
-	_, err = tx.ExecContext(ctx,
-		"INSERT INTO sold_items (item_id, ol_shop, invoice_id) VALUES ($1, $2, $3)",
-			sold_item.ItemID, sold_item.OnlineShop, sold_item.InvoiceID,
+	// Price and tax are fixed at the time of sale, the item type's settings win over the channel's. Without an
+	// agreed price, foreign list prices are converted at today's rate and the sale fails when there is none
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO sold_items (item_id, ol_shop, invoice_id, unit_price, tax_rate, price_includes_tax)
+		SELECT i.id, $2, $3, COALESCE($4::BIGINT, to_base_minor(t.price, t.price_currency, CURRENT_TIMESTAMP::TIMESTAMP)),
+			COALESCE(CASE WHEN tr.active THEN tr.rate END, dr.rate, 0),
+			COALESCE(t.price_includes_tax, c.price_includes_tax, true)
+		FROM items i
+		JOIN item_type t ON i.type_ref = t.item_type
+		LEFT JOIN tax_rates tr ON tr.id = t.tax_rate_id
+		LEFT JOIN tax_rates dr ON dr.is_default AND dr.active
+		LEFT JOIN channels c ON c.name = $2
+		WHERE i.id = $1 AND COALESCE($4::BIGINT, to_base_minor(t.price, t.price_currency, CURRENT_TIMESTAMP::TIMESTAMP)) IS NOT NULL`,
+			sold_item.ItemID, sold_item.OnlineShop, sold_item.InvoiceID, sold_item.UnitPrice,
 		)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, "UPDATE items SET status = $1 WHERE id = $2", "sold-pending", sold_item.ItemID)
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d not found or its price has no exchange rate", sold_item.ItemID)
+	}
+
+	// Only an item still for sale can be sold, so two sales cannot race for one unit
+	res, err = tx.ExecContext(ctx, "UPDATE items SET status = $1 WHERE id = $2 AND status = $3", "sold-pending", sold_item.ItemID, "not sold")
 	if err != nil {
 		return err
-	} 
+	}
+
+	rowsAffected, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is no longer for sale", sold_item.ItemID)
+	}
 
 	return nil
 }
@@ -394,7 +453,7 @@ func (s *Store) ShipItem(item_id int, tx *sql.Tx, ctx context.Context) error {
 func (s *Store) GetItemsByInvoice (invoice_id int) ([]types.SoldItem, error) {
 	var items []types.SoldItem
 
-	rows, err := s.db.Query(`SELECT i.id, i.rfid_tag, i.serial_number, i.type_ref 
+	rows, err := s.db.Query(`SELECT i.id, i.rfid_tag, i.serial_number, i.type_ref, i.status, s.shipment_id
 							FROM sold_items s JOIN items i ON s.item_id = i.id
 							WHERE s.invoice_id = $1`, invoice_id);
 	if err != nil {
@@ -405,7 +464,7 @@ func (s *Store) GetItemsByInvoice (invoice_id int) ([]types.SoldItem, error) {
 	for rows.Next() {
 		var item types.SoldItem
 
-		if err = rows.Scan(&item.ID, &item.ItemTag, &item.ItemSN, &item.ItemType); err != nil {
+		if err = rows.Scan(&item.ID, &item.ItemTag, &item.ItemSN, &item.ItemType, &item.Status, &item.ShipmentID); err != nil {
 			return nil, err
 		}
 
@@ -449,11 +508,15 @@ func (s *Store) GetInvoices (invoice string) ([]types.Invoice, error) {
 	return invoices, nil
 }
 
+// Payment columns come from the invoice_balances view
+const invoiceColumns = `id, invoice_str, status, online_shop, shipped_at, delivered_at, b.payment_status, b.amount_due, b.paid - b.refunded, b.tax, journaled_at`
+
 func (s *Store) GetInvoiceByID(id int) (*types.Invoice, error) {
 	var invoice types.Invoice
 
-	err := s.db.QueryRow("SELECT invoice_str, status, online_shop FROM invoice WHERE id = $1", id).Scan(
-		&invoice.InvoiceStr, &invoice.Status, &invoice.OnlineShop,
+	err := s.db.QueryRow("SELECT "+invoiceColumns+" FROM invoice JOIN invoice_balances b ON b.invoice_id = invoice.id WHERE id = $1", id).Scan(
+		&invoice.ID, &invoice.InvoiceStr, &invoice.Status, &invoice.OnlineShop, &invoice.ShippedAt, &invoice.DeliveredAt,
+		&invoice.PaymentStatus, &invoice.AmountDue, &invoice.AmountPaid, &invoice.TaxAmount, &invoice.JournaledAt,
 	)
 
 	if err != nil {
@@ -463,16 +526,7 @@ func (s *Store) GetInvoiceByID(id int) (*types.Invoice, error) {
 	return &invoice, nil
 }
 
-func (s *Store) ShipInvoice (invoice_id int, tx *sql.Tx, ctx context.Context) error {
-	_, err := tx.ExecContext(ctx, `UPDATE invoice SET status = $1 WHERE id = $2`, "shipped", invoice_id)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status string) ([]types.Invoice, int, error) {
+func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status string, payment_status string) ([]types.Invoice, int, error) {
 	var (
 		rows *sql.Rows
 		err error
@@ -482,7 +536,7 @@ func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status str
    var args []interface{}
    var conditions []string
 
-   query := "SELECT id, invoice_str, status, online_shop FROM invoice"
+   query := "SELECT " + invoiceColumns + " FROM invoice JOIN invoice_balances b ON b.invoice_id = invoice.id"
 
 	if invoice != "" {
 		args = append(args, invoice+"%")
@@ -496,6 +550,12 @@ func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status str
 		conditions = append(conditions, fmt.Sprintf("status ILIKE $%d", len(args)))
 	}
 
+	if payment_status != "" {
+		args = append(args, payment_status)
+
+		conditions = append(conditions, fmt.Sprintf("b.payment_status = $%d", len(args)))
+	}
+
 	if len(conditions) > 0 {
 		query += " WHERE " + strings.Join(conditions, " AND ")
 	}
@@ -513,7 +573,8 @@ func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status str
 	for rows.Next() {
 		var invoice types.Invoice
 
-		if err := rows.Scan(&invoice.ID, &invoice.InvoiceStr, &invoice.Status, &invoice.OnlineShop); err != nil {
+		if err := rows.Scan(&invoice.ID, &invoice.InvoiceStr, &invoice.Status, &invoice.OnlineShop, &invoice.ShippedAt, &invoice.DeliveredAt,
+			&invoice.PaymentStatus, &invoice.AmountDue, &invoice.AmountPaid, &invoice.TaxAmount, &invoice.JournaledAt); err != nil {
 			return nil, 0, err
 		}
 
@@ -524,7 +585,7 @@ func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status str
         return nil, 0, err
     }
 
-	count, err := s.GetInvoiceCount(invoice, status)
+	count, err := s.GetInvoiceCount(invoice, status, payment_status)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -532,13 +593,13 @@ func (s *Store) GetAllInvoice (limit int, offset int, invoice string, status str
     return invoices, count, nil
 }
 
-func (s *Store) GetInvoiceCount (invoice string, status string) (int, error) {
+func (s *Store) GetInvoiceCount (invoice string, status string, payment_status string) (int, error) {
 	invoiceCount := 0
 
 	var args []interface{}
    	var conditions []string
 
-	query := "SELECT COUNT(*) FROM invoice"
+	query := "SELECT COUNT(*) FROM invoice JOIN invoice_balances b ON b.invoice_id = invoice.id"
 
 	if invoice != "" {
 		args = append(args, invoice+"%")
@@ -552,6 +613,12 @@ func (s *Store) GetInvoiceCount (invoice string, status string) (int, error) {
 		conditions = append(conditions, fmt.Sprintf("status ILIKE $%d", len(args)))
 	}
 
+	if payment_status != "" {
+		args = append(args, payment_status)
+
+		conditions = append(conditions, fmt.Sprintf("b.payment_status = $%d", len(args)))
+	}
+
 	if len(conditions) > 0 {
 		query += " WHERE " + strings.Join(conditions, " AND ")
 	}
@@ -564,7 +631,8 @@ func (s *Store) GetInvoiceCount (invoice string, status string) (int, error) {
 	return invoiceCount, nil
 }
 
-func (s *Store) EditInvoice(id int, payload types.EditInvoice) error {
+// EditInvoice keeps sold_items.ol_shop in step with the invoice's channel
+func (s *Store) EditInvoice(id int, payload types.EditInvoice) (err error) {
 	var setClauses []string
 	var args []interface{}
 
@@ -593,13 +661,91 @@ func (s *Store) EditInvoice(id int, payload types.EditInvoice) error {
 
 	args = append(args, id)
 
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
 	// Execute query
-	_, err := s.db.Exec(query, args...)
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	if payload.OnlineShop != "" {
+		_, err = tx.Exec("UPDATE sold_items SET ol_shop = $1 WHERE invoice_id = $2", payload.OnlineShop, id)
+	}
+
 	return err
 }
 
+// SplitInvoice moves unshipped items to a new invoice on the same shop, returns the new invoice id
+func (s *Store) SplitInvoice(invoice_id int, new_invoice string, item_ids []int, tx *sql.Tx, ctx context.Context) (int, error) {
+	new_invoice_id := 0
+	journaled := false
+
+	// A posted sale covers every item of the invoice, moving some out would post them again and a later
+	// reversal of the original would take them back out as well
+	err := tx.QueryRowContext(ctx, "SELECT journaled_at IS NOT NULL FROM invoice WHERE id = $1 FOR UPDATE", invoice_id).Scan(&journaled)
+	if err != nil {
+		return 0, err
+	}
+
+	if journaled {
+		return 0, types.ErrInvoiceJournaled
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO invoice (invoice_str, online_shop) SELECT $1, online_shop FROM invoice WHERE id = $2 RETURNING id`,
+		new_invoice, invoice_id,
+	).Scan(&new_invoice_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item_id := range item_ids {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE sold_items SET invoice_id = $1 WHERE invoice_id = $2 AND item_id = $3 AND shipment_id IS NULL`,
+			new_invoice_id, invoice_id, item_id,
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error checking affected rows: %v", err)
+		}
+
+		if rowsAffected == 0 {
+			return 0, fmt.Errorf("item %d is not an unshipped item of invoice %d", item_id, invoice_id)
+		}
+	}
+
+	return new_invoice_id, nil
+}
+
 func (s *Store) DeleteInvoice(id int, tx *sql.Tx, ctx context.Context) error {
-	_, err := tx.ExecContext(ctx, `DELETE FROM invoice WHERE id = $1`, id)
+	var in_use bool
+
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM marketplace_orders WHERE invoice_id = $1)
+		OR EXISTS (SELECT 1 FROM payments WHERE invoice_id = $1)`, id).Scan(&in_use)
+	if err != nil {
+		return err
+	}
+
+	if in_use {
+		return types.ErrInvoiceInUse
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM invoice WHERE id = $1`, id)
 	if err != nil {
 		return err
 	}
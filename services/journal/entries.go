@@ -0,0 +1,82 @@
+package journal
+
+import (
+	"fmt"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// BuildSaleEntry books the invoice total to receivable against revenue and output tax, the marketplace's cut
+// out of the receivable and the cost of the items out of inventory. Zero and negative amounts are left out
+func BuildSaleEntry(source types.JournalSource) types.JournalEntry {
+	entry := types.JournalEntry{
+		InvoiceID: source.InvoiceID,
+		InvoiceStr: source.InvoiceStr,
+		Kind: types.EntrySale,
+		EntryDate: source.SoldAt,
+		Description: fmt.Sprintf("Sale %s", source.InvoiceStr),
+	}
+
+	if source.OnlineShop != "" {
+		entry.Description += " via " + source.OnlineShop
+	}
+
+	debit(&entry, types.AccountReceivable, source.Revenue.Add(source.Tax))
+	credit(&entry, types.AccountRevenue, source.Revenue)
+	credit(&entry, types.AccountTaxPayable, source.Tax)
+
+	debit(&entry, types.AccountMarketplaceFees, source.Fees)
+	credit(&entry, types.AccountReceivable, source.Fees)
+
+	debit(&entry, types.AccountCOGS, source.Cost)
+	credit(&entry, types.AccountInventory, source.Cost)
+
+	return entry
+}
+
+// BuildRefundEntry takes a partial refund back out of revenue and output tax, the receivable shrinks by what
+// was paid back
+func BuildRefundEntry(refund types.JournalRefund) types.JournalEntry {
+	entry := types.JournalEntry{
+		InvoiceID: refund.InvoiceID,
+		InvoiceStr: refund.InvoiceStr,
+		Kind: types.EntryRefund,
+		EntryDate: refund.RefundedAt,
+		Description: fmt.Sprintf("Refund on %s", refund.InvoiceStr),
+	}
+
+	debit(&entry, types.AccountRevenue, refund.Amount.Sub(refund.Tax))
+	debit(&entry, types.AccountTaxPayable, refund.Tax)
+	credit(&entry, types.AccountReceivable, refund.Amount)
+
+	return entry
+}
+
+func debit(entry *types.JournalEntry, account string, amount types.Money) {
+	if amount.Amount > 0 {
+		entry.Lines = append(entry.Lines, types.JournalLine{Account: account, Debit: amount})
+	}
+}
+
+func credit(entry *types.JournalEntry, account string, amount types.Money) {
+	if amount.Amount > 0 {
+		entry.Lines = append(entry.Lines, types.JournalLine{Account: account, Credit: amount})
+	}
+}
+
+// Balanced reports whether the debit lines add up to the credit lines. A line has to be a positive amount on
+// one side only, entries that are not balanced are never posted
+func Balanced(entry types.JournalEntry) bool {
+	var debits, credits int64
+
+	for _, line := range entry.Lines {
+		if line.Debit.Amount < 0 || line.Credit.Amount < 0 || (line.Debit.Amount == 0) == (line.Credit.Amount == 0) {
+			return false
+		}
+
+		debits += line.Debit.Amount
+		credits += line.Credit.Amount
+	}
+
+	return len(entry.Lines) > 0 && debits == credits
+}
@@ -0,0 +1,109 @@
+package journal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+func lines(entry types.JournalEntry) map[string]int64 {
+	net := make(map[string]int64)
+	for _, line := range entry.Lines {
+		net[line.Account] += line.Debit.Amount - line.Credit.Amount
+	}
+	return net
+}
+
+func TestBuildSaleEntry(t *testing.T) {
+	entry := BuildSaleEntry(types.JournalSource{
+		InvoiceID: 7,
+		InvoiceStr: "INV/7",
+		OnlineShop: "tokopedia",
+		SoldAt: time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local),
+		Revenue: types.BaseMoney(1000000),
+		Tax: types.BaseMoney(110000),
+		Fees: types.BaseMoney(50000),
+		Cost: types.BaseMoney(700000),
+	})
+
+	if !Balanced(entry) {
+		t.Fatalf("sale entry does not balance: %+v", entry.Lines)
+	}
+	if entry.Kind != types.EntrySale || entry.Description != "Sale INV/7 via tokopedia" {
+		t.Fatalf("entry = %+v", entry)
+	}
+
+	want := map[string]int64{
+		types.AccountReceivable: types.BaseMoney(1110000 - 50000).Amount,
+		types.AccountRevenue: -types.BaseMoney(1000000).Amount,
+		types.AccountTaxPayable: -types.BaseMoney(110000).Amount,
+		types.AccountMarketplaceFees: types.BaseMoney(50000).Amount,
+		types.AccountCOGS: types.BaseMoney(700000).Amount,
+		types.AccountInventory: -types.BaseMoney(700000).Amount,
+	}
+	got := lines(entry)
+	for account, amount := range want {
+		if got[account] != amount {
+			t.Fatalf("%s nets %d, want %d", account, got[account], amount)
+		}
+	}
+
+	// Without tax, fees or a cost there is only the sale itself
+	entry = BuildSaleEntry(types.JournalSource{InvoiceStr: "INV/8", Revenue: types.BaseMoney(500000)})
+	if len(entry.Lines) != 2 || !Balanced(entry) {
+		t.Fatalf("lines = %+v, want receivable against revenue", entry.Lines)
+	}
+}
+
+func TestBuildRefundEntry(t *testing.T) {
+	entry := BuildRefundEntry(types.JournalRefund{
+		PaymentID: 3,
+		InvoiceID: 7,
+		InvoiceStr: "INV/7",
+		Amount: types.BaseMoney(222000),
+		Tax: types.BaseMoney(22000),
+	})
+
+	if !Balanced(entry) || entry.Kind != types.EntryRefund {
+		t.Fatalf("refund entry = %+v", entry)
+	}
+
+	got := lines(entry)
+	if got[types.AccountRevenue] != types.BaseMoney(200000).Amount || got[types.AccountTaxPayable] != types.BaseMoney(22000).Amount ||
+		got[types.AccountReceivable] != -types.BaseMoney(222000).Amount {
+		t.Fatalf("refund nets %v", got)
+	}
+}
+
+func TestBalanced(t *testing.T) {
+	debit := func(account string, amount int64) types.JournalLine {
+		return types.JournalLine{Account: account, Debit: types.BaseMoney(amount)}
+	}
+	credit := func(account string, amount int64) types.JournalLine {
+		return types.JournalLine{Account: account, Credit: types.BaseMoney(amount)}
+	}
+
+	tests := []struct {
+		name	string
+		lines	[]types.JournalLine
+		want	bool
+	}{
+		{"one against one", []types.JournalLine{debit("receivable", 100), credit("revenue", 100)}, true},
+		{"one against two", []types.JournalLine{debit("receivable", 111), credit("revenue", 100), credit("tax_payable", 11)}, true},
+		{"short a credit", []types.JournalLine{debit("receivable", 111), credit("revenue", 100)}, false},
+		{"more credit than debit", []types.JournalLine{debit("receivable", 100), credit("revenue", 100), credit("tax_payable", 11)}, false},
+		{"negative line", []types.JournalLine{debit("receivable", -100), credit("revenue", -100)}, false},
+		{"both sides on a line", []types.JournalLine{{Account: "receivable", Debit: types.BaseMoney(5), Credit: types.BaseMoney(5)}}, false},
+		{"zero line", []types.JournalLine{debit("receivable", 100), credit("revenue", 100), debit("cogs", 0)}, false},
+		{"no lines", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Balanced(types.JournalEntry{Lines: tt.lines}); got != tt.want {
+				t.Fatalf("Balanced = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
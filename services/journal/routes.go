@@ -0,0 +1,331 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.JournalStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.JournalStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/generate", auth.WithRole(h.handleGenerate, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("POST")
+	router.HandleFunc("/entries", auth.WithJWTAuth(h.handleGetEntries, h.userStore)).Methods("GET")
+	router.HandleFunc("/export", auth.WithRole(h.handleExport, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("GET")
+	router.HandleFunc("/accounts", auth.WithJWTAuth(h.handleGetAccounts, h.userStore)).Methods("GET")
+	router.HandleFunc("/accounts", auth.WithRole(h.handleSetAccount, h.userStore, types.RoleAdmin)).Methods("PUT")
+}
+
+// handleGenerate posts a sale entry for every invoice sold before ?until= (YYYY-MM-DD, inclusive, default
+// today) that is not journaled yet, reverses posted invoices that have since been refunded in full and books
+// partial refunds of posted invoices. Everything is read inside the transaction with the rows locked, so two
+// runs at once cannot post the same invoice twice
+func (h *Handler) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	until := time.Now()
+	if untilStr := r.URL.Query().Get("until"); untilStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", untilStr, time.Local)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid until date: %v", err))
+			return
+		}
+		until = parsed.AddDate(0, 0, 1)
+	}
+
+	// Transaction
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	sources, err := h.store.GetUnjournaledSales(until, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting sales: %v", err))
+		return
+	}
+
+	posted := 0
+	for _, source := range sources {
+		entry := BuildSaleEntry(source)
+
+		// Invoices with no priced items have nothing to post but are still marked so they are not picked up again
+		if len(entry.Lines) > 0 {
+			if !Balanced(entry) {
+				err = fmt.Errorf("entry for %s does not balance", source.InvoiceStr)
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if _, err = h.store.PostEntry(entry, tx, ctx); err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error posting %s: %v", source.InvoiceStr, err))
+				return
+			}
+			posted++
+		}
+
+		err = h.store.MarkInvoiceJournaled(source.InvoiceID, tx, ctx)
+		if err == types.ErrAlreadyJournaled {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("%s: %v", source.InvoiceStr, err))
+			return
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error marking %s journaled: %v", source.InvoiceStr, err))
+			return
+		}
+	}
+
+	// Full refunds are reversed before partial ones are booked, a reversed invoice has nothing left to refund against
+	refunded, err := h.store.GetRefundedInvoices(tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting refunds: %v", err))
+		return
+	}
+
+	reversed := 0
+	for _, invoice_id := range refunded {
+		var count int
+		count, err = h.store.ReverseInvoice(invoice_id, "refunded", tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error reversing invoice %d: %v", invoice_id, err))
+			return
+		}
+		reversed += count
+	}
+
+	refunds, err := h.store.GetUnjournaledRefunds(tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting refunds: %v", err))
+		return
+	}
+
+	for _, refund := range refunds {
+		entry := BuildRefundEntry(refund)
+		if !Balanced(entry) {
+			err = fmt.Errorf("refund entry for %s does not balance", refund.InvoiceStr)
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		var entry_id int
+		if entry_id, err = h.store.PostEntry(entry, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error posting refund on %s: %v", refund.InvoiceStr, err))
+			return
+		}
+
+		err = h.store.MarkRefundJournaled(refund.PaymentID, entry_id, tx, ctx)
+		if err == types.ErrAlreadyJournaled {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("refund on %s: %v", refund.InvoiceStr, err))
+			return
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error marking refund on %s journaled: %v", refund.InvoiceStr, err))
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving journal: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"posted": posted,
+		"refunds": len(refunds),
+		"reversed": reversed,
+	})
+}
+
+// parseRange reads ?from= and ?to= as inclusive YYYY-MM-DD dates, defaulting to the current month
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", fromStr, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from date: %v", err)
+		}
+		from = parsed
+	}
+
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", toStr, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to date: %v", err)
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+
+	return from, to, nil
+}
+
+func (h *Handler) handleGetEntries(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseRange(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := h.store.GetEntries(from, to, r.URL.Query().Get("unexported") == "true")
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting entries: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+// handleExport writes one CSV row per journal line using the configured chart of accounts. Only entries
+// not exported before are included unless ?all=true, and they are marked exported unless ?preview=true. The
+// CSV is only sent once the entries are marked, a failed export leaves them for the next one
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseRange(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	accounts, err := h.store.GetAccounts()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting accounts: %v", err))
+		return
+	}
+
+	chart := make(map[string]types.JournalAccount)
+	for _, account := range accounts {
+		chart[account.Key] = account
+	}
+
+	entries, err := h.store.GetEntries(from, to, r.URL.Query().Get("all") != "true")
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting entries: %v", err))
+		return
+	}
+
+	var export bytes.Buffer
+	writer := csv.NewWriter(&export)
+	writer.Write([]string{"date", "entry", "reference", "description", "account_code", "account_name", "debit", "credit"})
+
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		for _, line := range entry.Lines {
+			account, ok := chart[line.Account]
+			if !ok {
+				account = types.JournalAccount{Code: line.Account, Name: line.Account}
+			}
+
+			writer.Write([]string{
+				entry.EntryDate.Format("2006-01-02"),
+				strconv.Itoa(entry.ID),
+				entry.InvoiceStr,
+				entry.Description,
+				account.Code,
+				account.Name,
+				line.Debit.String(),
+				line.Credit.String(),
+			})
+		}
+		ids = append(ids, entry.ID)
+	}
+
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error writing journal export: %v", err))
+		return
+	}
+
+	if r.URL.Query().Get("preview") != "true" {
+		if err = h.markExported(r.Context(), ids); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error marking journal entries exported: %v", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="journal_%s_%s.csv"`,
+		from.Format("20060102"), to.AddDate(0, 0, -1).Format("20060102")))
+
+	if _, err := w.Write(export.Bytes()); err != nil {
+		log.Printf("error sending journal export: %v", err)
+	}
+}
+
+func (h *Handler) markExported(ctx context.Context, ids []int) error {
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = h.store.MarkEntriesExported(ids, tx, ctx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (h *Handler) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts, err := h.store.GetAccounts()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting accounts: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"accounts": accounts,
+	})
+}
+
+func (h *Handler) handleSetAccount(w http.ResponseWriter, r *http.Request) {
+	var payload types.JournalAccount
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.SetAccount(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error saving account: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Account saved")
+}
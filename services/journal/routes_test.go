@@ -0,0 +1,236 @@
+package journal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/internal/txtest"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// memoryStore holds what the journal tables would, calling anything else panics on the nil interface
+type memoryStore struct {
+	types.JournalStore
+	db			*sql.DB
+	sales		[]types.JournalSource
+	refunded	[]int
+	refunds		[]types.JournalRefund
+	journaled	map[int]bool
+	entries		[]types.JournalEntry
+	reversed	map[int]bool
+	booked		map[int]int
+	exported	[]int
+	markFails	bool
+}
+
+func newMemoryStore(t *testing.T) *memoryStore {
+	return &memoryStore{
+		db: txtest.Open(t),
+		journaled: make(map[int]bool),
+		reversed: make(map[int]bool),
+		booked: make(map[int]int),
+	}
+}
+
+func (s *memoryStore) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+func (s *memoryStore) GetUnjournaledSales(until time.Time, tx *sql.Tx, ctx context.Context) ([]types.JournalSource, error) {
+	var sources []types.JournalSource
+	for _, source := range s.sales {
+		if !s.journaled[source.InvoiceID] {
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+func (s *memoryStore) GetRefundedInvoices(tx *sql.Tx, ctx context.Context) ([]int, error) {
+	return s.refunded, nil
+}
+
+func (s *memoryStore) GetUnjournaledRefunds(tx *sql.Tx, ctx context.Context) ([]types.JournalRefund, error) {
+	var refunds []types.JournalRefund
+	for _, refund := range s.refunds {
+		if _, ok := s.booked[refund.PaymentID]; !ok && !s.reversed[refund.InvoiceID] {
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds, nil
+}
+
+func (s *memoryStore) PostEntry(entry types.JournalEntry, tx *sql.Tx, ctx context.Context) (int, error) {
+	entry.ID = len(s.entries) + 1
+	s.entries = append(s.entries, entry)
+	return entry.ID, nil
+}
+
+func (s *memoryStore) MarkInvoiceJournaled(invoice_id int, tx *sql.Tx, ctx context.Context) error {
+	if s.journaled[invoice_id] {
+		return types.ErrAlreadyJournaled
+	}
+	s.journaled[invoice_id] = true
+	return nil
+}
+
+func (s *memoryStore) MarkRefundJournaled(payment_id int, entry_id int, tx *sql.Tx, ctx context.Context) error {
+	if _, ok := s.booked[payment_id]; ok {
+		return types.ErrAlreadyJournaled
+	}
+	s.booked[payment_id] = entry_id
+	return nil
+}
+
+func (s *memoryStore) ReverseInvoice(invoice_id int, reason string, tx *sql.Tx, ctx context.Context) (int, error) {
+	s.reversed[invoice_id] = true
+	return 1, nil
+}
+
+func (s *memoryStore) GetAccounts() ([]types.JournalAccount, error) {
+	return []types.JournalAccount{{Key: types.AccountReceivable, Code: "1-1300", Name: "Piutang Usaha"}}, nil
+}
+
+func (s *memoryStore) GetEntries(from time.Time, to time.Time, unexported bool) ([]types.JournalEntry, error) {
+	return s.entries, nil
+}
+
+func (s *memoryStore) MarkEntriesExported(ids []int, tx *sql.Tx, ctx context.Context) error {
+	if s.markFails {
+		return errors.New("connection reset")
+	}
+	s.exported = append(s.exported, ids...)
+	return nil
+}
+
+func sale(invoice_id int, invoice_str string) types.JournalSource {
+	return types.JournalSource{
+		InvoiceID: invoice_id,
+		InvoiceStr: invoice_str,
+		SoldAt: time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local),
+		Revenue: types.BaseMoney(1000000),
+		Tax: types.BaseMoney(110000),
+	}
+}
+
+func generate(h *Handler) (*httptest.ResponseRecorder, map[string]int) {
+	w := httptest.NewRecorder()
+	h.handleGenerate(w, httptest.NewRequest("POST", "/api/journal/generate", nil))
+
+	var counts map[string]int
+	json.Unmarshal(w.Body.Bytes(), &counts)
+
+	return w, counts
+}
+
+func TestGenerate(t *testing.T) {
+	store := newMemoryStore(t)
+	store.sales = []types.JournalSource{sale(7, "INV/7"), sale(8, "INV/8")}
+	store.refunded = []int{5}
+	store.refunds = []types.JournalRefund{
+		{PaymentID: 1, InvoiceID: 7, InvoiceStr: "INV/7", Amount: types.BaseMoney(111000), Tax: types.BaseMoney(11000)},
+		{PaymentID: 2, InvoiceID: 5, InvoiceStr: "INV/5", Amount: types.BaseMoney(50000)},
+	}
+	h := NewHandler(store, nil)
+
+	w, counts := generate(h)
+	if w.Code != http.StatusOK {
+		t.Fatalf("generate = %d %s", w.Code, w.Body.String())
+	}
+
+	// The refund on the reversed invoice is not booked on top of the reversal
+	if counts["posted"] != 2 || counts["reversed"] != 1 || counts["refunds"] != 1 {
+		t.Fatalf("counts = %v", counts)
+	}
+	if len(store.entries) != 3 || store.entries[2].Kind != types.EntryRefund || store.booked[1] != 3 {
+		t.Fatalf("entries = %+v, booked %v", store.entries, store.booked)
+	}
+	for _, entry := range store.entries {
+		if !Balanced(entry) {
+			t.Fatalf("posted an entry that does not balance: %+v", entry)
+		}
+	}
+
+	// A second run finds nothing left to do
+	w, counts = generate(h)
+	if w.Code != http.StatusOK || counts["posted"] != 0 || counts["refunds"] != 0 || len(store.entries) != 3 {
+		t.Fatalf("second run = %d %v with %d entries", w.Code, counts, len(store.entries))
+	}
+}
+
+func TestGenerateLosesRace(t *testing.T) {
+	store := newMemoryStore(t)
+	store.sales = []types.JournalSource{sale(7, "INV/7")}
+
+	// Another run marked the invoice after this one read it
+	store.journaled[7] = true
+	h := NewHandler(&racingStore{store}, nil)
+
+	w, _ := generate(h)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("generate = %d %s, want 409", w.Code, w.Body.String())
+	}
+}
+
+// racingStore hands out sales regardless of whether they were posted, as a read before another run committed would
+type racingStore struct {
+	*memoryStore
+}
+
+func (s *racingStore) GetUnjournaledSales(until time.Time, tx *sql.Tx, ctx context.Context) ([]types.JournalSource, error) {
+	return s.sales, nil
+}
+
+func TestGenerateUnbalanced(t *testing.T) {
+	store := newMemoryStore(t)
+	bad := sale(7, "INV/7")
+	bad.Revenue = types.BaseMoney(-5)
+	store.sales = []types.JournalSource{bad}
+	h := NewHandler(store, nil)
+
+	w, _ := generate(h)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "does not balance") {
+		t.Fatalf("generate = %d %s, want the entry refused", w.Code, w.Body.String())
+	}
+	if len(store.entries) != 0 {
+		t.Fatalf("entries = %+v", store.entries)
+	}
+}
+
+func TestExport(t *testing.T) {
+	store := newMemoryStore(t)
+	store.entries = []types.JournalEntry{BuildSaleEntry(sale(7, "INV/7"))}
+	store.entries[0].ID = 1
+	h := NewHandler(store, nil)
+
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.handleExport(w, httptest.NewRequest("GET", "/api/journal/export"+query, nil))
+		return w
+	}
+
+	w := export("?preview=true")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "1-1300,Piutang Usaha") || len(store.exported) != 0 {
+		t.Fatalf("preview = %d %s, exported %v", w.Code, w.Body.String(), store.exported)
+	}
+
+	// The CSV is not sent when the entries could not be marked
+	store.markFails = true
+	w = export("")
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "INV/7") {
+		t.Fatalf("failed export = %d %s, want a 500 without the CSV", w.Code, w.Body.String())
+	}
+
+	store.markFails = false
+	w = export("")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" || len(store.exported) != 1 {
+		t.Fatalf("export = %d %s, exported %v", w.Code, w.Body.String(), store.exported)
+	}
+}
@@ -0,0 +1,398 @@
+package journal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// GetUnjournaledSales returns invoices sold before the cutoff that have not been posted yet. Invoices refunded
+// before they were ever posted are left out, there is nothing to book or reverse. The invoices are locked, ones
+// another run holds are left to it
+func (s *Store) GetUnjournaledSales(until time.Time, tx *sql.Tx, ctx context.Context) ([]types.JournalSource, error) {
+	var sources []types.JournalSource
+
+	rows, err := tx.QueryContext(ctx, `SELECT i.id, i.invoice_str, COALESCE(i.online_shop, ''), b.sold_at, b.amount_due - b.tax, b.tax,
+							 COALESCE(pf.fees, ROUND(b.amount_due * COALESCE(c.fee_percent, 0) / 100)::BIGINT),
+							 COALESCE(cost.total, 0)
+							 FROM invoice i
+							 JOIN invoice_balances b ON b.invoice_id = i.id
+							 LEFT JOIN channels c ON c.name = i.online_shop
+							 LEFT JOIN (SELECT invoice_id, SUM(fees) AS fees FROM payout_lines
+										WHERE invoice_id IS NOT NULL GROUP BY invoice_id) pf ON pf.invoice_id = i.id
+							 LEFT JOIN (SELECT s.invoice_id, SUM(COALESCE(to_base_minor(it.modal, it.modal_currency, it.createdat), 0)) AS total FROM sold_items s
+										JOIN items it ON s.item_id = it.id GROUP BY s.invoice_id) cost ON cost.invoice_id = i.id
+							 WHERE i.journaled_at IS NULL AND b.sold_at IS NOT NULL AND b.sold_at < $1 AND b.payment_status <> $2
+							 ORDER BY b.sold_at, i.id
+							 FOR UPDATE OF i SKIP LOCKED`, until, types.PaymentRefunded)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var source types.JournalSource
+
+		err := rows.Scan(&source.InvoiceID, &source.InvoiceStr, &source.OnlineShop, &source.SoldAt,
+			&source.Revenue, &source.Tax, &source.Fees, &source.Cost,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, source)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// GetRefundedInvoices returns posted invoices that were fully refunded and still have a sale entry standing,
+// locked like GetUnjournaledSales
+func (s *Store) GetRefundedInvoices(tx *sql.Tx, ctx context.Context) ([]int, error) {
+	var ids []int
+
+	rows, err := tx.QueryContext(ctx, `SELECT i.id FROM invoice i JOIN invoice_balances b ON b.invoice_id = i.id
+							 WHERE i.journaled_at IS NOT NULL AND b.payment_status = $1
+							 AND EXISTS (`+unreversedSales+` AND e.invoice_id = i.id)
+							 ORDER BY i.id
+							 FOR UPDATE OF i SKIP LOCKED`, types.PaymentRefunded)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+const unreversedSales = `SELECT e.id, e.description FROM journal_entries e WHERE e.kind = 'sale'
+						 AND NOT EXISTS (SELECT 1 FROM journal_entries r WHERE r.reverses_id = e.id)`
+
+// unreversedEntries also takes in the refunds booked against a sale, reversing the invoice undoes those too
+const unreversedEntries = `SELECT e.id, e.description FROM journal_entries e WHERE e.kind IN ('sale', 'refund')
+						   AND NOT EXISTS (SELECT 1 FROM journal_entries r WHERE r.reverses_id = e.id)`
+
+// GetUnjournaledRefunds returns refunds on posted invoices that are not booked yet, the refunds are locked.
+// Invoices refunded in full are reversed instead, once that is done they have no sale standing
+func (s *Store) GetUnjournaledRefunds(tx *sql.Tx, ctx context.Context) ([]types.JournalRefund, error) {
+	var refunds []types.JournalRefund
+
+	rows, err := tx.QueryContext(ctx, `SELECT p.id, i.id, i.invoice_str, p.paid_at, p.amount,
+							 CASE WHEN b.amount_due > 0 THEN ROUND(p.amount::NUMERIC * b.tax / b.amount_due)::BIGINT ELSE 0 END
+							 FROM payments p
+							 JOIN invoice i ON i.id = p.invoice_id
+							 JOIN invoice_balances b ON b.invoice_id = i.id
+							 WHERE p.kind = $1 AND p.voided_at IS NULL AND p.journal_entry_id IS NULL
+							 AND i.journaled_at IS NOT NULL AND b.payment_status <> $2
+							 AND EXISTS (`+unreversedSales+` AND e.invoice_id = i.id)
+							 ORDER BY p.paid_at, p.id
+							 FOR UPDATE OF p SKIP LOCKED`, types.KindRefund, types.PaymentRefunded)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var refund types.JournalRefund
+
+		err := rows.Scan(&refund.PaymentID, &refund.InvoiceID, &refund.InvoiceStr, &refund.RefundedAt, &refund.Amount, &refund.Tax)
+		if err != nil {
+			return nil, err
+		}
+
+		refunds = append(refunds, refund)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+func (s *Store) PostEntry(entry types.JournalEntry, tx *sql.Tx, ctx context.Context) (int, error) {
+	entry_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO journal_entries (invoice_id, invoice_str, kind, entry_date, description, reverses_id)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		entry.InvoiceID, entry.InvoiceStr, entry.Kind, entry.EntryDate, entry.Description, entry.ReversesID,
+	).Scan(&entry_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range entry.Lines {
+		_, err = tx.ExecContext(ctx, "INSERT INTO journal_lines (entry_id, account, debit, credit) VALUES ($1, $2, $3, $4)",
+			entry_id, line.Account, line.Debit, line.Credit,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return entry_id, nil
+}
+
+func (s *Store) MarkInvoiceJournaled(invoice_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE invoice SET journaled_at = CURRENT_TIMESTAMP WHERE id = $1 AND journaled_at IS NULL", invoice_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrAlreadyJournaled
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sold_items SET journal = true WHERE invoice_id = $1", invoice_id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) MarkRefundJournaled(payment_id int, entry_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE payments SET journal_entry_id = $1 WHERE id = $2 AND journal_entry_id IS NULL", entry_id, payment_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrAlreadyJournaled
+	}
+
+	return nil
+}
+
+// ReverseInvoice posts a mirror image of every standing sale and refund entry of the invoice dated today,
+// returns how many entries were reversed. Invoices that were never posted have nothing to reverse
+func (s *Store) ReverseInvoice(invoice_id int, reason string, tx *sql.Tx, ctx context.Context) (int, error) {
+	type sale struct {
+		id			int
+		description	string
+	}
+
+	var sales []sale
+
+	rows, err := tx.QueryContext(ctx, unreversedEntries+" AND e.invoice_id = $1 ORDER BY e.id", invoice_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var entry sale
+
+		if err := rows.Scan(&entry.id, &entry.description); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		sales = append(sales, entry)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, entry := range sales {
+		reversal_id := 0
+
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO journal_entries (invoice_id, invoice_str, kind, entry_date, description, reverses_id)
+			SELECT invoice_id, invoice_str, $1, CURRENT_DATE, $2, id FROM journal_entries WHERE id = $3 RETURNING id`,
+			types.EntryReversal, fmt.Sprintf("Reversal of %s: %s", entry.description, reason), entry.id,
+		).Scan(&reversal_id)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO journal_lines (entry_id, account, debit, credit)
+			SELECT $1, account, credit, debit FROM journal_lines WHERE entry_id = $2 ORDER BY id`,
+			reversal_id, entry.id,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(sales), nil
+}
+
+// GetEntries returns entries dated in [from, to) with their lines, unexported limits it to entries not yet exported
+func (s *Store) GetEntries(from time.Time, to time.Time, unexported bool) ([]types.JournalEntry, error) {
+	var entries []*types.JournalEntry
+
+	rows, err := s.db.Query(`SELECT id, invoice_id, invoice_str, kind, entry_date, description, reverses_id, exported_at
+							 FROM journal_entries
+							 WHERE entry_date >= $1 AND entry_date < $2 AND (NOT $3 OR exported_at IS NULL)
+							 ORDER BY entry_date, id`, from, to, unexported)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	byID := make(map[int]*types.JournalEntry)
+	var ids []string
+
+	for rows.Next() {
+		var entry types.JournalEntry
+
+		err := rows.Scan(&entry.ID, &entry.InvoiceID, &entry.InvoiceStr, &entry.Kind, &entry.EntryDate,
+			&entry.Description, &entry.ReversesID, &entry.ExportedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Lines = []types.JournalLine{}
+		entries = append(entries, &entry)
+		byID[entry.ID] = &entry
+		ids = append(ids, fmt.Sprint(entry.ID))
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		lines, err := s.db.Query(`SELECT entry_id, account, debit, credit FROM journal_lines
+								  WHERE entry_id = ANY(string_to_array($1, ',')::int[]) ORDER BY entry_id, id`,
+			strings.Join(ids, ","),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		defer lines.Close()
+
+		for lines.Next() {
+			var entry_id int
+			var line types.JournalLine
+
+			if err := lines.Scan(&entry_id, &line.Account, &line.Debit, &line.Credit); err != nil {
+				return nil, err
+			}
+
+			byID[entry_id].Lines = append(byID[entry_id].Lines, line)
+		}
+
+		if err = lines.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]types.JournalEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, *entry)
+	}
+
+	return result, nil
+}
+
+func (s *Store) MarkEntriesExported(ids []int, tx *sql.Tx, ctx context.Context) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, fmt.Sprint(id))
+	}
+
+	_, err := tx.ExecContext(ctx, `UPDATE journal_entries SET exported_at = CURRENT_TIMESTAMP
+						 WHERE id = ANY(string_to_array($1, ',')::int[]) AND exported_at IS NULL`,
+		strings.Join(strs, ","),
+	)
+	return err
+}
+
+func (s *Store) GetAccounts() ([]types.JournalAccount, error) {
+	var accounts []types.JournalAccount
+
+	rows, err := s.db.Query("SELECT key, code, name FROM journal_accounts ORDER BY code")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var account types.JournalAccount
+
+		if err := rows.Scan(&account.Key, &account.Code, &account.Name); err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+func (s *Store) SetAccount(account types.JournalAccount) error {
+	_, err := s.db.Exec(`INSERT INTO journal_accounts (key, code, name) VALUES ($1, $2, $3)
+						 ON CONFLICT (key) DO UPDATE SET code = EXCLUDED.code, name = EXCLUDED.name`,
+		account.Key, account.Code, account.Name,
+	)
+	return err
+}
@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers plain text mail, one implementation per transport
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailerFromEnv picks the transport named by MAILER. "file" (the default) writes each message to MAIL_DIR
+// for local development and tests, "smtp" sends through SMTP_HOST
+func NewMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch strings.ToLower(os.Getenv("MAILER")) {
+	case "", "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir, from), nil
+	case "smtp":
+		if os.Getenv("SMTP_HOST") == "" {
+			return nil, fmt.Errorf("missing SMTP_HOST")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), from), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", os.Getenv("MAILER"))
+	}
+}
+
+// FileMailer writes every message as an .eml file, nothing leaves the machine
+type FileMailer struct {
+	mu		sync.Mutex
+	dir		string
+	from	string
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{
+		dir: dir,
+		from: from,
+	}
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102T150405.000000000"), sanitizeFileName(to))
+
+	return os.WriteFile(filepath.Join(m.dir, name), message(m.from, to, subject, body), 0o600)
+}
+
+// SMTPMailer sends through a relay with PLAIN auth, net/smtp upgrades to TLS when the server offers it
+type SMTPMailer struct {
+	addr		string
+	host		string
+	user		string
+	password	string
+	from		string
+}
+
+func NewSMTPMailer(host string, port string, user string, password string, from string) *SMTPMailer {
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		host: host,
+		user: user,
+		password: password,
+		from: from,
+	}
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.user != "" {
+		auth = smtp.PlainAuth("", m.user, m.password, m.host)
+	}
+
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, message(m.from, to, subject, body))
+}
+
+func message(from string, to string, subject string, body string) []byte {
+	var b strings.Builder
+
+	b.WriteString("From: " + stripNewlines(from) + "\r\n")
+	b.WriteString("To: " + stripNewlines(to) + "\r\n")
+	b.WriteString("Subject: " + stripNewlines(subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// stripNewlines keeps header values from injecting more headers
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+func sanitizeFileName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,329 @@
+package marketplace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Connector turns one marketplace's order exports and webhooks into orders, SKUs are resolved to item types later by the handler
+type Connector interface {
+	Name() string
+	ShopName() string	// Written to invoice.online_shop
+	ParseExport(r io.Reader) ([]types.MarketplaceOrder, error)
+	VerifyWebhook(r *http.Request, body []byte) error
+	ParseWebhook(body []byte) ([]types.MarketplaceOrder, error)
+	ParseSettlement(r io.Reader) ([]types.SettlementLine, error)
+}
+
+// exportColumns maps the fields we need to the header names a marketplace uses, exports are renamed often
+// so every field accepts several spellings
+type exportColumns struct {
+	orderID		[]string
+	invoice		[]string
+	orderedAt	[]string
+	buyer		[]string
+	sku			[]string
+	product		[]string
+	quantity	[]string
+	unitPrice	[]string
+}
+
+// settlementColumns is exportColumns for payout reports, fees are often split over several columns that
+// are added up
+type settlementColumns struct {
+	invoice		[]string
+	gross		[]string
+	fees		[][]string
+	net			[]string
+	settledAt	[]string
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"02-01-2006 15:04:05",
+	"02-01-2006 15:04",
+	"02/01/2006 15:04:05",
+	"2006-01-02",
+}
+
+// parseCSVExport reads a one-row-per-product export and groups the rows into orders
+func parseCSVExport(r io.Reader, marketplace string, columns exportColumns) ([]types.MarketplaceOrder, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+
+	find := func(aliases []string) int {
+		for _, alias := range aliases {
+			if i, ok := index[strings.ToLower(alias)]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+
+	col := map[string]int{
+		"order_id": find(columns.orderID),
+		"invoice": find(columns.invoice),
+		"ordered_at": find(columns.orderedAt),
+		"buyer": find(columns.buyer),
+		"sku": find(columns.sku),
+		"product": find(columns.product),
+		"quantity": find(columns.quantity),
+		"unit_price": find(columns.unitPrice),
+	}
+
+	for _, required := range []string{"order_id", "ordered_at", "sku", "quantity"} {
+		if col[required] < 0 {
+			return nil, fmt.Errorf("export is missing the %s column", required)
+		}
+	}
+
+	var orders []types.MarketplaceOrder
+	byID := make(map[string]int)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		field := func(name string) string {
+			if i := col[name]; i >= 0 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		orderID := field("order_id")
+		if orderID == "" {
+			continue
+		}
+
+		quantity, err := strconv.Atoi(field("quantity"))
+		if err != nil || quantity <= 0 {
+			return nil, fmt.Errorf("line %d: invalid quantity %q", line, field("quantity"))
+		}
+
+		orderLine := types.MarketplaceOrderLine{
+			SKU: field("sku"),
+			ProductName: field("product"),
+			Quantity: quantity,
+			UnitPrice: parseAmount(field("unit_price")),
+		}
+
+		i, ok := byID[orderID]
+		if !ok {
+			orderedAt, err := parseDate(field("ordered_at"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+
+			invoice := field("invoice")
+			if invoice == "" {
+				invoice = orderID
+			}
+
+			orders = append(orders, types.MarketplaceOrder{
+				Marketplace: marketplace,
+				ExternalID: orderID,
+				InvoiceStr: invoice,
+				BuyerName: field("buyer"),
+				OrderedAt: orderedAt,
+			})
+			i = len(orders) - 1
+			byID[orderID] = i
+		}
+
+		orders[i].Lines = append(orders[i].Lines, orderLine)
+	}
+
+	return orders, nil
+}
+
+// parseCSVSettlement reads a one-row-per-invoice payout report, whichever of gross and net is missing is
+// derived from the other and the fees
+func parseCSVSettlement(r io.Reader, columns settlementColumns) ([]types.SettlementLine, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+
+	find := func(aliases []string) int {
+		for _, alias := range aliases {
+			if i, ok := index[strings.ToLower(alias)]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+
+	invoiceCol, grossCol, netCol, dateCol := find(columns.invoice), find(columns.gross), find(columns.net), find(columns.settledAt)
+	if invoiceCol < 0 {
+		return nil, fmt.Errorf("report is missing the invoice column")
+	}
+	if grossCol < 0 && netCol < 0 {
+		return nil, fmt.Errorf("report has neither a gross nor a net amount column")
+	}
+	if dateCol < 0 {
+		return nil, fmt.Errorf("report is missing the settlement date column")
+	}
+
+	var feeCols []int
+	for _, aliases := range columns.fees {
+		if i := find(aliases); i >= 0 {
+			feeCols = append(feeCols, i)
+		}
+	}
+
+	var lines []types.SettlementLine
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		field := func(i int) string {
+			if i >= 0 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		invoice := field(invoiceCol)
+		if invoice == "" {
+			continue
+		}
+
+		settledAt, err := parseDate(field(dateCol))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		settlement := types.SettlementLine{
+			InvoiceStr: invoice,
+			Gross: parseAmount(field(grossCol)),
+			Net: parseAmount(field(netCol)),
+			SettledAt: settledAt,
+		}
+
+		for _, i := range feeCols {
+			settlement.Fees = settlement.Fees.Add(parseAmount(field(i)))	// Signs are dropped, fees are always a deduction
+		}
+
+		if grossCol < 0 {
+			settlement.Gross = settlement.Net.Add(settlement.Fees)
+		}
+		if netCol < 0 {
+			settlement.Net = settlement.Gross.Sub(settlement.Fees)
+		}
+
+		lines = append(lines, settlement)
+	}
+
+	return lines, nil
+}
+
+// parseAmount reads "Rp 1.250.000", "1,250,000.50" or "1250000" as rupiah, a separator followed by exactly
+// two digits is the decimal point and every other one groups thousands
+func parseAmount(value string) types.Money {
+	cents := ""
+	if i := strings.LastIndexAny(value, ".,"); i >= 0 && len(value)-i == 3 {
+		cents = value[i+1:]
+		value = value[:i]
+	}
+
+	var digits strings.Builder
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+
+	amount, err := types.ParseMoney(digits.String()+"."+cents, types.BaseCurrency)
+	if err != nil {
+		return types.BaseMoney(0)
+	}
+
+	return amount
+}
+
+// parseDate tries every layout in dateLayouts, a date none of them reads rejects the row rather than dating
+// an order or payout at the time of import
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing date")
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+func verifyHMAC(secret string, data []byte, signature string) error {
+	if secret == "" {
+		return fmt.Errorf("webhook secret not configured")
+	}
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(data)
+	expected := hex.EncodeToString(h.Sum(nil))
+
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// ConnectorsFromEnv returns every supported marketplace keyed by the name used in routes, webhooks are
+// rejected until their secret is set but CSV imports always work
+func ConnectorsFromEnv() map[string]Connector {
+	connectors := make(map[string]Connector)
+	for _, connector := range []Connector{tokopediaFromEnv(), shopeeFromEnv()} {
+		connectors[connector.Name()] = connector
+	}
+
+	return connectors
+}
@@ -0,0 +1,292 @@
+package marketplace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func sign(secret string, data []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func localTime(t *testing.T, layout string, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestTokopediaParseExport(t *testing.T) {
+	orders, err := NewTokopedia("").ParseExport(openFixture(t, "tokopedia_orders.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 2 {
+		t.Fatalf("got %d orders, want 2", len(orders))
+	}
+
+	first := orders[0]
+	if first.Marketplace != "tokopedia" || first.ExternalID != "1187354021" || first.InvoiceStr != "INV/20261018/MPL/3561240981" || first.BuyerName != "Budi Santoso" {
+		t.Fatalf("first order = %+v", first)
+	}
+	if want := localTime(t, "02-01-2006 15:04:05", "18-10-2026 09:14:22"); !first.OrderedAt.Equal(want) {
+		t.Fatalf("ordered at %v, want %v", first.OrderedAt, want)
+	}
+
+	// Rows of the same order become its lines
+	if len(first.Lines) != 2 {
+		t.Fatalf("first order has %d lines, want 2", len(first.Lines))
+	}
+	if line := first.Lines[0]; line.SKU != "RB750GR3" || line.Quantity != 2 || line.UnitPrice != types.BaseMoney(1150000) {
+		t.Fatalf("first line = %+v", line)
+	}
+	if line := first.Lines[1]; line.SKU != "RBD52G-5HACD2HND" || line.Quantity != 1 || line.UnitPrice != types.BaseMoney(1425000) {
+		t.Fatalf("second line = %+v", line)
+	}
+
+	if orders[1].ExternalID != "1187359344" || len(orders[1].Lines) != 1 {
+		t.Fatalf("second order = %+v", orders[1])
+	}
+}
+
+func TestShopeeParseExport(t *testing.T) {
+	orders, err := NewShopee("", "").ParseExport(openFixture(t, "shopee_orders.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 2 {
+		t.Fatalf("got %d orders, want 2", len(orders))
+	}
+
+	// Shopee has no invoice number, the order SN stands in for it
+	first := orders[0]
+	if first.ExternalID != "261018K3W9PQ2B" || first.InvoiceStr != "261018K3W9PQ2B" || first.BuyerName != "andi.pratama" {
+		t.Fatalf("first order = %+v", first)
+	}
+	if want := localTime(t, "2006-01-02 15:04", "2026-10-18 08:43"); !first.OrderedAt.Equal(want) {
+		t.Fatalf("ordered at %v, want the payment time %v", first.OrderedAt, want)
+	}
+	if line := first.Lines[0]; line.SKU != "RB750GR3" || line.Quantity != 1 || line.UnitPrice != types.BaseMoney(1150000) {
+		t.Fatalf("first line = %+v, want the discounted price", line)
+	}
+
+	if line := orders[1].Lines[0]; line.SKU != "RBD52G-5HACD2HND" || line.Quantity != 2 || line.UnitPrice != types.BaseMoney(1425000) {
+		t.Fatalf("second order line = %+v", line)
+	}
+}
+
+func TestParseExportRejectsBadDate(t *testing.T) {
+	export := "Order ID,Invoice,Payment Date,SKU,Quantity\n" +
+		"1,INV/1,2026-10-18 09:00:00,RB750GR3,1\n" +
+		"2,INV/2,yesterday,RB750GR3,1\n"
+
+	_, err := NewTokopedia("").ParseExport(strings.NewReader(export))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("err = %v, want the unparseable date on line 3 rejected", err)
+	}
+
+	export = "Order ID,Invoice,SKU,Quantity\n1,INV/1,RB750GR3,1\n"
+	if _, err := NewTokopedia("").ParseExport(strings.NewReader(export)); err == nil {
+		t.Fatal("an export without an order date column was accepted")
+	}
+}
+
+func TestTokopediaWebhook(t *testing.T) {
+	const secret = "tokopedia-secret"
+	connector := NewTokopedia(secret)
+	body := readFixture(t, "tokopedia_webhook.json")
+
+	r := httptest.NewRequest("POST", "/api/marketplace/webhook/tokopedia", nil)
+	r.Header.Set("X-Tokopedia-Signature", sign(secret, body))
+	if err := connector.VerifyWebhook(r, body); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+
+	r.Header.Set("X-Tokopedia-Signature", sign("wrong-secret", body))
+	if err := connector.VerifyWebhook(r, body); err == nil {
+		t.Fatal("signature with the wrong secret was accepted")
+	}
+
+	r.Header.Set("X-Tokopedia-Signature", sign(secret, append(body, ' ')))
+	if err := connector.VerifyWebhook(r, body); err == nil {
+		t.Fatal("signature of a different body was accepted")
+	}
+
+	if err := NewTokopedia("").VerifyWebhook(r, body); err == nil {
+		t.Fatal("webhook accepted without a secret configured")
+	}
+
+	orders, err := connector.ParseWebhook(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(orders))
+	}
+
+	order := orders[0]
+	if order.ExternalID != "1187361187" || order.InvoiceStr != "INV/20261018/MPL/3561262034" || order.BuyerName != "Dewi Lestari" {
+		t.Fatalf("order = %+v", order)
+	}
+	if !order.OrderedAt.Equal(time.Unix(1792300800, 0)) {
+		t.Fatalf("ordered at %v, want the payment date", order.OrderedAt)
+	}
+	if len(order.Lines) != 1 || order.Lines[0].SKU != "RB750GR3" || order.Lines[0].UnitPrice != types.BaseMoney(1150000) {
+		t.Fatalf("lines = %+v", order.Lines)
+	}
+}
+
+func TestShopeeWebhook(t *testing.T) {
+	const key = "shopee-partner-key"
+	const callback = "https://api.moengoet-inventory.my.id/api/marketplace/webhook/shopee"
+	connector := NewShopee(key, callback)
+	body := readFixture(t, "shopee_webhook.json")
+
+	r := httptest.NewRequest("POST", "/api/marketplace/webhook/shopee", nil)
+	r.Header.Set("Authorization", sign(key, append([]byte(callback+"|"), body...)))
+	if err := connector.VerifyWebhook(r, body); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+
+	// The callback URL is part of what is signed
+	r.Header.Set("Authorization", sign(key, body))
+	if err := connector.VerifyWebhook(r, body); err == nil {
+		t.Fatal("signature without the callback URL was accepted")
+	}
+
+	r.Header.Set("Authorization", "not-a-signature")
+	if err := connector.VerifyWebhook(r, body); err == nil {
+		t.Fatal("bad signature was accepted")
+	}
+
+	orders, err := connector.ParseWebhook(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(orders))
+	}
+
+	order := orders[0]
+	if order.ExternalID != "261018K6T2XH8C" || order.InvoiceStr != "261018K6T2XH8C" || order.BuyerName != "rudi.net" {
+		t.Fatalf("order = %+v", order)
+	}
+	if !order.OrderedAt.Equal(time.Unix(1792304400, 0)) {
+		t.Fatalf("ordered at %v, want the push timestamp", order.OrderedAt)
+	}
+	if len(order.Lines) != 1 || order.Lines[0].SKU != "RBD52G-5HACD2HND" || order.Lines[0].Quantity != 1 || order.Lines[0].UnitPrice != types.BaseMoney(1425000) {
+		t.Fatalf("lines = %+v", order.Lines)
+	}
+
+	// Status pushes other than ready to ship are acknowledged without orders
+	other := strings.Replace(string(body), "READY_TO_SHIP", "COMPLETED", 1)
+	orders, err = connector.ParseWebhook([]byte(other))
+	if err != nil || len(orders) != 0 {
+		t.Fatalf("COMPLETED push gave %d orders, err %v", len(orders), err)
+	}
+}
+
+func TestTokopediaParseSettlement(t *testing.T) {
+	lines, err := NewTokopedia("").ParseSettlement(openFixture(t, "tokopedia_settlement.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+
+	first := lines[0]
+	if first.InvoiceStr != "INV/20261018/MPL/3561240981" {
+		t.Fatalf("first line = %+v", first)
+	}
+	if first.Gross != types.BaseMoney(3725000) || first.Fees != types.BaseMoney(111750) || first.Net != types.BaseMoney(3613250) {
+		t.Fatalf("first line amounts = %v / %v / %v", first.Gross, first.Fees, first.Net)
+	}
+	if want := localTime(t, "2006-01-02 15:04:05", "2026-10-22 10:00:00"); !first.SettledAt.Equal(want) {
+		t.Fatalf("settled at %v, want %v", first.SettledAt, want)
+	}
+}
+
+func TestShopeeParseSettlement(t *testing.T) {
+	lines, err := NewShopee("", "").ParseSettlement(openFixture(t, "shopee_settlement.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+
+	// Administration, service and transaction fees are added up
+	second := lines[1]
+	if second.InvoiceStr != "261018K4B7ZD1M" || second.Gross != types.BaseMoney(2850000) || second.Fees != types.BaseMoney(256500) || second.Net != types.BaseMoney(2593500) {
+		t.Fatalf("second line = %+v", second)
+	}
+	if want := localTime(t, "2006-01-02", "2026-10-23"); !second.SettledAt.Equal(want) {
+		t.Fatalf("settled at %v, want %v", second.SettledAt, want)
+	}
+}
+
+func TestParseSettlementDerivesMissingAmount(t *testing.T) {
+	report := "Nomor Invoice,Tanggal Pencairan,Jumlah Diterima,Biaya Layanan\nINV/1,2026-10-22,\"Rp 980.000\",\"Rp 20.000\"\n"
+
+	lines, err := NewTokopedia("").ParseSettlement(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 1 || lines[0].Gross != types.BaseMoney(1000000) {
+		t.Fatalf("lines = %+v, want gross derived as net plus fees", lines)
+	}
+}
+
+func TestParseSettlementRejectsBadDate(t *testing.T) {
+	report := "Nomor Invoice,Tanggal Pencairan,Jumlah Diterima\nINV/1,2026-10-22,1000\nINV/2,22 Okt,1000\n"
+
+	_, err := NewTokopedia("").ParseSettlement(strings.NewReader(report))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("err = %v, want the unparseable date on line 3 rejected", err)
+	}
+}
@@ -0,0 +1,421 @@
+package marketplace
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const maxUploadSize = 10 << 20
+
+type Handler struct {
+	store types.MarketplaceStore
+	itemStore types.ItemStore
+	userStore types.UserStore
+	events types.EventPublisher
+	connectors map[string]Connector
+}
+
+func NewHandler(store types.MarketplaceStore, itemStore types.ItemStore, userStore types.UserStore, events types.EventPublisher, connectors map[string]Connector) *Handler {
+	return &Handler{
+		store: store,
+		itemStore: itemStore,
+		userStore: userStore,
+		events: events,
+		connectors: connectors,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/import/{marketplace}", auth.WithJWTAuth(h.handleImportOrders, h.userStore)).Methods("POST")
+	router.HandleFunc("/webhook/{marketplace}", h.handleWebhook).Methods("POST")	// Called by the marketplace, signed
+	router.HandleFunc("/orders", auth.WithJWTAuth(h.handleGetOrders, h.userStore)).Methods("GET")
+	router.HandleFunc("/orders/{id}", auth.MobileAuth(h.handleGetOrder, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/orders/{id}/allocate", auth.MobileAuth(h.handleAllocateOrder, h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/sku-map", auth.WithJWTAuth(h.handleSetSKUMapping, h.userStore)).Methods("PUT")
+}
+
+func (h *Handler) connector(r *http.Request) (Connector, error) {
+	name := strings.ToLower(mux.Vars(r)["marketplace"])
+
+	connector, ok := h.connectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown marketplace: %s", name)
+	}
+
+	return connector, nil
+}
+
+// handleImportOrders takes the export either as a multipart "file" field or as the raw CSV body
+func (h *Handler) handleImportOrders(w http.ResponseWriter, r *http.Request) {
+	connector, err := h.connector(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	var export io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading file: %v", err))
+			return
+		}
+
+		defer file.Close()
+		export = file
+	}
+
+	orders, err := connector.ParseExport(export)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing export: %v", err))
+		return
+	}
+
+	result := h.ingest(r.Context(), connector, orders)
+
+	utils.WriteJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	connector, err := h.connector(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading body: %v", err))
+		return
+	}
+
+	if err := connector.VerifyWebhook(r, body); err != nil {
+		log.Printf("rejected %s webhook: %v", connector.Name(), err)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	orders, err := connector.ParseWebhook(bytes.TrimSpace(body))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result := h.ingest(r.Context(), connector, orders)
+	if len(result.Errors) > 0 {
+		log.Printf("%s webhook: %v", connector.Name(), result.Errors)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, result)
+}
+
+// ingest creates a pending invoice and order per new order, each in its own transaction so one bad
+// order does not hold back the rest of an export. Orders already imported are skipped, so exports and
+// webhooks can overlap safely
+func (h *Handler) ingest(ctx context.Context, connector Connector, orders []types.MarketplaceOrder) types.ImportResult {
+	result := types.ImportResult{
+		Errors: []string{},
+	}
+
+	for _, order := range orders {
+		exists, err := h.store.OrderExists(order.Marketplace, order.ExternalID)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("order %s: %v", order.ExternalID, err))
+			continue
+		}
+
+		if exists {
+			result.Skipped++
+			continue
+		}
+
+		if err := checkLines(order); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("order %s: %v", order.ExternalID, err))
+			continue
+		}
+
+		for i, line := range order.Lines {
+			type_ref, err := h.store.ResolveSKU(order.Marketplace, line.SKU)
+			if err != nil {
+				// Left unresolved until a SKU mapping is added, the order is still imported
+				result.Errors = append(result.Errors, fmt.Sprintf("order %s: %v", order.ExternalID, err))
+				continue
+			}
+
+			order.Lines[i].TypeRef = type_ref
+		}
+
+		order_id, err := h.createOrder(ctx, connector, order)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("order %s: %v", order.ExternalID, err))
+			continue
+		}
+
+		result.Created++
+
+		h.events.Publish(types.TopicSales, "order.imported", map[string]interface{}{
+			"order_id": order_id,
+			"marketplace": order.Marketplace,
+			"invoice": order.InvoiceStr,
+		})
+	}
+
+	return result
+}
+
+// checkLines refuses orders the marketplace sent nonsense quantities for, such a line could never be filled
+// or would count as filled from the start
+func checkLines(order types.MarketplaceOrder) error {
+	for _, line := range order.Lines {
+		if line.Quantity <= 0 {
+			return fmt.Errorf("line %s has quantity %d", line.SKU, line.Quantity)
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) createOrder(ctx context.Context, connector Connector, order types.MarketplaceOrder) (order_id int, err error) {
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	order.InvoiceID, err = h.itemStore.CreateInvoice(order.InvoiceStr, connector.ShopName(), tx, ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error creating invoice: %v", err)
+	}
+
+	return h.store.CreateOrder(order, tx, ctx)
+}
+
+func (h *Handler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	orders, err := h.store.GetOrders(r.URL.Query().Get("status"), limit, offset)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting orders: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"orders": orders,
+	})
+}
+
+func (h *Handler) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	order, err := h.store.GetOrderByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, order)
+}
+
+// handleAllocateOrder fills an order with scanned serial numbers, the same way item-sold-bulk fills a
+// manual invoice. Each item goes to an open line of its type, the order is allocated once every line is full
+func (h *Handler) handleAllocateOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.AllocateOrderPayload
+	if err = utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("parsing error: %v", err))
+		return
+	}
+
+	if err = utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	order, err := h.store.GetOrderByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found: %v", err))
+		return
+	}
+
+	if order.Status != types.OrderPending {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("order is already %s", order.Status))
+		return
+	}
+
+	shop := order.Marketplace
+	if connector, ok := h.connectors[order.Marketplace]; ok {
+		shop = connector.ShopName()
+	}
+
+	// Transaction
+	var onCommit func()
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+			return
+		}
+		if onCommit != nil {
+			onCommit()
+		}
+	}()
+
+	for _, serial_num := range payload.SerialNums {
+		var item *types.Item
+		item, err = h.itemStore.GetItemBySN(serial_num, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("item %s not found: %v", serial_num, err))
+			return
+		}
+
+		if item.Status != "not sold" {
+			err = fmt.Errorf("item %s is %s", serial_num, item.Status)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		line := openLine(order, item.TypeRef)
+		if line == nil {
+			err = fmt.Errorf("order has no open line for %s (%s)", serial_num, item.TypeRef)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// The buyer paid the marketplace's price, not our list price
+		var price *types.Money
+		if line.UnitPrice.Amount > 0 {
+			price = &line.UnitPrice
+		}
+
+		err = h.itemStore.NewItemSold(types.SoldItem{
+			ItemID: item.ID,
+			InvoiceID: order.InvoiceID,
+			OnlineShop: shop,
+			UnitPrice: price,
+		}, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error registering sold item: %v", err))
+			return
+		}
+
+		if err = h.store.AllocateOrderLine(line.ID, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		line.Allocated++
+	}
+
+	// Another scanner may have filled lines of this order since it was read, so the database decides
+	complete, err := h.store.CompleteOrder(order.ID, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error updating order: %v", err))
+		return
+	}
+
+	if complete {
+		order.Status = types.OrderAllocated
+	}
+
+	onCommit = func() {
+		h.events.Publish(types.TopicSales, "sale.created", map[string]interface{}{
+			"invoice_id": order.InvoiceID,
+			"invoice": order.InvoiceStr,
+			"ol_shop": shop,
+			"serial_numbers": payload.SerialNums,
+		})
+	}
+
+	utils.WriteJSON(w, http.StatusOK, order)
+}
+
+func openLine(order *types.MarketplaceOrder, type_ref string) *types.MarketplaceOrderLine {
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		if line.TypeRef == type_ref && line.Allocated < line.Quantity {
+			return line
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) handleSetSKUMapping(w http.ResponseWriter, r *http.Request) {
+	var payload types.SKUMapping
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	payload.Marketplace = strings.ToLower(payload.Marketplace)
+	if _, ok := h.connectors[payload.Marketplace]; !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("unknown marketplace: %s", payload.Marketplace))
+		return
+	}
+
+	if err := h.store.SetSKUMapping(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error saving SKU mapping: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "SKU mapping saved")
+}
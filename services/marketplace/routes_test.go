@@ -0,0 +1,182 @@
+package marketplace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PatrickA727/mikrotik-db-sys/internal/txtest"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// orderStore keeps one order the way the marketplace tables would, calling anything else panics on the nil
+// interface
+type orderStore struct {
+	types.MarketplaceStore
+	db			*sql.DB
+	order		types.MarketplaceOrder
+	created		[]types.MarketplaceOrder
+	afterRead	func()	// Runs once the handler has its copy of the order, like another scanner would
+}
+
+func (s *orderStore) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+func (s *orderStore) OrderExists(marketplace string, external_id string) (bool, error) {
+	return false, nil
+}
+
+func (s *orderStore) ResolveSKU(marketplace string, sku string) (string, error) {
+	return sku, nil
+}
+
+func (s *orderStore) CreateOrder(order types.MarketplaceOrder, tx *sql.Tx, ctx context.Context) (int, error) {
+	s.created = append(s.created, order)
+	return len(s.created), nil
+}
+
+func (s *orderStore) GetOrderByID(id int) (*types.MarketplaceOrder, error) {
+	order := s.order
+	order.Lines = append([]types.MarketplaceOrderLine(nil), s.order.Lines...)
+
+	if s.afterRead != nil {
+		s.afterRead()
+	}
+	return &order, nil
+}
+
+func (s *orderStore) AllocateOrderLine(line_id int, tx *sql.Tx, ctx context.Context) error {
+	for i := range s.order.Lines {
+		line := &s.order.Lines[i]
+		if line.ID == line_id && line.Allocated < line.Quantity {
+			line.Allocated++
+			return nil
+		}
+	}
+	return errors.New("order line is already fully allocated")
+}
+
+func (s *orderStore) CompleteOrder(id int, tx *sql.Tx, ctx context.Context) (bool, error) {
+	for _, line := range s.order.Lines {
+		if line.Allocated < line.Quantity {
+			return false, nil
+		}
+	}
+	s.order.Status = types.OrderAllocated
+	return true, nil
+}
+
+// stockStore has two routers for sale and records what was sold at which price
+type stockStore struct {
+	types.ItemStore
+	sold []types.SoldItem
+}
+
+func (s *stockStore) CreateInvoice(invoice string, ol_shop string, tx *sql.Tx, ctx context.Context) (int, error) {
+	return 7, nil
+}
+
+func (s *stockStore) GetItemBySN(serial_num string, tx *sql.Tx, ctx context.Context) (*types.Item, error) {
+	switch serial_num {
+	case "SN-750":
+		return &types.Item{ID: 1, SerialNumber: serial_num, Status: "not sold", TypeRef: "RB750GR3"}, nil
+	case "SN-D52":
+		return &types.Item{ID: 2, SerialNumber: serial_num, Status: "not sold", TypeRef: "RBD52G"}, nil
+	}
+	return nil, errors.New("item not found")
+}
+
+func (s *stockStore) NewItemSold(sold_item types.SoldItem, tx *sql.Tx, ctx context.Context) error {
+	s.sold = append(s.sold, sold_item)
+	return nil
+}
+
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Publish(topic string, eventType string, data any) {
+	r.events = append(r.events, eventType)
+}
+
+func newOrderHandler(t *testing.T) (*Handler, *orderStore, *stockStore) {
+	store := &orderStore{
+		db: txtest.Open(t),
+		order: types.MarketplaceOrder{ID: 3, Marketplace: "tokopedia", InvoiceID: 7, InvoiceStr: "INV/7", Status: types.OrderPending,
+			Lines: []types.MarketplaceOrderLine{
+				{ID: 1, SKU: "RB750GR3", TypeRef: "RB750GR3", Quantity: 1, UnitPrice: types.BaseMoney(1099000)},
+				{ID: 2, SKU: "RBD52G", TypeRef: "RBD52G", Quantity: 1, UnitPrice: types.BaseMoney(1425000)},
+			},
+		},
+	}
+	stock := &stockStore{}
+	connectors := map[string]Connector{"tokopedia": NewTokopedia("")}
+
+	return NewHandler(store, stock, nil, &recorder{}, connectors), store, stock
+}
+
+func allocate(h *Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/marketplace/orders/3/allocate", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": "3"})
+
+	w := httptest.NewRecorder()
+	h.handleAllocateOrder(w, r)
+
+	return w
+}
+
+func TestAllocateSellsAtOrderPrice(t *testing.T) {
+	h, store, stock := newOrderHandler(t)
+
+	w := allocate(h, `{"serial_numbers": ["SN-750"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("allocate = %d %s", w.Code, w.Body.String())
+	}
+
+	if len(stock.sold) != 1 || stock.sold[0].UnitPrice == nil || *stock.sold[0].UnitPrice != types.BaseMoney(1099000) {
+		t.Fatalf("sold %+v, want the marketplace's price of 1099000", stock.sold)
+	}
+	if store.order.Status != types.OrderPending {
+		t.Fatalf("order is %s with a line still open", store.order.Status)
+	}
+}
+
+func TestAllocateCompletesWithConcurrentScan(t *testing.T) {
+	h, store, _ := newOrderHandler(t)
+
+	// The other line is filled after this request read the order
+	store.afterRead = func() { store.order.Lines[1].Allocated = 1 }
+
+	w := allocate(h, `{"serial_numbers": ["SN-750"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("allocate = %d %s", w.Code, w.Body.String())
+	}
+
+	if store.order.Status != types.OrderAllocated || !strings.Contains(w.Body.String(), `"status":"allocated"`) {
+		t.Fatalf("order is %s, response %s, want allocated", store.order.Status, w.Body.String())
+	}
+}
+
+func TestIngestRejectsBadQuantity(t *testing.T) {
+	h, store, _ := newOrderHandler(t)
+
+	orders := []types.MarketplaceOrder{
+		{Marketplace: "tokopedia", ExternalID: "A", InvoiceStr: "INV/A", Lines: []types.MarketplaceOrderLine{{SKU: "RB750GR3", Quantity: 1}}},
+		{Marketplace: "tokopedia", ExternalID: "B", InvoiceStr: "INV/B", Lines: []types.MarketplaceOrderLine{{SKU: "RB750GR3", Quantity: 0}}},
+		{Marketplace: "tokopedia", ExternalID: "C", InvoiceStr: "INV/C", Lines: []types.MarketplaceOrderLine{{SKU: "RB750GR3", Quantity: -2}}},
+	}
+
+	result := h.ingest(context.Background(), h.connectors["tokopedia"], orders)
+	if result.Created != 1 || len(result.Errors) != 2 {
+		t.Fatalf("result = %+v, want one order created and two refused", result)
+	}
+	if len(store.created) != 1 || store.created[0].ExternalID != "A" {
+		t.Fatalf("created %+v", store.created)
+	}
+}
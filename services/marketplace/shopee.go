@@ -0,0 +1,130 @@
+package marketplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Shopee reads the seller centre "Export Pesanan" file and the push notification for order status updates
+type Shopee struct {
+	partnerKey	string
+	callbackURL	string
+}
+
+func NewShopee(partnerKey string, callbackURL string) *Shopee {
+	return &Shopee{
+		partnerKey: partnerKey,
+		callbackURL: callbackURL,
+	}
+}
+
+func (s *Shopee) Name() string {
+	return "shopee"
+}
+
+func (s *Shopee) ShopName() string {
+	return "Shopee"
+}
+
+var shopeeColumns = exportColumns{
+	orderID: []string{"No. Pesanan", "Order ID", "Order SN"},
+	orderedAt: []string{"Waktu Pembayaran Dilakukan", "Waktu Pesanan Dibuat", "Order Creation Date"},
+	buyer: []string{"Username (Pembeli)", "Nama Penerima", "Buyer Username"},
+	sku: []string{"Nomor Referensi SKU", "SKU Induk", "SKU Reference No.", "Parent SKU Reference No."},
+	product: []string{"Nama Produk", "Product Name"},
+	quantity: []string{"Jumlah", "Quantity"},
+	unitPrice: []string{"Harga Setelah Diskon", "Harga Awal", "Deal Price", "Original Price"},
+}
+
+// ParseExport uses the order SN as the invoice, Shopee has no separate invoice number
+func (s *Shopee) ParseExport(r io.Reader) ([]types.MarketplaceOrder, error) {
+	return parseCSVExport(r, s.Name(), shopeeColumns)
+}
+
+var shopeeSettlementColumns = settlementColumns{
+	invoice: []string{"No. Pesanan", "Order ID", "Order SN"},
+	gross: []string{"Harga Asli Produk", "Original Product Price"},
+	fees: [][]string{
+		{"Biaya Administrasi", "Commission Fee"},
+		{"Biaya Layanan", "Service Fee"},
+		{"Biaya Transaksi", "Transaction Fee"},
+	},
+	net: []string{"Total Penghasilan", "Total Released Amount", "Escrow Amount"},
+	settledAt: []string{"Tanggal Dana Dilepaskan", "Payout Completed Date", "Escrow Release Date"},
+}
+
+// ParseSettlement reads the "Penghasilan Saya" income report
+func (s *Shopee) ParseSettlement(r io.Reader) ([]types.SettlementLine, error) {
+	return parseCSVSettlement(r, shopeeSettlementColumns)
+}
+
+// VerifyWebhook checks the Authorization header, the hex HMAC-SHA256 of "<callback url>|<raw body>" keyed with the partner key
+func (s *Shopee) VerifyWebhook(r *http.Request, body []byte) error {
+	base := append([]byte(s.callbackURL+"|"), body...)
+	return verifyHMAC(s.partnerKey, base, r.Header.Get("Authorization"))
+}
+
+type shopeeWebhook struct {
+	Code		int		`json:"code"`
+	Timestamp	int64	`json:"timestamp"`
+	Data		struct {
+		OrderSN		string	`json:"ordersn"`
+		Status		string	`json:"status"`
+		BuyerName	string	`json:"buyer_username"`
+		Items		[]struct {
+			Name		string	`json:"item_name"`
+			SKU			string	`json:"item_sku"`
+			Quantity	int		`json:"model_quantity_purchased"`
+			Price		int64	`json:"model_discounted_price"`
+		}	`json:"item_list"`
+	}	`json:"data"`
+}
+
+// ParseWebhook only takes orders that are ready to ship, other status pushes are acknowledged and ignored
+func (s *Shopee) ParseWebhook(body []byte) ([]types.MarketplaceOrder, error) {
+	var payload shopeeWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("error parsing webhook: %v", err)
+	}
+
+	if payload.Data.OrderSN == "" {
+		return nil, fmt.Errorf("webhook has no order")
+	}
+
+	if payload.Data.Status != "READY_TO_SHIP" || len(payload.Data.Items) == 0 {
+		return nil, nil
+	}
+
+	order := types.MarketplaceOrder{
+		Marketplace: s.Name(),
+		ExternalID: payload.Data.OrderSN,
+		InvoiceStr: payload.Data.OrderSN,
+		BuyerName: payload.Data.BuyerName,
+		OrderedAt: time.Now(),
+	}
+
+	if payload.Timestamp > 0 {
+		order.OrderedAt = time.Unix(payload.Timestamp, 0)
+	}
+
+	for _, item := range payload.Data.Items {
+		order.Lines = append(order.Lines, types.MarketplaceOrderLine{
+			SKU: item.SKU,
+			ProductName: item.Name,
+			Quantity: item.Quantity,
+			UnitPrice: types.BaseMoney(item.Price),
+		})
+	}
+
+	return []types.MarketplaceOrder{order}, nil
+}
+
+func shopeeFromEnv() Connector {
+	return NewShopee(os.Getenv("SHOPEE_PARTNER_KEY"), os.Getenv("SHOPEE_WEBHOOK_URL"))
+}
@@ -0,0 +1,236 @@
+package marketplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *Store) OrderExists(marketplace string, external_id string) (bool, error) {
+	exists := false
+
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM marketplace_orders WHERE marketplace = $1 AND external_id = $2)",
+		marketplace, external_id,
+	).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// ResolveSKU prefers an explicit mapping and falls back to an item type named exactly like the SKU
+func (s *Store) ResolveSKU(marketplace string, sku string) (string, error) {
+	type_ref := ""
+
+	err := s.db.QueryRow(`SELECT type_ref FROM (
+							  SELECT type_ref, 1 AS priority FROM marketplace_skus WHERE marketplace = $1 AND sku = $2
+							  UNION ALL
+							  SELECT item_type, 2 FROM item_type WHERE LOWER(item_type) = LOWER($2)
+						  ) m
+						  ORDER BY priority, type_ref LIMIT 1`, marketplace, sku,
+	).Scan(&type_ref)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("unknown SKU %q", sku)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return type_ref, nil
+}
+
+// SetSKUMapping also fills in pending order lines that were imported before the SKU was known
+func (s *Store) SetSKUMapping(mapping types.SKUMapping) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	_, err = tx.Exec(`INSERT INTO marketplace_skus (marketplace, sku, type_ref) VALUES ($1, $2, $3)
+					  ON CONFLICT (marketplace, sku) DO UPDATE SET type_ref = EXCLUDED.type_ref`,
+		mapping.Marketplace, mapping.SKU, mapping.TypeRef,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE marketplace_order_lines l SET type_ref = $1
+					  FROM marketplace_orders o
+					  WHERE l.order_id = o.id AND o.marketplace = $2 AND l.sku = $3 AND l.type_ref IS NULL AND o.status = $4`,
+		mapping.TypeRef, mapping.Marketplace, mapping.SKU, types.OrderPending,
+	)
+	return err
+}
+
+func (s *Store) CreateOrder(order types.MarketplaceOrder, tx *sql.Tx, ctx context.Context) (int, error) {
+	order_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO marketplace_orders (marketplace, external_id, invoice_id, buyer_name, ordered_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5) RETURNING id`,
+		order.Marketplace, order.ExternalID, order.InvoiceID, order.BuyerName, order.OrderedAt,
+	).Scan(&order_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range order.Lines {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO marketplace_order_lines (order_id, sku, product_name, type_ref, quantity, unit_price)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)`,
+			order_id, line.SKU, line.ProductName, line.TypeRef, line.Quantity, line.UnitPrice,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return order_id, nil
+}
+
+const orderColumns = `o.id, o.marketplace, o.external_id, o.invoice_id, i.invoice_str, COALESCE(o.buyer_name, ''), o.status, o.ordered_at`
+
+func scanOrder(row interface{ Scan(dest ...any) error }) (*types.MarketplaceOrder, error) {
+	var order types.MarketplaceOrder
+
+	err := row.Scan(&order.ID, &order.Marketplace, &order.ExternalID, &order.InvoiceID, &order.InvoiceStr,
+		&order.BuyerName, &order.Status, &order.OrderedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	order.Lines = []types.MarketplaceOrderLine{}
+
+	return &order, nil
+}
+
+// GetOrders lists orders newest first without their lines, status is optional
+func (s *Store) GetOrders(status string, limit int, offset int) ([]types.MarketplaceOrder, error) {
+	var orders []types.MarketplaceOrder
+
+	rows, err := s.db.Query(`SELECT `+orderColumns+` FROM marketplace_orders o JOIN invoice i ON o.invoice_id = i.id
+							 WHERE ($1 = '' OR o.status = $1)
+							 ORDER BY o.ordered_at DESC, o.id DESC LIMIT $2 OFFSET $3`, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, *order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (s *Store) GetOrderByID(id int) (*types.MarketplaceOrder, error) {
+	order, err := scanOrder(s.db.QueryRow(`SELECT `+orderColumns+` FROM marketplace_orders o JOIN invoice i ON o.invoice_id = i.id
+										   WHERE o.id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT id, sku, COALESCE(product_name, ''), COALESCE(type_ref, ''), quantity, unit_price, allocated
+							 FROM marketplace_order_lines WHERE order_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var line types.MarketplaceOrderLine
+
+		if err := rows.Scan(&line.ID, &line.SKU, &line.ProductName, &line.TypeRef, &line.Quantity, &line.UnitPrice, &line.Allocated); err != nil {
+			return nil, err
+		}
+
+		order.Lines = append(order.Lines, line)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (s *Store) AllocateOrderLine(line_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE marketplace_order_lines SET allocated = allocated + 1 WHERE id = $1 AND allocated < quantity",
+		line_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("order line %d is already fully allocated", line_id)
+	}
+
+	return nil
+}
+
+// CompleteOrder marks a pending order allocated once none of its lines has room left, reading the lines as
+// the transaction sees them so allocations committed in between count
+func (s *Store) CompleteOrder(id int, tx *sql.Tx, ctx context.Context) (bool, error) {
+	res, err := tx.ExecContext(ctx,
+		`UPDATE marketplace_orders SET status = $1 WHERE id = $2 AND status = $3
+		AND NOT EXISTS (SELECT 1 FROM marketplace_order_lines WHERE order_id = $2 AND allocated < quantity)`,
+		types.OrderAllocated, id, types.OrderPending,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	return rowsAffected > 0, nil
+}
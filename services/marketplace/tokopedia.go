@@ -0,0 +1,125 @@
+package marketplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Tokopedia reads the seller center "Download Pesanan" export and the order notification webhook
+type Tokopedia struct {
+	secret string
+}
+
+func NewTokopedia(secret string) *Tokopedia {
+	return &Tokopedia{
+		secret: secret,
+	}
+}
+
+func (t *Tokopedia) Name() string {
+	return "tokopedia"
+}
+
+func (t *Tokopedia) ShopName() string {
+	return "Tokopedia"
+}
+
+var tokopediaColumns = exportColumns{
+	orderID: []string{"Order ID", "ID Pesanan"},
+	invoice: []string{"Invoice", "Nomor Invoice", "Invoice Number"},
+	orderedAt: []string{"Payment Date", "Tanggal Pembayaran", "Order Date", "Tanggal Pesanan"},
+	buyer: []string{"Customer Name", "Nama Pembeli", "Buyer Name"},
+	sku: []string{"SKU", "Stock Keeping Unit (SKU)", "Nomor SKU"},
+	product: []string{"Product Name", "Nama Produk"},
+	quantity: []string{"Quantity", "Jumlah Produk Dibeli", "Jumlah"},
+	unitPrice: []string{"Price (Rp.)", "Harga Jual (IDR)", "Harga Satuan", "Price"},
+}
+
+func (t *Tokopedia) ParseExport(r io.Reader) ([]types.MarketplaceOrder, error) {
+	return parseCSVExport(r, t.Name(), tokopediaColumns)
+}
+
+var tokopediaSettlementColumns = settlementColumns{
+	invoice: []string{"Invoice", "Nomor Invoice", "Invoice Number"},
+	gross: []string{"Total Penjualan", "Sales Amount", "Nominal Transaksi"},
+	fees: [][]string{
+		{"Biaya Layanan", "Service Fee"},
+		{"Biaya Power Merchant", "Power Merchant Fee"},
+		{"Biaya Layanan Bebas Ongkir", "Free Shipping Service Fee"},
+	},
+	net: []string{"Jumlah Diterima", "Settlement Amount", "Dana Diterima"},
+	settledAt: []string{"Tanggal Pencairan", "Settlement Date", "Tanggal"},
+}
+
+func (t *Tokopedia) ParseSettlement(r io.Reader) ([]types.SettlementLine, error) {
+	return parseCSVSettlement(r, tokopediaSettlementColumns)
+}
+
+// VerifyWebhook checks X-Tokopedia-Signature, the hex HMAC-SHA256 of the raw body
+func (t *Tokopedia) VerifyWebhook(r *http.Request, body []byte) error {
+	return verifyHMAC(t.secret, body, r.Header.Get("X-Tokopedia-Signature"))
+}
+
+type tokopediaWebhook struct {
+	OrderID		int64	`json:"order_id"`
+	InvoiceRef	string	`json:"invoice_ref_num"`
+	PaymentDate	int64	`json:"payment_date"`	// Unix seconds
+	Customer	struct {
+		Name	string	`json:"name"`
+	}	`json:"customer"`
+	Products	[]struct {
+		Name		string	`json:"name"`
+		SKU			string	`json:"sku"`
+		Quantity	int		`json:"quantity"`
+		Price		types.Money	`json:"price"`	// Rupiah, fractions are kept
+	}	`json:"products"`
+}
+
+func (t *Tokopedia) ParseWebhook(body []byte) ([]types.MarketplaceOrder, error) {
+	var payload tokopediaWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("error parsing webhook: %v", err)
+	}
+
+	if payload.OrderID == 0 || len(payload.Products) == 0 {
+		return nil, fmt.Errorf("webhook has no order")
+	}
+
+	order := types.MarketplaceOrder{
+		Marketplace: t.Name(),
+		ExternalID: strconv.FormatInt(payload.OrderID, 10),
+		InvoiceStr: payload.InvoiceRef,
+		BuyerName: payload.Customer.Name,
+		OrderedAt: time.Now(),
+	}
+
+	if order.InvoiceStr == "" {
+		order.InvoiceStr = order.ExternalID
+	}
+
+	if payload.PaymentDate > 0 {
+		order.OrderedAt = time.Unix(payload.PaymentDate, 0)
+	}
+
+	for _, product := range payload.Products {
+		order.Lines = append(order.Lines, types.MarketplaceOrderLine{
+			SKU: product.SKU,
+			ProductName: product.Name,
+			Quantity: product.Quantity,
+			UnitPrice: product.Price,
+		})
+	}
+
+	return []types.MarketplaceOrder{order}, nil
+}
+
+func tokopediaFromEnv() Connector {
+	return NewTokopedia(os.Getenv("TOKOPEDIA_WEBHOOK_SECRET"))
+}
@@ -0,0 +1,276 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MockKeyID is the kid of the only key a MockIdP publishes
+const MockKeyID = "mock-1"
+
+type mockGrant struct {
+	clientID		string
+	redirectURI		string
+	nonce			string
+	challenge		string
+	subject			string
+	email			string
+	emailVerified	bool
+	name			string
+	expires			time.Time
+}
+
+// MockIdP is an OpenID Connect provider for trying single sign-on locally, see cmd/mockidp, and for tests. It
+// signs ID tokens for whoever is typed into its login form, or for Auto without asking
+type MockIdP struct {
+	Issuer			string	// How the API reaches it, can be set after NewMockIdP for an httptest server
+	ClientID		string
+	ClientSecret	string	// Empty accepts a public client
+	Auto			string	// Email everyone is logged in as without the form, verified
+	KeyID			string	// kid on the ID tokens, anything but MockKeyID names a key clients cannot find
+
+	key				*rsa.PrivateKey
+	mux				*http.ServeMux
+
+	mu				sync.Mutex
+	grants			map[string]mockGrant
+}
+
+func NewMockIdP(issuer string, clientID string, clientSecret string) (*MockIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &MockIdP{
+		Issuer: strings.TrimRight(issuer, "/"),
+		ClientID: clientID,
+		ClientSecret: clientSecret,
+		KeyID: MockKeyID,
+		key: key,
+		mux: http.NewServeMux(),
+		grants: make(map[string]mockGrant),
+	}
+
+	p.mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	p.mux.HandleFunc("/jwks", p.handleJWKS)
+	p.mux.HandleFunc("/authorize", p.handleAuthorize)
+	p.mux.HandleFunc("/token", p.handleToken)
+
+	return p, nil
+}
+
+func (p *MockIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *MockIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	mockJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer": p.Issuer,
+		"authorization_endpoint": p.Issuer + "/authorize",
+		"token_endpoint": p.Issuer + "/token",
+		"jwks_uri": p.Issuer + "/jwks",
+		"response_types_supported": []string{"code"},
+		"subject_types_supported": []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func (p *MockIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+
+	mockJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": MockKeyID,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+var mockLoginForm = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock identity provider</title>
+<h1>Mock identity provider</h1>
+<form method="post">
+{{range $k, $v := .Hidden}}<input type="hidden" name="{{$k}}" value="{{$v}}">
+{{end}}<p><label>Email <input name="email" value="staff@example.com"></label>
+<p><label>Name <input name="name" value="Staff Member"></label>
+<p><label>Subject <input name="sub" placeholder="defaults to the email"></label>
+<p><label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label>
+<p><button>Log in</button>
+</form>`))
+
+// handleAuthorize shows the login form on GET and issues a code on POST, or straight away with Auto
+func (p *MockIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := map[string]string{}
+	for _, name := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		params[name] = r.Form.Get(name)
+	}
+
+	if params["response_type"] != "code" || params["client_id"] != p.ClientID || params["redirect_uri"] == "" {
+		http.Error(w, "expected response_type=code, the configured client_id and a redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if params["code_challenge"] != "" && params["code_challenge_method"] != "S256" {
+		http.Error(w, "only S256 code challenges are supported", http.StatusBadRequest)
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	verified := r.PostForm.Get("email_verified") == "true"
+	if p.Auto != "" {
+		email, verified = p.Auto, true
+	}
+
+	if email == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockLoginForm.Execute(w, map[string]interface{}{"Hidden": params})
+		return
+	}
+
+	subject := r.PostForm.Get("sub")
+	if subject == "" {
+		sum := sha256.Sum256([]byte(strings.ToLower(email)))
+		subject = hex.EncodeToString(sum[:8])
+	}
+
+	code := mockRandomString()
+	p.mu.Lock()
+	p.grants[code] = mockGrant{
+		clientID: params["client_id"],
+		redirectURI: params["redirect_uri"],
+		nonce: params["nonce"],
+		challenge: params["code_challenge"],
+		subject: subject,
+		email: email,
+		emailVerified: verified,
+		name: r.PostForm.Get("name"),
+		expires: time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	target, err := url.Parse(params["redirect_uri"])
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	query.Set("code", code)
+	query.Set("state", params["state"])
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// handleToken exchanges a code once, checking the client, redirect URI and PKCE verifier like a real provider
+func (p *MockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		mockTokenError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		mockTokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID != p.ClientID || (p.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.ClientSecret)) != 1) {
+		mockTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, found := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+
+	if !found || time.Now().After(g.expires) || g.clientID != clientID || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		mockTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	if g.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			mockTokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": p.Issuer,
+		"sub": g.subject,
+		"aud": clientID,
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"iat": now.Unix(),
+		"nonce": g.nonce,
+		"email": g.email,
+		"email_verified": g.emailVerified,
+		"name": g.name,
+	})
+	token.Header["kid"] = p.KeyID
+
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		mockTokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	mockJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": mockRandomString(),
+		"token_type": "Bearer",
+		"expires_in": 300,
+		"id_token": idToken,
+	})
+}
+
+func mockTokenError(w http.ResponseWriter, status int, code string) {
+	mockJSON(w, status, map[string]string{"error": code})
+}
+
+func mockJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func mockRandomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
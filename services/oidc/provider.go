@@ -0,0 +1,371 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config is the client registration at the identity provider
+type Config struct {
+	Issuer			string
+	ClientID		string
+	ClientSecret	string
+	RedirectURL		string	// This API's /api/user/oidc/callback as registered at the provider
+	Scopes			[]string
+}
+
+// Identity is what the provider vouches for in a verified ID token
+type Identity struct {
+	Issuer			string
+	Subject			string
+	Email			string
+	EmailVerified	bool
+	Name			string
+}
+
+type discovery struct {
+	Issuer					string	`json:"issuer"`
+	AuthorizationEndpoint	string	`json:"authorization_endpoint"`
+	TokenEndpoint			string	`json:"token_endpoint"`
+	JWKSURI					string	`json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow with PKCE against one OpenID Connect provider. Discovery and
+// signing keys are fetched on first use, keys again when a token names one we have not seen
+type Provider struct {
+	config		Config
+	client		*http.Client
+
+	mu			sync.Mutex	// Never held over a request to the provider
+	discovery	*discovery
+	keys		map[string]*rsa.PublicKey
+	keysFetched	time.Time
+	keysLoading	chan struct{}	// Closed when the key set being fetched arrives, nil when none is
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewProviderFromEnv reads OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL and OIDC_SCOPES,
+// nil means single sign-on is disabled
+func NewProviderFromEnv() (*Provider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := Config{
+		Issuer: strings.TrimRight(issuer, "/"),
+		ClientID: os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL: os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes: strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER is set but OIDC_CLIENT_ID or OIDC_REDIRECT_URL is missing")
+	}
+
+	return NewProvider(config), nil
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// AuthCodeURL is where the browser goes to log in, state and nonce come back to us, verifier stays with us
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the code from the callback for tokens and returns the identity in the verified ID token
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (*Identity, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		IDToken	string	`json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, d, tokens.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	Nonce			string	`json:"nonce"`
+	Email			string	`json:"email"`
+	EmailVerified	any		`json:"email_verified"`	// Some providers send "true"
+	Name			string	`json:"name"`
+	PreferredName	string	`json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, d *discovery, idToken string, nonce string) (*Identity, error) {
+	var claims idTokenClaims
+
+	_, err := jwt.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(ctx, d, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("invalid id_token: nonce mismatch")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid id_token: no subject")
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredName
+	}
+
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+
+	return &Identity{
+		Issuer: d.Issuer,
+		Subject: claims.Subject,
+		Email: strings.TrimSpace(claims.Email),
+		EmailVerified: verified,
+		Name: name,
+	}, nil
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	cached := p.discovery
+	p.mu.Unlock()
+
+	if cached != nil {
+		return cached, nil
+	}
+
+	// Logins arriving together before the first one finishes may each fetch it, the document is the same
+	var d discovery
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+
+	if strings.TrimRight(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.config.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery == nil {
+		p.discovery = &d
+	}
+	return p.discovery, nil
+}
+
+// getKey returns the provider's signing key kid, refetching the key set at most once a minute. Logins that
+// need the key set while it is being fetched wait for that fetch instead of starting their own
+func (p *Provider) getKey(ctx context.Context, d *discovery, kid string) (*rsa.PublicKey, error) {
+	for {
+		p.mu.Lock()
+
+		if key, ok := p.keys[kid]; ok {
+			p.mu.Unlock()
+			return key, nil
+		}
+
+		if loading := p.keysLoading; loading != nil {
+			p.mu.Unlock()
+
+			select {
+			case <-loading:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if time.Since(p.keysFetched) < time.Minute {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		loading := make(chan struct{})
+		p.keysLoading = loading
+		p.mu.Unlock()
+
+		keys, err := p.fetchKeys(ctx, d)
+
+		p.mu.Lock()
+		p.keysLoading = nil
+		if err == nil {
+			p.keys = keys
+			p.keysFetched = time.Now()
+		}
+		key, ok := p.keys[kid]
+		p.mu.Unlock()
+		close(loading)
+
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, d *discovery) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys	[]struct {
+			Kid	string	`json:"kid"`
+			Kty	string	`json:"kty"`
+			Use	string	`json:"use"`
+			N	string	`json:"n"`
+			E	string	`json:"e"`
+		}	`json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys failed: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	return keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
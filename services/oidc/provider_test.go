@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startMockIdP serves a MockIdP that logs everyone in as email and a Provider registered with it
+func startMockIdP(t *testing.T, email string) (*MockIdP, *Provider) {
+	t.Helper()
+
+	idp, err := NewMockIdP("", "inventory", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Auto = email
+
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	idp.Issuer = server.URL
+
+	return idp, NewProvider(Config{
+		Issuer: server.URL,
+		ClientID: "inventory",
+		ClientSecret: "dev",
+		RedirectURL: "http://localhost:8080/api/user/oidc/callback",
+	})
+}
+
+// authorize follows the login URL to the provider and returns the callback query it redirects to
+func authorize(t *testing.T, p *Provider, state string, nonce string, verifier string) url.Values {
+	t.Helper()
+
+	target, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := res.Location()
+	if err != nil {
+		t.Fatalf("authorize = %s, want a redirect to the callback", res.Status)
+	}
+
+	return callback.Query()
+}
+
+func TestExchange(t *testing.T) {
+	idp, p := startMockIdP(t, "Staff@Example.com")
+
+	query := authorize(t, p, "state-1", "nonce-1", "verifier-1")
+	if query.Get("state") != "state-1" {
+		t.Fatalf("state came back as %q", query.Get("state"))
+	}
+
+	identity, err := p.Exchange(context.Background(), query.Get("code"), "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Issuer != idp.Issuer || identity.Subject == "" || identity.Email != "Staff@Example.com" || !identity.EmailVerified {
+		t.Fatalf("identity = %+v", identity)
+	}
+
+	// A code is good once
+	if _, err := p.Exchange(context.Background(), query.Get("code"), "verifier-1", "nonce-1"); err == nil {
+		t.Fatal("code was exchanged twice")
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	_, p := startMockIdP(t, "staff@example.com")
+
+	query := authorize(t, p, "state-1", "nonce-1", "verifier-1")
+	if _, err := p.Exchange(context.Background(), query.Get("code"), "verifier-2", "nonce-1"); err == nil {
+		t.Fatal("code was exchanged with another login's PKCE verifier")
+	}
+}
+
+func TestExchangeWrongNonce(t *testing.T) {
+	_, p := startMockIdP(t, "staff@example.com")
+
+	query := authorize(t, p, "state-1", "nonce-1", "verifier-1")
+	_, err := p.Exchange(context.Background(), query.Get("code"), "verifier-1", "nonce-2")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("err = %v, want the ID token of another login refused", err)
+	}
+}
+
+func TestExchangeUnknownKey(t *testing.T) {
+	idp, p := startMockIdP(t, "staff@example.com")
+	idp.KeyID = "rotated-away"
+
+	query := authorize(t, p, "state-1", "nonce-1", "verifier-1")
+	_, err := p.Exchange(context.Background(), query.Get("code"), "verifier-1", "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("err = %v, want the token signed with a key outside the key set refused", err)
+	}
+}
+
+func TestSlowKeySetBlocksNobody(t *testing.T) {
+	idp, err := NewMockIdP("", "inventory", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set is held back until release is closed
+	var fetches atomic.Int32
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			fetches.Add(1)
+			fetching <- struct{}{}
+			<-release
+		}
+		idp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	idp.Issuer = server.URL
+
+	p := NewProvider(Config{Issuer: server.URL, ClientID: "inventory", ClientSecret: "dev"})
+	d, err := p.getDiscovery(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.getKey(context.Background(), d, MockKeyID)
+			errs <- err
+		}()
+	}
+	<-fetching
+
+	// Another login starting meanwhile is not held up behind the fetch
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-1"); err != nil {
+		t.Fatalf("AuthCodeURL during the key fetch: %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("key set fetched %d times, want the waiting login to share the fetch", n)
+	}
+}
@@ -0,0 +1,371 @@
+package packing
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.PackStore
+	itemStore types.ItemStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.PackStore, itemStore types.ItemStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		itemStore: itemStore,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/start/{invoice_id}", auth.MobileAuth(h.handleStartSession, h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/scan/{invoice_id}", auth.MobileAuth(h.handleScan, h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/unscan/{invoice_id}", auth.MobileAuth(h.handleRemoveScan, h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/status/{invoice_id}", auth.MobileAuth(h.handleGetStatus, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/override/{invoice_id}", auth.WithRole(h.handleOverride, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("POST")
+}
+
+// BuildStatus checks the scans of a session against the invoice items, the set is verified only when every
+// item was scanned and nothing that is not on the invoice is still in the box
+func BuildStatus(session *types.PackSession, expected []types.SoldItem, scans []types.PackScan) types.PackStatus {
+	status := types.PackStatus{
+		SessionID: session.ID,
+		InvoiceID: session.InvoiceID,
+		Status: session.Status,
+		Expected: len(expected),
+		Matched: []string{},
+		Missing: []string{},
+		Wrong: []string{},
+	}
+
+	scanned := make(map[string]bool)
+	wrong := make(map[string]bool)
+	for _, scan := range scans {
+		switch scan.Result {
+		case types.ScanMatched:
+			scanned[scan.RFIDTag] = true
+		case types.ScanWrong:
+			wrong[scan.RFIDTag] = true
+		}
+	}
+
+	for _, item := range expected {
+		if scanned[item.ItemTag] {
+			status.Matched = append(status.Matched, item.ItemTag)
+		} else {
+			status.Missing = append(status.Missing, item.ItemTag)
+		}
+	}
+
+	for tag := range wrong {
+		status.Wrong = append(status.Wrong, tag)
+	}
+
+	status.Verified = len(expected) > 0 && len(status.Missing) == 0 && len(status.Wrong) == 0
+	status.CanShip = status.Verified || session.Status == types.PackOverridden
+
+	return status
+}
+
+// Unshipped drops the items that already went out in an earlier parcel
+func Unshipped(items []types.SoldItem) []types.SoldItem {
+	var unshipped []types.SoldItem
+
+	for _, item := range items {
+		if item.ShipmentID == nil {
+			unshipped = append(unshipped, item)
+		}
+	}
+
+	return unshipped
+}
+
+// CanShipSubset reports whether a partial shipment is fully scanned and nothing wrong is in the box
+func CanShipSubset(status types.PackStatus, items []types.SoldItem) bool {
+	if status.Status == types.PackOverridden {
+		return true
+	}
+
+	if len(items) == 0 || len(status.Wrong) > 0 {
+		return false
+	}
+
+	matched := make(map[string]bool)
+	for _, tag := range status.Matched {
+		matched[tag] = true
+	}
+
+	for _, item := range items {
+		if !matched[item.ItemTag] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *Handler) handleStartSession(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	invoice, err := h.itemStore.GetInvoiceByID(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("invoice not found: %v", err))
+		return
+	}
+
+	if invoice.Status == types.InvoiceShipped || invoice.Status == types.InvoiceDelivered {	// Partially shipped invoices pack the rest
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("invoice %s is already shipped", invoice.InvoiceStr))
+		return
+	}
+
+	// Resume the open session if the packer restarted the app
+	session, err := h.store.GetOpenPackSession(invoice_id)
+	if err == sql.ErrNoRows {
+		session, err = h.store.CreatePackSession(invoice_id)
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting pack session: %v", err))
+		return
+	}
+
+	status, err := h.getStatus(session)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+func (h *Handler) handleScan(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	// Get JSON payload
+	var payload types.PackScanPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	// Validate JSON
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	session, err := h.store.GetOpenPackSession(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("no open pack session for invoice %d", invoice_id))
+		return
+	}
+
+	items, err := h.itemStore.GetItemsByInvoice(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting invoice items: %v", err))
+		return
+	}
+	expected := Unshipped(items)
+
+	scans, err := h.store.GetPackScans(session.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting scans: %v", err))
+		return
+	}
+
+	scan := types.PackScan{
+		SessionID: session.ID,
+		RFIDTag: strings.TrimSpace(payload.RFIDTag),
+		Result: scanResult(payload.RFIDTag, expected, scans),
+	}
+
+	if err := h.store.AddPackScan(scan); err != nil {
+		if err == types.ErrPackSessionClosed {
+			utils.WriteError(w, http.StatusConflict, err)
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving scan: %v", err))
+		return
+	}
+
+	status := BuildStatus(session, expected, append(scans, scan))
+	status.LastScan = &scan
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// handleRemoveScan drops every scan of a tag from the session, used when a wrong unit is taken out of the box
+func (h *Handler) handleRemoveScan(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.PackScanPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	session, err := h.store.GetOpenPackSession(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("no open pack session for invoice %d", invoice_id))
+		return
+	}
+
+	removed, err := h.store.RemovePackScans(session.ID, strings.TrimSpace(payload.RFIDTag))
+	if err == types.ErrPackSessionClosed {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error removing scan: %v", err))
+		return
+	}
+
+	if removed == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("tag %s was not scanned", payload.RFIDTag))
+		return
+	}
+
+	status, err := h.getStatus(session)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+func (h *Handler) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	session, err := h.store.GetOpenPackSession(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("no open pack session for invoice %d", invoice_id))
+		return
+	}
+
+	status, err := h.getStatus(session)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// handleOverride lets a supervisor allow shipping an invoice whose scans do not match, who and why is kept on the session
+func (h *Handler) handleOverride(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.PackOverridePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	session, err := h.store.GetOpenPackSession(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("no open pack session for invoice %d", invoice_id))
+		return
+	}
+
+	if err := h.store.OverridePackSession(session.ID, userID, payload.Reason); err != nil {
+		if err == types.ErrPackSessionClosed {
+			utils.WriteError(w, http.StatusConflict, err)
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error overriding pack session: %v", err))
+		return
+	}
+
+	session.Status = types.PackOverridden
+
+	status, err := h.getStatus(session)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+func (h *Handler) getStatus(session *types.PackSession) (types.PackStatus, error) {
+	items, err := h.itemStore.GetItemsByInvoice(session.InvoiceID)
+	if err != nil {
+		return types.PackStatus{}, err
+	}
+	expected := Unshipped(items)
+
+	scans, err := h.store.GetPackScans(session.ID)
+	if err != nil {
+		return types.PackStatus{}, err
+	}
+
+	return BuildStatus(session, expected, scans), nil
+}
+
+func scanResult(tag string, expected []types.SoldItem, scans []types.PackScan) string {
+	tag = strings.TrimSpace(tag)
+
+	for _, scan := range scans {
+		if scan.RFIDTag == tag && scan.Result == types.ScanMatched {
+			return types.ScanDuplicate
+		}
+	}
+
+	for _, item := range expected {
+		if item.ItemTag == tag {
+			return types.ScanMatched
+		}
+	}
+
+	return types.ScanWrong
+}
@@ -0,0 +1,112 @@
+package packing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+func items(tags ...string) []types.SoldItem {
+	var sold []types.SoldItem
+	for i, tag := range tags {
+		sold = append(sold, types.SoldItem{ID: i + 1, ItemTag: tag, InvoiceID: 7})
+	}
+	return sold
+}
+
+func scans(pairs ...string) []types.PackScan {
+	var scanned []types.PackScan
+	for i := 0; i+1 < len(pairs); i += 2 {
+		scanned = append(scanned, types.PackScan{SessionID: 1, RFIDTag: pairs[i], Result: pairs[i+1]})
+	}
+	return scanned
+}
+
+func TestBuildStatus(t *testing.T) {
+	open := &types.PackSession{ID: 1, InvoiceID: 7, Status: types.PackOpen}
+	overridden := &types.PackSession{ID: 1, InvoiceID: 7, Status: types.PackOverridden}
+
+	tests := []struct {
+		name		string
+		session		*types.PackSession
+		expected	[]types.SoldItem
+		scans		[]types.PackScan
+		verified	bool
+		canShip		bool
+		missing		string
+		wrong		string
+	}{
+		{"everything scanned", open, items("A", "B"), scans("A", types.ScanMatched, "B", types.ScanMatched), true, true, "", ""},
+		{"duplicates do not count twice", open, items("A", "B"), scans("A", types.ScanMatched, "A", types.ScanDuplicate), false, false, "B", ""},
+		{"an item missing", open, items("A", "B"), scans("B", types.ScanMatched), false, false, "A", ""},
+		{"a stranger in the box", open, items("A"), scans("A", types.ScanMatched, "X", types.ScanWrong), false, false, "", "X"},
+		{"nothing to pack", open, nil, nil, false, false, "", ""},
+		{"overridden ships unverified", overridden, items("A", "B"), scans("A", types.ScanMatched), false, true, "B", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := BuildStatus(tt.session, tt.expected, tt.scans)
+
+			if status.Verified != tt.verified || status.CanShip != tt.canShip {
+				t.Fatalf("verified %v can ship %v, want %v %v", status.Verified, status.CanShip, tt.verified, tt.canShip)
+			}
+			if strings.Join(status.Missing, ",") != tt.missing || strings.Join(status.Wrong, ",") != tt.wrong {
+				t.Fatalf("missing %v wrong %v, want %q %q", status.Missing, status.Wrong, tt.missing, tt.wrong)
+			}
+			if status.Expected != len(tt.expected) || status.SessionID != 1 || status.InvoiceID != 7 {
+				t.Fatalf("status = %+v", status)
+			}
+		})
+	}
+}
+
+func TestCanShipSubset(t *testing.T) {
+	tests := []struct {
+		name	string
+		status	types.PackStatus
+		items	[]types.SoldItem
+		want	bool
+	}{
+		{"parcel fully scanned", types.PackStatus{Status: types.PackOpen, Matched: []string{"A", "B"}}, items("A"), true},
+		{"parcel item not scanned", types.PackStatus{Status: types.PackOpen, Matched: []string{"A"}}, items("A", "B"), false},
+		{"wrong tag in the box", types.PackStatus{Status: types.PackOpen, Matched: []string{"A"}, Wrong: []string{"X"}}, items("A"), false},
+		{"empty parcel", types.PackStatus{Status: types.PackOpen, Matched: []string{"A"}}, nil, false},
+		{"overridden", types.PackStatus{Status: types.PackOverridden, Wrong: []string{"X"}}, items("A"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanShipSubset(tt.status, tt.items); got != tt.want {
+				t.Fatalf("CanShipSubset = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanResult(t *testing.T) {
+	expected := items("A", "B")
+
+	tests := []struct {
+		name	string
+		tag		string
+		scans	[]types.PackScan
+		want	string
+	}{
+		{"on the invoice", "A", nil, types.ScanMatched},
+		{"surrounding whitespace", " B\n", nil, types.ScanMatched},
+		{"scanned before", "A", scans("A", types.ScanMatched), types.ScanDuplicate},
+		{"earlier wrong scan of it", "A", scans("A", types.ScanWrong), types.ScanMatched},
+		{"not on the invoice", "X", nil, types.ScanWrong},
+		{"stranger scanned again", "X", scans("X", types.ScanWrong), types.ScanWrong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanResult(tt.tag, expected, tt.scans); got != tt.want {
+				t.Fatalf("scanResult(%q) = %s, want %s", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
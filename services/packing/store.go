@@ -0,0 +1,201 @@
+package packing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) CreatePackSession(invoice_id int) (*types.PackSession, error) {
+	var session types.PackSession
+
+	err := s.db.QueryRow(`INSERT INTO pack_sessions (invoice_id) VALUES ($1)
+						  RETURNING id, invoice_id, status, createdat`, invoice_id).Scan(
+		&session.ID, &session.InvoiceID, &session.Status, &session.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetOpenPackSession returns the session that has not been shipped or cancelled yet, an overridden session still counts as open
+func (s *Store) GetOpenPackSession(invoice_id int) (*types.PackSession, error) {
+	var session types.PackSession
+
+	err := s.db.QueryRow(`SELECT id, invoice_id, status, override_by, override_reason, override_at, createdat
+						  FROM pack_sessions WHERE invoice_id = $1 AND status IN ($2, $3)
+						  ORDER BY id DESC LIMIT 1`, invoice_id, types.PackOpen, types.PackOverridden).Scan(
+		&session.ID, &session.InvoiceID, &session.Status, &session.OverrideBy,
+		&session.OverrideReason, &session.OverrideAt, &session.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s *Store) GetPackScans(session_id int) ([]types.PackScan, error) {
+	rows, err := s.db.Query(`SELECT id, session_id, rfid_tag, result, scannedat FROM pack_scans
+							 WHERE session_id = $1 ORDER BY id`, session_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPackScans(rows)
+}
+
+// LockOpenPackSession is GetOpenPackSession inside a transaction, the row stays locked until it ends so scans,
+// unscans and overrides wait for a shipment that is checking the session
+func (s *Store) LockOpenPackSession(invoice_id int, tx *sql.Tx, ctx context.Context) (*types.PackSession, error) {
+	var session types.PackSession
+
+	err := tx.QueryRowContext(ctx, `SELECT id, invoice_id, status, override_by, override_reason, override_at, createdat
+						  FROM pack_sessions WHERE invoice_id = $1 AND status IN ($2, $3)
+						  ORDER BY id DESC LIMIT 1 FOR UPDATE`, invoice_id, types.PackOpen, types.PackOverridden).Scan(
+		&session.ID, &session.InvoiceID, &session.Status, &session.OverrideBy,
+		&session.OverrideReason, &session.OverrideAt, &session.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetPackScansTx reads the scans of a session locked with LockOpenPackSession
+func (s *Store) GetPackScansTx(session_id int, tx *sql.Tx, ctx context.Context) ([]types.PackScan, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, session_id, rfid_tag, result, scannedat FROM pack_scans
+									  WHERE session_id = $1 ORDER BY id`, session_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPackScans(rows)
+}
+
+func scanPackScans(rows *sql.Rows) ([]types.PackScan, error) {
+	var scans []types.PackScan
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var scan types.PackScan
+
+		if err := rows.Scan(&scan.ID, &scan.SessionID, &scan.RFIDTag, &scan.Result, &scan.ScannedAt); err != nil {
+			return nil, err
+		}
+
+		scans = append(scans, scan)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return scans, nil
+}
+
+// AddPackScan, RemovePackScans and OverridePackSession only touch a session that is still open. The share lock
+// on the session makes them wait for a shipment holding it and then see it shipped
+func (s *Store) AddPackScan(scan types.PackScan) error {
+	res, err := s.db.Exec(`INSERT INTO pack_scans (session_id, rfid_tag, result)
+						   SELECT id, $2, $3 FROM pack_sessions WHERE id = $1 AND status IN ($4, $5) FOR SHARE`,
+		scan.SessionID, scan.RFIDTag, scan.Result, types.PackOpen, types.PackOverridden,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrPackSessionClosed
+	}
+
+	return nil
+}
+
+func (s *Store) RemovePackScans(session_id int, rfid_tag string) (int, error) {
+	var open bool
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT status IN ($2, $3) FROM pack_sessions WHERE id = $1 FOR SHARE",
+		session_id, types.PackOpen, types.PackOverridden,
+	).Scan(&open)
+	if err != nil {
+		return 0, err
+	}
+
+	if !open {
+		return 0, types.ErrPackSessionClosed
+	}
+
+	res, err := tx.Exec("DELETE FROM pack_scans WHERE session_id = $1 AND rfid_tag = $2", session_id, rfid_tag)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+func (s *Store) OverridePackSession(session_id int, user_id int, reason string) error {
+	res, err := s.db.Exec(`UPDATE pack_sessions SET status = $1, override_by = $2, override_reason = $3,
+						 override_at = CURRENT_TIMESTAMP WHERE id = $4 AND status IN ($5, $1)`,
+		types.PackOverridden, user_id, reason, session_id, types.PackOpen,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrPackSessionClosed
+	}
+
+	return nil
+}
+
+func (s *Store) ClosePackSession(session_id int, status string, tx *sql.Tx, ctx context.Context) error {
+	_, err := tx.ExecContext(ctx, "UPDATE pack_sessions SET status = $1 WHERE id = $2", status, session_id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
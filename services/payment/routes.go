@@ -0,0 +1,197 @@
+package payment
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.PaymentStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.PaymentStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/invoice/{invoice_id}", auth.WithJWTAuth(h.handleRecordPayment, h.userStore)).Methods("POST")
+	router.HandleFunc("/invoice/{invoice_id}", auth.WithJWTAuth(h.handleGetInvoicePayments, h.userStore)).Methods("GET")
+	router.HandleFunc("/void/{id}", auth.WithRole(h.handleVoidPayment, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("PATCH")
+	router.HandleFunc("/aging", auth.WithJWTAuth(h.handleGetAging, h.userStore)).Methods("GET")
+}
+
+func (h *Handler) handleRecordPayment(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.PaymentPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if payload.Amount.Currency != types.BaseCurrency {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("payments are recorded in %s", types.BaseCurrency))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	// The refund cap is checked by the store with the invoice locked
+	payment_id, err := h.store.RecordPayment(invoice_id, payload, userID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("invoice %d not found", invoice_id))
+		return
+	}
+	if err == types.ErrRefundExceedsPaid {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error recording payment: %v", err))
+		return
+	}
+
+	balance, err := h.store.GetInvoiceBalance(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"payment_id": payment_id,
+		"balance": balance,
+	})
+}
+
+func (h *Handler) handleGetInvoicePayments(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	balance, err := h.store.GetInvoiceBalance(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("invoice not found: %v", err))
+		return
+	}
+
+	payments, err := h.store.GetPaymentsByInvoice(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting payments: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"payments": payments,
+		"balance": balance,
+	})
+}
+
+func (h *Handler) handleVoidPayment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	err = h.store.VoidPayment(id, userID)
+	if err == types.ErrPaymentNotFound {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if err == types.ErrRefundExceedsPaid {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("void the refunds first: %v", err))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Payment voided")
+}
+
+// agingBuckets are upper bounds in days since the sale, the last bucket takes everything older
+var agingBuckets = []struct {
+	label	string
+	maxDays	int
+}{
+	{"0-30", 30},
+	{"31-60", 60},
+	{"61-90", 90},
+	{"90+", -1},
+}
+
+// handleGetAging groups unpaid and partially paid invoices by how long ago they were sold
+func (h *Handler) handleGetAging(w http.ResponseWriter, r *http.Request) {
+	invoices, err := h.store.GetOutstandingInvoices()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting invoices: %v", err))
+		return
+	}
+
+	buckets := make([]types.AgingBucket, len(agingBuckets))
+	for i, bucket := range agingBuckets {
+		buckets[i] = types.AgingBucket{Label: bucket.label, Invoices: []types.InvoiceBalance{}}
+	}
+
+	total := types.BaseMoney(0)
+	now := time.Now()
+
+	for _, invoice := range invoices {
+		days := 0
+		if invoice.SoldAt != nil {
+			days = int(now.Sub(*invoice.SoldAt).Hours() / 24)
+		}
+
+		for i, bucket := range agingBuckets {
+			if bucket.maxDays < 0 || days <= bucket.maxDays {
+				buckets[i].Count++
+				buckets[i].Outstanding = buckets[i].Outstanding.Add(invoice.Outstanding)
+				buckets[i].Invoices = append(buckets[i].Invoices, invoice)
+				break
+			}
+		}
+
+		total = total.Add(invoice.Outstanding)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"buckets": buckets,
+		"outstanding": total,
+	})
+}
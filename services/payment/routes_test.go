@@ -0,0 +1,158 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// memoryStore keeps payments the way the payments table and invoice_balances view would, invoice 7 is owed
+// 1000000. Calling anything else panics on the nil interface
+type memoryStore struct {
+	types.PaymentStore
+	payments []types.Payment
+}
+
+func (s *memoryStore) net(invoice_id int) int64 {
+	var net int64
+	for _, p := range s.payments {
+		if p.InvoiceID != invoice_id || p.VoidedAt != nil {
+			continue
+		}
+		if p.Kind == types.KindRefund {
+			net -= p.Amount.Amount
+		} else {
+			net += p.Amount.Amount
+		}
+	}
+	return net
+}
+
+func (s *memoryStore) RecordPayment(invoice_id int, payment types.PaymentPayload, recorded_by int) (int, error) {
+	if invoice_id != 7 {
+		return 0, sql.ErrNoRows
+	}
+
+	kind := payment.Kind
+	if kind == "" {
+		kind = types.KindPayment
+	}
+	if kind == types.KindRefund && payment.Amount.Amount > s.net(invoice_id) {
+		return 0, types.ErrRefundExceedsPaid
+	}
+
+	id := len(s.payments) + 1
+	s.payments = append(s.payments, types.Payment{ID: id, InvoiceID: invoice_id, Kind: kind, Amount: payment.Amount, Method: payment.Method})
+	return id, nil
+}
+
+func (s *memoryStore) VoidPayment(id int, voided_by int) error {
+	if id < 1 || id > len(s.payments) {
+		return types.ErrPaymentNotFound
+	}
+
+	payment := &s.payments[id-1]
+	if payment.Kind == types.KindPayment && payment.VoidedAt == nil && payment.Amount.Amount > s.net(payment.InvoiceID) {
+		return types.ErrRefundExceedsPaid
+	}
+
+	now := payment.PaidAt
+	payment.VoidedAt = &now
+	return nil
+}
+
+func (s *memoryStore) GetInvoiceBalance(invoice_id int) (*types.InvoiceBalance, error) {
+	net := types.Money{Amount: s.net(invoice_id), Currency: types.BaseCurrency}
+	return &types.InvoiceBalance{InvoiceID: invoice_id, AmountDue: types.BaseMoney(1000000), Paid: net, Outstanding: types.BaseMoney(1000000).Sub(net)}, nil
+}
+
+func withUser(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auth.UserKey, 1))
+}
+
+func record(h *Handler, invoice_id string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/payment/invoice/"+invoice_id, strings.NewReader(body))
+	r = withUser(mux.SetURLVars(r, map[string]string{"invoice_id": invoice_id}))
+
+	w := httptest.NewRecorder()
+	h.handleRecordPayment(w, r)
+
+	return w
+}
+
+func void(h *Handler, id string) *httptest.ResponseRecorder {
+	r := withUser(mux.SetURLVars(httptest.NewRequest("PATCH", "/api/payment/void/"+id, nil), map[string]string{"id": id}))
+
+	w := httptest.NewRecorder()
+	h.handleVoidPayment(w, r)
+
+	return w
+}
+
+func TestRecordPayment(t *testing.T) {
+	tests := []struct {
+		name		string
+		invoice_id	string
+		body		string
+		status		int
+	}{
+		{"payment", "7", `{"amount": 600000, "method": "transfer"}`, http.StatusCreated},
+		{"refund within what was paid", "7", `{"kind": "refund", "amount": 200000, "method": "transfer"}`, http.StatusCreated},
+		{"refund over what is left", "7", `{"kind": "refund", "amount": 500000, "method": "transfer"}`, http.StatusBadRequest},
+		{"foreign currency", "7", `{"amount": {"amount": "40", "currency": "USD"}, "method": "card"}`, http.StatusBadRequest},
+		{"unknown method", "7", `{"amount": 1000, "method": "barter"}`, http.StatusBadRequest},
+		{"unknown invoice", "8", `{"amount": 1000, "method": "cash"}`, http.StatusNotFound},
+	}
+
+	// The cases run in order against one invoice
+	h := NewHandler(&memoryStore{}, nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := record(h, tt.invoice_id, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("record = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestVoidPayment(t *testing.T) {
+	store := &memoryStore{}
+	h := NewHandler(store, nil)
+
+	record(h, "7", `{"amount": 600000, "method": "transfer"}`)
+	record(h, "7", `{"amount": 400000, "method": "cash"}`)
+	record(h, "7", `{"kind": "refund", "amount": 500000, "method": "transfer"}`)
+
+	// Voiding the transfer would leave the refund paying back more than was received
+	if w := void(h, "1"); w.Code != http.StatusConflict {
+		t.Fatalf("void under a refund = %d %s, want 409", w.Code, w.Body.String())
+	}
+
+	if w := void(h, "3"); w.Code != http.StatusOK {
+		t.Fatalf("void refund = %d %s", w.Code, w.Body.String())
+	}
+	if w := void(h, "1"); w.Code != http.StatusOK {
+		t.Fatalf("void payment = %d %s", w.Code, w.Body.String())
+	}
+
+	// Voided entries stay on the invoice but stop counting
+	if len(store.payments) != 3 || store.payments[0].VoidedAt == nil {
+		t.Fatalf("payments = %+v, want the transfer kept and voided", store.payments)
+	}
+	if net := store.net(7); net != types.BaseMoney(400000).Amount {
+		t.Fatalf("net paid = %d, want the cash payment only", net)
+	}
+
+	if w := void(h, "9"); w.Code != http.StatusNotFound {
+		t.Fatalf("void unknown = %d, want 404", w.Code)
+	}
+}
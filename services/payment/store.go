@@ -0,0 +1,236 @@
+package payment
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+// RecordPayment locks the invoice first, so two refunds entered at once cannot both fit under what was paid
+func (s *Store) RecordPayment(invoice_id int, payment types.PaymentPayload, recorded_by int) (payment_id int, err error) {
+	paid_at := time.Now()
+	if payment.PaidAt != nil {
+		paid_at = *payment.PaidAt
+	}
+
+	kind := payment.Kind
+	if kind == "" {
+		kind = types.KindPayment
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	net, err := lockInvoicePayments(tx, invoice_id)
+	if err != nil {
+		return 0, err
+	}
+
+	if kind == types.KindRefund && payment.Amount.Amount > net.Amount {
+		return 0, types.ErrRefundExceedsPaid
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO payments (invoice_id, kind, amount, method, paid_at, reference, recorded_by)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, 0)) RETURNING id`,
+		invoice_id, kind, payment.Amount, payment.Method, paid_at, payment.Reference, recorded_by,
+	).Scan(&payment_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return payment_id, nil
+}
+
+// lockInvoicePayments locks the invoice row and returns what was paid less what was refunded, voided entries
+// left out. sql.ErrNoRows means there is no such invoice
+func lockInvoicePayments(tx *sql.Tx, invoice_id int) (types.Money, error) {
+	var net types.Money
+
+	if _, err := tx.Exec(`SELECT 1 FROM invoice WHERE id = $1 FOR UPDATE`, invoice_id); err != nil {
+		return net, err
+	}
+
+	err := tx.QueryRow(
+		`SELECT i.id, COALESCE(SUM(CASE WHEN p.kind = $2 THEN -p.amount ELSE p.amount END), 0)
+		FROM invoice i LEFT JOIN payments p ON p.invoice_id = i.id AND p.voided_at IS NULL
+		WHERE i.id = $1 GROUP BY i.id`, invoice_id, types.KindRefund,
+	).Scan(new(int), &net)
+
+	return net, err
+}
+
+const paymentColumns = `id, invoice_id, kind, amount, method, paid_at, COALESCE(reference, ''), recorded_by, voided_at, createdat`
+
+func scanPayment(row interface{ Scan(dest ...any) error }) (*types.Payment, error) {
+	var payment types.Payment
+
+	err := row.Scan(&payment.ID, &payment.InvoiceID, &payment.Kind, &payment.Amount, &payment.Method,
+		&payment.PaidAt, &payment.Reference, &payment.RecordedBy, &payment.VoidedAt, &payment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+func (s *Store) GetPaymentsByInvoice(invoice_id int) ([]types.Payment, error) {
+	payments := []types.Payment{}
+
+	rows, err := s.db.Query("SELECT "+paymentColumns+" FROM payments WHERE invoice_id = $1 ORDER BY paid_at, id", invoice_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		payments = append(payments, *payment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
+
+func (s *Store) GetPaymentByID(id int) (*types.Payment, error) {
+	return scanPayment(s.db.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1", id))
+}
+
+// VoidPayment is for entries made by mistake, a refund is recorded as its own payment. The entry stays on the
+// invoice but no longer counts, payments from a payout are voided by reversing the payout instead
+func (s *Store) VoidPayment(id int, voided_by int) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	payment, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return types.ErrPaymentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	net, err := lockInvoicePayments(tx, payment.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	// Refunds already made would be left without the payment they paid back
+	if payment.Kind == types.KindPayment && payment.VoidedAt == nil && payment.Amount.Amount > net.Amount {
+		return types.ErrRefundExceedsPaid
+	}
+
+	// A refund booked in the journal stays, the journal would still take it off the sale
+	res, err := tx.Exec(`UPDATE payments SET voided_at = CURRENT_TIMESTAMP, voided_by = NULLIF($2, 0)
+						 WHERE id = $1 AND payout_line_id IS NULL AND journal_entry_id IS NULL AND voided_at IS NULL`, id, voided_by)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("payment is already voided, recorded from a payout or posted to the journal")
+	}
+
+	return nil
+}
+
+const balanceQuery = `SELECT b.invoice_id, i.invoice_str, COALESCE(i.online_shop, ''), b.amount_due, b.paid, b.refunded,
+					  b.payment_status, b.sold_at
+					  FROM invoice_balances b JOIN invoice i ON b.invoice_id = i.id`
+
+func scanBalance(row interface{ Scan(dest ...any) error }) (*types.InvoiceBalance, error) {
+	var balance types.InvoiceBalance
+
+	err := row.Scan(&balance.InvoiceID, &balance.InvoiceStr, &balance.OnlineShop, &balance.AmountDue, &balance.Paid,
+		&balance.Refunded, &balance.PaymentStatus, &balance.SoldAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	balance.Outstanding = balance.AmountDue.Sub(balance.Paid.Sub(balance.Refunded))
+	if balance.Outstanding.Amount < 0 || balance.PaymentStatus == types.PaymentRefunded {
+		balance.Outstanding = types.BaseMoney(0)
+	}
+
+	return &balance, nil
+}
+
+func (s *Store) GetInvoiceBalance(invoice_id int) (*types.InvoiceBalance, error) {
+	return scanBalance(s.db.QueryRow(balanceQuery+" WHERE b.invoice_id = $1", invoice_id))
+}
+
+// GetOutstandingInvoices returns unpaid and partially paid invoices that have items, oldest sale first
+func (s *Store) GetOutstandingInvoices() ([]types.InvoiceBalance, error) {
+	var balances []types.InvoiceBalance
+
+	rows, err := s.db.Query(balanceQuery+` WHERE b.payment_status IN ($1, $2) AND b.amount_due > 0 ORDER BY b.sold_at`,
+		types.PaymentUnpaid, types.PaymentPartial,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		balance, err := scanBalance(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		balances = append(balances, *balance)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
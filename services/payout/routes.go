@@ -0,0 +1,240 @@
+package payout
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/marketplace"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/gorilla/mux"
+)
+
+const maxUploadSize = 10 << 20
+
+type Handler struct {
+	store types.PayoutStore
+	userStore types.UserStore
+	connectors map[string]marketplace.Connector
+}
+
+func NewHandler(store types.PayoutStore, userStore types.UserStore, connectors map[string]marketplace.Connector) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+		connectors: connectors,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/import/{marketplace}", auth.WithRole(h.handleImportSettlement, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("POST")
+	router.HandleFunc("/rematch", auth.WithRole(h.handleRematch, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("POST")
+	router.HandleFunc("/unreconciled", auth.WithJWTAuth(h.handleGetUnreconciled, h.userStore)).Methods("GET")
+	router.HandleFunc("/unmatched", auth.WithJWTAuth(h.handleGetUnmatched, h.userStore)).Methods("GET")
+	router.HandleFunc("/invoice/{invoice_id}", auth.WithJWTAuth(h.handleGetInvoicePayouts, h.userStore)).Methods("GET")
+}
+
+// handleImportSettlement takes the report as a multipart "file" field or as the raw CSV body, the same
+// file is only imported once
+func (h *Handler) handleImportSettlement(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(mux.Vars(r)["marketplace"])
+	connector, ok := h.connectors[name]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown marketplace: %s", name))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	var report io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading file: %v", err))
+			return
+		}
+
+		defer file.Close()
+		report = file
+	}
+
+	content, err := io.ReadAll(report)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reading report: %v", err))
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	reference := hex.EncodeToString(sum[:])
+
+	exists, err := h.store.PayoutExists(name, reference)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+	if exists {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("report already imported"))
+		return
+	}
+
+	lines, err := connector.ParseSettlement(bytes.NewReader(content))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing report: %v", err))
+		return
+	}
+
+	if len(lines) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("report has no lines"))
+		return
+	}
+
+	// Transaction
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+		}
+	}()
+
+	result := types.PayoutImportResult{
+		Unmatched: []string{},
+	}
+
+	result.PayoutID, err = h.store.CreatePayout(name, reference, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error creating payout: %v", err))
+		return
+	}
+
+	for _, line := range lines {
+		var matched bool
+		matched, err = h.store.AddPayoutLine(result.PayoutID, connector.ShopName(), line, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error recording %s: %v", line.InvoiceStr, err))
+			return
+		}
+
+		if matched {
+			result.Matched++
+		} else {
+			result.Unmatched = append(result.Unmatched, line.InvoiceStr)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, result)
+}
+
+func (h *Handler) handleRematch(w http.ResponseWriter, r *http.Request) {
+	shops := make(map[string]string)
+	for name, connector := range h.connectors {
+		shops[name] = connector.ShopName()
+	}
+
+	matched, err := h.store.MatchPayoutLines(shops)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error matching payouts: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"matched": matched,
+	})
+}
+
+// handleGetUnreconciled lists marketplace invoices older than ?days= (default 14) with no payout,
+// ?marketplace= narrows it to one marketplace
+func (h *Handler) handleGetUnreconciled(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 0 {
+		days = 14
+	}
+
+	var shops []string
+	for name, connector := range h.connectors {
+		if filter := r.URL.Query().Get("marketplace"); filter != "" && !strings.EqualFold(filter, name) {
+			continue
+		}
+		shops = append(shops, connector.ShopName())
+	}
+
+	if len(shops) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("unknown marketplace"))
+		return
+	}
+
+	invoices, err := h.store.GetUnreconciledInvoices(shops, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting invoices: %v", err))
+		return
+	}
+
+	outstanding := types.BaseMoney(0)
+	for _, invoice := range invoices {
+		outstanding = outstanding.Add(invoice.Expected)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"invoices": invoices,
+		"count": len(invoices),
+		"outstanding": outstanding,
+	})
+}
+
+func (h *Handler) handleGetUnmatched(w http.ResponseWriter, r *http.Request) {
+	lines, err := h.store.GetUnmatchedPayoutLines(strings.ToLower(r.URL.Query().Get("marketplace")))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting payout lines: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"lines": lines,
+	})
+}
+
+func (h *Handler) handleGetInvoicePayouts(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	lines, err := h.store.GetPayoutLinesByInvoice(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting payout lines: %v", err))
+		return
+	}
+
+	paid, fees := types.BaseMoney(0), types.BaseMoney(0)
+	for _, line := range lines {
+		paid = paid.Add(line.Net)
+		fees = fees.Add(line.Fees)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"lines": lines,
+		"paid": paid,
+		"fees": fees,
+	})
+}
@@ -0,0 +1,197 @@
+package payout
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/marketplace"
+	"github.com/PatrickA727/mikrotik-db-sys/internal/txtest"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+type invoice struct {
+	id		int
+	str		string
+	shop	string
+}
+
+// fakeStore matches lines like the SQL does, an invoice number only counts when exactly one invoice on the
+// payout's shop has it
+type fakeStore struct {
+	db			*sql.DB
+	invoices	[]invoice
+	payouts		map[string]bool
+	lines		[]types.SettlementLine
+	shops		[]string
+}
+
+func newFakeStore(t *testing.T, invoices ...invoice) *fakeStore {
+	return &fakeStore{db: txtest.Open(t), invoices: invoices, payouts: make(map[string]bool)}
+}
+
+func (s *fakeStore) match(invoice_str string, shop string) *int {
+	var found []int
+	for _, i := range s.invoices {
+		if i.str == invoice_str && strings.EqualFold(i.shop, shop) {
+			found = append(found, i.id)
+		}
+	}
+
+	if len(found) != 1 {
+		return nil
+	}
+	return &found[0]
+}
+
+func (s *fakeStore) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+func (s *fakeStore) PayoutExists(marketplace string, reference string) (bool, error) {
+	return s.payouts[marketplace+":"+reference], nil
+}
+
+func (s *fakeStore) CreatePayout(marketplace string, reference string, tx *sql.Tx, ctx context.Context) (int, error) {
+	s.payouts[marketplace+":"+reference] = true
+	return len(s.payouts), nil
+}
+
+func (s *fakeStore) AddPayoutLine(payout_id int, shop string, line types.SettlementLine, tx *sql.Tx, ctx context.Context) (bool, error) {
+	s.shops = append(s.shops, shop)
+
+	line.PayoutID = payout_id
+	line.InvoiceID = s.match(line.InvoiceStr, shop)
+	s.lines = append(s.lines, line)
+
+	return line.InvoiceID != nil, nil
+}
+
+func (s *fakeStore) GetPayoutLinesByInvoice(invoice_id int) ([]types.SettlementLine, error) {
+	return nil, nil
+}
+
+func (s *fakeStore) GetUnmatchedPayoutLines(marketplace string) ([]types.SettlementLine, error) {
+	return nil, nil
+}
+
+func (s *fakeStore) MatchPayoutLines(shops map[string]string) (int, error) {
+	s.shops = nil
+	for _, shop := range shops {
+		s.shops = append(s.shops, shop)
+	}
+
+	return 0, nil
+}
+
+func (s *fakeStore) GetUnreconciledInvoices(shops []string, before time.Time) ([]types.UnreconciledInvoice, error) {
+	return nil, nil
+}
+
+func newTestHandler(store types.PayoutStore) *Handler {
+	return NewHandler(store, nil, map[string]marketplace.Connector{
+		"tokopedia": marketplace.NewTokopedia(""),
+		"shopee": marketplace.NewShopee("", ""),
+	})
+}
+
+func importReport(h *Handler, name string, report []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/payout/import/"+name, bytes.NewReader(report))
+	r = mux.SetURLVars(r, map[string]string{"marketplace": name})
+
+	w := httptest.NewRecorder()
+	h.handleImportSettlement(w, r)
+
+	return w
+}
+
+func TestImportSettlement(t *testing.T) {
+	report, err := os.ReadFile("../marketplace/testdata/tokopedia_settlement.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newFakeStore(t,
+		invoice{1, "INV/20261018/MPL/3561240981", "Tokopedia"},
+		// The same number on another marketplace is not this payout's invoice
+		invoice{2, "INV/20261018/MPL/3561257710", "Shopee"},
+		// Two invoices with one number are left for a person to sort out
+		invoice{3, "INV/20261017/MPL/3560011111", "Tokopedia"},
+		invoice{4, "INV/20261017/MPL/3560011111", "Tokopedia"},
+	)
+	h := newTestHandler(store)
+
+	w := importReport(h, "tokopedia", report)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("import = %d %s", w.Code, w.Body.String())
+	}
+
+	var result types.PayoutImportResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Matched != 1 {
+		t.Fatalf("matched %d lines, want 1", result.Matched)
+	}
+	wantUnmatched := []string{"INV/20261018/MPL/3561257710", "INV/20261017/MPL/3560011111"}
+	if strings.Join(result.Unmatched, ",") != strings.Join(wantUnmatched, ",") {
+		t.Fatalf("unmatched = %v, want %v", result.Unmatched, wantUnmatched)
+	}
+
+	for _, shop := range store.shops {
+		if shop != "Tokopedia" {
+			t.Fatalf("lines matched against shop %q, want Tokopedia", shop)
+		}
+	}
+
+	if line := store.lines[0]; line.InvoiceID == nil || *line.InvoiceID != 1 || line.Net != types.BaseMoney(3613250) {
+		t.Fatalf("first line = %+v", line)
+	}
+
+	// The same file again is refused and records nothing
+	w = importReport(h, "tokopedia", report)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already imported") {
+		t.Fatalf("re-import = %d %s", w.Code, w.Body.String())
+	}
+	if len(store.lines) != 3 {
+		t.Fatalf("re-import recorded %d lines, want the original 3", len(store.lines))
+	}
+
+	// A Tokopedia report uploaded as Shopee has none of its columns
+	w = importReport(h, "shopee", report)
+	if w.Code == http.StatusCreated {
+		t.Fatalf("Tokopedia report parsed as Shopee: %s", w.Body.String())
+	}
+}
+
+func TestImportSettlementUnknownMarketplace(t *testing.T) {
+	w := importReport(newTestHandler(newFakeStore(t)), "lazada", []byte("x"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("import = %d, want 404", w.Code)
+	}
+}
+
+func TestRematchScopesByShop(t *testing.T) {
+	store := newFakeStore(t)
+	h := newTestHandler(store)
+
+	w := httptest.NewRecorder()
+	h.handleRematch(w, httptest.NewRequest("POST", "/api/payout/rematch", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rematch = %d %s", w.Code, w.Body.String())
+	}
+
+	shops := strings.Join(store.shops, ",")
+	if len(store.shops) != 2 || !strings.Contains(shops, "Tokopedia") || !strings.Contains(shops, "Shopee") {
+		t.Fatalf("rematch shops = %v, want every connector's shop", store.shops)
+	}
+}
@@ -0,0 +1,239 @@
+package payout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *Store) PayoutExists(marketplace string, reference string) (bool, error) {
+	exists := false
+
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM payouts WHERE marketplace = $1 AND reference = $2)",
+		marketplace, reference,
+	).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (s *Store) CreatePayout(marketplace string, reference string, tx *sql.Tx, ctx context.Context) (int, error) {
+	payout_id := 0
+
+	err := tx.QueryRowContext(ctx, "INSERT INTO payouts (marketplace, reference) VALUES ($1, $2) RETURNING id",
+		marketplace, reference,
+	).Scan(&payout_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return payout_id, nil
+}
+
+// AddPayoutLine matches the line to the invoice with the same invoice_str sold on the marketplace's shop, marks
+// the invoice's items paid and records the gross as a payment, marketplace fees are a cost and not a shortfall.
+// Several invoices with that number leave the line unmatched rather than paying a guess. Returns whether a
+// match was found
+func (s *Store) AddPayoutLine(payout_id int, shop string, line types.SettlementLine, tx *sql.Tx, ctx context.Context) (bool, error) {
+	var invoice_id *int
+	line_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO payout_lines (payout_id, invoice_id, invoice_str, gross, fees, net, settled_at)
+		VALUES ($1, (SELECT MIN(id) FROM invoice WHERE invoice_str = $2 AND LOWER(online_shop) = LOWER($7) HAVING COUNT(*) = 1),
+		$2, $3, $4, $5, $6) RETURNING id, invoice_id`,
+		payout_id, line.InvoiceStr, line.Gross, line.Fees, line.Net, line.SettledAt, shop,
+	).Scan(&line_id, &invoice_id)
+	if err != nil {
+		return false, err
+	}
+
+	if invoice_id == nil {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sold_items SET payment_status = true WHERE invoice_id = $1", *invoice_id)
+	if err != nil {
+		return false, err
+	}
+
+	if line.Gross.Amount > 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO payments (invoice_id, kind, amount, method, paid_at, reference, payout_line_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			*invoice_id, types.KindPayment, line.Gross, types.MethodMarketplace, line.SettledAt, fmt.Sprintf("payout %d", payout_id), line_id,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// MatchPayoutLines retries unmatched lines, for payouts imported before their invoice was entered. shops maps
+// each marketplace to the shop its invoices are on, lines are matched the same way AddPayoutLine does
+func (s *Store) MatchPayoutLines(shops map[string]string) (matched int, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for marketplace, shop := range shops {
+		res, err := tx.Exec(`UPDATE payout_lines l SET invoice_id = i.id
+							 FROM payouts p, (
+								 SELECT invoice_str, MIN(id) AS id FROM invoice WHERE LOWER(online_shop) = LOWER($2)
+								 GROUP BY invoice_str HAVING COUNT(*) = 1
+							 ) i
+							 WHERE l.payout_id = p.id AND p.marketplace = $1
+							 AND l.invoice_id IS NULL AND l.invoice_str = i.invoice_str`, marketplace, shop)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		matched += int(rowsAffected)
+	}
+
+	_, err = tx.Exec(`UPDATE sold_items s SET payment_status = true
+					  WHERE s.payment_status = false AND EXISTS (SELECT 1 FROM payout_lines l WHERE l.invoice_id = s.invoice_id)`)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO payments (invoice_id, kind, amount, method, paid_at, reference, payout_line_id)
+					  SELECT l.invoice_id, $1, l.gross, $2, l.settled_at, 'payout ' || l.payout_id, l.id
+					  FROM payout_lines l
+					  WHERE l.invoice_id IS NOT NULL AND l.gross > 0
+					  AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.payout_line_id = l.id)`,
+		types.KindPayment, types.MethodMarketplace,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return matched, nil
+}
+
+const lineColumns = `id, payout_id, invoice_id, invoice_str, gross, fees, net, settled_at`
+
+func scanLines(rows *sql.Rows) ([]types.SettlementLine, error) {
+	defer rows.Close()
+
+	lines := []types.SettlementLine{}
+
+	for rows.Next() {
+		var line types.SettlementLine
+
+		err := rows.Scan(&line.ID, &line.PayoutID, &line.InvoiceID, &line.InvoiceStr, &line.Gross, &line.Fees, &line.Net, &line.SettledAt)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+func (s *Store) GetPayoutLinesByInvoice(invoice_id int) ([]types.SettlementLine, error) {
+	rows, err := s.db.Query("SELECT "+lineColumns+" FROM payout_lines WHERE invoice_id = $1 ORDER BY settled_at", invoice_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanLines(rows)
+}
+
+// GetUnmatchedPayoutLines lists money received for invoices we have no record of, marketplace is optional
+func (s *Store) GetUnmatchedPayoutLines(marketplace string) ([]types.SettlementLine, error) {
+	rows, err := s.db.Query(`SELECT l.id, l.payout_id, l.invoice_id, l.invoice_str, l.gross, l.fees, l.net, l.settled_at
+							 FROM payout_lines l JOIN payouts p ON l.payout_id = p.id
+							 WHERE l.invoice_id IS NULL AND ($1 = '' OR p.marketplace = $1)
+							 ORDER BY l.settled_at`, marketplace)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanLines(rows)
+}
+
+// GetUnreconciledInvoices returns invoices on the given shops sold before the cutoff that no payout has covered
+func (s *Store) GetUnreconciledInvoices(shops []string, before time.Time) ([]types.UnreconciledInvoice, error) {
+	invoices := []types.UnreconciledInvoice{}
+
+	rows, err := s.db.Query(`SELECT i.id, i.invoice_str, i.online_shop, MIN(s.datetime_sold),
+							 ROUND(COALESCE(SUM(a.gross), 0) * (100 - COALESCE(MAX(c.fee_percent), 0)) / 100)::BIGINT
+							 FROM invoice i
+							 JOIN sold_items s ON s.invoice_id = i.id
+							 JOIN sold_item_amounts a ON a.sold_item_id = s.id
+							 LEFT JOIN channels c ON i.online_shop = c.name
+							 WHERE i.online_shop = ANY(string_to_array($1, ','))
+							 AND NOT EXISTS (SELECT 1 FROM payout_lines l WHERE l.invoice_id = i.id)
+							 GROUP BY i.id, i.invoice_str, i.online_shop
+							 HAVING MIN(s.datetime_sold) < $2
+							 ORDER BY MIN(s.datetime_sold)`, strings.Join(shops, ","), before)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var invoice types.UnreconciledInvoice
+
+		if err := rows.Scan(&invoice.InvoiceID, &invoice.InvoiceStr, &invoice.OnlineShop, &invoice.SoldAt, &invoice.Expected); err != nil {
+			return nil, err
+		}
+
+		invoice.DaysOpen = int(time.Since(invoice.SoldAt).Hours() / 24)
+
+		invoices = append(invoices, invoice)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
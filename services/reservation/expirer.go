@@ -0,0 +1,55 @@
+package reservation
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Expirer periodically puts the items of lapsed reservations back on sale
+type Expirer struct {
+	store		types.ReservationStore
+	events		types.EventPublisher
+	interval	time.Duration
+}
+
+func NewExpirer(store types.ReservationStore, events types.EventPublisher, interval time.Duration) *Expirer {
+	return &Expirer{
+		store: store,
+		events: events,
+		interval: interval,
+	}
+}
+
+func (e *Expirer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			e.ExpireOnce()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (e *Expirer) ExpireOnce() {
+	ids, err := e.store.ExpireReservations(time.Now())
+	if err != nil {
+		log.Printf("reservations: error expiring reservations: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		e.events.Publish(types.TopicItems, "reservation.expired", map[string]interface{}{
+			"reservation_id": id,
+		})
+	}
+}
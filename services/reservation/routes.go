@@ -0,0 +1,360 @@
+package reservation
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/channel"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.ReservationStore
+	itemStore types.ItemStore
+	channelStore types.ChannelStore
+	userStore types.UserStore
+	events types.EventPublisher
+	hold time.Duration	// Used when a reservation does not say how long to hold
+}
+
+func NewHandler(store types.ReservationStore, itemStore types.ItemStore, channelStore types.ChannelStore, userStore types.UserStore, events types.EventPublisher, hold time.Duration) *Handler {
+	return &Handler{
+		store: store,
+		itemStore: itemStore,
+		channelStore: channelStore,
+		userStore: userStore,
+		events: events,
+		hold: hold,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/create", auth.WithJWTAuth(h.handleCreateReservation, h.userStore)).Methods("POST")
+	router.HandleFunc("/list", auth.WithJWTAuth(h.handleGetReservations, h.userStore)).Methods("GET")
+	router.HandleFunc("/{id}", auth.MobileAuth(h.handleGetReservation, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/{id}/extend", auth.WithJWTAuth(h.handleExtendReservation, h.userStore)).Methods("PATCH")
+	router.HandleFunc("/{id}/release", auth.WithJWTAuth(h.handleReleaseReservation, h.userStore)).Methods("POST")
+	router.HandleFunc("/{id}/convert", auth.WithJWTAuth(h.handleConvertReservation, h.userStore)).Methods("POST")
+}
+
+// handleCreateReservation holds every listed serial number or none of them
+func (h *Handler) handleCreateReservation(w http.ResponseWriter, r *http.Request) {
+	var payload types.ReservationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	var err error
+	if payload.OnlineShop != "" {
+		payload.OnlineShop, err = channel.Resolve(h.channelStore, payload.OnlineShop)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	hold := h.hold
+	if payload.HoldHours > 0 {
+		hold = time.Duration(payload.HoldHours) * time.Hour
+	}
+	expires_at := time.Now().Add(hold)
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	var onCommit func()
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+			return
+		}
+		if onCommit != nil {
+			onCommit()
+		}
+	}()
+
+	reservation_id, err := h.store.CreateReservation(payload, expires_at, userID, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating reservation: %v", err))
+		return
+	}
+
+	for _, serial_num := range payload.SerialNums {
+		var item *types.Item
+		item, err = h.itemStore.GetItemBySN(serial_num, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("item %s not found: %v", serial_num, err))
+			return
+		}
+
+		if item.Status != "not sold" {
+			err = fmt.Errorf("item %s is %s", serial_num, item.Status)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = h.store.ReserveItem(reservation_id, item.ID, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error reserving %s: %v", serial_num, err))
+			return
+		}
+	}
+
+	onCommit = func() {
+		h.events.Publish(types.TopicItems, "reservation.created", map[string]interface{}{
+			"reservation_id": reservation_id,
+			"serial_numbers": payload.SerialNums,
+			"expires_at": expires_at,
+		})
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"reservation_id": reservation_id,
+		"expires_at": expires_at,
+	})
+}
+
+// handleGetReservations takes an optional ?status=, active reservations are the ones still holding items
+func (h *Handler) handleGetReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := h.store.GetReservations(r.URL.Query().Get("status"))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting reservations: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"reservations": reservations,
+	})
+}
+
+func (h *Handler) handleGetReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	reservation, err := h.store.GetReservationByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("reservation not found: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, reservation)
+}
+
+func (h *Handler) handleExtendReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.ExtendReservationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	expires_at := time.Now().Add(time.Duration(payload.HoldHours) * time.Hour)
+
+	if err := h.store.ExtendReservation(id, expires_at); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"expires_at": expires_at,
+	})
+}
+
+func (h *Handler) handleReleaseReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	item_ids, err := h.store.CloseReservation(id, types.ReservationReleased, nil, tx, ctx)
+	if err != nil {
+		tx.Rollback()
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error releasing reservation: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicItems, "reservation.released", map[string]interface{}{
+		"reservation_id": id,
+		"item_ids": item_ids,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, "Reservation released")
+}
+
+// handleConvertReservation sells every held item on a new invoice, the reservation is closed in the same
+// transaction so the items are never on sale in between
+func (h *Handler) handleConvertReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.ConvertReservationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	reservation, err := h.store.GetReservationByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("reservation not found: %v", err))
+		return
+	}
+
+	if reservation.Status != types.ReservationActive {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("reservation is %s", reservation.Status))
+		return
+	}
+
+	if !reservation.ExpiresAt.After(time.Now()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("reservation expired at %s", reservation.ExpiresAt.Format(time.RFC3339)))
+		return
+	}
+
+	shop := payload.OnlineShop
+	if shop == "" {
+		shop = reservation.OnlineShop
+	}
+
+	shop, err = channel.Resolve(h.channelStore, shop)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	var onCommit func()
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+			return
+		}
+		if onCommit != nil {
+			onCommit()
+		}
+	}()
+
+	invoice_id, err := h.itemStore.CreateInvoice(payload.Invoice, shop, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating invoice: %v", err))
+		return
+	}
+
+	item_ids, err := h.store.CloseReservation(id, types.ReservationConverted, &invoice_id, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	if len(item_ids) == 0 {
+		err = fmt.Errorf("reservation holds no items")
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, item_id := range item_ids {
+		err = h.itemStore.NewItemSold(types.SoldItem{
+			ItemID: item_id,
+			InvoiceID: invoice_id,
+			OnlineShop: shop,
+		}, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error registering sold item: %v", err))
+			return
+		}
+	}
+
+	serial_nums := make([]string, 0, len(reservation.Items))
+	for _, item := range reservation.Items {
+		serial_nums = append(serial_nums, item.SerialNumber)
+	}
+
+	onCommit = func() {
+		h.events.Publish(types.TopicSales, "sale.created", map[string]interface{}{
+			"invoice_id": invoice_id,
+			"invoice": payload.Invoice,
+			"ol_shop": shop,
+			"serial_numbers": serial_nums,
+			"reservation_id": id,
+		})
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]int{"invoice_id": invoice_id})
+}
@@ -0,0 +1,305 @@
+package reservation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *Store) CreateReservation(payload types.ReservationPayload, expires_at time.Time, created_by int, tx *sql.Tx, ctx context.Context) (int, error) {
+	reservation_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO reservations (customer_name, customer_contact, ol_shop, notes, expires_at, created_by)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5, $6) RETURNING id`,
+		payload.CustomerName, payload.CustomerContact, payload.OnlineShop, payload.Notes, expires_at, created_by,
+	).Scan(&reservation_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return reservation_id, nil
+}
+
+// ReserveItem only takes items that are still for sale, so two reservations or a sale cannot race for one unit
+func (s *Store) ReserveItem(reservation_id int, item_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE items SET status = $1 WHERE id = $2 AND status = $3",
+		types.ItemReserved, item_id, "not sold",
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is no longer for sale", item_id)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO reservation_items (reservation_id, item_id) VALUES ($1, $2)",
+		reservation_id, item_id,
+	)
+	return err
+}
+
+const reservationColumns = `id, customer_name, COALESCE(customer_contact, ''), COALESCE(ol_shop, ''), COALESCE(notes, ''),
+	status, expires_at, invoice_id, created_by, createdat, closed_at`
+
+func scanReservation(row interface{ Scan(dest ...any) error }) (*types.Reservation, error) {
+	var reservation types.Reservation
+
+	err := row.Scan(&reservation.ID, &reservation.CustomerName, &reservation.CustomerContact, &reservation.OnlineShop,
+		&reservation.Notes, &reservation.Status, &reservation.ExpiresAt, &reservation.InvoiceID, &reservation.CreatedBy,
+		&reservation.CreatedAt, &reservation.ClosedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation.Items = []types.ReservationItem{}
+
+	return &reservation, nil
+}
+
+// GetReservations returns reservations newest first, an empty status returns all of them
+func (s *Store) GetReservations(status string) ([]types.Reservation, error) {
+	rows, err := s.db.Query(`SELECT `+reservationColumns+` FROM reservations
+							 WHERE $1 = '' OR status = $1 ORDER BY createdat DESC`, status)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var reservations []*types.Reservation
+
+	for rows.Next() {
+		reservation, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, reservation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadItems(reservations); err != nil {
+		return nil, err
+	}
+
+	result := make([]types.Reservation, 0, len(reservations))
+	for _, reservation := range reservations {
+		result = append(result, *reservation)
+	}
+
+	return result, nil
+}
+
+func (s *Store) GetReservationByID(id int) (*types.Reservation, error) {
+	reservation, err := scanReservation(s.db.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadItems([]*types.Reservation{reservation}); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// loadItems fills in the held items priced at today's list price, the total is left nil when any price
+// cannot be converted
+func (s *Store) loadItems(reservations []*types.Reservation) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*types.Reservation)
+	ids := make([]string, 0, len(reservations))
+	for _, reservation := range reservations {
+		byID[reservation.ID] = reservation
+		ids = append(ids, fmt.Sprint(reservation.ID))
+	}
+
+	rows, err := s.db.Query(`SELECT ri.reservation_id, i.id, i.serial_number, i.rfid_tag, i.type_ref,
+							 to_base_minor(t.price, t.price_currency, CURRENT_TIMESTAMP::TIMESTAMP)
+							 FROM reservation_items ri
+							 JOIN items i ON ri.item_id = i.id
+							 LEFT JOIN item_type t ON i.type_ref = t.item_type
+							 WHERE ri.reservation_id = ANY(string_to_array($1, ',')::int[]) ORDER BY i.id`,
+		strings.Join(ids, ","),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	complete := make(map[int]bool)
+	totals := make(map[int]types.Money)
+
+	for rows.Next() {
+		var reservation_id int
+		var item types.ReservationItem
+		var price sql.NullInt64
+
+		if err := rows.Scan(&reservation_id, &item.ItemID, &item.SerialNumber, &item.RFIDTag, &item.TypeRef, &price); err != nil {
+			return err
+		}
+
+		if _, ok := complete[reservation_id]; !ok {
+			complete[reservation_id] = true
+		}
+
+		if price.Valid {
+			amount := types.NewMoney(price.Int64, types.BaseCurrency)
+			item.Price = &amount
+			totals[reservation_id] = totals[reservation_id].Add(amount)
+		} else {
+			complete[reservation_id] = false
+		}
+
+		byID[reservation_id].Items = append(byID[reservation_id].Items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, ok := range complete {
+		if ok {
+			total := totals[id]
+			byID[id].Total = &total
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) ExtendReservation(id int, expires_at time.Time) error {
+	// A lapsed hold the expirer has not reached yet is not brought back
+	res, err := s.db.Exec("UPDATE reservations SET expires_at = $1 WHERE id = $2 AND status = $3 AND expires_at > now()",
+		expires_at, id, types.ReservationActive,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("reservation not found, no longer active or expired")
+	}
+
+	return nil
+}
+
+// CloseReservation ends an active reservation and puts its items back on sale, returning their IDs. When
+// converting, the caller sells the items in the same transaction and the hold must not have lapsed
+func (s *Store) CloseReservation(id int, status string, invoice_id *int, tx *sql.Tx, ctx context.Context) ([]int, error) {
+	query := `UPDATE reservations SET status = $1, invoice_id = $2, closed_at = CURRENT_TIMESTAMP WHERE id = $3 AND status = $4`
+	if status == types.ReservationConverted {
+		query += " AND expires_at > now()"
+	}
+
+	res, err := tx.ExecContext(ctx, query, status, invoice_id, id, types.ReservationActive)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("reservation not found, no longer active or expired")
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`UPDATE items SET status = $1 WHERE status = $2
+		AND id IN (SELECT item_id FROM reservation_items WHERE reservation_id = $3) RETURNING id`,
+		"not sold", types.ItemReserved, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var item_ids []int
+
+	for rows.Next() {
+		var item_id int
+		if err := rows.Scan(&item_id); err != nil {
+			return nil, err
+		}
+		item_ids = append(item_ids, item_id)
+	}
+
+	return item_ids, rows.Err()
+}
+
+// ExpireReservations closes every active reservation past its expiry and releases the items in one
+// statement, returning the reservation IDs
+func (s *Store) ExpireReservations(now time.Time) ([]int, error) {
+	rows, err := s.db.Query(
+		`WITH expired AS (
+			UPDATE reservations SET status = $1, closed_at = $2 WHERE status = $3 AND expires_at <= $2 RETURNING id
+		), released AS (
+			UPDATE items SET status = 'not sold' WHERE status = $4
+			AND id IN (SELECT ri.item_id FROM reservation_items ri JOIN expired e ON ri.reservation_id = e.id)
+		)
+		SELECT id FROM expired ORDER BY id`,
+		types.ReservationExpired, now, types.ReservationActive, types.ItemReserved,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []int
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,55 @@
+package salesorder
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Expirer periodically puts the items of abandoned sales orders back on sale
+type Expirer struct {
+	store		types.SalesOrderStore
+	events		types.EventPublisher
+	interval	time.Duration
+}
+
+func NewExpirer(store types.SalesOrderStore, events types.EventPublisher, interval time.Duration) *Expirer {
+	return &Expirer{
+		store: store,
+		events: events,
+		interval: interval,
+	}
+}
+
+func (e *Expirer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			e.ExpireOnce()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (e *Expirer) ExpireOnce() {
+	ids, err := e.store.ExpireSalesOrders(time.Now())
+	if err != nil {
+		log.Printf("sales orders: error expiring sales orders: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		e.events.Publish(types.TopicItems, "sales_order.expired", map[string]interface{}{
+			"sales_order_id": id,
+		})
+	}
+}
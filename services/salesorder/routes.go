@@ -0,0 +1,418 @@
+package salesorder
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/channel"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.SalesOrderStore
+	itemStore types.ItemStore
+	channelStore types.ChannelStore
+	userStore types.UserStore
+	events types.EventPublisher
+	hold time.Duration	// How long an order keeps its items when nobody finishes scanning
+}
+
+func NewHandler(store types.SalesOrderStore, itemStore types.ItemStore, channelStore types.ChannelStore, userStore types.UserStore, events types.EventPublisher, hold time.Duration) *Handler {
+	return &Handler{
+		store: store,
+		itemStore: itemStore,
+		channelStore: channelStore,
+		userStore: userStore,
+		events: events,
+		hold: hold,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/suggest", auth.WithJWTAuth(h.handleSuggestItems, h.userStore)).Methods("GET")
+	router.HandleFunc("/create", auth.WithJWTAuth(h.handleCreateSalesOrder, h.userStore)).Methods("POST")
+	router.HandleFunc("/list", auth.WithJWTAuth(h.handleGetSalesOrders, h.userStore)).Methods("GET")
+	router.HandleFunc("/{id}", auth.MobileAuth(h.handleGetSalesOrder, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/{id}/scan", auth.MobileAuth(h.handleScanItems, h.userStore)).Methods("POST")	// Mobile App
+	router.HandleFunc("/{id}/cancel", auth.WithJWTAuth(h.handleCancelSalesOrder, h.userStore)).Methods("POST")
+}
+
+// handleSuggestItems shows which serial numbers ?type_ref= and ?quantity= would get, nothing is held
+func (h *Handler) handleSuggestItems(w http.ResponseWriter, r *http.Request) {
+	type_ref := r.URL.Query().Get("type_ref")
+	if type_ref == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("type_ref is required"))
+		return
+	}
+
+	quantity, err := strconv.Atoi(r.URL.Query().Get("quantity"))
+	if err != nil || quantity <= 0 {
+		quantity = 1
+	}
+
+	items, err := h.store.SuggestItems(type_ref, quantity)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting items: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"short": quantity - len(items),	// Missing stock
+	})
+}
+
+// handleCreateSalesOrder allocates the oldest stock for every line or creates nothing
+func (h *Handler) handleCreateSalesOrder(w http.ResponseWriter, r *http.Request) {
+	var payload types.SalesOrderPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	var err error
+	payload.OnlineShop, err = channel.Resolve(h.channelStore, payload.OnlineShop)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hold := h.hold
+	if payload.HoldHours > 0 {
+		hold = time.Duration(payload.HoldHours) * time.Hour
+	}
+	expires_at := time.Now().Add(hold)
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+		}
+	}()
+
+	order_id, err := h.store.CreateSalesOrder(payload, expires_at, userID, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating sales order: %v", err))
+		return
+	}
+
+	for _, line := range payload.Lines {
+		var line_id int
+		line_id, err = h.store.CreateSalesOrderLine(order_id, line, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error adding %s: %v", line.TypeRef, err))
+			return
+		}
+
+		if err = h.store.AllocateItems(order_id, line_id, line.TypeRef, line.Quantity, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error allocating %s: %v", line.TypeRef, err))
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"sales_order_id": order_id,
+		"expires_at": expires_at,
+	})
+}
+
+// handleGetSalesOrders takes an optional ?status=
+func (h *Handler) handleGetSalesOrders(w http.ResponseWriter, r *http.Request) {
+	orders, err := h.store.GetSalesOrders(r.URL.Query().Get("status"))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting sales orders: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"sales_orders": orders,
+	})
+}
+
+// handleGetSalesOrder is the pick list, items are in the order they should be taken off the shelf
+func (h *Handler) handleGetSalesOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	order, err := h.store.GetSalesOrderByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("sales order not found: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, order)
+}
+
+// handleScanItems confirms picked items. Scanning another unsold unit of the same type takes the place of
+// an unconfirmed pick. Once everything is confirmed the order is invoiced in the same transaction
+func (h *Handler) handleScanItems(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.ScanSalesOrderPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	order, err := h.store.GetSalesOrderByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("sales order not found: %v", err))
+		return
+	}
+
+	if order.Status != types.SalesOrderOpen {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("sales order is %s", order.Status))
+		return
+	}
+
+	if !order.ExpiresAt.After(time.Now()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("sales order expired at %s", order.ExpiresAt.Format(time.RFC3339)))
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	var onCommit func()
+
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("failed to rollback transaction: %v", rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			log.Printf("failed to commit transaction: %v", commitErr)
+			return
+		}
+		if onCommit != nil {
+			onCommit()
+		}
+	}()
+
+	for _, serial_num := range payload.SerialNums {
+		var item *types.Item
+		item, err = h.itemStore.GetItemBySN(serial_num, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("item %s not found: %v", serial_num, err))
+			return
+		}
+
+		if picked := findItem(order, item.ID); picked != nil {
+			if picked.Confirmed {
+				err = fmt.Errorf("item %s was already scanned", serial_num)
+				utils.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			if err = h.store.ConfirmItem(id, item.ID, tx, ctx); err != nil {
+				utils.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			picked.Confirmed = true
+			continue
+		}
+
+		if item.Status != "not sold" {
+			err = fmt.Errorf("item %s is %s", serial_num, item.Status)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		replaced := lastUnconfirmed(order, item.TypeRef)
+		if replaced == nil {
+			err = fmt.Errorf("order has no unscanned %s left for %s", item.TypeRef, serial_num)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = h.store.SwapItem(id, replaced.ItemID, item.ID, tx, ctx); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		*replaced = types.SalesOrderItem{
+			ItemID: item.ID,
+			SerialNumber: item.SerialNumber,
+			RFIDTag: item.RFIDTag,
+			Batch: item.Batch,
+			Confirmed: true,
+		}
+	}
+
+	remaining, err := h.store.CountUnconfirmed(id, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	if remaining > 0 {
+		utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"remaining": remaining,
+		})
+		return
+	}
+
+	invoice_id, err := h.itemStore.CreateInvoice(order.InvoiceStr, order.OnlineShop, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating invoice: %v", err))
+		return
+	}
+
+	item_ids, err := h.store.CloseSalesOrder(id, types.SalesOrderCompleted, &invoice_id, tx, ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	for _, item_id := range item_ids {
+		err = h.itemStore.NewItemSold(types.SoldItem{
+			ItemID: item_id,
+			InvoiceID: invoice_id,
+			OnlineShop: order.OnlineShop,
+		}, tx, ctx)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error registering sold item: %v", err))
+			return
+		}
+	}
+
+	serial_nums := []string{}
+	for _, line := range order.Lines {
+		for _, item := range line.Items {
+			serial_nums = append(serial_nums, item.SerialNumber)
+		}
+	}
+
+	onCommit = func() {
+		h.events.Publish(types.TopicSales, "sale.created", map[string]interface{}{
+			"invoice_id": invoice_id,
+			"invoice": order.InvoiceStr,
+			"ol_shop": order.OnlineShop,
+			"serial_numbers": serial_nums,
+			"sales_order_id": id,
+		})
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"remaining": 0,
+		"invoice_id": invoice_id,
+	})
+}
+
+// handleCancelSalesOrder closes an open order and puts the items it still holds back on sale
+func (h *Handler) handleCancelSalesOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := h.store.BeginTransaction(ctx)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting transaction: %v", err))
+		return
+	}
+
+	item_ids, err := h.store.CloseSalesOrder(id, types.SalesOrderCancelled, nil, tx, ctx)
+	if err != nil {
+		tx.Rollback()
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error cancelling sales order: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicItems, "sales_order.cancelled", map[string]interface{}{
+		"sales_order_id": id,
+		"item_ids": item_ids,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, "Sales order cancelled")
+}
+
+func findItem(order *types.SalesOrder, item_id int) *types.SalesOrderItem {
+	for i := range order.Lines {
+		for j := range order.Lines[i].Items {
+			if order.Lines[i].Items[j].ItemID == item_id {
+				return &order.Lines[i].Items[j]
+			}
+		}
+	}
+
+	return nil
+}
+
+// lastUnconfirmed picks the newest unscanned item of the type, so a substitute displaces the pick that was
+// least urgent to sell
+func lastUnconfirmed(order *types.SalesOrder, type_ref string) *types.SalesOrderItem {
+	var found *types.SalesOrderItem
+
+	for i := range order.Lines {
+		if order.Lines[i].TypeRef != type_ref {
+			continue
+		}
+
+		for j := range order.Lines[i].Items {
+			if !order.Lines[i].Items[j].Confirmed {
+				found = &order.Lines[i].Items[j]
+			}
+		}
+	}
+
+	return found
+}
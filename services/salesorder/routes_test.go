@@ -0,0 +1,233 @@
+package salesorder
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/internal/txtest"
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// memoryStore keeps orders and item statuses the way the sales order tables would, calling anything else
+// panics on the nil interface
+type memoryStore struct {
+	types.SalesOrderStore
+	db		*sql.DB
+	orders	map[int]*types.SalesOrder
+	items	map[int]string	// Item status by ID
+}
+
+func newMemoryStore(t *testing.T) *memoryStore {
+	return &memoryStore{
+		db: txtest.Open(t),
+		orders: make(map[int]*types.SalesOrder),
+		items: make(map[int]string),
+	}
+}
+
+// open adds an order holding the given items, expiring after hold
+func (s *memoryStore) open(id int, hold time.Duration, item_ids ...int) {
+	line := types.SalesOrderLine{ID: id, TypeRef: "RB750GR3", Quantity: len(item_ids)}
+	for _, item_id := range item_ids {
+		s.items[item_id] = types.ItemAllocated
+		line.Items = append(line.Items, types.SalesOrderItem{ItemID: item_id})
+	}
+
+	s.orders[id] = &types.SalesOrder{ID: id, InvoiceStr: "INV/SO", OnlineShop: "tokopedia", Status: types.SalesOrderOpen,
+		ExpiresAt: time.Now().Add(hold), Lines: []types.SalesOrderLine{line}}
+}
+
+// release puts the order's allocated items back on sale
+func (s *memoryStore) release(order *types.SalesOrder) []int {
+	var item_ids []int
+	for _, line := range order.Lines {
+		for _, item := range line.Items {
+			if s.items[item.ItemID] == types.ItemAllocated {
+				s.items[item.ItemID] = "not sold"
+				item_ids = append(item_ids, item.ItemID)
+			}
+		}
+	}
+	return item_ids
+}
+
+func (s *memoryStore) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+func (s *memoryStore) CreateSalesOrder(payload types.SalesOrderPayload, expires_at time.Time, created_by int, tx *sql.Tx, ctx context.Context) (int, error) {
+	id := len(s.orders) + 1
+	s.orders[id] = &types.SalesOrder{ID: id, InvoiceStr: payload.Invoice, OnlineShop: payload.OnlineShop, Status: types.SalesOrderOpen, ExpiresAt: expires_at}
+	return id, nil
+}
+
+func (s *memoryStore) CreateSalesOrderLine(order_id int, line types.SalesOrderLinePayload, tx *sql.Tx, ctx context.Context) (int, error) {
+	return 1, nil
+}
+
+func (s *memoryStore) AllocateItems(order_id int, line_id int, type_ref string, quantity int, tx *sql.Tx, ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) GetSalesOrderByID(id int) (*types.SalesOrder, error) {
+	order, ok := s.orders[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	copied := *order
+	return &copied, nil
+}
+
+func (s *memoryStore) CloseSalesOrder(id int, status string, invoice_id *int, tx *sql.Tx, ctx context.Context) ([]int, error) {
+	order, ok := s.orders[id]
+	if !ok || order.Status != types.SalesOrderOpen {
+		return nil, sql.ErrNoRows
+	}
+
+	order.Status = status
+	return s.release(order), nil
+}
+
+func (s *memoryStore) ExpireSalesOrders(now time.Time) ([]int, error) {
+	var ids []int
+	for id, order := range s.orders {
+		if order.Status == types.SalesOrderOpen && !order.ExpiresAt.After(now) {
+			order.Status = types.SalesOrderExpired
+			s.release(order)
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+type channelStore struct {
+	types.ChannelStore
+}
+
+func (s *channelStore) GetChannelByName(name string) (*types.Channel, error) {
+	return &types.Channel{Name: name, Active: true}, nil
+}
+
+type recorder struct {
+	events	[]string
+	data	[]any
+}
+
+func (r *recorder) Publish(topic string, eventType string, data any) {
+	r.events = append(r.events, eventType)
+	r.data = append(r.data, data)
+}
+
+func newTestHandler(t *testing.T) (*Handler, *memoryStore, *recorder) {
+	store := newMemoryStore(t)
+	events := &recorder{}
+	return NewHandler(store, nil, &channelStore{}, nil, events, 72 * time.Hour), store, events
+}
+
+func TestCreateSalesOrderHold(t *testing.T) {
+	tests := []struct {
+		name	string
+		body	string
+		hold	time.Duration
+	}{
+		{"default hold", `{"invoice": "INV/1", "ol_shop": "tokopedia", "lines": [{"type_ref": "RB750GR3", "quantity": 2}]}`, 72 * time.Hour},
+		{"hold from the request", `{"invoice": "INV/2", "ol_shop": "tokopedia", "hold_hours": 4, "lines": [{"type_ref": "RB750GR3", "quantity": 1}]}`, 4 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store, _ := newTestHandler(t)
+
+			r := httptest.NewRequest("POST", "/api/sales-order/create", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), auth.UserKey, 1))
+			w := httptest.NewRecorder()
+			h.handleCreateSalesOrder(w, r)
+
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create = %d %s", w.Code, w.Body.String())
+			}
+
+			left := time.Until(store.orders[1].ExpiresAt)
+			if left > tt.hold || left < tt.hold - time.Minute {
+				t.Fatalf("order expires in %v, want %v", left, tt.hold)
+			}
+		})
+	}
+}
+
+func TestCancelSalesOrder(t *testing.T) {
+	h, store, events := newTestHandler(t)
+	store.open(1, time.Hour, 10, 11)
+
+	cancel := func() *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/api/sales-order/1/cancel", nil), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		h.handleCancelSalesOrder(w, r)
+		return w
+	}
+
+	if w := cancel(); w.Code != http.StatusOK {
+		t.Fatalf("cancel = %d %s", w.Code, w.Body.String())
+	}
+
+	if store.items[10] != "not sold" || store.items[11] != "not sold" {
+		t.Fatalf("items = %v, want both back on sale", store.items)
+	}
+
+	payload, _ := json.Marshal(events.data)
+	if len(events.events) != 1 || events.events[0] != "sales_order.cancelled" || !strings.Contains(string(payload), `"item_ids":[10,11]`) {
+		t.Fatalf("published %v %s", events.events, payload)
+	}
+
+	if w := cancel(); w.Code != http.StatusBadRequest {
+		t.Fatalf("second cancel = %d, want 400", w.Code)
+	}
+}
+
+func TestScanExpiredSalesOrder(t *testing.T) {
+	h, store, _ := newTestHandler(t)
+	store.open(1, -time.Minute, 10)
+
+	r := httptest.NewRequest("POST", "/api/sales-order/1/scan", strings.NewReader(`{"serial_numbers": ["SN-10"]}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	h.handleScanItems(w, r)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "expired") {
+		t.Fatalf("scan = %d %s, want the lapsed order refused", w.Code, w.Body.String())
+	}
+}
+
+func TestExpirer(t *testing.T) {
+	store := newMemoryStore(t)
+	store.open(1, -time.Minute, 10, 11)
+	store.open(2, time.Hour, 12)
+	events := &recorder{}
+
+	NewExpirer(store, events, time.Minute).ExpireOnce()
+
+	if store.orders[1].Status != types.SalesOrderExpired || store.items[10] != "not sold" || store.items[11] != "not sold" {
+		t.Fatalf("abandoned order is %s with items %v, want expired and released", store.orders[1].Status, store.items)
+	}
+	if store.orders[2].Status != types.SalesOrderOpen || store.items[12] != types.ItemAllocated {
+		t.Fatalf("order still in its hold is %s with items %v", store.orders[2].Status, store.items)
+	}
+	if len(events.events) != 1 || events.events[0] != "sales_order.expired" {
+		t.Fatalf("published %v", events.events)
+	}
+
+	// Nothing left to expire
+	NewExpirer(store, events, time.Minute).ExpireOnce()
+	if len(events.events) != 1 {
+		t.Fatalf("published %v after a second sweep", events.events)
+	}
+}
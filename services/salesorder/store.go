@@ -0,0 +1,416 @@
+package salesorder
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *Store) CreateSalesOrder(payload types.SalesOrderPayload, expires_at time.Time, created_by int, tx *sql.Tx, ctx context.Context) (int, error) {
+	order_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO sales_orders (invoice_str, ol_shop, customer_name, expires_at, created_by)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5) RETURNING id`,
+		payload.Invoice, payload.OnlineShop, payload.CustomerName, expires_at, created_by,
+	).Scan(&order_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return order_id, nil
+}
+
+func (s *Store) CreateSalesOrderLine(order_id int, line types.SalesOrderLinePayload, tx *sql.Tx, ctx context.Context) (int, error) {
+	line_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO sales_order_lines (order_id, type_ref, quantity) VALUES ($1, $2, $3) RETURNING id",
+		order_id, line.TypeRef, line.Quantity,
+	).Scan(&line_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return line_id, nil
+}
+
+// fifoOrder is the order stock leaves the warehouse in, oldest batch first
+const fifoOrder = "batch ASC, createdat ASC, id ASC"
+
+// SuggestItems lists the items an order for the type would get right now without holding them
+func (s *Store) SuggestItems(type_ref string, quantity int) ([]types.SalesOrderItem, error) {
+	items := []types.SalesOrderItem{}
+
+	rows, err := s.db.Query(`SELECT id, serial_number, rfid_tag, batch, createdat FROM items
+							 WHERE type_ref = $1 AND status = $2 ORDER BY `+fifoOrder+` LIMIT $3`,
+		type_ref, "not sold", quantity,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var item types.SalesOrderItem
+
+		if err := rows.Scan(&item.ItemID, &item.SerialNumber, &item.RFIDTag, &item.Batch, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// AllocateItems holds the oldest unsold items of the type for the line, skipping rows another sale is
+// holding a lock on. Fails when there is not enough stock
+func (s *Store) AllocateItems(order_id int, line_id int, type_ref string, quantity int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx,
+		`WITH picked AS (
+			UPDATE items SET status = $1 WHERE id IN (
+				SELECT id FROM items WHERE type_ref = $2 AND status = $3
+				ORDER BY `+fifoOrder+` LIMIT $4 FOR UPDATE SKIP LOCKED
+			) RETURNING id
+		)
+		INSERT INTO sales_order_items (line_id, item_id) SELECT $5, id FROM picked`,
+		types.ItemAllocated, type_ref, "not sold", quantity, line_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected < int64(quantity) {
+		return fmt.Errorf("only %d of %d %s in stock", rowsAffected, quantity, type_ref)
+	}
+
+	return nil
+}
+
+const salesOrderColumns = `id, invoice_str, ol_shop, COALESCE(customer_name, ''), status, invoice_id, expires_at, created_by,
+	createdat, closed_at`
+
+func scanSalesOrder(row interface{ Scan(dest ...any) error }) (*types.SalesOrder, error) {
+	var order types.SalesOrder
+
+	err := row.Scan(&order.ID, &order.InvoiceStr, &order.OnlineShop, &order.CustomerName, &order.Status,
+		&order.InvoiceID, &order.ExpiresAt, &order.CreatedBy, &order.CreatedAt, &order.ClosedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	order.Lines = []types.SalesOrderLine{}
+
+	return &order, nil
+}
+
+// GetSalesOrders returns orders newest first, an empty status returns all of them
+func (s *Store) GetSalesOrders(status string) ([]types.SalesOrder, error) {
+	rows, err := s.db.Query(`SELECT `+salesOrderColumns+` FROM sales_orders
+							 WHERE $1 = '' OR status = $1 ORDER BY createdat DESC`, status)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var orders []*types.SalesOrder
+
+	for rows.Next() {
+		order, err := scanSalesOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadLines(orders); err != nil {
+		return nil, err
+	}
+
+	result := make([]types.SalesOrder, 0, len(orders))
+	for _, order := range orders {
+		result = append(result, *order)
+	}
+
+	return result, nil
+}
+
+func (s *Store) GetSalesOrderByID(id int) (*types.SalesOrder, error) {
+	order, err := scanSalesOrder(s.db.QueryRow("SELECT "+salesOrderColumns+" FROM sales_orders WHERE id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadLines([]*types.SalesOrder{order}); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (s *Store) loadLines(orders []*types.SalesOrder) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*types.SalesOrder)
+	ids := make([]string, 0, len(orders))
+	for _, order := range orders {
+		byID[order.ID] = order
+		ids = append(ids, fmt.Sprint(order.ID))
+	}
+
+	// Lines and their items come back together, a line without items yet has a NULL item
+	rows, err := s.db.Query(`SELECT l.order_id, l.id, l.type_ref, l.quantity,
+							 i.id, i.serial_number, i.rfid_tag, i.batch, i.createdat, si.confirmed
+							 FROM sales_order_lines l
+							 LEFT JOIN sales_order_items si ON si.line_id = l.id
+							 LEFT JOIN items i ON si.item_id = i.id
+							 WHERE l.order_id = ANY(string_to_array($1, ',')::int[])
+							 ORDER BY l.id, i.batch, i.createdat, i.id`,
+		strings.Join(ids, ","),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var order_id int
+		var line types.SalesOrderLine
+		var item_id, batch sql.NullInt64
+		var serial_number, rfid_tag sql.NullString
+		var createdat sql.NullTime
+		var confirmed sql.NullBool
+
+		err := rows.Scan(&order_id, &line.ID, &line.TypeRef, &line.Quantity,
+			&item_id, &serial_number, &rfid_tag, &batch, &createdat, &confirmed,
+		)
+		if err != nil {
+			return err
+		}
+
+		order := byID[order_id]
+		if n := len(order.Lines); n == 0 || order.Lines[n-1].ID != line.ID {
+			line.Items = []types.SalesOrderItem{}
+			order.Lines = append(order.Lines, line)
+		}
+
+		if !item_id.Valid {
+			continue
+		}
+
+		current := &order.Lines[len(order.Lines)-1]
+		current.Items = append(current.Items, types.SalesOrderItem{
+			ItemID: int(item_id.Int64),
+			SerialNumber: serial_number.String,
+			RFIDTag: rfid_tag.String,
+			Batch: int(batch.Int64),
+			CreatedAt: createdat.Time,
+			Confirmed: confirmed.Bool,
+		})
+	}
+
+	return rows.Err()
+}
+
+func (s *Store) ConfirmItem(order_id int, item_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx,
+		`UPDATE sales_order_items SET confirmed = true WHERE item_id = $1 AND NOT confirmed
+		AND line_id IN (SELECT id FROM sales_order_lines WHERE order_id = $2)`,
+		item_id, order_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is not waiting to be scanned on this order", item_id)
+	}
+
+	return nil
+}
+
+// SwapItem replaces an unconfirmed pick with an item staff scanned instead, the new item is confirmed
+// straight away and the old one goes back on sale
+func (s *Store) SwapItem(order_id int, old_item_id int, new_item_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE items SET status = $1 WHERE id = $2 AND status = $3",
+		types.ItemAllocated, new_item_id, "not sold",
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is no longer for sale", new_item_id)
+	}
+
+	res, err = tx.ExecContext(ctx,
+		`UPDATE sales_order_items SET item_id = $1, confirmed = true WHERE item_id = $2 AND NOT confirmed
+		AND line_id IN (SELECT id FROM sales_order_lines WHERE order_id = $3)`,
+		new_item_id, old_item_id, order_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is not waiting to be scanned on this order", old_item_id)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE items SET status = $1 WHERE id = $2 AND status = $3",
+		"not sold", old_item_id, types.ItemAllocated,
+	)
+	return err
+}
+
+func (s *Store) CountUnconfirmed(order_id int, tx *sql.Tx, ctx context.Context) (int, error) {
+	count := 0
+
+	err := tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM sales_order_items si JOIN sales_order_lines l ON si.line_id = l.id
+		WHERE l.order_id = $1 AND NOT si.confirmed`, order_id,
+	).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CloseSalesOrder ends an open order and puts its items back on sale, returning their IDs. When completing,
+// the caller sells the items in the same transaction and the hold must not have lapsed
+func (s *Store) CloseSalesOrder(id int, status string, invoice_id *int, tx *sql.Tx, ctx context.Context) ([]int, error) {
+	query := `UPDATE sales_orders SET status = $1, invoice_id = $2, closed_at = CURRENT_TIMESTAMP WHERE id = $3 AND status = $4`
+	if status == types.SalesOrderCompleted {
+		query += " AND expires_at > now()"
+	}
+
+	res, err := tx.ExecContext(ctx, query, status, invoice_id, id, types.SalesOrderOpen)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("sales order not found, no longer open or expired")
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`UPDATE items SET status = $1 WHERE status = $2 AND id IN (
+			SELECT si.item_id FROM sales_order_items si JOIN sales_order_lines l ON si.line_id = l.id WHERE l.order_id = $3
+		) RETURNING id`,
+		"not sold", types.ItemAllocated, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var item_ids []int
+
+	for rows.Next() {
+		var item_id int
+		if err := rows.Scan(&item_id); err != nil {
+			return nil, err
+		}
+		item_ids = append(item_ids, item_id)
+	}
+
+	return item_ids, rows.Err()
+}
+
+// ExpireSalesOrders closes every open order past its hold and puts the allocated items back on sale in one
+// statement, returning the order IDs
+func (s *Store) ExpireSalesOrders(now time.Time) ([]int, error) {
+	rows, err := s.db.Query(
+		`WITH expired AS (
+			UPDATE sales_orders SET status = $1, closed_at = $2 WHERE status = $3 AND expires_at <= $2 RETURNING id
+		), released AS (
+			UPDATE items SET status = 'not sold' WHERE status = $4 AND id IN (
+				SELECT si.item_id FROM sales_order_items si JOIN sales_order_lines l ON si.line_id = l.id
+				JOIN expired e ON l.order_id = e.id
+			)
+		)
+		SELECT id FROM expired ORDER BY id`,
+		types.SalesOrderExpired, now, types.SalesOrderOpen, types.ItemAllocated,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []int
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,121 @@
+package shipment
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.ShipmentStore
+	userStore types.UserStore
+	events types.EventPublisher
+}
+
+func NewHandler(store types.ShipmentStore, userStore types.UserStore, events types.EventPublisher) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+		events: events,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/invoice/{invoice_id}", auth.MobileAuth(h.handleGetInvoiceShipments, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/edit/{id}", auth.WithJWTAuth(h.handleEditShipment, h.userStore)).Methods("PATCH")
+	router.HandleFunc("/mark-delivered/{id}", auth.WithJWTAuth(h.handleMarkDelivered, h.userStore)).Methods("PATCH")
+}
+
+func (h *Handler) handleGetInvoiceShipments(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	shipments, err := h.store.GetShipmentsByInvoice(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting shipments: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"shipments": shipments,
+	})
+}
+
+func (h *Handler) handleEditShipment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.ShipmentPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if len(payload.RFIDTags) > 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("items of a shipment cannot be changed"))
+		return
+	}
+
+	if payload.ShippingCost.Currency != "" && payload.ShippingCost.Currency != types.BaseCurrency {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("shipping cost must be in %s", types.BaseCurrency))
+		return
+	}
+
+	if _, err := h.store.GetShipmentByID(id); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("shipment not found: %v", err))
+		return
+	}
+
+	if err := h.store.EditShipment(id, payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Shipment updated")
+}
+
+// handleMarkDelivered is for couriers the tracking provider does not cover
+func (h *Handler) handleMarkDelivered(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	shipment, err := h.store.GetShipmentByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("shipment not found: %v", err))
+		return
+	}
+
+	if err := h.store.MarkShipmentDelivered(id, time.Now()); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	h.events.Publish(types.TopicShipments, "shipment.delivered", map[string]interface{}{
+		"invoice_id": shipment.InvoiceID,
+		"shipment_id": shipment.ID,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, "Shipment delivered")
+}
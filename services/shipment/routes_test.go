@@ -0,0 +1,131 @@
+package shipment
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// memoryStore is the part of ShipmentStore the handlers use, calling anything else panics on the nil interface
+type memoryStore struct {
+	types.ShipmentStore
+	shipments	map[int]*types.Shipment
+	edited		[]types.ShipmentPayload
+}
+
+func (s *memoryStore) GetShipmentByID(id int) (*types.Shipment, error) {
+	shipment, ok := s.shipments[id]
+	if !ok {
+		return nil, errors.New("sql: no rows in result set")
+	}
+	return shipment, nil
+}
+
+func (s *memoryStore) EditShipment(id int, payload types.ShipmentPayload) error {
+	// The real store writes the cost through Money.Value, which refuses foreign amounts
+	if _, err := payload.ShippingCost.Value(); err != nil {
+		return err
+	}
+	s.edited = append(s.edited, payload)
+	return nil
+}
+
+func (s *memoryStore) MarkShipmentDelivered(shipment_id int, delivered_at time.Time) error {
+	shipment := s.shipments[shipment_id]
+	if shipment.Status != types.ShipmentShipped {
+		return errors.New("shipment not found or already delivered")
+	}
+	shipment.Status = types.ShipmentDelivered
+	shipment.DeliveredAt = &delivered_at
+	return nil
+}
+
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Publish(topic string, eventType string, data any) {
+	r.events = append(r.events, eventType)
+}
+
+func newTestHandler() (*Handler, *memoryStore, *recorder) {
+	store := &memoryStore{shipments: map[int]*types.Shipment{
+		1: {ID: 1, InvoiceID: 7, Status: types.ShipmentShipped},
+	}}
+	events := &recorder{}
+
+	return NewHandler(store, nil, events), store, events
+}
+
+func TestEditShipment(t *testing.T) {
+	tests := []struct {
+		name	string
+		id		string
+		body	string
+		status	int
+	}{
+		{"courier details", "1", `{"courier": "jne", "tracking_number": "JNE001", "shipping_cost": 18000}`, http.StatusOK},
+		{"cost in rupiah", "1", `{"shipping_cost": {"amount": "18000", "currency": "IDR"}}`, http.StatusOK},
+		{"foreign cost", "1", `{"shipping_cost": {"amount": "12.50", "currency": "USD"}}`, http.StatusBadRequest},
+		{"negative weight", "1", `{"package_weight": -1}`, http.StatusBadRequest},
+		{"changing the items", "1", `{"rfid_tags": ["TAG-1"]}`, http.StatusBadRequest},
+		{"unknown shipment", "2", `{"courier": "jne"}`, http.StatusNotFound},
+		{"not JSON", "1", `courier=jne`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store, _ := newTestHandler()
+
+			r := httptest.NewRequest("PATCH", "/api/shipment/edit/"+tt.id, strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": tt.id})
+			w := httptest.NewRecorder()
+			h.handleEditShipment(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("edit = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if edited := len(store.edited) == 1; edited != (tt.status == http.StatusOK) {
+				t.Fatalf("edits = %+v", store.edited)
+			}
+		})
+	}
+}
+
+func TestMarkDelivered(t *testing.T) {
+	h, store, events := newTestHandler()
+
+	deliver := func(id string) int {
+		r := mux.SetURLVars(httptest.NewRequest("PATCH", "/api/shipment/mark-delivered/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		h.handleMarkDelivered(w, r)
+		return w.Code
+	}
+
+	if code := deliver("1"); code != http.StatusOK {
+		t.Fatalf("mark delivered = %d", code)
+	}
+	if store.shipments[1].Status != types.ShipmentDelivered || store.shipments[1].DeliveredAt == nil {
+		t.Fatalf("shipment = %+v, want delivered", store.shipments[1])
+	}
+	if len(events.events) != 1 || events.events[0] != "shipment.delivered" {
+		t.Fatalf("events = %v", events.events)
+	}
+
+	// A second delivery of the same parcel and an unknown parcel publish nothing
+	if code := deliver("1"); code != http.StatusBadRequest {
+		t.Fatalf("delivering twice = %d, want 400", code)
+	}
+	if code := deliver("2"); code != http.StatusNotFound {
+		t.Fatalf("unknown shipment = %d, want 404", code)
+	}
+	if len(events.events) != 1 {
+		t.Fatalf("events = %v", events.events)
+	}
+}
@@ -0,0 +1,327 @@
+package shipment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+// Optional courier columns are NULL when the parcel went out without tracking details
+const shipmentColumns = `id, invoice_id, status, COALESCE(courier, ''), COALESCE(courier_service, ''),
+	COALESCE(tracking_number, ''), COALESCE(package_weight, 0), COALESCE(shipping_cost, 0),
+	COALESCE(tracking_status, ''), shipped_at, delivered_at`
+
+func scanShipment(row interface{ Scan(dest ...any) error }) (*types.Shipment, error) {
+	var shipment types.Shipment
+
+	err := row.Scan(&shipment.ID, &shipment.InvoiceID, &shipment.Status, &shipment.Courier, &shipment.CourierService,
+		&shipment.TrackingNumber, &shipment.PackageWeight, &shipment.ShippingCost, &shipment.TrackingStatus,
+		&shipment.ShippedAt, &shipment.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	shipment.RFIDTags = []string{}
+
+	return &shipment, nil
+}
+
+func (s *Store) CreateShipment(invoice_id int, shipment types.ShipmentPayload, tx *sql.Tx, ctx context.Context) (int, error) {
+	shipment_id := 0
+
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO shipments (invoice_id, courier, courier_service, tracking_number, package_weight, shipping_cost)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0)) RETURNING id`,
+		invoice_id, shipment.Courier, shipment.CourierService, shipment.TrackingNumber,
+		shipment.PackageWeight, shipment.ShippingCost,
+	).Scan(&shipment_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return shipment_id, nil
+}
+
+func (s *Store) AssignShipment(shipment_id int, item_id int, tx *sql.Tx, ctx context.Context) error {
+	res, err := tx.ExecContext(ctx, "UPDATE sold_items SET shipment_id = $1 WHERE item_id = $2 AND shipment_id IS NULL",
+		shipment_id, item_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item %d is already shipped", item_id)
+	}
+
+	return nil
+}
+
+// RefreshInvoiceShipStatus recomputes the invoice status from its items' shipments, partially-shipped while an item
+// has none, delivered once every parcel has arrived and shipped otherwise. The first shipped_at is kept
+func (s *Store) RefreshInvoiceShipStatus(invoice_id int, tx *sql.Tx, ctx context.Context) (string, error) {
+	var remaining, shipped, in_transit int
+
+	err := tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FILTER (WHERE s.shipment_id IS NULL), COUNT(*) FILTER (WHERE s.shipment_id IS NOT NULL),
+		COUNT(*) FILTER (WHERE sh.status = $2)
+		FROM sold_items s LEFT JOIN shipments sh ON sh.id = s.shipment_id WHERE s.invoice_id = $1`,
+		invoice_id, types.ShipmentShipped,
+	).Scan(&remaining, &shipped, &in_transit)
+	if err != nil {
+		return "", err
+	}
+
+	if shipped == 0 {
+		return "", fmt.Errorf("invoice %d has no shipped items", invoice_id)
+	}
+
+	status := types.InvoiceShipped
+	if remaining > 0 {
+		status = types.InvoicePartiallyShipped
+	} else if in_transit == 0 {
+		status = types.InvoiceDelivered
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE invoice SET status = $1,
+			shipped_at = CASE WHEN $1 = $2 THEN shipped_at ELSE COALESCE(shipped_at, CURRENT_TIMESTAMP) END,
+			delivered_at = CASE WHEN $1 = $3 THEN COALESCE(delivered_at, (
+				SELECT MAX(sh.delivered_at) FROM shipments sh JOIN sold_items s ON s.shipment_id = sh.id WHERE s.invoice_id = $4
+			)) END
+		WHERE id = $4`,
+		status, types.InvoicePartiallyShipped, types.InvoiceDelivered, invoice_id,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+func (s *Store) GetShipmentByID(id int) (*types.Shipment, error) {
+	shipment, err := scanShipment(s.db.QueryRow("SELECT "+shipmentColumns+" FROM shipments WHERE id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadTags([]*types.Shipment{shipment}); err != nil {
+		return nil, err
+	}
+
+	return shipment, nil
+}
+
+func (s *Store) GetShipmentsByInvoice(invoice_id int) ([]types.Shipment, error) {
+	rows, err := s.db.Query("SELECT "+shipmentColumns+" FROM shipments WHERE invoice_id = $1 ORDER BY id", invoice_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var shipments []*types.Shipment
+
+	for rows.Next() {
+		shipment, err := scanShipment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		shipments = append(shipments, shipment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadTags(shipments); err != nil {
+		return nil, err
+	}
+
+	result := make([]types.Shipment, 0, len(shipments))
+	for _, shipment := range shipments {
+		result = append(result, *shipment)
+	}
+
+	return result, nil
+}
+
+func (s *Store) loadTags(shipments []*types.Shipment) error {
+	if len(shipments) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*types.Shipment)
+	ids := make([]string, 0, len(shipments))
+	for _, shipment := range shipments {
+		byID[shipment.ID] = shipment
+		ids = append(ids, fmt.Sprint(shipment.ID))
+	}
+
+	rows, err := s.db.Query(`SELECT s.shipment_id, i.rfid_tag FROM sold_items s JOIN items i ON s.item_id = i.id
+							 WHERE s.shipment_id = ANY(string_to_array($1, ',')::int[]) ORDER BY i.id`,
+		strings.Join(ids, ","),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var shipment_id int
+		var tag string
+
+		if err := rows.Scan(&shipment_id, &tag); err != nil {
+			return err
+		}
+
+		byID[shipment_id].RFIDTags = append(byID[shipment_id].RFIDTags, tag)
+	}
+
+	return rows.Err()
+}
+
+// EditShipment fills in tracking details that are often only known after the parcel was handed to the courier
+func (s *Store) EditShipment(id int, payload types.ShipmentPayload) error {
+	var setClauses []string
+	var args []interface{}
+
+	argIndex := 1
+
+	if payload.Courier != "" {
+		setClauses = append(setClauses, fmt.Sprintf("courier = $%d", argIndex))
+		args = append(args, payload.Courier)
+		argIndex++
+	}
+
+	if payload.CourierService != "" {
+		setClauses = append(setClauses, fmt.Sprintf("courier_service = $%d", argIndex))
+		args = append(args, payload.CourierService)
+		argIndex++
+	}
+
+	if payload.TrackingNumber != "" {
+		setClauses = append(setClauses, fmt.Sprintf("tracking_number = $%d", argIndex))
+		args = append(args, payload.TrackingNumber)
+		argIndex++
+	}
+
+	if payload.PackageWeight != 0 {
+		setClauses = append(setClauses, fmt.Sprintf("package_weight = $%d", argIndex))
+		args = append(args, payload.PackageWeight)
+		argIndex++
+	}
+
+	if payload.ShippingCost.Amount != 0 {
+		setClauses = append(setClauses, fmt.Sprintf("shipping_cost = $%d", argIndex))
+		args = append(args, payload.ShippingCost)
+		argIndex++
+	}
+
+	if len(setClauses) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE shipments SET %s WHERE id = $%d",
+		strings.Join(setClauses, ", "), argIndex)
+
+	args = append(args, id)
+
+	_, err := s.db.Exec(query, args...)
+	return err
+}
+
+// GetTrackedShipments returns shipments with a tracking number that have not been delivered yet
+func (s *Store) GetTrackedShipments() ([]types.Shipment, error) {
+	var shipments []types.Shipment
+
+	rows, err := s.db.Query(`SELECT `+shipmentColumns+` FROM shipments
+							 WHERE status = $1 AND tracking_number IS NOT NULL AND courier IS NOT NULL
+							 ORDER BY tracking_checked_at ASC NULLS FIRST`, types.ShipmentShipped)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		shipment, err := scanShipment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		shipments = append(shipments, *shipment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return shipments, nil
+}
+
+func (s *Store) UpdateTrackingStatus(shipment_id int, status string) error {
+	_, err := s.db.Exec("UPDATE shipments SET tracking_status = $1, tracking_checked_at = CURRENT_TIMESTAMP WHERE id = $2",
+		status, shipment_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkShipmentDelivered also marks the invoice delivered when it is fully shipped and this was its last parcel in transit
+func (s *Store) MarkShipmentDelivered(shipment_id int, delivered_at time.Time) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	invoice_id := 0
+	err = tx.QueryRow(`UPDATE shipments SET status = $1, delivered_at = $2 WHERE id = $3 AND status = $4 RETURNING invoice_id`,
+		types.ShipmentDelivered, delivered_at, shipment_id, types.ShipmentShipped,
+	).Scan(&invoice_id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("shipment not found or already delivered")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE invoice SET status = $1, delivered_at = $2 WHERE id = $3 AND status = $4
+					  AND NOT EXISTS (SELECT 1 FROM shipments WHERE invoice_id = $3 AND status <> $5)`,
+		types.InvoiceDelivered, delivered_at, invoice_id, types.InvoiceShipped, types.ShipmentDelivered,
+	)
+	return err
+}
@@ -0,0 +1,177 @@
+package tax
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store types.TaxStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.TaxStore, userStore types.UserStore) *Handler {
+	return &Handler{
+		store: store,
+		userStore: userStore,
+	}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/rates", auth.WithJWTAuth(h.handleGetTaxRates, h.userStore)).Methods("GET")
+	router.HandleFunc("/rates", auth.WithRole(h.handleCreateTaxRate, h.userStore, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/rates/{id}", auth.WithRole(h.handleEditTaxRate, h.userStore, types.RoleAdmin)).Methods("PATCH")
+	router.HandleFunc("/item-type/{item_type}", auth.WithRole(h.handleSetItemTypeTax, h.userStore, types.RoleAdmin)).Methods("PUT")
+	router.HandleFunc("/invoice/{invoice_id}", auth.MobileAuth(h.handleGetInvoiceTax, h.userStore)).Methods("GET")	// Mobile App
+	router.HandleFunc("/summary", auth.WithRole(h.handleGetTaxSummary, h.userStore, types.RoleAdmin, types.RoleSupervisor)).Methods("GET")
+}
+
+func (h *Handler) handleGetTaxRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.store.GetTaxRates()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting tax rates: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"rates": rates,
+	})
+}
+
+func (h *Handler) handleCreateTaxRate(w http.ResponseWriter, r *http.Request) {
+	var payload types.TaxRatePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.CreateTaxRate(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error creating tax rate: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, "Tax rate created")
+}
+
+func (h *Handler) handleEditTaxRate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	var payload types.EditTaxRatePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.EditTaxRate(id, payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Tax rate updated")
+}
+
+func (h *Handler) handleSetItemTypeTax(w http.ResponseWriter, r *http.Request) {
+	var payload types.ItemTypeTaxPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.SetItemTypeTax(mux.Vars(r)["item_type"], payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Item type tax updated")
+}
+
+func (h *Handler) handleGetInvoiceTax(w http.ResponseWriter, r *http.Request) {
+	invoice_id, err := strconv.Atoi(mux.Vars(r)["invoice_id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error: %v", err))
+		return
+	}
+
+	lines, err := h.store.GetInvoiceTaxLines(invoice_id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting tax lines: %v", err))
+		return
+	}
+
+	invoice := types.InvoiceTax{
+		InvoiceID: invoice_id,
+		Lines: lines,
+	}
+
+	for _, line := range lines {
+		invoice.Subtotal = invoice.Subtotal.Add(line.Base)
+		invoice.Tax = invoice.Tax.Add(line.Tax)
+		invoice.Total = invoice.Total.Add(line.Gross)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, invoice)
+}
+
+// handleGetTaxSummary reports ?year= (default this year) month by month for the monthly PPN return
+func (h *Handler) handleGetTaxSummary(w http.ResponseWriter, r *http.Request) {
+	year := time.Now().Year()
+	if yearStr := r.URL.Query().Get("year"); yearStr != "" {
+		parsed, err := strconv.Atoi(yearStr)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid year: %v", err))
+			return
+		}
+		year = parsed
+	}
+
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+
+	summaries, err := h.store.GetTaxSummary(from, from.AddDate(1, 0, 0))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting tax summary: %v", err))
+		return
+	}
+
+	base, tax := types.BaseMoney(0), types.BaseMoney(0)
+	for _, summary := range summaries {
+		base = base.Add(summary.Base)
+		tax = tax.Add(summary.Tax)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"year": year,
+		"months": summaries,
+		"base": base,
+		"tax": tax,
+	})
+}
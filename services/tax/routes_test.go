@@ -0,0 +1,99 @@
+package tax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+// recordingStore takes whatever gets past the handler, calling anything else panics on the nil interface
+type recordingStore struct {
+	types.TaxStore
+	rates		map[int]types.EditTaxRatePayload
+	itemTypes	map[string]types.ItemTypeTaxPayload
+}
+
+func (s *recordingStore) EditTaxRate(id int, payload types.EditTaxRatePayload) error {
+	s.rates[id] = payload
+	return nil
+}
+
+func (s *recordingStore) SetItemTypeTax(item_type string, payload types.ItemTypeTaxPayload) error {
+	s.itemTypes[item_type] = payload
+	return nil
+}
+
+func newTestHandler() (*Handler, *recordingStore) {
+	store := &recordingStore{
+		rates: make(map[int]types.EditTaxRatePayload),
+		itemTypes: make(map[string]types.ItemTypeTaxPayload),
+	}
+	return NewHandler(store, nil), store
+}
+
+func TestEditTaxRate(t *testing.T) {
+	tests := []struct {
+		name	string
+		body	string
+		status	int
+	}{
+		{"rename", `{"name": "PPN 12%"}`, http.StatusOK},
+		{"deactivate", `{"active": false}`, http.StatusOK},
+		{"name too long", `{"name": "` + strings.Repeat("x", 101) + `"}`, http.StatusBadRequest},
+		{"not JSON", `name=PPN`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandler()
+
+			r := httptest.NewRequest("PATCH", "/api/tax/rates/1", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			h.handleEditTaxRate(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("edit = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if _, saved := store.rates[1]; saved != (tt.status == http.StatusOK) {
+				t.Fatalf("saved %v with status %d", saved, w.Code)
+			}
+		})
+	}
+}
+
+func TestSetItemTypeTax(t *testing.T) {
+	tests := []struct {
+		name	string
+		body	string
+		status	int
+	}{
+		{"override", `{"tax_rate_id": 2, "price_includes_tax": false}`, http.StatusOK},
+		{"clear the override", `{"tax_rate_id": null, "price_includes_tax": null}`, http.StatusOK},
+		{"zero rate id", `{"tax_rate_id": 0}`, http.StatusBadRequest},
+		{"negative rate id", `{"tax_rate_id": -3}`, http.StatusBadRequest},
+		{"rate id as text", `{"tax_rate_id": "2"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandler()
+
+			r := httptest.NewRequest("PUT", "/api/tax/item-type/RB750GR3", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"item_type": "RB750GR3"})
+			w := httptest.NewRecorder()
+			h.handleSetItemTypeTax(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("set = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if _, saved := store.itemTypes["RB750GR3"]; saved != (tt.status == http.StatusOK) {
+				t.Fatalf("saved %v with status %d", saved, w.Code)
+			}
+		})
+	}
+}
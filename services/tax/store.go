@@ -0,0 +1,229 @@
+package tax
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db: db,
+	}
+}
+
+func (s *Store) GetTaxRates() ([]types.TaxRate, error) {
+	var rates []types.TaxRate
+
+	rows, err := s.db.Query("SELECT id, name, rate, is_default, active FROM tax_rates ORDER BY is_default DESC, name")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rate types.TaxRate
+
+		if err := rows.Scan(&rate.ID, &rate.Name, &rate.Rate, &rate.IsDefault, &rate.Active); err != nil {
+			return nil, err
+		}
+
+		rates = append(rates, rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// CreateTaxRate takes over as the default when asked to, there is only ever one default
+func (s *Store) CreateTaxRate(payload types.TaxRatePayload) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if payload.IsDefault {
+		if _, err = tx.Exec("UPDATE tax_rates SET is_default = false WHERE is_default"); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO tax_rates (name, rate, is_default) VALUES ($1, $2, $3)",
+		strings.TrimSpace(payload.Name), payload.Rate, payload.IsDefault,
+	)
+	return err
+}
+
+func (s *Store) EditTaxRate(id int, payload types.EditTaxRatePayload) (err error) {
+	var setClauses []string
+	var args []interface{}
+
+	argIndex := 1
+
+	if strings.TrimSpace(payload.Name) != "" {
+		setClauses = append(setClauses, fmt.Sprintf("name = $%d", argIndex))
+		args = append(args, strings.TrimSpace(payload.Name))
+		argIndex++
+	}
+
+	if payload.IsDefault != nil {
+		setClauses = append(setClauses, fmt.Sprintf("is_default = $%d", argIndex))
+		args = append(args, *payload.IsDefault)
+		argIndex++
+	}
+
+	if payload.Active != nil {
+		setClauses = append(setClauses, fmt.Sprintf("active = $%d", argIndex))
+		args = append(args, *payload.Active)
+		argIndex++
+	}
+
+	if len(setClauses) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE tax_rates SET %s WHERE id = $%d",
+		strings.Join(setClauses, ", "), argIndex)
+
+	args = append(args, id)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if payload.IsDefault != nil && *payload.IsDefault {
+		if _, err = tx.Exec("UPDATE tax_rates SET is_default = false WHERE is_default AND id <> $1", id); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("tax rate not found")
+	}
+
+	return nil
+}
+
+func (s *Store) SetItemTypeTax(item_type string, payload types.ItemTypeTaxPayload) error {
+	res, err := s.db.Exec("UPDATE item_type SET tax_rate_id = $1, price_includes_tax = $2 WHERE item_type = $3",
+		payload.TaxRateID, payload.PriceIncludesTax, item_type,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("item type not found")
+	}
+
+	return nil
+}
+
+func (s *Store) GetInvoiceTaxLines(invoice_id int) ([]types.TaxLine, error) {
+	lines := []types.TaxLine{}
+
+	rows, err := s.db.Query(`SELECT tax_rate, price_includes_tax, COUNT(*), SUM(base), SUM(tax), SUM(gross)
+							 FROM sold_item_amounts WHERE invoice_id = $1
+							 GROUP BY tax_rate, price_includes_tax
+							 ORDER BY tax_rate DESC, price_includes_tax`, invoice_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var line types.TaxLine
+
+		if err := rows.Scan(&line.Rate, &line.PriceIncludesTax, &line.Items, &line.Base, &line.Tax, &line.Gross); err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// GetTaxSummary totals sales in [from, to) by month of sale and rate
+func (s *Store) GetTaxSummary(from time.Time, to time.Time) ([]types.TaxSummary, error) {
+	summaries := []types.TaxSummary{}
+
+	rows, err := s.db.Query(`SELECT TO_CHAR(datetime_sold, 'YYYY-MM'), tax_rate, COUNT(DISTINCT invoice_id), COUNT(*),
+							 SUM(base), SUM(tax), SUM(gross)
+							 FROM sold_item_amounts
+							 WHERE datetime_sold >= $1 AND datetime_sold < $2
+							 GROUP BY 1, 2
+							 ORDER BY 1, 2 DESC`, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary types.TaxSummary
+
+		err := rows.Scan(&summary.Month, &summary.Rate, &summary.Invoices, &summary.Items,
+			&summary.Base, &summary.Tax, &summary.Gross,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
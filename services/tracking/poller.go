@@ -0,0 +1,89 @@
+package tracking
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Poller periodically asks the provider about every shipment with a tracking number
+// and marks it delivered once the courier reports it
+type Poller struct {
+	store		types.TrackingStore
+	provider	Provider
+	events		types.EventPublisher
+	interval	time.Duration
+}
+
+func NewPoller(store types.TrackingStore, provider Provider, events types.EventPublisher, interval time.Duration) *Poller {
+	return &Poller{
+		store: store,
+		provider: provider,
+		events: events,
+		interval: interval,
+	}
+}
+
+func (p *Poller) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			p.PollOnce(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *Poller) PollOnce(ctx context.Context) {
+	shipments, err := p.store.GetTrackedShipments()
+	if err != nil {
+		log.Printf("tracking: error getting shipments: %v", err)
+		return
+	}
+
+	for _, shipment := range shipments {
+		if ctx.Err() != nil {
+			return
+		}
+
+		result, err := p.provider.Track(ctx, shipment.Courier, shipment.TrackingNumber)
+		if err != nil {
+			log.Printf("tracking: error tracking %s %s: %v", shipment.Courier, shipment.TrackingNumber, err)
+			continue
+		}
+
+		if err := p.store.UpdateTrackingStatus(shipment.ID, result.Status); err != nil {
+			log.Printf("tracking: error updating shipment %d: %v", shipment.ID, err)
+			continue
+		}
+
+		if !result.Delivered {
+			continue
+		}
+
+		deliveredAt := time.Now()
+		if result.DeliveredAt != nil {
+			deliveredAt = *result.DeliveredAt
+		}
+
+		if err := p.store.MarkShipmentDelivered(shipment.ID, deliveredAt); err != nil {
+			log.Printf("tracking: error marking shipment %d delivered: %v", shipment.ID, err)
+			continue
+		}
+
+		p.events.Publish(types.TopicShipments, "shipment.delivered", map[string]interface{}{
+			"invoice_id": shipment.InvoiceID,
+			"shipment_id": shipment.ID,
+			"tracking_number": shipment.TrackingNumber,
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package tracking
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// memoryStore keeps shipments in a map the way the shipments table would, only shipped parcels are tracked
+type memoryStore struct {
+	shipments map[int]*types.Shipment
+}
+
+func (s *memoryStore) GetTrackedShipments() ([]types.Shipment, error) {
+	var tracked []types.Shipment
+	for _, shipment := range s.shipments {
+		if shipment.Status == types.ShipmentShipped && shipment.TrackingNumber != "" && shipment.Courier != "" {
+			tracked = append(tracked, *shipment)
+		}
+	}
+	return tracked, nil
+}
+
+func (s *memoryStore) UpdateTrackingStatus(shipment_id int, status string) error {
+	s.shipments[shipment_id].TrackingStatus = status
+	return nil
+}
+
+func (s *memoryStore) MarkShipmentDelivered(shipment_id int, delivered_at time.Time) error {
+	s.shipments[shipment_id].Status = types.ShipmentDelivered
+	s.shipments[shipment_id].DeliveredAt = &delivered_at
+	return nil
+}
+
+type recordedEvent struct {
+	topic		string
+	eventType	string
+	data		any
+}
+
+type recorder struct {
+	events []recordedEvent
+}
+
+func (r *recorder) Publish(topic string, eventType string, data any) {
+	r.events = append(r.events, recordedEvent{topic, eventType, data})
+}
+
+func TestPollerMarksShipmentDelivered(t *testing.T) {
+	store := &memoryStore{shipments: map[int]*types.Shipment{
+		1: {ID: 1, InvoiceID: 10, Status: types.ShipmentShipped, Courier: "jne", TrackingNumber: "JNE001"},
+		2: {ID: 2, InvoiceID: 11, Status: types.ShipmentShipped, Courier: "jne", TrackingNumber: "JNE002"},
+	}}
+	provider := NewFakeProvider()
+	events := &recorder{}
+	poller := NewPoller(store, provider, events, time.Minute)
+	ctx := context.Background()
+
+	poller.PollOnce(ctx)
+
+	for _, shipment := range store.shipments {
+		if shipment.Status != types.ShipmentShipped || shipment.TrackingStatus != "IN TRANSIT" {
+			t.Fatalf("shipment %d = %s/%s before delivery, want shipped/IN TRANSIT", shipment.ID, shipment.Status, shipment.TrackingStatus)
+		}
+	}
+	if len(events.events) != 0 {
+		t.Fatalf("published %d events before delivery", len(events.events))
+	}
+
+	deliveredAt := time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC)
+	provider.SetDelivered("JNE001", deliveredAt)
+
+	poller.PollOnce(ctx)
+
+	delivered := store.shipments[1]
+	if delivered.Status != types.ShipmentDelivered || delivered.TrackingStatus != "DELIVERED" {
+		t.Fatalf("shipment 1 = %s/%s, want delivered/DELIVERED", delivered.Status, delivered.TrackingStatus)
+	}
+	if delivered.DeliveredAt == nil || !delivered.DeliveredAt.Equal(deliveredAt) {
+		t.Fatalf("shipment 1 delivered at %v, want the courier's time %v", delivered.DeliveredAt, deliveredAt)
+	}
+	if store.shipments[2].Status != types.ShipmentShipped {
+		t.Fatal("shipment 2 was marked delivered without the courier reporting it")
+	}
+
+	if len(events.events) != 1 {
+		t.Fatalf("published %d events, want one shipment.delivered", len(events.events))
+	}
+	event := events.events[0]
+	data, _ := event.data.(map[string]interface{})
+	if event.topic != types.TopicShipments || event.eventType != "shipment.delivered" || data["shipment_id"] != 1 || data["invoice_id"] != 10 {
+		t.Fatalf("event = %+v", event)
+	}
+
+	// Delivered shipments are no longer tracked
+	poller.PollOnce(ctx)
+	if len(events.events) != 1 {
+		t.Fatalf("delivered shipment was reported again, %d events", len(events.events))
+	}
+}
+
+func TestFakeProviderDeliversDLVSuffix(t *testing.T) {
+	result, err := NewFakeProvider().Track(context.Background(), "jne", "JNE003dlv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delivered || result.DeliveredAt == nil {
+		t.Fatalf("result = %+v, want delivered", result)
+	}
+}
@@ -0,0 +1,74 @@
+package tracking
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// Provider looks up the delivery status of a parcel, one implementation per courier aggregator
+type Provider interface {
+	Name() string
+	Track(ctx context.Context, courier string, trackingNumber string) (*types.TrackingResult, error)
+}
+
+// NewProviderFromEnv picks the provider named by TRACKING_PROVIDER, nil means tracking is disabled
+func NewProviderFromEnv() (Provider, error) {
+	switch strings.ToLower(os.Getenv("TRACKING_PROVIDER")) {
+	case "":
+		return nil, nil
+	case "fake":
+		return NewFakeProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown tracking provider: %s", os.Getenv("TRACKING_PROVIDER"))
+	}
+}
+
+// FakeProvider is an in memory provider for local development and tests, parcels are in transit
+// until SetDelivered is called or the tracking number ends in "DLV"
+type FakeProvider struct {
+	mu			sync.Mutex
+	delivered	map[string]time.Time
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		delivered: make(map[string]time.Time),
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) SetDelivered(trackingNumber string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.delivered[trackingNumber] = at
+}
+
+func (p *FakeProvider) Track(ctx context.Context, courier string, trackingNumber string) (*types.TrackingResult, error) {
+	p.mu.Lock()
+	deliveredAt, ok := p.delivered[trackingNumber]
+	p.mu.Unlock()
+
+	if !ok && strings.HasSuffix(strings.ToUpper(trackingNumber), "DLV") {
+		deliveredAt, ok = time.Now(), true
+	}
+
+	if !ok {
+		return &types.TrackingResult{Status: "IN TRANSIT"}, nil
+	}
+
+	return &types.TrackingResult{
+		Status: "DELIVERED",
+		Delivered: true,
+		DeliveredAt: &deliveredAt,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+// tokenTTL is how long a mailed link works, PASSWORD_RESET_TTL and EMAIL_VERIFY_TTL override the defaults
+func tokenTTL(purpose string) time.Duration {
+	if purpose == types.TokenPasswordReset {
+		return envDuration("PASSWORD_RESET_TTL", time.Hour)
+	}
+	return envDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+}
+
+// appURL is a page of the web app at APP_URL
+func appURL(page string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+
+	return strings.TrimRight(base, "/") + page
+}
+
+// appLink points into the web app, which reads the token and posts it back to the API
+func appLink(page string, token string) string {
+	return appURL(page) + "?token=" + url.QueryEscape(token)
+}
+
+// sendUserToken issues a single use token for purpose and mails the link to the user
+func (h *Handler) sendUserToken(u types.User, purpose string) error {
+	token, err := auth.NewUserToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := tokenTTL(purpose)
+	if err := h.store.CreateUserToken(u.ID, purpose, auth.HashToken(token), time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	var subject, body string
+	switch purpose {
+	case types.TokenPasswordReset:
+		subject = "Reset your password"
+		body = fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your inventory account. Open this link within %v to choose a new one:\n\n%s\n\nIf it was not you, ignore this email, your password stays the same.\n",
+			u.Username, ttl, appLink("/reset-password", token))
+	case types.TokenEmailVerify:
+		subject = "Verify your email"
+		body = fmt.Sprintf("Hi %s,\n\nAn inventory account was created for this address. Open this link within %v to verify it before logging in:\n\n%s\n",
+			u.Username, ttl, appLink("/verify-email", token))
+	default:
+		return fmt.Errorf("unknown token purpose %q", purpose)
+	}
+
+	return h.mailer.Send(u.Email, subject, body)
+}
@@ -3,11 +3,14 @@ package user
 import (
 	// "context"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/mailer"
+	"github.com/PatrickA727/mikrotik-db-sys/services/oidc"
 	"github.com/PatrickA727/mikrotik-db-sys/types"
 	"github.com/PatrickA727/mikrotik-db-sys/utils"
 	"github.com/go-playground/validator/v10"
@@ -16,22 +19,59 @@ import (
 
 type Handler struct {
 	store types.UserStore
+	mailer mailer.Mailer
+	oidc *oidc.Provider	// nil when single sign-on is not configured
 }
 
-func NewHandler (store types.UserStore) *Handler {
+func NewHandler (store types.UserStore, mailer mailer.Mailer, oidc *oidc.Provider) *Handler {
 	return &Handler{
 		store: store,
+		mailer: mailer,
+		oidc: oidc,
 	}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/register-user", auth.WithJWTAuth(h.handleRegisterUser, h.store)).Methods("POST")
+	router.HandleFunc("/register-user", auth.WithRole(h.handleRegisterUser, h.store, types.RoleAdmin)).Methods("POST")
 	router.HandleFunc("/login", h.handleLoginUser).Methods("POST")
+	router.HandleFunc("/login/2fa", h.handleLoginMFA).Methods("POST")
+	router.HandleFunc("/login/2fa/enroll", h.handleLoginEnrollTOTP).Methods("POST")
+	router.HandleFunc("/oidc/login", h.handleOIDCLogin).Methods("GET")
+	router.HandleFunc("/oidc/callback", h.handleOIDCCallback).Methods("GET")
 	router.HandleFunc("/logout", auth.WithJWTAuth(h.handleLogout, h.store)).Methods("POST")
 	router.HandleFunc("/logout-all", auth.WithJWTAuth(h.handleLogoutAllDevice, h.store)).Methods("POST")
 	router.HandleFunc("/delete-user", auth.WithJWTAuth(h.handleDeleteCurrentUser, h.store)).Methods("DELETE")
-	router.HandleFunc("/refresh", h.handleRenewToken).Methods("POST")
+	router.HandleFunc("/refresh", auth.WithCSRF(h.handleRenewToken)).Methods("POST")
+	router.HandleFunc("/csrf", h.handleGetCSRFToken).Methods("GET")
+	router.HandleFunc("/change-password", auth.WithJWTAuth(h.handleChangePassword, h.store)).Methods("POST")
+	router.HandleFunc("/forgot-password", h.handleForgotPassword).Methods("POST")
+	router.HandleFunc("/reset-password", h.handleResetPassword).Methods("POST")
+	router.HandleFunc("/verify-email", h.handleVerifyEmail).Methods("POST")
+	router.HandleFunc("/resend-verification", h.handleResendVerification).Methods("POST")
+	router.HandleFunc("/2fa/enroll", auth.WithJWTAuth(h.handleEnrollTOTP, h.store)).Methods("POST")
+	router.HandleFunc("/2fa/confirm", auth.WithJWTAuth(h.handleConfirmTOTP, h.store)).Methods("POST")
+	router.HandleFunc("/2fa/disable", auth.WithJWTAuth(h.handleDisableTOTP, h.store)).Methods("POST")
+	router.HandleFunc("/2fa/recovery-codes", auth.WithJWTAuth(h.handleRegenerateRecoveryCodes, h.store)).Methods("POST")
 	router.HandleFunc("/auth-client-mk", auth.WithJWTAuth(h.handleCheckAuthClient, h.store)).Methods("GET")
+	router.HandleFunc("/sessions", auth.WithJWTAuth(h.handleGetSessions, h.store)).Methods("GET")
+	router.HandleFunc("/sessions/{id}", auth.WithJWTAuth(h.handleRevokeSession, h.store)).Methods("DELETE")
+	router.HandleFunc("/admin/sessions", auth.WithRole(h.handleAdminGetSessions, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/sessions/{id}", auth.WithRole(h.handleAdminRevokeSession, h.store, types.RoleAdmin)).Methods("DELETE")
+	router.HandleFunc("/admin/lockouts", auth.WithRole(h.handleGetLockouts, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/unlock", auth.WithRole(h.handleUnlock, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/auth-events", auth.WithRole(h.handleGetAuthEvents, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/users", auth.WithRole(h.handleGetUsers, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/users/{id}", auth.WithRole(h.handleGetUser, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/users/{id}", auth.WithRole(h.handleEditUser, h.store, types.RoleAdmin)).Methods("PATCH")
+	router.HandleFunc("/admin/users/{id}/deactivate", auth.WithRole(h.handleDeactivateUser, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/activate", auth.WithRole(h.handleActivateUser, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/logout", auth.WithRole(h.handleForceLogout, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/2fa-policy", auth.WithRole(h.handleGetMFAPolicy, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/2fa-policy", auth.WithRole(h.handleSetMFAPolicy, h.store, types.RoleAdmin)).Methods("PUT")
+	router.HandleFunc("/admin/users/{id}/2fa/reset", auth.WithRole(h.handleResetUserTOTP, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/devices", auth.WithRole(h.handleIssueDevice, h.store, types.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/admin/devices", auth.WithRole(h.handleGetDevices, h.store, types.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/admin/devices/{id}", auth.WithRole(h.handleRevokeDevice, h.store, types.RoleAdmin)).Methods("DELETE")
 }
 
 func (h *Handler) handleRenewToken(w http.ResponseWriter, r *http.Request) {
@@ -45,39 +85,117 @@ func (h *Handler) handleRenewToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionExists, userID, err := h.store.CheckSession(refCookie.Value)
+	// Every refresh hands out a new refresh token, the old one stops working
+	tokenUser, err := auth.TokenUser(refCookie.Value, auth.TokenRefresh)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %v", err))
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized: %v", err))
 		return
-	} 
+	}
 
-	if !sessionExists {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("unauthorized, session does not exist"))
+	newRefToken, err := auth.CreateRefreshJWT(tokenUser)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
 		return
-	} else {
-		secret := []byte(os.Getenv("JWT_SECRET"))
-		token, err := auth.CreateJWT(secret, userID)
-		if err != nil {
-			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
-			return
-		}
+	}
 
-		accessCookie := &http.Cookie{
-			Name:     "access_token",                
-			Value:    token,                      
-			Expires:  time.Now().Add(time.Duration(600) * time.Second), 
-			HttpOnly: true,	// SET TO TRUE FOR DEPLOY       
-			Path: "/",        
-			Secure:   true,                       
-			SameSite: http.SameSiteNoneMode,       
+	// A second tab refreshing with the same token at the same time gets the first one's token back
+	session, err := h.store.RotateSession(refCookie.Value, types.Session{
+		RefreshToken: newRefToken,
+		UserAgent: r.UserAgent(),
+		IPAddress: utils.ClientIP(r),
+	}, auth.RefreshReuseGrace())
+	if err != nil {
+		switch err {
+		case types.ErrRefreshTokenReused:
+			log.Printf("refresh token reuse detected for user %d, login revoked", tokenUser)
+			h.auditAuth(r, tokenUser, "", types.AuthRefreshTokenReuse, "")
+			fallthrough
+		case types.ErrSessionNotFound, types.ErrSessionRevoked, types.ErrSessionExpired:
+			clearAuthCookies(w)
+			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized: %v", err))
+		default:
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %v", err))
 		}
+		return
+	}
+
+	userID := session.Userid
+	if userID != tokenUser {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized, session does not match token"))
+		return
+	}
+
+	token, err := auth.CreateJWT(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
+		return
+	}
+
+	accessCookie := &http.Cookie{
+		Name:     "access_token",                
+		Value:    token,                      
+		Expires:  time.Now().Add(auth.AccessTokenTTL()), 
+		HttpOnly: true,	// SET TO TRUE FOR DEPLOY       
+		Path: "/",        
+		Secure:   true,                       
+		SameSite: http.SameSiteNoneMode,       
+	}
+
+	refreshCookie := &http.Cookie{
+		Name:     "refresh_token",                
+		Value:    session.RefreshToken,                      
+		Expires:  session.Expiration,
+		HttpOnly: true,	// SET TO TRUE FOR DEPLOY       
+		Path: "/",        
+		Secure:   true,                       
+		SameSite: http.SameSiteNoneMode,       
+	}
+
+	http.SetCookie(w, accessCookie)
+	http.SetCookie(w, refreshCookie)
 
-		http.SetCookie(w, accessCookie)
+	if _, err := auth.IssueCSRFToken(w); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating CSRF token: %v", err))
+		return
 	}
 
 	utils.WriteJSON(w, http.StatusCreated, map[string]string{"msg": "new access token created"})
 }
 
+// clearAuthCookies expires both auth cookies
+func clearAuthCookies(w http.ResponseWriter) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,	// SET TO TRUE FOR DEPLOY
+			Expires:  time.Unix(0, 0), 
+			MaxAge:   -1,             
+			Secure:   true,        
+		})
+	}
+
+	auth.ClearCSRFCookie(w)
+}
+
+// handleGetCSRFToken hands the web app the CSRF token for its X-CSRF-Token header, issuing one when there is
+// none yet. Only allowed origins can read the response through CORS
+func (h *Handler) handleGetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(auth.CSRFCookie); err == nil && cookie.Value != "" {
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"csrf_token": cookie.Value})
+		return
+	}
+
+	token, err := auth.IssueCSRFToken(w)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating CSRF token: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"csrf_token": token})
+}
+
 func (h *Handler) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 	// Get JSON
 	var payload types.UserPayload
@@ -104,20 +222,30 @@ func (h *Handler) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 	hashedPass, err := auth.HashPass(payload.Password)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error hashing pass: %v", err))
+		return
 	}
 
 	// Register User
-	if err := h.store.RegisterNewUser(
-		types.User{
-			Username: payload.Username,
-			Email: payload.Email,
-			Password: hashedPass,
-		},
-	); err != nil {
+	u := types.User{
+		Username: payload.Username,
+		Email: payload.Email,
+		Password: hashedPass,
+		Role: payload.Role,
+	}
+
+	u.ID, err = h.store.RegisterNewUser(u)
+	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error registering user: %v", err))
 		return
 	}
 
+	// The user can log in once they follow the link, it can be sent again from /resend-verification
+	if err := h.sendUserToken(u, types.TokenEmailVerify); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", u.ID, err)
+		utils.WriteJSON(w, http.StatusCreated, "New User Created, verification email could not be sent")
+		return
+	}
+
 	utils.WriteJSON(w, http.StatusCreated, "New User Created")
 }
 
@@ -134,25 +262,16 @@ func (h *Handler) handleCheckAuthClient(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate JWT token
-	token, err := auth.ValidateJWT(cookie.Value)
-	if err != nil {
+	if _, err := auth.TokenUser(cookie.Value, auth.TokenAccess); err != nil {
 		// log.Println("token not valid: ", err)
 		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied1: %v", err))
 		return
 	}
 
-	if !token.Valid {
-		// log.Println("invalid token")
-		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied2: %v", err))
-		return
-	}
-
 	utils.WriteJSON(w, http.StatusAccepted, map[string]string{"msg": "authorized"})
 }
 
 func (h *Handler) handleLoginUser(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
 	// Get JSON
 	var payload types.LoginPayload
 	if err := utils.ParseJSON(r, &payload); err != nil {
@@ -170,49 +289,134 @@ func (h *Handler) handleLoginUser(w http.ResponseWriter, r *http.Request) {
 	// Email sanitation
 	payload.Email = utils.SanitizeInput(payload.Email)
 
+	// Refuse early while the account or the IP is backing off, without checking the password
+	email := throttleEmail(payload.Email)
+	ip := utils.ClientIP(r)
+
+	if h.loginBlocked(w, r, email, ip) {
+		return
+	}
+
 	// Check if user email exists
 	u, err := h.store.GetUserByEmail(payload.Email)
 	if err != nil {
+		h.auditAuth(r, 0, email, types.AuthLoginFailure, "unknown email")
+		h.recordLoginFailure(r, 0, email, ip)
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("email or password incorrect"))
 		return
 	}
 
 	// Check user password
 	if !auth.ComparePasswords(u.Password, []byte(payload.Password)) {
+		h.auditAuth(r, u.ID, email, types.AuthLoginFailure, "wrong password")
+		h.recordLoginFailure(r, u.ID, email, ip)
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("email or password incorrect"))
 		return
 	}
 
-	// Create access token
-	secret := []byte(os.Getenv("JWT_SECRET"))
-	token, err := auth.CreateJWT(secret, u.ID)
+	if !u.EmailVerified {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("email not verified, check your inbox for the verification link"))
+		return
+	}
+
+	if !u.Active {
+		h.auditAuth(r, u.ID, email, types.AuthLoginFailure, "account deactivated")
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("account deactivated"))
+		return
+	}
+
+	// Second factor, cookies are only set once it is passed at /login/2fa
+	required, err := h.mfaRequired(u.Role)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking two-factor policy: %v", err))
+		return
+	}
+
+	if u.TOTPEnabled || required {
+		mfaToken, err := auth.CreateMFAToken(u.ID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
+			return
+		}
+
+		response := map[string]interface{}{"mfa_required": true, "mfa_token": mfaToken}
+
+		// The role requires two-factor but the user has no authenticator yet, they enroll on the way in
+		if !u.TOTPEnabled {
+			enrollment, err := h.startTOTPEnrollment(u)
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting two-factor enrollment: %v", err))
+				return
+			}
+			enrollment["mfa_enrollment"] = true
+			for k, v := range enrollment {
+				response[k] = v
+			}
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	h.completeLogin(w, r, u, email, nil)
+}
+
+// completeLogin sets the auth cookies of a new session once every factor is checked, response is the body
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, u *types.User, email string, response interface{}) {
+	// The login went through, the account starts over. The IP keeps its count so one known password does not
+	// reset the guessing budget for others
+	if err := h.store.ClearLoginThrottle(types.ThrottleAccount, email); err != nil {
+		log.Printf("failed to clear login failures of %q: %v", email, err)
+	}
+
+	if err := h.startSession(w, r, u); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	h.auditAuth(r, u.ID, email, types.AuthLoginSuccess, "")
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// startSession creates the session of a new login and sets the access and refresh cookies
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, u *types.User) error {
+	// Create access token
+	token, err := auth.CreateJWT(u.ID)
+	if err != nil {
+		return fmt.Errorf("error generating token: %v", err)
+	}
+
 	// Create refresh token
-	refToken, err := auth.CreateRefreshJWT(secret, u.ID) 
+	refToken, err := auth.CreateRefreshJWT(u.ID) 
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating token: %v", err))
-		return
+		return fmt.Errorf("error generating token: %v", err)
+	}
+
+	// Create db session, later refreshes rotate it within the same family
+	familyID, err := auth.NewTokenID()
+	if err != nil {
+		return fmt.Errorf("error creating session: %v", err)
 	}
 
-	// Create db session
-	err = h.store.CreateSession(ctx, types.Session{
+	expiration := time.Now().Add(auth.RefreshTokenTTL())
+	err = h.store.CreateSession(r.Context(), types.Session{
 		Userid: u.ID,
 		RefreshToken: refToken,
+		FamilyID: familyID,
+		Expiration: expiration,
+		UserAgent: r.UserAgent(),
+		IPAddress: utils.ClientIP(r),
 	})
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error creating session: %v", err))
-		return
+		return fmt.Errorf("error creating session: %v", err)
 	}
 
 	// Create JWT access token and log in user
 	accessCookie := &http.Cookie{
 		Name:     "access_token",                
 		Value:    token,                      
-		Expires:  time.Now().Add(time.Duration(900) * time.Second), 
+		Expires:  time.Now().Add(auth.AccessTokenTTL()), 
 		HttpOnly: true,	// SET TO TRUE FOR DEPLOY       
 		Path: "/",        
 		Secure:   true,                       
@@ -223,7 +427,7 @@ func (h *Handler) handleLoginUser(w http.ResponseWriter, r *http.Request) {
 	refreshCookie := &http.Cookie{
 		Name:     "refresh_token",                
 		Value:    refToken,                      
-		Expires:  time.Now().Add(time.Duration(3600 * 24) * time.Second), // 1 day
+		Expires:  expiration,
 		HttpOnly: true,	// SET TO TRUE FOR DEPLOY       
 		Path: "/",        
 		Secure:   true,                       
@@ -233,7 +437,11 @@ func (h *Handler) handleLoginUser(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, accessCookie)
 	http.SetCookie(w, refreshCookie)
 
-	utils.WriteJSON(w, http.StatusOK, nil)
+	if _, err := auth.IssueCSRFToken(w); err != nil {
+		return fmt.Errorf("error generating CSRF token: %v", err)
+	}
+
+	return nil
 }
 
 func (h *Handler) handleLogout (w http.ResponseWriter, r *http.Request) {
@@ -292,6 +500,8 @@ func (h *Handler) handleLogout (w http.ResponseWriter, r *http.Request) {
         Secure:   true,        
     })
 
+	auth.ClearCSRFCookie(w)
+
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"res": "Successfully logged out"})
 }
 
@@ -307,7 +517,7 @@ func (h *Handler) handleLogoutAllDevice (w http.ResponseWriter, r *http.Request)
 	} 
 
 	// logout all sessions with this ID
-	err := h.store.RevokeSessionBulk(intID)
+	_, err := h.store.RevokeSessionBulk(intID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error logging out devices: %v", err))
 		return
@@ -333,6 +543,8 @@ func (h *Handler) handleLogoutAllDevice (w http.ResponseWriter, r *http.Request)
         Secure:   true,        
     })
 
+	auth.ClearCSRFCookie(w)
+
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "Logged out all devices"})
 }
 
@@ -379,6 +591,8 @@ func (h *Handler) handleDeleteCurrentUser (w http.ResponseWriter, r *http.Reques
         Secure:   true,        
     })
 
+	auth.ClearCSRFCookie(w)
+
 	// Delete user
 	err = h.store.DeleteUserById(u.ID, ctx)
 	if err != nil {
@@ -387,4 +601,932 @@ func (h *Handler) handleDeleteCurrentUser (w http.ResponseWriter, r *http.Reques
 	}
 
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"res": "user deleted"})
-}
\ No newline at end of file
+}
+
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	current := ""
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		current = cookie.Value
+	}
+
+	sessions, err := h.store.GetSessions(userID, current)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting sessions: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// handleRevokeSession logs out one of the user's own devices, revoking the one in use also clears the cookies
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	if err := h.store.RevokeSessionFamily(mux.Vars(r)["id"], userID); err != nil {
+		if err == types.ErrSessionNotFound {
+			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("session not found or already revoked"))
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error revoking session: %v", err))
+		return
+	}
+
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		if active, _, err := h.store.CheckSession(cookie.Value); err == nil && !active {
+			clearAuthCookies(w)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "session revoked"})
+}
+
+// handleAdminGetSessions lists the active sessions of ?user_id=, or of every user without it
+func (h *Handler) handleAdminGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if param := r.URL.Query().Get("user_id"); param != "" {
+		var err error
+		userID, err = strconv.Atoi(param)
+		if err != nil || userID <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user_id"))
+			return
+		}
+	}
+
+	sessions, err := h.store.GetSessions(userID, "")
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting sessions: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+func (h *Handler) handleAdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.RevokeSessionFamily(mux.Vars(r)["id"], 0); err != nil {
+		if err == types.ErrSessionNotFound {
+			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("session not found or already revoked"))
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error revoking session: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "session revoked"})
+}
+
+// handleIssueDevice creates the key a handheld or reader signs with, the secret is in this response only
+func (h *Handler) handleIssueDevice(w http.ResponseWriter, r *http.Request) {
+	var payload types.DevicePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	keyID, err := auth.NewTokenID()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating device key: %v", err))
+		return
+	}
+
+	secret, err := auth.NewDeviceSecret()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating device key: %v", err))
+		return
+	}
+
+	device := types.Device{
+		Name: payload.Name,
+		KeyID: keyID,
+		Secret: secret,
+		CreatedBy: userID,
+	}
+
+	device.ID, err = h.store.CreateDevice(device)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error creating device: %v", err))
+		return
+	}
+
+	device.CreatedAt = time.Now()
+
+	utils.WriteJSON(w, http.StatusCreated, types.IssuedDevice{Device: device, Secret: secret})
+}
+
+func (h *Handler) handleGetDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.store.GetDevices()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting devices: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"devices": devices})
+}
+
+// handleRevokeDevice stops the device's key working straight away
+func (h *Handler) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid device id"))
+		return
+	}
+
+	if err := h.store.RevokeDevice(id); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "device revoked"})
+}
+
+// handleChangePassword needs the current password, every session including this one is logged out after
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ChangePasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	u, err := h.store.GetUserById(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("user not found"))
+		return
+	}
+
+	if !auth.ComparePasswords(u.Password, []byte(payload.CurrentPassword)) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("current password incorrect"))
+		return
+	}
+
+	hashedPass, err := auth.HashPass(payload.NewPassword)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error hashing pass: %v", err))
+		return
+	}
+
+	if err := h.store.SetPassword(u.ID, hashedPass); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error changing password: %v", err))
+		return
+	}
+
+	h.auditAuth(r, u.ID, u.Email, types.AuthPasswordChanged, "")
+
+	clearAuthCookies(w)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "password changed, log in again"})
+}
+
+// handleForgotPassword mails a reset link, the response is the same whether or not the email is registered
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	// Counted per address and IP whether or not the email is registered, apart from failed logins
+	email := throttleEmail(payload.Email)
+	ip := utils.ClientIP(r)
+
+	if h.throttled(w, r, types.MailScopes, email, ip, "too many emails requested") {
+		return
+	}
+	h.recordAttempt(r, types.MailScopes, 0, email, ip)
+
+	if u, err := h.store.GetUserByEmail(utils.SanitizeInput(payload.Email)); err == nil {
+		if err := h.sendUserToken(*u, types.TokenPasswordReset); err != nil {
+			log.Printf("failed to send password reset to user %d: %v", u.ID, err)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "if the email is registered a reset link has been sent"})
+}
+
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ResetPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	hashedPass, err := auth.HashPass(payload.Password)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error hashing pass: %v", err))
+		return
+	}
+
+	userID, err := h.store.ResetPassword(auth.HashToken(payload.Token), hashedPass)
+	if err != nil {
+		if err == types.ErrInvalidUserToken {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error resetting password: %v", err))
+		return
+	}
+
+	h.auditAuth(r, userID, "", types.AuthPasswordReset, "")
+
+	clearAuthCookies(w)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "password reset, log in with the new password"})
+}
+
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload types.TokenPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, err := h.store.ConsumeUserToken(types.TokenEmailVerify, auth.HashToken(payload.Token))
+	if err != nil {
+		if err == types.ErrInvalidUserToken {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking verification token: %v", err))
+		return
+	}
+
+	if err := h.store.VerifyEmail(userID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error verifying email: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "email verified"})
+}
+
+// handleResendVerification answers the same for unknown and already verified emails
+func (h *Handler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload types.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	// Counted per address and IP whether or not the email is registered, apart from failed logins
+	email := throttleEmail(payload.Email)
+	ip := utils.ClientIP(r)
+
+	if h.throttled(w, r, types.MailScopes, email, ip, "too many emails requested") {
+		return
+	}
+	h.recordAttempt(r, types.MailScopes, 0, email, ip)
+
+	if u, err := h.store.GetUserByEmail(utils.SanitizeInput(payload.Email)); err == nil && !u.EmailVerified {
+		if err := h.sendUserToken(*u, types.TokenEmailVerify); err != nil {
+			log.Printf("failed to send verification email to user %d: %v", u.ID, err)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "if the email is registered and unverified a link has been sent"})
+}
+
+func (h *Handler) handleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := h.store.GetLockouts(time.Now())
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting lockouts: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"lockouts": lockouts})
+}
+
+// handleUnlock clears the failed logins of an account, an IP or both
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	var payload types.UnlockPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	adminID, _ := r.Context().Value(auth.UserKey).(int)
+
+	if payload.Email != "" {
+		email := throttleEmail(payload.Email)
+		if err := h.store.ClearLoginThrottle(types.ThrottleAccount, email); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error unlocking account: %v", err))
+			return
+		}
+		h.auditAuth(r, 0, email, types.AuthUnlock, fmt.Sprintf("account unlocked by user %d", adminID))
+	}
+
+	if payload.IP != "" {
+		if err := h.store.ClearLoginThrottle(types.ThrottleIP, payload.IP); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error unlocking ip: %v", err))
+			return
+		}
+		h.auditAuth(r, 0, "", types.AuthUnlock, fmt.Sprintf("ip %s unlocked by user %d", payload.IP, adminID))
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "unlocked"})
+}
+
+// handleGetAuthEvents reads the audit log, ?user_id= narrows it to one user and ?limit= defaults to 100
+func (h *Handler) handleGetAuthEvents(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if param := r.URL.Query().Get("user_id"); param != "" {
+		var err error
+		userID, err = strconv.Atoi(param)
+		if err != nil || userID <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user_id"))
+			return
+		}
+	}
+
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 || limit > 1000 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and 1000"))
+			return
+		}
+	}
+
+	events, err := h.store.GetAuthEvents(userID, limit)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting auth events: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
+
+// handleLoginMFA finishes a login with an authenticator or recovery code. A user enrolling on the way in
+// confirms their authenticator with the code and gets their recovery codes in the response
+func (h *Handler) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var payload types.LoginMFAPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, err := auth.TokenUser(payload.MFAToken, auth.TokenMFA)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("login expired, enter your password again"))
+		return
+	}
+
+	u, err := h.store.GetUserById(userID)
+	if err != nil || !u.Active {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("user not found or deactivated"))
+		return
+	}
+
+	// Wrong codes count as failed logins, so the code cannot be guessed either
+	email := throttleEmail(u.Email)
+	ip := utils.ClientIP(r)
+
+	if h.loginBlocked(w, r, email, ip) {
+		return
+	}
+
+	state, err := h.store.GetTOTP(u.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting two-factor state: %v", err))
+		return
+	}
+
+	var response interface{}
+	ok := false
+
+	switch {
+	case payload.RecoveryCode != "":
+		if state.Enabled {
+			ok, err = h.store.UseRecoveryCode(u.ID, auth.HashRecoveryCode(payload.RecoveryCode))
+			if ok {
+				h.auditAuth(r, u.ID, email, types.AuthRecoveryCodeUsed, "")
+			}
+		}
+	case state.Enabled:
+		ok, err = h.checkTOTP(u.ID, payload.Code)
+	case state.Secret != "":
+		step, valid := auth.ValidateTOTP(state.Secret, payload.Code, time.Now())
+		if valid {
+			codes, hashes, genErr := newRecoveryCodes()
+			if genErr != nil {
+				utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating recovery codes: %v", genErr))
+				return
+			}
+
+			if err = h.store.EnableTOTP(u.ID, step, hashes); err == nil {
+				ok = true
+				response = map[string]interface{}{"recovery_codes": codes}
+				h.auditAuth(r, u.ID, email, types.AuthMFAEnabled, "enrolled at login")
+			}
+		}
+	default:
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor authentication is not set up, log in again"))
+		return
+	}
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking two-factor code: %v", err))
+		return
+	}
+
+	if !ok {
+		h.auditAuth(r, u.ID, email, types.AuthLoginFailure, "wrong two-factor code")
+		h.recordLoginFailure(r, u.ID, email, ip)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("two-factor code incorrect"))
+		return
+	}
+
+	h.completeLogin(w, r, u, email, response)
+}
+
+// handleLoginEnrollTOTP starts enrollment for a login stopped at two-factor whose user has no authenticator
+// yet, for logins like single sign-on that could not return the secret themselves
+func (h *Handler) handleLoginEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken	string	`json:"mfa_token" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, err := auth.TokenUser(payload.MFAToken, auth.TokenMFA)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("login expired, log in again"))
+		return
+	}
+
+	u, err := h.store.GetUserById(userID)
+	if err != nil || !u.Active {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("user not found or deactivated"))
+		return
+	}
+
+	if u.TOTPEnabled {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("two-factor authentication is already enabled"))
+		return
+	}
+
+	enrollment, err := h.startTOTPEnrollment(u)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting two-factor enrollment: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, enrollment)
+}
+
+// handleEnrollTOTP returns a new secret and otpauth URI to scan, it only counts once confirmed with a code
+func (h *Handler) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	u, err := h.store.GetUserById(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("user not found"))
+		return
+	}
+
+	if u.TOTPEnabled {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("two-factor authentication is already enabled"))
+		return
+	}
+
+	enrollment, err := h.startTOTPEnrollment(u)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting two-factor enrollment: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, enrollment)
+}
+
+// handleConfirmTOTP enables the enrolled authenticator with its first code and returns the recovery codes
+func (h *Handler) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload types.TOTPCodePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	state, err := h.store.GetTOTP(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting two-factor state: %v", err))
+		return
+	}
+
+	if state.Enabled || state.Secret == "" {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("no two-factor enrollment in progress"))
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(state.Secret, payload.Code, time.Now())
+	if !valid {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor code incorrect"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating recovery codes: %v", err))
+		return
+	}
+
+	if err := h.store.EnableTOTP(userID, step, hashes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error enabling two-factor authentication: %v", err))
+		return
+	}
+
+	h.auditAuth(r, userID, "", types.AuthMFAEnabled, "")
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// handleDisableTOTP needs the password and a current code, roles the policy covers cannot turn it off
+func (h *Handler) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload types.DisableTOTPPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	u, err := h.store.GetUserById(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("user not found"))
+		return
+	}
+
+	required, err := h.mfaRequired(u.Role)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking two-factor policy: %v", err))
+		return
+	}
+
+	if required {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("two-factor authentication is required for the %s role", u.Role))
+		return
+	}
+
+	if !auth.ComparePasswords(u.Password, []byte(payload.Password)) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("password incorrect"))
+		return
+	}
+
+	valid, err := h.checkTOTP(u.ID, payload.Code)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error checking two-factor code: %v", err))
+		return
+	}
+
+	if !valid {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor code incorrect"))
+		return
+	}
+
+	if err := h.store.DisableTOTP(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error disabling two-factor authentication: %v", err))
+		return
+	}
+
+	h.auditAuth(r, u.ID, u.Email, types.AuthMFADisabled, "")
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "two-factor authentication disabled"})
+}
+
+// handleRegenerateRecoveryCodes replaces every recovery code, used or not
+func (h *Handler) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var payload types.TOTPCodePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserKey).(int)
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("ID type invalid"))
+		return
+	}
+
+	valid, err := h.checkTOTP(userID, payload.Code)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error checking two-factor code: %v", err))
+		return
+	}
+
+	if !valid {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor code incorrect"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error generating recovery codes: %v", err))
+		return
+	}
+
+	if err := h.store.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving recovery codes: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+func (h *Handler) handleGetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.store.GetMFARequiredRoles()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting two-factor policy: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"roles": roles})
+}
+
+// handleSetMFAPolicy replaces the roles that must use two-factor, users of those roles without it enroll at
+// their next login
+func (h *Handler) handleSetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	var payload types.MFAPolicyPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if err := h.store.SetMFARequiredRoles(payload.Roles); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error saving two-factor policy: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"roles": payload.Roles})
+}
+
+// handleResetUserTOTP removes a user's authenticator when they lost it and their recovery codes
+func (h *Handler) handleResetUserTOTP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id"))
+		return
+	}
+
+	u, err := h.store.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	if err := h.store.DisableTOTP(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error resetting two-factor authentication: %v", err))
+		return
+	}
+
+	adminID, _ := r.Context().Value(auth.UserKey).(int)
+	h.auditAuth(r, u.ID, u.Email, types.AuthMFADisabled, fmt.Sprintf("reset by user %d", adminID))
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "two-factor authentication reset"})
+}
+
+func (h *Handler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.store.GetUsers()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting users: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+}
+
+func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id"))
+		return
+	}
+
+	u, err := h.store.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleEditUser changes a user's username, email or role, admins cannot change their own role
+func (h *Handler) handleEditUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id"))
+		return
+	}
+
+	var payload types.EditUserPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing JSON: %v", err))
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	adminID, _ := r.Context().Value(auth.UserKey).(int)
+	if id == adminID && payload.Role != "" && payload.Role != types.RoleAdmin {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot remove your own admin role"))
+		return
+	}
+
+	if payload.Email != "" {
+		payload.Email = utils.SanitizeInput(payload.Email)
+		if existing, err := h.store.GetUserByEmail(payload.Email); err == nil && existing.ID != id {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("user already exists: %v", payload.Email))
+			return
+		}
+	}
+
+	if err := h.store.EditUser(id, payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error editing user: %v", err))
+		return
+	}
+
+	h.auditAuth(r, id, payload.Email, types.AuthUserUpdated, fmt.Sprintf("edited by user %d", adminID))
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": "user updated"})
+}
+
+// handleDeactivateUser blocks a user from logging in and logs them out, their history stays
+func (h *Handler) handleDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, false)
+}
+
+func (h *Handler) handleActivateUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, true)
+}
+
+func (h *Handler) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id"))
+		return
+	}
+
+	adminID, _ := r.Context().Value(auth.UserKey).(int)
+	if id == adminID && !active {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot deactivate yourself"))
+		return
+	}
+
+	if err := h.store.SetUserActive(id, active); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	event, msg := types.AuthUserDeactivated, "user deactivated"
+	if active {
+		event, msg = types.AuthUserActivated, "user activated"
+	}
+	h.auditAuth(r, id, "", event, fmt.Sprintf("by user %d", adminID))
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"msg": msg})
+}
+
+// handleForceLogout revokes every session of a user, their access token still works until it expires
+func (h *Handler) handleForceLogout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id"))
+		return
+	}
+
+	if _, err := h.store.GetUserById(id); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	// A user with no live sessions is already logged out, that is not an error
+	revoked, err := h.store.RevokeSessionBulk(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error logging out user: %v", err))
+		return
+	}
+
+	adminID, _ := r.Context().Value(auth.UserKey).(int)
+	h.auditAuth(r, id, "", types.AuthForcedLogout, fmt.Sprintf("by user %d, %d sessions", adminID, revoked))
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"msg": "user logged out of all devices",
+		"sessions": revoked,
+	})
+}
@@ -0,0 +1,291 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/gorilla/mux"
+)
+
+type session struct {
+	user_id		int
+	family		string
+	revoked		bool
+	replaced_by	string
+	rotated_at	time.Time
+	expiration	time.Time
+}
+
+// sessionStore rotates refresh tokens the way the sessions table does, one rotation at a time like the
+// FOR UPDATE lock, calling anything else panics on the nil interface
+type sessionStore struct {
+	types.UserStore
+	mu			sync.Mutex
+	sessions	map[string]*session
+	events		[]string
+}
+
+func (s *sessionStore) RotateSession(old_token string, next types.Session, grace time.Duration) (*types.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.sessions[old_token]
+	if !ok {
+		return nil, types.ErrSessionNotFound
+	}
+
+	if old.replaced_by != "" {
+		if successor := s.sessions[old.replaced_by]; !successor.revoked && time.Since(old.rotated_at) < grace {
+			return &types.Session{Userid: old.user_id, RefreshToken: old.replaced_by, Expiration: successor.expiration}, nil
+		}
+
+		for _, session := range s.sessions {
+			if session.family == old.family {
+				session.revoked = true
+			}
+		}
+		return nil, types.ErrRefreshTokenReused
+	}
+
+	if old.revoked {
+		return nil, types.ErrSessionRevoked
+	}
+
+	s.sessions[next.RefreshToken] = &session{user_id: old.user_id, family: old.family, expiration: old.expiration}
+	old.revoked = true
+	old.replaced_by = next.RefreshToken
+	old.rotated_at = time.Now()
+
+	return &types.Session{Userid: old.user_id, RefreshToken: next.RefreshToken, Expiration: old.expiration}, nil
+}
+
+func (s *sessionStore) RecordAuthEvent(event types.AuthEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event.Event)
+	return nil
+}
+
+func refresh(h *Handler, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/user/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: "refresh_token", Value: token})
+
+	w := httptest.NewRecorder()
+	h.handleRenewToken(w, r)
+
+	return w
+}
+
+func refreshCookie(w *httptest.ResponseRecorder) string {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "refresh_token" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestRefreshCookieLastsAsLongAsSession(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	token, err := auth.CreateRefreshJWT(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logged in 20 days ago with the default 30 day refresh lifetime
+	expiration := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	store := &sessionStore{sessions: map[string]*session{token: {user_id: 3, family: "login", expiration: expiration}}}
+	h := NewHandler(store, nil, nil)
+
+	w := refresh(h, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("refresh = %d %s", w.Code, w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "refresh_token" && !cookie.Expires.Equal(expiration) {
+			t.Fatalf("refresh cookie expires %v, want the session's %v", cookie.Expires, expiration)
+		}
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_REFRESH_GRACE", "200ms")
+
+	token, err := auth.CreateRefreshJWT(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &sessionStore{sessions: map[string]*session{token: {user_id: 3, family: "login"}}}
+	h := NewHandler(store, nil, nil)
+
+	// Every tab of the web app refreshes with the same cookie when the access token runs out
+	const tabs = 5
+	results := make([]*httptest.ResponseRecorder, tabs)
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = refresh(h, token)
+		}(i)
+	}
+	wg.Wait()
+
+	next := refreshCookie(results[0])
+	for i, w := range results {
+		if w.Code != http.StatusCreated {
+			t.Fatalf("tab %d refresh = %d %s", i, w.Code, w.Body.String())
+		}
+		if refreshCookie(w) != next {
+			t.Fatalf("tab %d got another refresh token, the tabs would log each other out", i)
+		}
+	}
+
+	if len(store.events) != 0 {
+		t.Fatalf("concurrent refreshes recorded %v", store.events)
+	}
+
+	// The token won is good for the next refresh
+	if w := refresh(h, next); w.Code != http.StatusCreated {
+		t.Fatalf("refresh with the new token = %d %s", w.Code, w.Body.String())
+	}
+
+	// Past the grace window the old token is a copy and the login is revoked
+	time.Sleep(250 * time.Millisecond)
+
+	if w := refresh(h, token); w.Code != http.StatusUnauthorized {
+		t.Fatalf("late reuse = %d, want 401", w.Code)
+	}
+	if len(store.events) != 1 || store.events[0] != types.AuthRefreshTokenReuse {
+		t.Fatalf("events = %v, want the reuse recorded", store.events)
+	}
+	for _, session := range store.sessions {
+		if !session.revoked {
+			t.Fatal("a session of the reused login is still live")
+		}
+	}
+}
+
+// resetStore holds one reset link, a failed reset must leave it usable. Calling anything else panics on the nil
+// interface, ConsumeUserToken included
+type resetStore struct {
+	types.UserStore
+	token_hash	string
+	used		bool
+	failSet		bool
+	password	string
+}
+
+func (s *resetStore) ResetPassword(token_hash string, password_hash string) (int, error) {
+	if token_hash != s.token_hash || s.used {
+		return 0, types.ErrInvalidUserToken
+	}
+	if s.failSet {
+		return 0, errors.New("connection reset")	// Rolled back with the token
+	}
+
+	s.used = true
+	s.password = password_hash
+	return 5, nil
+}
+
+func (s *resetStore) RecordAuthEvent(event types.AuthEvent) error {
+	return nil
+}
+
+func TestResetPassword(t *testing.T) {
+	store := &resetStore{token_hash: auth.HashToken("link-token"), failSet: true}
+	h := NewHandler(store, nil, nil)
+
+	reset := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/user/reset-password", strings.NewReader(`{"token": "link-token", "password": "new-secret"}`))
+		w := httptest.NewRecorder()
+		h.handleResetPassword(w, r)
+		return w
+	}
+
+	if w := reset(); w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed reset = %d %s, want 500", w.Code, w.Body.String())
+	}
+
+	// The link still works once the database is back
+	store.failSet = false
+	if w := reset(); w.Code != http.StatusOK || !auth.ComparePasswords(store.password, []byte("new-secret")) {
+		t.Fatalf("retry = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := reset(); w.Code != http.StatusBadRequest {
+		t.Fatalf("reuse = %d, want 400", w.Code)
+	}
+}
+
+// logoutStore has users 2 and 3, only user 2 has live sessions. Calling anything else panics on the nil
+// interface
+type logoutStore struct {
+	types.UserStore
+	live	map[int]int64
+	events	[]string
+}
+
+func (s *logoutStore) GetUserById(id int) (*types.User, error) {
+	if id != 2 && id != 3 {
+		return nil, errors.New("user not found")
+	}
+	return &types.User{ID: id}, nil
+}
+
+func (s *logoutStore) RevokeSessionBulk(id int) (int64, error) {
+	revoked := s.live[id]
+	delete(s.live, id)
+	return revoked, nil
+}
+
+func (s *logoutStore) RecordAuthEvent(event types.AuthEvent) error {
+	s.events = append(s.events, event.Event)
+	return nil
+}
+
+func TestForceLogout(t *testing.T) {
+	store := &logoutStore{live: map[int]int64{2: 3}}
+	h := NewHandler(store, nil, nil)
+
+	tests := []struct {
+		name	string
+		id		string
+		status	int
+	}{
+		{"live sessions", "2", http.StatusOK},
+		{"already logged out", "2", http.StatusOK},
+		{"never logged in", "3", http.StatusOK},
+		{"unknown user", "9", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.SetURLVars(httptest.NewRequest("POST", "/api/user/admin/users/"+tt.id+"/logout", nil), map[string]string{"id": tt.id})
+			w := httptest.NewRecorder()
+			h.handleForceLogout(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("force logout = %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+
+	if len(store.events) != 3 {
+		t.Fatalf("events = %v, want every logout audited", store.events)
+	}
+}
@@ -0,0 +1,220 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/oidc"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+)
+
+// oidcStateCookie carries state, nonce and PKCE verifier from /oidc/login to /oidc/callback
+const oidcStateCookie = "oidc_state"
+
+// handleOIDCLogin sends the browser to the identity provider
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("single sign-on is not configured"))
+		return
+	}
+
+	var parts [3]string
+	for i := range parts {
+		value, err := auth.NewUserToken()
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error starting single sign-on: %v", err))
+			return
+		}
+		parts[i] = value
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+
+	target, err := h.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("single sign-on unavailable: %v", err)
+		utils.WriteError(w, http.StatusBadGateway, fmt.Errorf("single sign-on is unavailable"))
+		return
+	}
+
+	// Lax so the cookie comes back on the provider's top level redirect to the callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes single sign-on and sends the browser back to the web app logged in, or to its
+// login page with sso_error or, when two-factor applies, an mfa_token in the fragment for /login/2fa
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("single sign-on is not configured"))
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	if err != nil {
+		ssoError(w, r, "single sign-on expired, try again")
+		return
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	query := r.URL.Query()
+	if len(parts) != 3 || query.Get("state") != parts[0] {
+		ssoError(w, r, "single sign-on state mismatch, try again")
+		return
+	}
+
+	if query.Get("error") != "" {
+		ssoError(w, r, "identity provider refused the login: "+query.Get("error"))
+		return
+	}
+
+	identity, err := h.oidc.Exchange(r.Context(), query.Get("code"), parts[2], parts[1])
+	if err != nil {
+		log.Printf("single sign-on failed: %v", err)
+		ssoError(w, r, "single sign-on failed")
+		return
+	}
+
+	u, err := h.oidcUser(r, identity)
+	if err != nil {
+		h.auditAuth(r, 0, identity.Email, types.AuthLoginFailure, "single sign-on: "+err.Error())
+		ssoError(w, r, err.Error())
+		return
+	}
+
+	if !u.Active {
+		h.auditAuth(r, u.ID, u.Email, types.AuthLoginFailure, "account deactivated")
+		ssoError(w, r, "account deactivated")
+		return
+	}
+
+	// The provider may enforce its own second factor, OIDC_TRUST_MFA=true skips ours
+	if os.Getenv("OIDC_TRUST_MFA") != "true" {
+		required, err := h.mfaRequired(u.Role)
+		if err != nil {
+			log.Printf("error checking two-factor policy: %v", err)
+			ssoError(w, r, "single sign-on failed")
+			return
+		}
+
+		if u.TOTPEnabled || required {
+			mfaToken, err := auth.CreateMFAToken(u.ID)
+			if err != nil {
+				log.Printf("error generating token: %v", err)
+				ssoError(w, r, "single sign-on failed")
+				return
+			}
+
+			fragment := url.Values{"mfa_token": {mfaToken}}
+			if !u.TOTPEnabled {
+				fragment.Set("mfa_enrollment", "true")
+			}
+
+			http.Redirect(w, r, appURL("/login")+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+	}
+
+	if err := h.startSession(w, r, u); err != nil {
+		log.Printf("single sign-on failed: %v", err)
+		ssoError(w, r, "single sign-on failed")
+		return
+	}
+
+	h.auditAuth(r, u.ID, u.Email, types.AuthLoginSuccess, "single sign-on")
+
+	http.Redirect(w, r, appURL("/"), http.StatusFound)
+}
+
+// oidcUser finds the user of a provider account: by subject, else by a verified email which then gets
+// linked unless the user is an admin or supervisor, else a new user when OIDC_AUTO_PROVISION=true with role
+// OIDC_DEFAULT_ROLE
+func (h *Handler) oidcUser(r *http.Request, identity *oidc.Identity) (*types.User, error) {
+	if u, err := h.store.GetUserByOIDC(identity.Issuer, identity.Subject); err == nil {
+		return u, nil
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, fmt.Errorf("identity provider did not share a verified email")
+	}
+
+	email := utils.SanitizeInput(identity.Email)
+
+	if u, err := h.store.GetUserByEmail(email); err == nil {
+		// Whoever controls the email at the provider would get the account, too much to hand over for these
+		if u.Role == types.RoleAdmin || u.Role == types.RoleSupervisor {
+			return nil, fmt.Errorf("%s accounts are not linked by email, sign in with your password", u.Role)
+		}
+
+		if err := h.store.LinkOIDC(u.ID, identity.Issuer, identity.Subject); err != nil {
+			return nil, err
+		}
+		h.auditAuth(r, u.ID, email, types.AuthSSOLinked, identity.Issuer+" "+identity.Subject)
+		return u, nil
+	}
+
+	if os.Getenv("OIDC_AUTO_PROVISION") != "true" {
+		return nil, fmt.Errorf("no account for %s, ask an admin to create one", email)
+	}
+
+	role := os.Getenv("OIDC_DEFAULT_ROLE")
+	switch role {
+	case types.RoleAdmin, types.RoleSupervisor, types.RoleStaff:
+	default:
+		role = types.RoleStaff
+	}
+
+	username := strings.TrimSpace(identity.Name)
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+
+	// Single sign-on users get a password nobody knows, a reset can set a real one
+	random, err := auth.NewUserToken()
+	if err != nil {
+		return nil, err
+	}
+	password, err := auth.HashPass(random)
+	if err != nil {
+		return nil, err
+	}
+
+	u := types.User{
+		Username: username,
+		Email: email,
+		Password: password,
+		Role: role,
+		EmailVerified: true,
+		Active: true,
+	}
+
+	u.ID, err = h.store.CreateOIDCUser(u, identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("could not create account: %v", err)
+	}
+
+	h.auditAuth(r, u.ID, email, types.AuthSSOProvisioned, identity.Issuer+" "+identity.Subject)
+
+	return &u, nil
+}
+
+// ssoError sends the browser back to the web app's login page with the reason
+func ssoError(w http.ResponseWriter, r *http.Request, reason string) {
+	http.Redirect(w, r, appURL("/login")+"?sso_error="+url.QueryEscape(reason), http.StatusFound)
+}
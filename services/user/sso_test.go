@@ -0,0 +1,211 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/services/oidc"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+type link struct {
+	user_id	int
+	issuer	string
+	subject	string
+}
+
+// ssoStore has password users and the provider accounts linked to them, calling anything else panics on the
+// nil interface
+type ssoStore struct {
+	types.UserStore
+	users		[]types.User
+	links		[]link
+	sessions	[]types.Session
+	events		[]string
+}
+
+func (s *ssoStore) GetUserByOIDC(issuer string, subject string) (*types.User, error) {
+	for _, l := range s.links {
+		if l.issuer == issuer && l.subject == subject {
+			for _, u := range s.users {
+				if u.ID == l.user_id {
+					return &u, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *ssoStore) GetUserByEmail(email string) (*types.User, error) {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Email, email) {
+			return &u, nil
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *ssoStore) LinkOIDC(user_id int, issuer string, subject string) error {
+	s.links = append(s.links, link{user_id, issuer, subject})
+	return nil
+}
+
+func (s *ssoStore) GetMFARequiredRoles() ([]string, error) {
+	return nil, nil
+}
+
+func (s *ssoStore) CreateSession(ctx context.Context, session types.Session) error {
+	s.sessions = append(s.sessions, session)
+	return nil
+}
+
+func (s *ssoStore) RecordAuthEvent(event types.AuthEvent) error {
+	s.events = append(s.events, event.Event)
+	return nil
+}
+
+func newSSOHandler(t *testing.T) (*Handler, *ssoStore, *oidc.MockIdP) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("APP_URL", "http://app.test")
+	t.Setenv("OIDC_AUTO_PROVISION", "")
+
+	idp, err := oidc.NewMockIdP("", "inventory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	idp.Issuer = server.URL
+
+	store := &ssoStore{users: []types.User{{ID: 4, Email: "staff@example.com", Role: types.RoleStaff, Active: true}}}
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer: server.URL,
+		ClientID: "inventory",
+		RedirectURL: "http://api.test/api/user/oidc/callback",
+	})
+
+	return NewHandler(store, nil, provider), store, idp
+}
+
+// ssoLogin goes through /oidc/login, the provider's login form and /oidc/callback, tamper changes the callback
+// query before it reaches us. It returns where the callback sends the browser
+func ssoLogin(t *testing.T, h *Handler, form url.Values, tamper func(url.Values)) *url.URL {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.handleOIDCLogin(w, httptest.NewRequest("GET", "/api/user/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Post(w.Header().Get("Location"), "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := res.Location()
+	if err != nil {
+		t.Fatalf("provider login = %s, want a redirect to the callback", res.Status)
+	}
+
+	query := callback.Query()
+	if tamper != nil {
+		tamper(query)
+	}
+
+	r := httptest.NewRequest("GET", "/api/user/oidc/callback?"+query.Encode(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+
+	w = httptest.NewRecorder()
+	h.handleOIDCCallback(w, r)
+
+	target, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("callback = %d %s", w.Code, w.Body.String())
+	}
+
+	return target
+}
+
+func TestSSOLinksVerifiedEmail(t *testing.T) {
+	h, store, idp := newSSOHandler(t)
+
+	form := url.Values{"email": {"Staff@Example.com"}, "email_verified": {"true"}, "sub": {"idp-user-1"}}
+	target := ssoLogin(t, h, form, nil)
+	if target.String() != "http://app.test/" {
+		t.Fatalf("callback sent the browser to %s, want the app", target)
+	}
+
+	if len(store.links) != 1 || store.links[0] != (link{4, idp.Issuer, "idp-user-1"}) {
+		t.Fatalf("links = %+v, want the provider account linked to user 4", store.links)
+	}
+	if len(store.sessions) != 1 || store.sessions[0].Userid != 4 {
+		t.Fatalf("sessions = %+v, want user 4 logged in", store.sessions)
+	}
+	if left := time.Until(store.sessions[0].Expiration); left > auth.RefreshTokenTTL() || left < auth.RefreshTokenTTL() - time.Minute {
+		t.Fatalf("session expires in %v, want the refresh lifetime", left)
+	}
+
+	// The next login finds the user by the link
+	target = ssoLogin(t, h, form, nil)
+	if target.String() != "http://app.test/" || len(store.links) != 1 {
+		t.Fatalf("second login went to %s with %d links", target, len(store.links))
+	}
+}
+
+func TestSSOUnverifiedEmailNotLinked(t *testing.T) {
+	h, store, _ := newSSOHandler(t)
+
+	target := ssoLogin(t, h, url.Values{"email": {"staff@example.com"}, "sub": {"idp-user-1"}}, nil)
+	if !strings.Contains(target.Query().Get("sso_error"), "verified email") {
+		t.Fatalf("callback sent the browser to %s, want a verified email asked for", target)
+	}
+
+	if len(store.links) != 0 || len(store.sessions) != 0 {
+		t.Fatalf("an unverified email was linked or logged in, links %+v", store.links)
+	}
+}
+
+func TestSSOPrivilegedEmailNotLinked(t *testing.T) {
+	h, store, _ := newSSOHandler(t)
+	store.users = append(store.users, types.User{ID: 1, Email: "admin@example.com", Role: types.RoleAdmin, Active: true})
+
+	form := url.Values{"email": {"admin@example.com"}, "email_verified": {"true"}, "sub": {"idp-user-1"}}
+	target := ssoLogin(t, h, form, nil)
+	if !strings.Contains(target.Query().Get("sso_error"), "not linked by email") {
+		t.Fatalf("callback sent the browser to %s, want the admin account refused", target)
+	}
+
+	if len(store.links) != 0 || len(store.sessions) != 0 {
+		t.Fatalf("an admin account was linked or logged in by email, links %+v", store.links)
+	}
+}
+
+func TestSSOStateMismatch(t *testing.T) {
+	h, store, _ := newSSOHandler(t)
+
+	form := url.Values{"email": {"staff@example.com"}, "email_verified": {"true"}}
+	target := ssoLogin(t, h, form, func(query url.Values) {
+		query.Set("state", "someone-elses-state")
+	})
+	if !strings.Contains(target.Query().Get("sso_error"), "state mismatch") {
+		t.Fatalf("callback sent the browser to %s, want a state mismatch", target)
+	}
+
+	if len(store.links) != 0 || len(store.sessions) != 0 {
+		t.Fatal("a callback with another login's state logged the user in")
+	}
+}
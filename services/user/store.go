@@ -5,6 +5,8 @@ import (
 	"context"
 	"github.com/PatrickA727/mikrotik-db-sys/types"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type Store struct {
@@ -25,21 +27,31 @@ func (s *Store) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
     return tx, nil
 }
 
-func (s *Store) RegisterNewUser(user types.User) error {
-	_, err := s.db.Exec("INSERT INTO users (username, email, password) VALUES ($1, $2, $3)", 
-				user.Username, user.Email, user.Password,
-			)
+// RegisterNewUser creates an unverified user, staff unless a role is given
+func (s *Store) RegisterNewUser(user types.User) (int, error) {
+	if user.Role == "" {
+		user.Role = types.RoleStaff
+	}
+
+	id := 0
+	err := s.db.QueryRow("INSERT INTO users (username, email, password, role) VALUES ($1, $2, $3, $4) RETURNING id", 
+				user.Username, user.Email, user.Password, user.Role,
+			).Scan(&id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return id, nil
 }
 
-func (s *Store) GetUserByEmail(email string) (*types.User, error) {
+const userColumns = `id, createdat, username, email, password, role, email_verified_at IS NOT NULL,
+					 totp_enabled_at IS NOT NULL, deactivated_at IS NULL`
+
+func scanUser(row interface{ Scan(dest ...any) error }) (*types.User, error) {
 	var user types.User
-	err := s.db.QueryRow("SELECT id,username, email, password FROM users WHERE email = $1", email).Scan(
-		&user.ID, &user.Username, &user.Email, &user.Password)
+
+	err := row.Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password, &user.Role,
+		&user.EmailVerified, &user.TOTPEnabled, &user.Active)
 	if err != nil {
 		return nil, err
 	}
@@ -47,15 +59,168 @@ func (s *Store) GetUserByEmail(email string) (*types.User, error) {
 	return &user, nil
 }
 
+func (s *Store) GetUserByEmail(email string) (*types.User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE email = $1", email))
+}
+
 func (s *Store) GetUserById(id int) (*types.User, error) {
-	var user types.User
-	err := s.db.QueryRow("SELECT id,username, email FROM users WHERE id = $1", id).Scan(
-		&user.ID, &user.Username, &user.Email)
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s *Store) GetUserByOIDC(issuer string, subject string) (*types.User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2", issuer, subject))
+}
+
+// LinkOIDC ties an existing user to their identity provider account, a user links to one account only
+func (s *Store) LinkOIDC(user_id int, issuer string, subject string) error {
+	res, err := s.db.Exec("UPDATE users SET oidc_issuer = $1, oidc_subject = $2 WHERE id = $3 AND oidc_subject IS NULL",
+		issuer, subject, user_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user is already linked to another single sign-on account")
+	}
+
+	return nil
+}
+
+// CreateOIDCUser provisions a user on their first single sign-on, the provider verified the email
+func (s *Store) CreateOIDCUser(user types.User, issuer string, subject string) (int, error) {
+	id := 0
+	err := s.db.QueryRow(`INSERT INTO users (username, email, password, role, email_verified_at, oidc_issuer, oidc_subject)
+						  VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, $5, $6) RETURNING id`,
+		user.Username, user.Email, user.Password, user.Role, issuer, subject,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetUsers lists every user, deactivated ones included, active first
+func (s *Store) GetUsers() ([]types.User, error) {
+	var users []types.User
+
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY deactivated_at IS NOT NULL, username")
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *Store) EditUser(id int, payload types.EditUserPayload) error {
+	var setClauses []string
+	var args []interface{}
+
+	argIndex := 1
+
+	if strings.TrimSpace(payload.Username) != "" {
+		setClauses = append(setClauses, fmt.Sprintf("username = $%d", argIndex))
+		args = append(args, strings.TrimSpace(payload.Username))
+		argIndex++
+	}
+
+	if strings.TrimSpace(payload.Email) != "" {
+		setClauses = append(setClauses, fmt.Sprintf("email = $%d", argIndex))
+		args = append(args, strings.TrimSpace(payload.Email))
+		argIndex++
+	}
+
+	if payload.Role != "" {
+		setClauses = append(setClauses, fmt.Sprintf("role = $%d", argIndex))
+		args = append(args, payload.Role)
+		argIndex++
+	}
+
+	if len(setClauses) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE users SET %s WHERE id = $%d",
+		strings.Join(setClauses, ", "), argIndex)
+
+	args = append(args, id)
+
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// SetUserActive deactivates or reactivates a user, deactivating also revokes every session in the same
+// transaction
+func (s *Store) SetUserActive(id int, active bool) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	res, err := tx.Exec(`UPDATE users SET deactivated_at = CASE WHEN $1 THEN NULL ELSE COALESCE(deactivated_at, CURRENT_TIMESTAMP) END
+						 WHERE id = $2`, active, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	if !active {
+		if _, err = tx.Exec("UPDATE sessions SET is_revoked = TRUE WHERE userid = $1 AND is_revoked = FALSE", id); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (s *Store) DeleteUserById(id int, ctx context.Context) error {
@@ -68,8 +233,9 @@ func (s *Store) DeleteUserById(id int, ctx context.Context) error {
 }
 
 func (s *Store) CreateSession(ctx context.Context, session types.Session) error {
-	_, err := s.db.ExecContext(ctx, "INSERT INTO sessions (userid, refresh_token) VALUES ($1, $2)", 
-			session.Userid, session.RefreshToken,
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sessions (userid, refresh_token, family_id, expiration, user_agent, ip_address)
+									 VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))`, 
+			session.Userid, session.RefreshToken, session.FamilyID, session.Expiration, truncate(session.UserAgent, 512), session.IPAddress,
 	)
 	if err != nil {
 		return err
@@ -97,29 +263,24 @@ func (s *Store) RevokeSession(session types.Session) error {
 
 	return nil
 }
-func (s *Store) RevokeSessionBulk(id int) error {
-	res, err := s.db.Exec("UPDATE sessions SET is_revoked = TRUE where userid = $1", id)
+// RevokeSessionBulk logs the user out everywhere and returns how many live sessions that ended, none is fine
+func (s *Store) RevokeSessionBulk(id int) (int64, error) {
+	res, err := s.db.Exec("UPDATE sessions SET is_revoked = TRUE WHERE userid = $1 AND is_revoked = FALSE", id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Check if any rows were updated
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error checking affected rows: %v", err)
+		return 0, fmt.Errorf("error checking affected rows: %v", err)
 	}
 
-	// If no rows were affected, return an error indicating the session wasn't found
-	if rowsAffected == 0 {
-		return fmt.Errorf("session not found or already revoked")
-	}
-
-	return nil
+	return rowsAffected, nil
 }
 
 func (s *Store) CheckSession(tokenString string) (bool, int, error) {
 	var session types.Session
-	err := s.db.QueryRow("SELECT userid FROM sessions WHERE refresh_token = $1 AND is_revoked = FALSE", 
+	err := s.db.QueryRow("SELECT userid FROM sessions WHERE refresh_token = $1 AND is_revoked = FALSE AND expiration > CURRENT_TIMESTAMP", 
 	tokenString).Scan(&session.Userid)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -129,4 +290,731 @@ func (s *Store) CheckSession(tokenString string) (bool, int, error) {
 	}
 
 	return true, session.Userid, nil
-}
\ No newline at end of file
+}
+
+// RotateSession swaps a refresh token for a new one and returns the session to hand out. The new session keeps
+// the old one's expiration, so a login never outlives it, and records the device that
+// refreshed. A token rotated less than grace ago gets its successor back, that is another tab that refreshed at
+// the same time. Presented any later it means the token was copied, every session of that login is revoked
+func (s *Store) RotateSession(old_token string, next types.Session, grace time.Duration) (rotated *types.Session, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		// A detected reuse still commits, the family revocation has to stick
+		if err != nil && err != types.ErrRefreshTokenReused {
+			tx.Rollback()
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			err = commitErr
+		}
+	}()
+
+	var id, user_id int
+	var family_id string
+	var is_revoked, expired bool
+	var replaced_by sql.NullInt64
+
+	err = tx.QueryRow(`SELECT id, userid, family_id, is_revoked, replaced_by, expiration <= CURRENT_TIMESTAMP
+					   FROM sessions WHERE refresh_token = $1 FOR UPDATE`, old_token,
+	).Scan(&id, &user_id, &family_id, &is_revoked, &replaced_by, &expired)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if replaced_by.Valid {
+		successor := types.Session{Userid: user_id, FamilyID: family_id}
+		err = tx.QueryRow(`SELECT refresh_token, expiration FROM sessions
+						   WHERE id = $1 AND is_revoked = FALSE AND expiration > CURRENT_TIMESTAMP
+						   AND (SELECT rotated_at FROM sessions WHERE id = $2) > CURRENT_TIMESTAMP - make_interval(secs => $3)`,
+			replaced_by.Int64, id, grace.Seconds(),
+		).Scan(&successor.RefreshToken, &successor.Expiration)
+		if err == nil {
+			return &successor, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		if _, err = tx.Exec("UPDATE sessions SET is_revoked = TRUE WHERE family_id = $1", family_id); err != nil {
+			return nil, err
+		}
+		return nil, types.ErrRefreshTokenReused
+	}
+
+	if is_revoked {
+		return nil, types.ErrSessionRevoked
+	}
+
+	if expired {
+		return nil, types.ErrSessionExpired
+	}
+
+	new_id := 0
+	next.Userid, next.FamilyID = user_id, family_id
+	err = tx.QueryRow(`INSERT INTO sessions (userid, refresh_token, family_id, expiration, user_agent, ip_address)
+					   SELECT userid, $1, family_id, expiration, COALESCE(NULLIF($3, ''), user_agent), COALESCE(NULLIF($4, ''), ip_address)
+					   FROM sessions WHERE id = $2 RETURNING id, expiration`,
+		next.RefreshToken, id, truncate(next.UserAgent, 512), next.IPAddress,
+	).Scan(&new_id, &next.Expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET is_revoked = TRUE, replaced_by = $1, rotated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		new_id, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// GetSessions lists the logins still able to refresh, only the newest row of a family is unrevoked. User 0
+// lists every user's, current_token marks the login the caller is on
+func (s *Store) GetSessions(user_id int, current_token string) ([]types.SessionInfo, error) {
+	var sessions []types.SessionInfo
+
+	rows, err := s.db.Query(`SELECT s.family_id, s.userid, COALESCE(s.user_agent, ''), COALESCE(s.ip_address, ''),
+								f.started, s.last_used_at, s.expiration, s.refresh_token = $2
+							 FROM sessions s
+							 JOIN (
+								SELECT family_id, MIN(createdat) AS started FROM sessions
+								WHERE $1 = 0 OR userid = $1
+								GROUP BY family_id
+							 ) f ON f.family_id = s.family_id
+							 WHERE s.is_revoked = FALSE AND s.expiration > CURRENT_TIMESTAMP AND ($1 = 0 OR s.userid = $1)
+							 ORDER BY s.last_used_at DESC`, user_id, current_token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var session types.SessionInfo
+
+		if err := rows.Scan(&session.ID, &session.Userid, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.Expiration, &session.Current); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSessionFamily logs out one login on every rotation of it, user 0 is for admins revoking anyone's
+func (s *Store) RevokeSessionFamily(family_id string, user_id int) error {
+	res, err := s.db.Exec("UPDATE sessions SET is_revoked = TRUE WHERE family_id = $1 AND ($2 = 0 OR userid = $2) AND is_revoked = FALSE",
+		family_id, user_id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return types.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) CreateDevice(device types.Device) (int, error) {
+	id := 0
+	err := s.db.QueryRow("INSERT INTO devices (name, key_id, secret, created_by) VALUES ($1, $2, $3, NULLIF($4, 0)) RETURNING id",
+		strings.TrimSpace(device.Name), device.KeyID, device.Secret, device.CreatedBy,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+const deviceColumns = "id, name, key_id, secret, COALESCE(created_by, 0), createdat, last_seen_at, revoked_at"
+
+func scanDevice(row interface{ Scan(dest ...any) error }) (types.Device, error) {
+	var device types.Device
+	var last_seen_at, revoked_at sql.NullTime
+
+	err := row.Scan(&device.ID, &device.Name, &device.KeyID, &device.Secret, &device.CreatedBy, &device.CreatedAt, &last_seen_at, &revoked_at)
+	if err != nil {
+		return device, err
+	}
+
+	if last_seen_at.Valid {
+		device.LastSeenAt = &last_seen_at.Time
+	}
+	if revoked_at.Valid {
+		device.RevokedAt = &revoked_at.Time
+	}
+
+	return device, nil
+}
+
+func (s *Store) GetDevices() ([]types.Device, error) {
+	var devices []types.Device
+
+	rows, err := s.db.Query("SELECT " + deviceColumns + " FROM devices ORDER BY revoked_at IS NOT NULL, name")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, device)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// GetActiveDevice finds the device signing a request, revoked devices are not found
+func (s *Store) GetActiveDevice(key_id string) (*types.Device, error) {
+	device, err := scanDevice(s.db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE key_id = $1 AND revoked_at IS NULL", key_id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+func (s *Store) RevokeDevice(id int) error {
+	res, err := s.db.Exec("UPDATE devices SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("device not found or already revoked")
+	}
+
+	return nil
+}
+
+func (s *Store) TouchDevice(id int) error {
+	_, err := s.db.Exec("UPDATE devices SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1", id)
+	return err
+}
+
+// SetPassword replaces the password hash and logs the user out everywhere, in one transaction
+func (s *Store) SetPassword(user_id int, password_hash string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return setPassword(tx, user_id, password_hash)
+}
+
+// ResetPassword uses up a reset token and sets the password in one transaction, so a failure leaves the link
+// working. Following the link also proves the user owns the address
+func (s *Store) ResetPassword(token_hash string, password_hash string) (user_id int, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = tx.QueryRow(`UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+					   WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+					   RETURNING userid`, token_hash, types.TokenPasswordReset,
+	).Scan(&user_id)
+	if err == sql.ErrNoRows {
+		return 0, types.ErrInvalidUserToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = setPassword(tx, user_id, password_hash); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = $1", user_id)
+	if err != nil {
+		return 0, err
+	}
+
+	return user_id, nil
+}
+
+func setPassword(tx *sql.Tx, user_id int, password_hash string) error {
+	res, err := tx.Exec("UPDATE users SET password = $1 WHERE id = $2", password_hash, user_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	// Reset links still out there go too, the new password supersedes them
+	_, err = tx.Exec("UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE userid = $1 AND purpose = $2 AND used_at IS NULL",
+		user_id, types.TokenPasswordReset,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET is_revoked = TRUE WHERE userid = $1 AND is_revoked = FALSE", user_id)
+	return err
+}
+
+func (s *Store) VerifyEmail(user_id int) error {
+	_, err := s.db.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = $1", user_id)
+	return err
+}
+
+// CreateUserToken stores a mailed token's hash, earlier unused tokens for the same purpose stop working
+func (s *Store) CreateUserToken(user_id int, purpose string, token_hash string, expires_at time.Time) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	_, err = tx.Exec("UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE userid = $1 AND purpose = $2 AND used_at IS NULL",
+		user_id, purpose,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_tokens (userid, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		user_id, purpose, token_hash, expires_at,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeUserToken uses up a token and returns its user, a token works once and only before it expires
+func (s *Store) ConsumeUserToken(purpose string, token_hash string) (int, error) {
+	user_id := 0
+	err := s.db.QueryRow(`UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+						  WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+						  RETURNING userid`, token_hash, purpose,
+	).Scan(&user_id)
+	if err == sql.ErrNoRows {
+		return 0, types.ErrInvalidUserToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return user_id, nil
+}
+
+const throttleColumns = "scope, subject, failures, last_failure_at, locked_until"
+
+func scanThrottle(row interface{ Scan(dest ...any) error }) (types.LoginThrottle, error) {
+	var throttle types.LoginThrottle
+	var locked_until sql.NullTime
+
+	err := row.Scan(&throttle.Scope, &throttle.Subject, &throttle.Failures, &throttle.LastFailureAt, &locked_until)
+	if err != nil {
+		return throttle, err
+	}
+
+	if locked_until.Valid {
+		throttle.LockedUntil = &locked_until.Time
+	}
+
+	return throttle, nil
+}
+
+// GetLoginThrottles returns the counters of the account and the IP a request comes from, either may be missing
+func (s *Store) GetLoginThrottles(scopes types.ThrottleScopes, email string, ip string) ([]types.LoginThrottle, error) {
+	var throttles []types.LoginThrottle
+
+	rows, err := s.db.Query("SELECT "+throttleColumns+" FROM login_throttles WHERE (scope = $1 AND subject = $2) OR (scope = $3 AND subject = $4)",
+		scopes.Account, email, scopes.IP, ip,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		throttle, err := scanThrottle(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		throttles = append(throttles, throttle)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
+
+// RecordLoginFailure counts a failure, starting over when the last one was before reset_before, and locks
+// until locked_until once there are lock_after of them
+func (s *Store) RecordLoginFailure(scope string, subject string, now time.Time, reset_before time.Time, lock_after int, locked_until time.Time) (*types.LoginThrottle, error) {
+	throttle, err := scanThrottle(s.db.QueryRow(`INSERT INTO login_throttles (scope, subject, failures, last_failure_at, locked_until)
+												 VALUES ($1, $2, 1, $3, CASE WHEN $5 <= 1 THEN $6::timestamp END)
+												 ON CONFLICT (scope, subject) DO UPDATE SET
+													failures = CASE WHEN login_throttles.last_failure_at < $4 THEN 1 ELSE login_throttles.failures + 1 END,
+													last_failure_at = $3,
+													locked_until = CASE
+														WHEN (CASE WHEN login_throttles.last_failure_at < $4 THEN 1 ELSE login_throttles.failures + 1 END) >= $5 THEN $6::timestamp
+														ELSE login_throttles.locked_until
+													END
+												 RETURNING `+throttleColumns,
+		scope, subject, now, reset_before, lock_after, locked_until,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+func (s *Store) ClearLoginThrottle(scope string, subject string) error {
+	_, err := s.db.Exec("DELETE FROM login_throttles WHERE scope = $1 AND subject = $2", scope, subject)
+	return err
+}
+
+// GetLockouts lists the accounts and IPs locked out at now
+func (s *Store) GetLockouts(now time.Time) ([]types.LoginThrottle, error) {
+	var throttles []types.LoginThrottle
+
+	rows, err := s.db.Query("SELECT "+throttleColumns+" FROM login_throttles WHERE locked_until > $1 ORDER BY locked_until DESC", now)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		throttle, err := scanThrottle(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		throttles = append(throttles, throttle)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
+
+func (s *Store) RecordAuthEvent(event types.AuthEvent) error {
+	_, err := s.db.Exec(`INSERT INTO auth_events (userid, email, event, ip_address, user_agent, detail)
+						 VALUES (NULLIF($1, 0), NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''))`,
+		event.Userid, truncate(event.Email, 255), event.Event, event.IPAddress, truncate(event.UserAgent, 512), event.Detail,
+	)
+	return err
+}
+
+// GetAuthEvents returns the newest events first, of one user or of everyone when user_id is 0
+func (s *Store) GetAuthEvents(user_id int, limit int) ([]types.AuthEvent, error) {
+	var events []types.AuthEvent
+
+	rows, err := s.db.Query(`SELECT id, COALESCE(userid, 0), COALESCE(email, ''), event, COALESCE(ip_address, ''),
+								COALESCE(user_agent, ''), COALESCE(detail, ''), createdat
+							 FROM auth_events WHERE $1 = 0 OR userid = $1
+							 ORDER BY createdat DESC, id DESC LIMIT $2`, user_id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var event types.AuthEvent
+
+		if err := rows.Scan(&event.ID, &event.Userid, &event.Email, &event.Event, &event.IPAddress,
+			&event.UserAgent, &event.Detail, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s *Store) GetTOTP(user_id int) (*types.TOTPState, error) {
+	var state types.TOTPState
+
+	err := s.db.QueryRow("SELECT COALESCE(totp_secret, ''), totp_enabled_at IS NOT NULL, COALESCE(totp_last_step, 0) FROM users WHERE id = $1",
+		user_id,
+	).Scan(&state.Secret, &state.Enabled, &state.LastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// SetPendingTOTP starts or restarts enrollment, it cannot replace the secret of an enabled authenticator
+func (s *Store) SetPendingTOTP(user_id int, secret string) error {
+	res, err := s.db.Exec("UPDATE users SET totp_secret = $1, totp_last_step = NULL WHERE id = $2 AND totp_enabled_at IS NULL", secret, user_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("two-factor authentication is already enabled")
+	}
+
+	return nil
+}
+
+// EnableTOTP turns on the pending secret after its first code, at step, and stores new recovery codes
+func (s *Store) EnableTOTP(user_id int, step int64, code_hashes []string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	res, err := tx.Exec(`UPDATE users SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = $1
+						 WHERE id = $2 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL`, step, user_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no two-factor enrollment in progress")
+	}
+
+	return replaceRecoveryCodes(tx, user_id, code_hashes)
+}
+
+func (s *Store) DisableTOTP(user_id int) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = $1", user_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE userid = $1", user_id)
+	return err
+}
+
+// UseTOTPStep records a code's step as used, false when that step or a later one was used already
+func (s *Store) UseTOTPStep(user_id int, step int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)", step, user_id)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (s *Store) ReplaceRecoveryCodes(user_id int, code_hashes []string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return replaceRecoveryCodes(tx, user_id, code_hashes)
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, user_id int, code_hashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE userid = $1", user_id); err != nil {
+		return err
+	}
+
+	for _, code_hash := range code_hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (userid, code_hash) VALUES ($1, $2)", user_id, code_hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes, false when it does not exist or was used
+func (s *Store) UseRecoveryCode(user_id int, code_hash string) (bool, error) {
+	res, err := s.db.Exec("UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE userid = $1 AND code_hash = $2 AND used_at IS NULL",
+		user_id, code_hash,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error checking affected rows: %v", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (s *Store) GetMFARequiredRoles() ([]string, error) {
+	roles := []string{}
+
+	rows, err := s.db.Query("SELECT role FROM mfa_required_roles ORDER BY role")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (s *Store) SetMFARequiredRoles(roles []string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.Exec("DELETE FROM mfa_required_roles"); err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if _, err = tx.Exec("INSERT INTO mfa_required_roles (role) VALUES ($1) ON CONFLICT DO NOTHING", role); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncate keeps client supplied strings within their column
+func truncate(value string, max int) string {
+	if len(value) > max {
+		return strings.ToValidUTF8(value[:max], "")
+	}
+	return value
+}
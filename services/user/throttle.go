@@ -0,0 +1,163 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+)
+
+// Failures before backoff starts, each one after doubles the wait from one second
+const freeLoginFailures = 3
+
+// loginPolicy is read from the environment, LOGIN_MAX_FAILURES and LOGIN_MAX_IP_FAILURES lock the account or
+// IP for LOGIN_LOCKOUT, failures older than LOGIN_FAILURE_WINDOW are forgotten
+type loginPolicy struct {
+	maxAccountFailures	int
+	maxIPFailures		int
+	lockout				time.Duration
+	window				time.Duration
+}
+
+func loginPolicyFromEnv() loginPolicy {
+	return loginPolicy{
+		maxAccountFailures: envInt("LOGIN_MAX_FAILURES", 10),
+		maxIPFailures: envInt("LOGIN_MAX_IP_FAILURES", 50),
+		lockout: envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		window: envDuration("LOGIN_FAILURE_WINDOW", time.Hour),
+	}
+}
+
+func (p loginPolicy) maxFailures(scope string) int {
+	if scope == types.ThrottleIP || scope == types.ThrottleMailIP {
+		return p.maxIPFailures
+	}
+	return p.maxAccountFailures
+}
+
+// backoff is the wait after the given number of failures, capped at the lockout
+func (p loginPolicy) backoff(failures int) time.Duration {
+	if failures < freeLoginFailures {
+		return 0
+	}
+
+	wait := time.Second
+	for i := freeLoginFailures; i < failures && wait < p.lockout; i++ {
+		wait *= 2
+	}
+
+	if wait > p.lockout {
+		return p.lockout
+	}
+	return wait
+}
+
+// blockedUntil is when the next attempt is allowed, the zero time when it is allowed now
+func (p loginPolicy) blockedUntil(throttles []types.LoginThrottle, now time.Time) time.Time {
+	var until time.Time
+
+	for _, throttle := range throttles {
+		if throttle.LastFailureAt.Before(now.Add(-p.window)) {
+			continue
+		}
+
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(until) {
+			until = *throttle.LockedUntil
+		}
+
+		if next := throttle.LastFailureAt.Add(p.backoff(throttle.Failures)); next.After(until) {
+			until = next
+		}
+	}
+
+	if !until.After(now) {
+		return time.Time{}
+	}
+	return until
+}
+
+// recordLoginFailure counts the failure against the account and the IP, reporting a new lockout in the log
+func (h *Handler) recordLoginFailure(r *http.Request, userID int, email string, ip string) {
+	h.recordAttempt(r, types.LoginScopes, userID, email, ip)
+}
+
+// recordAttempt counts against the account and the IP in the given scopes, the mail endpoints count every
+// request so nobody can flood an inbox
+func (h *Handler) recordAttempt(r *http.Request, scopes types.ThrottleScopes, userID int, email string, ip string) {
+	policy := loginPolicyFromEnv()
+	now := time.Now()
+
+	for _, target := range []struct{ scope, subject string }{{scopes.Account, email}, {scopes.IP, ip}} {
+		throttle, err := h.store.RecordLoginFailure(target.scope, target.subject, now, now.Add(-policy.window),
+			policy.maxFailures(target.scope), now.Add(policy.lockout))
+		if err != nil {
+			log.Printf("failed to record login failure for %s %s: %v", target.scope, target.subject, err)
+			continue
+		}
+
+		if throttle.Failures == policy.maxFailures(target.scope) {
+			h.auditAuth(r, userID, email, types.AuthLockout, target.scope+" "+target.subject+" locked after "+strconv.Itoa(throttle.Failures)+" failures")
+		}
+	}
+}
+
+// throttled answers 429 while the account or IP is backing off in the given scopes
+func (h *Handler) throttled(w http.ResponseWriter, r *http.Request, scopes types.ThrottleScopes, email string, ip string, reason string) bool {
+	throttles, err := h.store.GetLoginThrottles(scopes, email, ip)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error checking attempts: %v", err))
+		return true
+	}
+
+	until := loginPolicyFromEnv().blockedUntil(throttles, time.Now())
+	if until.IsZero() {
+		return false
+	}
+
+	h.auditAuth(r, 0, email, types.AuthLoginBlocked, scopes.Account)
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	utils.WriteError(w, http.StatusTooManyRequests, fmt.Errorf("%s, try again after %s", reason, until.Format(time.RFC3339)))
+	return true
+}
+
+// auditAuth writes to the auth audit log, a failed write is logged and does not fail the request
+func (h *Handler) auditAuth(r *http.Request, userID int, email string, event string, detail string) {
+	err := h.store.RecordAuthEvent(types.AuthEvent{
+		Userid: userID,
+		Email: email,
+		Event: event,
+		IPAddress: utils.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Detail: detail,
+	})
+	if err != nil {
+		log.Printf("failed to record auth event %s for %q: %v", event, email, err)
+	}
+}
+
+// throttleEmail is the account subject, the email as typed but case-insensitive
+func throttleEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,162 @@
+package user
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+	"github.com/PatrickA727/mikrotik-db-sys/utils"
+)
+
+// throttleStore counts failures the way the login_throttles table does, calling anything else panics on the
+// nil interface
+type throttleStore struct {
+	types.UserStore
+	throttles	map[string]*types.LoginThrottle
+}
+
+func (s *throttleStore) RecordLoginFailure(scope string, subject string, now time.Time, reset_before time.Time, lock_after int, locked_until time.Time) (*types.LoginThrottle, error) {
+	throttle, ok := s.throttles[scope+" "+subject]
+	if !ok || throttle.LastFailureAt.Before(reset_before) {
+		throttle = &types.LoginThrottle{Scope: scope, Subject: subject}
+		s.throttles[scope+" "+subject] = throttle
+	}
+
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	if throttle.Failures >= lock_after {
+		throttle.LockedUntil = &locked_until
+	}
+
+	copied := *throttle
+	return &copied, nil
+}
+
+func (s *throttleStore) GetLoginThrottles(scopes types.ThrottleScopes, email string, ip string) ([]types.LoginThrottle, error) {
+	var throttles []types.LoginThrottle
+	for _, key := range []string{scopes.Account + " " + email, scopes.IP + " " + ip} {
+		if throttle, ok := s.throttles[key]; ok {
+			throttles = append(throttles, *throttle)
+		}
+	}
+	return throttles, nil
+}
+
+func (s *throttleStore) RecordAuthEvent(event types.AuthEvent) error {
+	return nil
+}
+
+func (s *throttleStore) GetUserByEmail(email string) (*types.User, error) {
+	return nil, sql.ErrNoRows
+}
+
+// proxied is a request as the reverse proxy at 10.0.0.2 forwards it, forwarded is the header the client sent
+// with the proxy's hop for the real client appended
+func proxied(forwarded string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/user/login", nil)
+	r.RemoteAddr = "10.0.0.2:41234"
+	r.Header.Set("X-Forwarded-For", forwarded+", 203.0.113.9")
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+
+	tests := []struct {
+		name		string
+		remote		string
+		forwarded	string
+		want		string
+	}{
+		{"no header", "10.0.0.2:1", "", "10.0.0.2"},
+		{"one proxy", "10.0.0.2:1", "203.0.113.9", "203.0.113.9"},
+		{"spoofed left-most hop", "10.0.0.2:1", "1.2.3.4, 203.0.113.9", "203.0.113.9"},
+		{"two proxies", "10.0.0.2:1", "1.2.3.4, 203.0.113.9, 10.0.0.7", "203.0.113.9"},
+		{"garbage from the client", "10.0.0.2:1", "not-an-ip, 10.0.0.7", "10.0.0.7"},
+		{"direct connection", "198.51.100.4:1", "1.2.3.4", "198.51.100.4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			if got := utils.ClientIP(r); got != tt.want {
+				t.Fatalf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// An explicit list replaces the private ranges
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.2")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:1"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.7")
+	if got := utils.ClientIP(r); got != "10.0.0.7" {
+		t.Fatalf("ClientIP = %s, want the untrusted 10.0.0.7", got)
+	}
+}
+
+func TestSpoofedForwardedForKeepsThrottleKey(t *testing.T) {
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	t.Setenv("LOGIN_MAX_IP_FAILURES", "3")
+
+	store := &throttleStore{throttles: make(map[string]*types.LoginThrottle)}
+	h := NewHandler(store, nil, nil)
+
+	// Every attempt claims another address and another account
+	for spoofed, email := range map[string]string{"1.1.1.1": "a@example.com", "2.2.2.2": "b@example.com", "3.3.3.3": "c@example.com"} {
+		r := proxied(spoofed)
+		h.recordLoginFailure(r, 0, email, utils.ClientIP(r))
+	}
+
+	if len(store.throttles) != 4 || store.throttles[types.ThrottleIP+" 203.0.113.9"].Failures != 3 {
+		t.Fatalf("throttles = %v, want every failure counted against 203.0.113.9", store.throttles)
+	}
+
+	r := proxied("4.4.4.4")
+	w := httptest.NewRecorder()
+	if !h.loginBlocked(w, r, "z@example.com", utils.ClientIP(r)) || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("blocked = %d, want the IP locked out whatever it claims", w.Code)
+	}
+}
+
+func TestMailRequestsThrottled(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+
+	store := &throttleStore{throttles: make(map[string]*types.LoginThrottle)}
+	h := NewHandler(store, nil, nil)
+
+	send := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/user/forgot-password", strings.NewReader(`{"email": "Owner@Example.com"}`))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := send(h.handleForgotPassword); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	// Both mail endpoints count together, for the address whether or not it is registered
+	if w := send(h.handleResendVerification); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("fourth request = %d, want 429", w.Code)
+	}
+	if w := send(h.handleForgotPassword); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("fifth request = %d, want 429", w.Code)
+	}
+
+	// Logins are counted apart, asking for mail locks nobody out
+	if throttles, _ := store.GetLoginThrottles(types.LoginScopes, "owner@example.com", "192.0.2.1"); len(throttles) != 0 {
+		t.Fatalf("login throttles = %+v, want none", throttles)
+	}
+}
@@ -0,0 +1,88 @@
+package user
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/PatrickA727/mikrotik-db-sys/services/auth"
+	"github.com/PatrickA727/mikrotik-db-sys/types"
+)
+
+const recoveryCodeCount = 10
+
+// totpIssuer names the account in authenticator apps, TOTP_ISSUER overrides it
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Moengoet Inventory"
+}
+
+// mfaRequired tells whether the admin policy makes two-factor mandatory for the role
+func (h *Handler) mfaRequired(role string) (bool, error) {
+	roles, err := h.store.GetMFARequiredRoles()
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(roles, role), nil
+}
+
+// startTOTPEnrollment gives the user a new pending secret and returns it with its provisioning URI
+func (h *Handler) startTOTPEnrollment(u *types.User) (map[string]interface{}, error) {
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.store.SetPendingTOTP(u.ID, secret); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"secret": secret,
+		"otpauth_uri": auth.TOTPURI(totpIssuer(), u.Email, secret),
+	}, nil
+}
+
+// newRecoveryCodes returns the codes to show the user once and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// checkTOTP validates a code against the user's enabled authenticator and uses up its time step
+func (h *Handler) checkTOTP(userID int, code string) (bool, error) {
+	state, err := h.store.GetTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !state.Enabled {
+		return false, fmt.Errorf("two-factor authentication is not enabled")
+	}
+
+	step, ok := auth.ValidateTOTP(state.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return h.store.UseTOTPStep(userID, step)
+}
+
+// loginBlocked answers 429 while the account or IP is backing off from failed logins
+func (h *Handler) loginBlocked(w http.ResponseWriter, r *http.Request, email string, ip string) bool {
+	return h.throttled(w, r, types.LoginScopes, email, ip, "too many failed logins")
+}
@@ -0,0 +1,49 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type ChannelStore interface {
+	GetChannels() ([]Channel, error)
+	GetChannelByName(name string) (*Channel, error)
+	CreateChannel(payload ChannelPayload) error
+	EditChannel(id int, payload EditChannelPayload) error
+	GetChannelReport(from time.Time, to time.Time) ([]ChannelReport, error)
+}
+
+// Channel is a place we sell through, invoice.online_shop and sold_items.ol_shop reference its name
+type Channel struct {
+	ID			int				`json:"id"`
+	Name		string			`json:"name"`
+	FeePercent	float64			`json:"fee_percent"`	// Marketplace commission taken from each sale
+	Settings	json.RawMessage	`json:"settings"`
+	Active		bool			`json:"active"`
+	PriceIncludesTax	bool	`json:"price_includes_tax"`	// Unless the item type says otherwise
+}
+
+type ChannelPayload struct {
+	Name		string			`json:"name" validate:"required"`
+	FeePercent	float64			`json:"fee_percent" validate:"gte=0,lt=100"`
+	Settings	json.RawMessage	`json:"settings"`
+	PriceIncludesTax	*bool	`json:"price_includes_tax"`	// Defaults to true
+}
+
+type EditChannelPayload struct {
+	Name		string			`json:"name"`
+	FeePercent	*float64		`json:"fee_percent" validate:"omitempty,gte=0,lt=100"`
+	Settings	json.RawMessage	`json:"settings"`
+	Active		*bool			`json:"active"`
+	PriceIncludesTax	*bool	`json:"price_includes_tax"`
+}
+
+// ChannelReport sums sales per channel at the price they were sold for, fees are estimated from the channel's fee percentage
+type ChannelReport struct {
+	Channel		string	`json:"channel"`
+	Invoices	int		`json:"invoices"`
+	ItemsSold	int		`json:"items_sold"`
+	Revenue		Money	`json:"revenue"`
+	Fees		Money	`json:"fees"`
+	Net			Money	`json:"net"`
+}
@@ -0,0 +1,42 @@
+package types
+
+import "time"
+
+type CurrencyStore interface {
+	GetCurrencies() ([]Currency, error)
+	GetExchangeRates(currency string) ([]ExchangeRate, error)
+	SetExchangeRate(payload ExchangeRatePayload) error
+	GetCostReport(from time.Time, to time.Time) ([]CostReport, error)
+}
+
+type Currency struct {
+	Code		string	`json:"code"`
+	Name		string	`json:"name"`
+	Exponent	int		`json:"exponent"`	// Digits after the decimal point
+	IsBase		bool	`json:"is_base"`
+}
+
+// ExchangeRate holds from EffectiveDate until the currency's next rate
+type ExchangeRate struct {
+	ID				int			`json:"id"`
+	Currency		string		`json:"currency"`
+	Rate			string		`json:"rate"`	// Base currency per one whole unit, kept as the exact NUMERIC text
+	EffectiveDate	time.Time	`json:"effective_date"`
+	CreatedAt		time.Time	`json:"createdat"`
+}
+
+type ExchangeRatePayload struct {
+	Currency		string	`json:"currency" validate:"required,len=3"`
+	Rate			string	`json:"rate" validate:"required,numeric"`
+	EffectiveDate	string	`json:"effective_date" validate:"required,datetime=2006-01-02"`
+}
+
+// CostReport is what the items registered in a period cost per item type and purchase currency, Converted
+// is nil when the currency had no rate on some item's registration date
+type CostReport struct {
+	ItemType	string	`json:"item_type"`
+	Currency	string	`json:"currency"`
+	Items		int		`json:"items"`
+	Cost		Money	`json:"cost"`		// In the purchase currency
+	Converted	*Money	`json:"converted"`	// In the base currency at each item's registration date
+}
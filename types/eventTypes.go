@@ -0,0 +1,23 @@
+package types
+
+import (
+	"time"
+)
+
+type EventPublisher interface {
+	Publish(topic string, eventType string, data any)
+}
+
+const (
+	TopicItems		= "items"
+	TopicSales		= "sales"
+	TopicShipments	= "shipments"
+)
+
+type Event struct {
+	ID		int64		`json:"id"`
+	Topic	string		`json:"topic"`
+	Type	string		`json:"type"`
+	Data	any			`json:"data"`
+	Time	time.Time	`json:"time"`
+}
@@ -0,0 +1,22 @@
+package types
+
+import "time"
+
+type IdempotencyStore interface {
+	ClaimKey(user_id int, device_id int, key string, fingerprint string, expired_before time.Time, stale_before time.Time) (bool, error)
+	GetKey(user_id int, device_id int, key string) (*IdempotencyRecord, error)
+	CompleteKey(user_id int, device_id int, key string, status_code int, content_type string, body []byte) error
+	ReleaseKey(user_id int, device_id int, key string) error
+	PurgeKeys(before time.Time) (int64, error)
+}
+
+// IdempotencyRecord is the first response to a request sent with an Idempotency-Key, StatusCode is 0 while
+// that request is still running
+type IdempotencyRecord struct {
+	Key			string
+	Fingerprint	string	// Hash of the method, path, query and body
+	StatusCode	int
+	ContentType	string
+	Body		[]byte
+	CreatedAt	time.Time
+}
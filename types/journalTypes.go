@@ -0,0 +1,91 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type JournalStore interface {
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	GetUnjournaledSales(until time.Time, tx *sql.Tx, ctx context.Context) ([]JournalSource, error)
+	GetRefundedInvoices(tx *sql.Tx, ctx context.Context) ([]int, error)
+	GetUnjournaledRefunds(tx *sql.Tx, ctx context.Context) ([]JournalRefund, error)
+	PostEntry(entry JournalEntry, tx *sql.Tx, ctx context.Context) (int, error)
+	MarkInvoiceJournaled(invoice_id int, tx *sql.Tx, ctx context.Context) error
+	MarkRefundJournaled(payment_id int, entry_id int, tx *sql.Tx, ctx context.Context) error
+	ReverseInvoice(invoice_id int, reason string, tx *sql.Tx, ctx context.Context) (int, error)
+	GetEntries(from time.Time, to time.Time, unexported bool) ([]JournalEntry, error)
+	MarkEntriesExported(ids []int, tx *sql.Tx, ctx context.Context) error
+	GetAccounts() ([]JournalAccount, error)
+	SetAccount(account JournalAccount) error
+}
+
+// ErrAlreadyJournaled means another run posted the invoice or refund first, nothing of this run is kept
+var ErrAlreadyJournaled = errors.New("already posted to the journal by another run")
+
+// ErrItemJournaled refuses removing a sold item from an invoice that is posted, the journal would still book it
+var ErrItemJournaled = errors.New("item is on an invoice posted to the journal, refund or delete the invoice instead")
+
+// Logical accounts the journal posts to, journal_accounts maps them to the bookkeeper's chart of accounts
+const (
+	AccountReceivable		= "receivable"
+	AccountRevenue			= "revenue"
+	AccountTaxPayable		= "tax_payable"
+	AccountMarketplaceFees	= "marketplace_fees"
+	AccountCOGS				= "cogs"
+	AccountInventory		= "inventory"
+)
+
+const (
+	EntrySale		= "sale"
+	EntryRefund		= "refund"
+	EntryReversal	= "reversal"
+)
+
+type JournalAccount struct {
+	Key		string	`json:"key" validate:"required,oneof=receivable revenue tax_payable marketplace_fees cogs inventory"`
+	Code	string	`json:"code" validate:"required"`
+	Name	string	`json:"name" validate:"required"`
+}
+
+type JournalEntry struct {
+	ID			int				`json:"id"`
+	InvoiceID	int				`json:"invoice_id"`	// Kept after the invoice is deleted
+	InvoiceStr	string			`json:"invoice"`
+	Kind		string			`json:"kind"`
+	EntryDate	time.Time		`json:"entry_date"`
+	Description	string			`json:"description"`
+	ReversesID	*int			`json:"reverses_id"`
+	ExportedAt	*time.Time		`json:"exported_at"`
+	Lines		[]JournalLine	`json:"lines"`
+}
+
+type JournalLine struct {
+	Account	string	`json:"account"`
+	Debit	Money	`json:"debit"`
+	Credit	Money	`json:"credit"`
+}
+
+// JournalSource is what a sale entry is built from, all amounts in whole rupiah
+type JournalSource struct {
+	InvoiceID	int
+	InvoiceStr	string
+	OnlineShop	string
+	SoldAt		time.Time
+	Revenue		Money	// Sale price of the items before tax
+	Tax			Money	// Output tax owed on the sale
+	Fees		Money	// Actual payout fees when reconciled, the channel's fee percentage otherwise
+	Cost		Money	// items.modal converted at the rate on the day the item was registered
+}
+
+// JournalRefund is a partial refund of a posted invoice, booked against the sale it gives money back on
+type JournalRefund struct {
+	PaymentID	int
+	InvoiceID	int
+	InvoiceStr	string
+	RefundedAt	time.Time
+	Amount		Money	// What was paid back, tax included
+	Tax			Money	// The output tax share of Amount, in proportion to the invoice's tax
+}
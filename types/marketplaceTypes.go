@@ -0,0 +1,64 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type MarketplaceStore interface {
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	OrderExists(marketplace string, external_id string) (bool, error)
+	ResolveSKU(marketplace string, sku string) (string, error)
+	SetSKUMapping(mapping SKUMapping) error
+	CreateOrder(order MarketplaceOrder, tx *sql.Tx, ctx context.Context) (int, error)
+	GetOrders(status string, limit int, offset int) ([]MarketplaceOrder, error)
+	GetOrderByID(id int) (*MarketplaceOrder, error)
+	AllocateOrderLine(line_id int, tx *sql.Tx, ctx context.Context) error
+	CompleteOrder(id int, tx *sql.Tx, ctx context.Context) (bool, error)
+}
+
+const (
+	OrderPending	= "pending"
+	OrderAllocated	= "allocated"
+)
+
+// MarketplaceOrder is an order pulled from a marketplace export or webhook, it owns a pending invoice
+// that staff fill by scanning serial numbers
+type MarketplaceOrder struct {
+	ID			int						`json:"id"`
+	Marketplace	string					`json:"marketplace"`
+	ExternalID	string					`json:"external_id"`
+	InvoiceID	int						`json:"invoice_id"`
+	InvoiceStr	string					`json:"invoice"`
+	BuyerName	string					`json:"buyer_name"`
+	Status		string					`json:"status"`
+	OrderedAt	time.Time				`json:"ordered_at"`
+	Lines		[]MarketplaceOrderLine	`json:"lines"`
+}
+
+type MarketplaceOrderLine struct {
+	ID			int		`json:"id"`
+	SKU			string	`json:"sku"`
+	ProductName	string	`json:"product_name"`
+	TypeRef		string	`json:"type_ref"`
+	Quantity	int		`json:"quantity"`
+	UnitPrice	Money	`json:"unit_price"`
+	Allocated	int		`json:"allocated"`
+}
+
+type SKUMapping struct {
+	Marketplace	string	`json:"marketplace" validate:"required"`
+	SKU			string	`json:"sku" validate:"required"`
+	TypeRef		string	`json:"type_ref" validate:"required"`
+}
+
+type AllocateOrderPayload struct {
+	SerialNums	[]string	`json:"serial_numbers" validate:"required,min=1"`
+}
+
+type ImportResult struct {
+	Created	int			`json:"created"`
+	Skipped	int			`json:"skipped"`	// Already imported
+	Errors	[]string	`json:"errors"`
+}
@@ -0,0 +1,230 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// BaseCurrency is what every sale, payment and report is kept in, foreign amounts are converted through
+// exchange_rates
+const BaseCurrency = "IDR"
+
+// currencyExponents are the ISO 4217 minor unit digits of the currencies we deal in
+var currencyExponents = map[string]int{
+	"IDR": 2,
+	"USD": 2,
+	"EUR": 2,
+	"SGD": 2,
+	"MYR": 2,
+	"CNY": 2,
+	"JPY": 0,
+}
+
+// Money is an exact amount in the currency's minor units, Rp 1.150.000 is {115000000, "IDR"}. An empty
+// currency means BaseCurrency, which is how amounts scanned from base-currency columns arrive
+type Money struct {
+	Amount		int64
+	Currency	string
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// BaseMoney takes whole units of the base currency, BaseMoney(1150000) is Rp 1.150.000
+func BaseMoney(major int64) Money {
+	return Money{Amount: major * pow10(currencyExponents[BaseCurrency]), Currency: BaseCurrency}
+}
+
+func SupportedCurrency(currency string) bool {
+	_, ok := currencyExponents[strings.ToUpper(currency)]
+	return ok
+}
+
+func pow10(n int) int64 {
+	result := int64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+// ParseMoney reads a plain decimal such as "1150000", "1150000.5" or "-12.75", more decimals than the
+// currency has are rejected rather than rounded
+func ParseMoney(value string, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = BaseCurrency
+	}
+
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency %q", currency)
+	}
+
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	whole, frac, _ := strings.Cut(value, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if len(frac) > exponent {
+		return Money{}, fmt.Errorf("%s has at most %d decimals", currency, exponent)
+	}
+	frac += strings.Repeat("0", exponent-len(frac))
+
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+
+	if negative {
+		amount = -amount
+	}
+
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return BaseCurrency
+	}
+	return m.Currency
+}
+
+// String formats the amount as a plain decimal without grouping, "1150000.00"
+func (m Money) String() string {
+	exponent := currencyExponents[m.currency()]
+
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	if exponent == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+
+	unit := pow10(exponent)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exponent, amount%unit)
+}
+
+// Whole rounds to whole units of the currency, half away from zero
+func (m Money) Whole() int64 {
+	unit := pow10(currencyExponents[m.currency()])
+	if m.Amount < 0 {
+		return -((-m.Amount + unit/2) / unit)
+	}
+	return (m.Amount + unit/2) / unit
+}
+
+// Add and Sub are for amounts in the same currency, which everything but item costs and list prices is
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount + other.Amount, Currency: m.currency()}
+}
+
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.currency()}
+}
+
+// Percent returns p percent of the amount rounded half away from zero
+func (m Money) Percent(p float64) Money {
+	value := float64(m.Amount) * p / 100
+	if value < 0 {
+		return Money{Amount: int64(value - 0.5), Currency: m.currency()}
+	}
+	return Money{Amount: int64(value + 0.5), Currency: m.currency()}
+}
+
+type moneyJSON struct {
+	Amount		json.RawMessage	`json:"amount"`
+	Currency	string			`json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"amount": m.String(),
+		"currency": m.currency(),
+	})
+}
+
+// UnmarshalJSON accepts {"amount": "1150000.00", "currency": "IDR"}, the amount as a JSON number, or a bare
+// number or string in the base currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var amount, currency string
+
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		var obj moneyJSON
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		amount = strings.Trim(string(obj.Amount), `"`)
+		currency = obj.Currency
+	default:
+		amount = strings.Trim(string(data), `"`)
+	}
+
+	if amount == "" || amount == "null" {
+		*m = Money{}
+		return nil
+	}
+
+	parsed, err := ParseMoney(amount, currency)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
+
+// Scan reads a BIGINT minor-unit column, the currency is the base currency unless set by a later column
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		m.Amount = v
+	case nil:
+		m.Amount = 0
+	case float64:
+		m.Amount = int64(math.Round(v))
+	case []byte:
+		return m.Scan(string(v))
+	case string:
+		if amount, err := strconv.ParseInt(v, 10, 64); err == nil {
+			m.Amount = amount
+			break
+		}
+
+		// NUMERIC with a fraction, only ever from rounding arithmetic
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("cannot scan %q into Money", v)
+		}
+		m.Amount = int64(math.Round(amount))
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+
+	if m.Currency == "" {
+		m.Currency = BaseCurrency
+	}
+
+	return nil
+}
+
+// Value writes the minor units, only base-currency amounts may go into columns without a currency
+func (m Money) Value() (driver.Value, error) {
+	if m.currency() != BaseCurrency {
+		return nil, fmt.Errorf("%s amount written to a %s column", m.Currency, BaseCurrency)
+	}
+	return m.Amount, nil
+}
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type PackStore interface {
+	CreatePackSession(invoice_id int) (*PackSession, error)
+	GetOpenPackSession(invoice_id int) (*PackSession, error)
+	GetPackScans(session_id int) ([]PackScan, error)
+	LockOpenPackSession(invoice_id int, tx *sql.Tx, ctx context.Context) (*PackSession, error)
+	GetPackScansTx(session_id int, tx *sql.Tx, ctx context.Context) ([]PackScan, error)
+	AddPackScan(scan PackScan) error
+	RemovePackScans(session_id int, rfid_tag string) (int, error)
+	OverridePackSession(session_id int, user_id int, reason string) error
+	ClosePackSession(session_id int, status string, tx *sql.Tx, ctx context.Context) error
+}
+
+const (
+	PackOpen		= "open"
+	PackOverridden	= "overridden"
+	PackShipped		= "shipped"
+	PackCancelled	= "cancelled"
+
+	ScanMatched		= "matched"
+	ScanWrong		= "wrong"
+	ScanDuplicate	= "duplicate"
+)
+
+// ErrPackSessionClosed is returned when a scan or override reaches a session that was shipped or cancelled meanwhile
+var ErrPackSessionClosed = errors.New("pack session is no longer open")
+
+type PackSession struct {
+	ID				int			`json:"id"`
+	InvoiceID		int			`json:"invoice_id"`
+	Status			string		`json:"status"`
+	OverrideBy		*int		`json:"override_by"`
+	OverrideReason	*string		`json:"override_reason"`
+	OverrideAt		*time.Time	`json:"override_at"`
+	CreatedAt		time.Time	`json:"createdat"`
+}
+
+type PackScan struct {
+	ID			int			`json:"id"`
+	SessionID	int			`json:"session_id"`
+	RFIDTag		string		`json:"rfid_tag"`
+	Result		string		`json:"result"`
+	ScannedAt	time.Time	`json:"scannedat"`
+}
+
+type PackScanPayload struct {
+	RFIDTag	string	`json:"rfid_tag" validate:"required"`
+}
+
+type PackOverridePayload struct {
+	Reason	string	`json:"reason" validate:"required"`
+}
+
+// PackStatus compares what was scanned into the box against the items on the invoice
+type PackStatus struct {
+	SessionID	int			`json:"session_id"`
+	InvoiceID	int			`json:"invoice_id"`
+	Status		string		`json:"status"`
+	Verified	bool		`json:"verified"`
+	CanShip		bool		`json:"can_ship"`
+	LastScan	*PackScan	`json:"last_scan,omitempty"`
+	Expected	int			`json:"expected"`
+	Matched		[]string	`json:"matched"`
+	Missing		[]string	`json:"missing"`
+	Wrong		[]string	`json:"wrong"`
+}
@@ -0,0 +1,75 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+type PaymentStore interface {
+	RecordPayment(invoice_id int, payment PaymentPayload, recorded_by int) (int, error)
+	GetPaymentsByInvoice(invoice_id int) ([]Payment, error)
+	GetPaymentByID(id int) (*Payment, error)
+	VoidPayment(id int, voided_by int) error
+	GetInvoiceBalance(invoice_id int) (*InvoiceBalance, error)
+	GetOutstandingInvoices() ([]InvoiceBalance, error)
+}
+
+// Derived from payments against the invoice's amount due, see the invoice_balances view
+const (
+	PaymentUnpaid	= "unpaid"
+	PaymentPartial	= "partial"
+	PaymentPaid		= "paid"
+	PaymentRefunded	= "refunded"
+)
+
+const (
+	KindPayment	= "payment"
+	KindRefund	= "refund"
+)
+
+var (
+	ErrPaymentNotFound		= errors.New("payment not found")
+	ErrRefundExceedsPaid	= errors.New("refunds would exceed what was paid on this invoice")
+)
+
+const MethodMarketplace = "marketplace"	// Recorded from a reconciled payout, not entered by hand
+
+type Payment struct {
+	ID			int			`json:"id"`
+	InvoiceID	int			`json:"invoice_id"`
+	Kind		string		`json:"kind"`
+	Amount		Money		`json:"amount"`
+	Method		string		`json:"method"`
+	PaidAt		time.Time	`json:"paid_at"`
+	Reference	string		`json:"reference"`
+	RecordedBy	*int		`json:"recorded_by"`
+	VoidedAt	*time.Time	`json:"voided_at"`	// Voided entries no longer count towards the balance
+	CreatedAt	time.Time	`json:"createdat"`
+}
+
+type PaymentPayload struct {
+	Kind		string		`json:"kind" validate:"omitempty,oneof=payment refund"`
+	Amount		Money		`json:"amount" validate:"required,gt=0"`
+	Method		string		`json:"method" validate:"required,oneof=cash transfer qris card ewallet other"`
+	PaidAt		*time.Time	`json:"paid_at"`	// Defaults to now
+	Reference	string		`json:"reference"`
+}
+
+type InvoiceBalance struct {
+	InvoiceID		int			`json:"invoice_id"`
+	InvoiceStr		string		`json:"invoice"`
+	OnlineShop		string		`json:"online_shop"`
+	AmountDue		Money		`json:"amount_due"`
+	Paid			Money		`json:"paid"`
+	Refunded		Money		`json:"refunded"`
+	Outstanding		Money		`json:"outstanding"`
+	PaymentStatus	string		`json:"payment_status"`
+	SoldAt			*time.Time	`json:"sold_at"`
+}
+
+type AgingBucket struct {
+	Label		string				`json:"label"`
+	Count		int					`json:"count"`
+	Outstanding	Money				`json:"outstanding"`
+	Invoices	[]InvoiceBalance	`json:"invoices"`
+}
@@ -0,0 +1,45 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type PayoutStore interface {
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	PayoutExists(marketplace string, reference string) (bool, error)
+	CreatePayout(marketplace string, reference string, tx *sql.Tx, ctx context.Context) (int, error)
+	AddPayoutLine(payout_id int, shop string, line SettlementLine, tx *sql.Tx, ctx context.Context) (bool, error)
+	GetPayoutLinesByInvoice(invoice_id int) ([]SettlementLine, error)
+	GetUnmatchedPayoutLines(marketplace string) ([]SettlementLine, error)
+	MatchPayoutLines(shops map[string]string) (int, error)
+	GetUnreconciledInvoices(shops []string, before time.Time) ([]UnreconciledInvoice, error)
+}
+
+// SettlementLine is one invoice's money in a marketplace payout report, amounts are whole rupiah
+type SettlementLine struct {
+	ID			int			`json:"id"`
+	PayoutID	int			`json:"payout_id"`
+	InvoiceID	*int		`json:"invoice_id"`	// Nil until an invoice with the same invoice_str exists
+	InvoiceStr	string		`json:"invoice"`
+	Gross		Money		`json:"gross"`
+	Fees		Money		`json:"fees"`
+	Net			Money		`json:"net"`	// What the marketplace actually paid out
+	SettledAt	time.Time	`json:"settled_at"`
+}
+
+type PayoutImportResult struct {
+	PayoutID	int			`json:"payout_id"`
+	Matched		int			`json:"matched"`
+	Unmatched	[]string	`json:"unmatched"`	// Invoice numbers with no invoice in the system
+}
+
+type UnreconciledInvoice struct {
+	InvoiceID	int			`json:"invoice_id"`
+	InvoiceStr	string		`json:"invoice"`
+	OnlineShop	string		`json:"online_shop"`
+	SoldAt		time.Time	`json:"sold_at"`
+	DaysOpen	int			`json:"days_open"`
+	Expected	Money		`json:"expected"`	// Sale price of the items less the channel fee
+}
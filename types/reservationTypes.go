@@ -0,0 +1,71 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type ReservationStore interface {
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	CreateReservation(payload ReservationPayload, expires_at time.Time, created_by int, tx *sql.Tx, ctx context.Context) (int, error)
+	ReserveItem(reservation_id int, item_id int, tx *sql.Tx, ctx context.Context) error
+	GetReservations(status string) ([]Reservation, error)
+	GetReservationByID(id int) (*Reservation, error)
+	ExtendReservation(id int, expires_at time.Time) error
+	CloseReservation(id int, status string, invoice_id *int, tx *sql.Tx, ctx context.Context) ([]int, error)
+	ExpireReservations(now time.Time) ([]int, error)
+}
+
+// ItemReserved is the item status while a reservation holds it, reserved items are left out of sales
+const ItemReserved = "reserved"
+
+const (
+	ReservationActive		= "active"
+	ReservationConverted	= "converted"	// Turned into an invoice
+	ReservationReleased		= "released"	// Cancelled by staff
+	ReservationExpired		= "expired"
+)
+
+// Reservation doubles as a quotation, Total is what the items would sell for today
+type Reservation struct {
+	ID				int					`json:"id"`
+	CustomerName	string				`json:"customer_name"`
+	CustomerContact	string				`json:"customer_contact"`
+	OnlineShop		string				`json:"ol_shop"`
+	Notes			string				`json:"notes"`
+	Status			string				`json:"status"`
+	ExpiresAt		time.Time			`json:"expires_at"`
+	InvoiceID		*int				`json:"invoice_id"`
+	CreatedBy		*int				`json:"created_by"`
+	CreatedAt		time.Time			`json:"createdat"`
+	ClosedAt		*time.Time			`json:"closed_at"`
+	Items			[]ReservationItem	`json:"items"`
+	Total			*Money				`json:"total,omitempty"`	// Nil when a price has no exchange rate
+}
+
+type ReservationItem struct {
+	ItemID			int		`json:"item_id"`
+	SerialNumber	string	`json:"serial_number"`
+	RFIDTag			string	`json:"rfid_tag"`
+	TypeRef			string	`json:"type_ref"`
+	Price			*Money	`json:"price"`	// List price in the base currency
+}
+
+type ReservationPayload struct {
+	CustomerName	string		`json:"customer_name" validate:"required"`
+	CustomerContact	string		`json:"customer_contact"`
+	OnlineShop		string		`json:"ol_shop"`
+	Notes			string		`json:"notes"`
+	SerialNums		[]string	`json:"serial_numbers" validate:"required,min=1"`
+	HoldHours		int			`json:"hold_hours" validate:"omitempty,gt=0,lte=720"`	// Defaults to RESERVATION_HOLD_HOURS
+}
+
+type ExtendReservationPayload struct {
+	HoldHours	int	`json:"hold_hours" validate:"required,gt=0,lte=720"`	// Counted from now
+}
+
+type ConvertReservationPayload struct {
+	Invoice		string	`json:"invoice" validate:"required"`
+	OnlineShop	string	`json:"ol_shop"`	// Defaults to the reservation's channel
+}
@@ -0,0 +1,81 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type SalesOrderStore interface {
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	CreateSalesOrder(payload SalesOrderPayload, expires_at time.Time, created_by int, tx *sql.Tx, ctx context.Context) (int, error)
+	CreateSalesOrderLine(order_id int, line SalesOrderLinePayload, tx *sql.Tx, ctx context.Context) (int, error)
+	SuggestItems(type_ref string, quantity int) ([]SalesOrderItem, error)
+	AllocateItems(order_id int, line_id int, type_ref string, quantity int, tx *sql.Tx, ctx context.Context) error
+	GetSalesOrders(status string) ([]SalesOrder, error)
+	GetSalesOrderByID(id int) (*SalesOrder, error)
+	ConfirmItem(order_id int, item_id int, tx *sql.Tx, ctx context.Context) error
+	SwapItem(order_id int, old_item_id int, new_item_id int, tx *sql.Tx, ctx context.Context) error
+	CountUnconfirmed(order_id int, tx *sql.Tx, ctx context.Context) (int, error)
+	CloseSalesOrder(id int, status string, invoice_id *int, tx *sql.Tx, ctx context.Context) ([]int, error)
+	ExpireSalesOrders(now time.Time) ([]int, error)
+}
+
+// ItemAllocated is the item status while a sales order holds it, allocated items are left out of sales
+const ItemAllocated = "allocated"
+
+const (
+	SalesOrderOpen		= "open"		// Allocated, waiting for every item to be scanned
+	SalesOrderCompleted	= "completed"	// Scanned and invoiced
+	SalesOrderCancelled	= "cancelled"
+	SalesOrderExpired	= "expired"		// Left open past its hold, the items went back on sale
+)
+
+// SalesOrder is a sale by item type and quantity, the server picks the oldest stock and staff confirm each
+// pick by scanning it
+type SalesOrder struct {
+	ID				int					`json:"id"`
+	InvoiceStr		string				`json:"invoice"`
+	OnlineShop		string				`json:"ol_shop"`
+	CustomerName	string				`json:"customer_name"`
+	Status			string				`json:"status"`
+	InvoiceID		*int				`json:"invoice_id"`	// Set once completed
+	CreatedBy		*int				`json:"created_by"`
+	ExpiresAt		time.Time			`json:"expires_at"`
+	CreatedAt		time.Time			`json:"createdat"`
+	ClosedAt		*time.Time			`json:"closed_at"`
+	Lines			[]SalesOrderLine	`json:"lines"`
+}
+
+type SalesOrderLine struct {
+	ID			int					`json:"id"`
+	TypeRef		string				`json:"type_ref"`
+	Quantity	int					`json:"quantity"`
+	Items		[]SalesOrderItem	`json:"items"`
+}
+
+type SalesOrderItem struct {
+	ItemID			int			`json:"item_id"`
+	SerialNumber	string		`json:"serial_number"`
+	RFIDTag			string		`json:"rfid_tag"`
+	Batch			int			`json:"batch"`
+	CreatedAt		time.Time	`json:"createdat"`
+	Confirmed		bool		`json:"confirmed"`
+}
+
+type SalesOrderPayload struct {
+	Invoice			string					`json:"invoice" validate:"required"`
+	OnlineShop		string					`json:"ol_shop" validate:"required"`
+	CustomerName	string					`json:"customer_name"`
+	HoldHours		int						`json:"hold_hours" validate:"omitempty,gt=0,lte=720"`	// Defaults to SALES_ORDER_HOLD_HOURS
+	Lines			[]SalesOrderLinePayload	`json:"lines" validate:"required,min=1,dive"`
+}
+
+type SalesOrderLinePayload struct {
+	TypeRef		string	`json:"type_ref" validate:"required"`
+	Quantity	int		`json:"quantity" validate:"required,gt=0"`
+}
+
+type ScanSalesOrderPayload struct {
+	SerialNums	[]string	`json:"serial_numbers" validate:"required,min=1"`
+}
@@ -0,0 +1,76 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type ShipmentStore interface {
+	TrackingStore
+	CreateShipment(invoice_id int, shipment ShipmentPayload, tx *sql.Tx, ctx context.Context) (int, error)
+	AssignShipment(shipment_id int, item_id int, tx *sql.Tx, ctx context.Context) error
+	RefreshInvoiceShipStatus(invoice_id int, tx *sql.Tx, ctx context.Context) (string, error)
+	GetShipmentByID(id int) (*Shipment, error)
+	GetShipmentsByInvoice(invoice_id int) ([]Shipment, error)
+	EditShipment(id int, payload ShipmentPayload) error
+}
+
+type TrackingStore interface {
+	GetTrackedShipments() ([]Shipment, error)
+	UpdateTrackingStatus(shipment_id int, status string) error
+	MarkShipmentDelivered(shipment_id int, delivered_at time.Time) error
+}
+
+const (
+	InvoicePartiallyShipped	= "partially-shipped"
+	InvoiceShipped			= "shipped"
+	InvoiceDelivered		= "delivered"
+
+	ShipmentShipped		= "shipped"
+	ShipmentDelivered	= "delivered"
+)
+
+// Shipment is one parcel, an invoice can go out in several of them
+type Shipment struct {
+	ID				int			`json:"id"`
+	InvoiceID		int			`json:"invoice_id"`
+	Status			string		`json:"status"`
+	Courier			string		`json:"courier"`
+	CourierService	string		`json:"courier_service"`
+	TrackingNumber	string		`json:"tracking_number"`
+	PackageWeight	int			`json:"package_weight"`	// Grams
+	ShippingCost	Money		`json:"shipping_cost"`
+	TrackingStatus	string		`json:"tracking_status"`
+	ShippedAt		time.Time	`json:"shipped_at"`
+	DeliveredAt		*time.Time	`json:"delivered_at"`
+	RFIDTags		[]string	`json:"rfid_tags"`
+}
+
+// ShipmentPayload is the optional body of ship-items and the body of shipment edits
+type ShipmentPayload struct {
+	RFIDTags		[]string	`json:"rfid_tags"`	// Ship only these items, empty ships everything left on the invoice
+	Courier			string		`json:"courier"`
+	CourierService	string		`json:"courier_service"`
+	TrackingNumber	string		`json:"tracking_number"`
+	PackageWeight	int			`json:"package_weight" validate:"gte=0"`
+	ShippingCost	Money		`json:"shipping_cost" validate:"gte=0"`
+}
+
+// ErrInvoiceJournaled refuses splitting an invoice whose sale is already posted to the journal
+var ErrInvoiceJournaled = errors.New("invoice is already posted to the journal and cannot be split")
+
+// ErrInvoiceInUse refuses deleting an invoice a marketplace order was imported into or money was taken against
+var ErrInvoiceInUse = errors.New("invoice has a marketplace order or payments and cannot be deleted")
+
+type SplitInvoicePayload struct {
+	Invoice		string		`json:"invoice" validate:"required"`
+	RFIDTags	[]string	`json:"rfid_tags" validate:"required,min=1"`
+}
+
+type TrackingResult struct {
+	Status		string		`json:"status"`	// Courier status text, e.g. "ON PROCESS" or "DELIVERED"
+	Delivered	bool		`json:"delivered"`
+	DeliveredAt	*time.Time	`json:"delivered_at"`
+}
@@ -0,0 +1,70 @@
+package types
+
+import (
+	"time"
+)
+
+type TaxStore interface {
+	GetTaxRates() ([]TaxRate, error)
+	CreateTaxRate(payload TaxRatePayload) error
+	EditTaxRate(id int, payload EditTaxRatePayload) error
+	SetItemTypeTax(item_type string, payload ItemTypeTaxPayload) error
+	GetInvoiceTaxLines(invoice_id int) ([]TaxLine, error)
+	GetTaxSummary(from time.Time, to time.Time) ([]TaxSummary, error)
+}
+
+type TaxRate struct {
+	ID			int		`json:"id"`
+	Name		string	`json:"name"`
+	Rate		float64	`json:"rate"`	// Percent, 11 for PPN 11%
+	IsDefault	bool	`json:"is_default"`
+	Active		bool	`json:"active"`
+}
+
+type TaxRatePayload struct {
+	Name		string	`json:"name" validate:"required,max=100"`
+	Rate		float64	`json:"rate" validate:"gte=0,lt=100"`
+	IsDefault	bool	`json:"is_default"`
+}
+
+// Rate is left out on purpose, a different rate is a new tax rate so filed periods keep theirs
+type EditTaxRatePayload struct {
+	Name		string	`json:"name" validate:"omitempty,max=100"`
+	IsDefault	*bool	`json:"is_default"`
+	Active		*bool	`json:"active"`
+}
+
+// ItemTypeTaxPayload overrides the default rate and the channel's pricing for one item type, nil clears
+// the override
+type ItemTypeTaxPayload struct {
+	TaxRateID			*int	`json:"tax_rate_id" validate:"omitempty,gt=0"`
+	PriceIncludesTax	*bool	`json:"price_includes_tax"`
+}
+
+// TaxLine sums an invoice's items sold at the same rate and pricing
+type TaxLine struct {
+	Rate				float64	`json:"rate"`
+	PriceIncludesTax	bool	`json:"price_includes_tax"`
+	Items				int		`json:"items"`
+	Base				Money	`json:"base"`	// Dasar Pengenaan Pajak
+	Tax					Money	`json:"tax"`
+	Gross				Money	`json:"gross"`
+}
+
+type InvoiceTax struct {
+	InvoiceID	int			`json:"invoice_id"`
+	Lines		[]TaxLine	`json:"lines"`
+	Subtotal	Money		`json:"subtotal"`
+	Tax			Money		`json:"tax"`
+	Total		Money		`json:"total"`
+}
+
+type TaxSummary struct {
+	Month		string	`json:"month"`	// YYYY-MM
+	Rate		float64	`json:"rate"`
+	Invoices	int		`json:"invoices"`
+	Items		int		`json:"items"`
+	Base		Money	`json:"base"`
+	Tax			Money	`json:"tax"`
+	Gross		Money	`json:"gross"`
+}
@@ -26,8 +26,8 @@ type ItemStore interface {
 	GetItemsByInvoice (invoice_id int) ([]SoldItem, error)
 	GetInvoices (invoice string) ([]Invoice, error)
 	CreateInvoice(invoice string, ol_shop string, tx *sql.Tx, ctx context.Context) (int, error)
-	ShipInvoice (invoice_id int, tx *sql.Tx, ctx context.Context) error
-	GetAllInvoice (limit int, offset int, invoice string, status string) ([]Invoice, int, error)
+	SplitInvoice(invoice_id int, new_invoice string, item_ids []int, tx *sql.Tx, ctx context.Context) (int, error)
+	GetAllInvoice (limit int, offset int, invoice string, status string, payment_status string) ([]Invoice, int, error)
 	EditInvoice(id int, payload EditInvoice) error
 	DeleteInvoice(id int, tx *sql.Tx, ctx context.Context) error
 	GetInvoiceByID(id int) (*Invoice, error)
@@ -44,12 +44,16 @@ type Item struct {
 	Status		 string	`json:"status"`
 	TypeRef		 string	`json:"type_ref"`
 	CreatedAt	 time.Time	`json:"createdat"`	
+	Cost		 *Money	`json:"cost,omitempty"`
 }
 
 type ItemType struct {
-	ID			int 	`json:"id"`
-	TypeName 	string	`json:"item_type"`
-	Price		int		`json:"price"`
+	ID					int 	`json:"id"`
+	TypeName 			string	`json:"item_type"`
+	ListPrice			Money	`json:"list_price"`	// Converted to the base currency when sold
+	Price				*int64	`json:"price"`	// Whole base-currency units at today's rate for older clients, nil when no rate is known
+	TaxRateID			*int	`json:"tax_rate_id"`	// Nil uses the default tax rate
+	PriceIncludesTax	*bool	`json:"price_includes_tax"`	// Nil follows the channel
 }
 
 type TypesResponse struct {
@@ -83,6 +87,8 @@ type SoldItem struct {
 	InvoiceID		int			`json:"invoice_id"`
 	OnlineShop		string		`json:"ol_shop"`
 	ItemType		string		`json:"item_type"`
+	ShipmentID		*int		`json:"shipment_id"`
+	UnitPrice		*Money		`json:"unit_price,omitempty"`	// Agreed price in the base currency, the item type's list price when nil
 }
 
 type RegisterItemPayload struct {
@@ -90,6 +96,7 @@ type RegisterItemPayload struct {
 	RFIDTag      string `json:"rfid_tag" validate:"required"`
 	TypeRef		 string	`json:"type_ref" validate:"required"`
 	Batch	 int	`json:"batch" validate:"required"`
+	Cost		 *Money	`json:"cost" validate:"omitempty,gte=0"`	// Purchase cost in any currency, the database default when nil
 }
 
 type NewWarrantyPayload struct {
@@ -105,7 +112,7 @@ type GetItemAndWarrantyPayload struct {
 
 type ItemTypePayload struct {
 	ItemType	string	`json:"item_type" validate:"required"`
-	Price		int		`json:"price" validate:"required"`
+	Price		Money	`json:"price" validate:"required,gt=0"`
 }
 
 type SoldItemPayload struct {
@@ -133,6 +140,13 @@ type Invoice struct {
 	InvoiceStr		string		`json:"invoice_str"`
 	Status			string		`json:"status"`
 	OnlineShop		string		`json:"online_shop"`
+	ShippedAt		*time.Time	`json:"shipped_at"`	// Set once the last item left
+	DeliveredAt		*time.Time	`json:"delivered_at"`	// Set once every shipment was delivered
+	PaymentStatus	string		`json:"payment_status"`
+	AmountDue		Money		`json:"amount_due"`
+	AmountPaid		Money		`json:"amount_paid"`	// Payments less refunds
+	TaxAmount		Money		`json:"tax_amount"`	// Included in AmountDue
+	JournaledAt		*time.Time	`json:"journaled_at"`	// Set once the sale is posted to the journal
 }
 type InvoicePayload struct {
 	ID			int		`json:"id" validate:"required"`
@@ -2,18 +2,53 @@ package types
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
 type UserStore interface {
-	RegisterNewUser(user User) error
+	RegisterNewUser(user User) (int, error)
 	GetUserByEmail(email string) (*User, error)
 	GetUserById(id int) (*User, error)
+	GetUsers() ([]User, error)
+	EditUser(id int, payload EditUserPayload) error
+	SetUserActive(id int, active bool) error
+	GetUserByOIDC(issuer string, subject string) (*User, error)
+	LinkOIDC(user_id int, issuer string, subject string) error
+	CreateOIDCUser(user User, issuer string, subject string) (int, error)
 	DeleteUserById(id int, ctx context.Context) error
 	CreateSession(ctx context.Context, session Session) error
 	RevokeSession(session Session) error
 	CheckSession(tokenString string) (bool, int, error)
-	RevokeSessionBulk(id int) error
+	RotateSession(old_token string, next Session, grace time.Duration) (*Session, error)
+	RevokeSessionBulk(id int) (int64, error)
+	GetSessions(user_id int, current_token string) ([]SessionInfo, error)
+	RevokeSessionFamily(family_id string, user_id int) error
+	CreateDevice(device Device) (int, error)
+	GetDevices() ([]Device, error)
+	GetActiveDevice(key_id string) (*Device, error)
+	RevokeDevice(id int) error
+	TouchDevice(id int) error
+	SetPassword(user_id int, password_hash string) error
+	ResetPassword(token_hash string, password_hash string) (int, error)
+	VerifyEmail(user_id int) error
+	CreateUserToken(user_id int, purpose string, token_hash string, expires_at time.Time) error
+	ConsumeUserToken(purpose string, token_hash string) (int, error)
+	GetLoginThrottles(scopes ThrottleScopes, email string, ip string) ([]LoginThrottle, error)
+	RecordLoginFailure(scope string, subject string, now time.Time, reset_before time.Time, lock_after int, locked_until time.Time) (*LoginThrottle, error)
+	ClearLoginThrottle(scope string, subject string) error
+	GetLockouts(now time.Time) ([]LoginThrottle, error)
+	RecordAuthEvent(event AuthEvent) error
+	GetAuthEvents(user_id int, limit int) ([]AuthEvent, error)
+	GetTOTP(user_id int) (*TOTPState, error)
+	SetPendingTOTP(user_id int, secret string) error
+	EnableTOTP(user_id int, step int64, code_hashes []string) error
+	DisableTOTP(user_id int) error
+	UseTOTPStep(user_id int, step int64) (bool, error)
+	ReplaceRecoveryCodes(user_id int, code_hashes []string) error
+	UseRecoveryCode(user_id int, code_hash string) (bool, error)
+	GetMFARequiredRoles() ([]string, error)
+	SetMFARequiredRoles(roles []string) error
 }
 
 type User struct {
@@ -22,12 +57,30 @@ type User struct {
 	Username	string		`json:"username"`
 	Email		string		`json:"email"`
 	Password	string		`json:"-"`	// - is to ignore this field for the response(obvious reasons)
+	Role		string		`json:"role"`
+	EmailVerified	bool	`json:"email_verified"`
+	TOTPEnabled		bool	`json:"totp_enabled"`
+	Active			bool	`json:"active"`	// False once deactivated, the user can no longer log in
 }
 
+const (
+	RoleAdmin		= "admin"
+	RoleSupervisor	= "supervisor"
+	RoleStaff		= "staff"
+)
+
 type UserPayload struct {
 	Username	string	`json:"username" validate:"required"`
 	Email		string 	`json:"email" validate:"required,email"`
 	Password 	string 	`json:"password" validate:"required,min=3,max=130"`
+	Role		string	`json:"role" validate:"omitempty,oneof=admin supervisor staff"`	// Staff when empty
+}
+
+// EditUserPayload changes only the fields that are set
+type EditUserPayload struct {
+	Username	string	`json:"username" validate:"omitempty,max=255"`
+	Email		string	`json:"email" validate:"omitempty,email"`
+	Role		string	`json:"role" validate:"omitempty,oneof=admin supervisor staff"`
 }
 
 type LoginPayload struct {
@@ -35,6 +88,30 @@ type LoginPayload struct {
 	Password 	string 	`json:"password" validate:"required"`
 }
 
+type ChangePasswordPayload struct {
+	CurrentPassword	string	`json:"current_password" validate:"required"`
+	NewPassword		string	`json:"new_password" validate:"required,min=3,max=130"`
+}
+
+type ForgotPasswordPayload struct {
+	Email	string	`json:"email" validate:"required,email"`
+}
+
+type ResetPasswordPayload struct {
+	Token		string	`json:"token" validate:"required"`
+	Password	string	`json:"password" validate:"required,min=3,max=130"`
+}
+
+type TokenPayload struct {
+	Token	string	`json:"token" validate:"required"`
+}
+
+// Purposes of the single use tokens mailed to users
+const (
+	TokenPasswordReset	= "password_reset"
+	TokenEmailVerify	= "email_verify"
+)
+
 type DeletePayload struct {
 	ID	int 
 }
@@ -42,4 +119,142 @@ type DeletePayload struct {
 type Session struct {
 	Userid 			int		`json:"userid" validate:"required"`
 	RefreshToken	string	`json:"refresh_token" validate:"required"`
+	FamilyID		string	`json:"-"`	// Shared by every rotation of one login
+	UserAgent		string	`json:"-"`
+	IPAddress		string	`json:"-"`
+	Expiration		time.Time	`json:"-"`	// The refresh cookie lasts as long
+}
+
+// SessionInfo is one login as listed to its user, the ID is the session family so it survives refreshes
+type SessionInfo struct {
+	ID			string		`json:"id"`
+	Userid		int			`json:"userid"`
+	UserAgent	string		`json:"user_agent"`
+	IPAddress	string		`json:"ip_address"`
+	CreatedAt	time.Time	`json:"createdat"`
+	LastUsedAt	time.Time	`json:"last_used_at"`
+	Expiration	time.Time	`json:"expiration"`
+	Current		bool		`json:"current"`	// The login the request came from
+}
+
+// Device is a handheld or desk reader signing requests for MobileAuth, KeyID is sent in the Device-Id header
+type Device struct {
+	ID			int			`json:"id"`
+	Name		string		`json:"name"`
+	KeyID		string		`json:"key_id"`
+	Secret		string		`json:"-"`	// Only shown once, when the device is issued
+	CreatedBy	int			`json:"created_by"`
+	CreatedAt	time.Time	`json:"createdat"`
+	LastSeenAt	*time.Time	`json:"last_seen_at"`
+	RevokedAt	*time.Time	`json:"revoked_at"`
+}
+
+type DevicePayload struct {
+	Name	string	`json:"name" validate:"required,max=100"`
+}
+
+// IssuedDevice is the response to issuing a device, the only time its secret leaves the server
+type IssuedDevice struct {
+	Device
+	Secret	string	`json:"secret"`
+}
+
+// TOTPState is a user's authenticator secret, set but not Enabled while enrollment awaits its first code
+type TOTPState struct {
+	Secret		string
+	Enabled		bool
+	LastStep	int64
+}
+
+type TOTPCodePayload struct {
+	Code	string	`json:"code" validate:"required,len=6,numeric"`
+}
+
+type DisableTOTPPayload struct {
+	Password	string	`json:"password" validate:"required"`
+	Code		string	`json:"code" validate:"required,len=6,numeric"`
+}
+
+// LoginMFAPayload finishes a login that answered mfa_required, with an authenticator code or a recovery code
+type LoginMFAPayload struct {
+	MFAToken		string	`json:"mfa_token" validate:"required"`
+	Code			string	`json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode	string	`json:"recovery_code" validate:"required_without=Code"`
 }
+
+type MFAPolicyPayload struct {
+	Roles	[]string	`json:"roles" validate:"dive,oneof=admin supervisor staff"`
+}
+
+// Scopes failed logins are counted in
+const (
+	ThrottleAccount	= "account"
+	ThrottleIP		= "ip"
+	ThrottleMailAccount	= "mail_account"	// Reset and verification mails asked for, apart so they cannot lock a login
+	ThrottleMailIP		= "mail_ip"
+)
+
+// ThrottleScopes are the account and IP scopes one limiter counts in
+type ThrottleScopes struct {
+	Account	string
+	IP		string
+}
+
+var (
+	LoginScopes	= ThrottleScopes{Account: ThrottleAccount, IP: ThrottleIP}
+	MailScopes	= ThrottleScopes{Account: ThrottleMailAccount, IP: ThrottleMailIP}
+)
+
+// LoginThrottle counts recent failed logins for one account or IP, see user.loginBlockedUntil
+type LoginThrottle struct {
+	Scope			string		`json:"scope"`
+	Subject			string		`json:"subject"`	// Lowercased email or IP
+	Failures		int			`json:"failures"`
+	LastFailureAt	time.Time	`json:"last_failure_at"`
+	LockedUntil		*time.Time	`json:"locked_until"`
+}
+
+type UnlockPayload struct {
+	Email	string	`json:"email" validate:"required_without=IP,omitempty,email"`
+	IP		string	`json:"ip" validate:"required_without=Email,omitempty,ip"`
+}
+
+// Events kept in the auth audit log
+const (
+	AuthLoginSuccess		= "login_success"
+	AuthLoginFailure		= "login_failure"
+	AuthLoginBlocked		= "login_blocked"
+	AuthLockout				= "lockout"
+	AuthUnlock				= "unlock"
+	AuthPasswordChanged		= "password_changed"
+	AuthPasswordReset		= "password_reset"
+	AuthRefreshTokenReuse	= "refresh_token_reuse"
+	AuthMFAEnabled			= "mfa_enabled"
+	AuthMFADisabled			= "mfa_disabled"
+	AuthRecoveryCodeUsed	= "recovery_code_used"
+	AuthUserUpdated			= "user_updated"
+	AuthUserDeactivated		= "user_deactivated"
+	AuthUserActivated		= "user_activated"
+	AuthForcedLogout		= "forced_logout"
+	AuthSSOLinked			= "sso_linked"
+	AuthSSOProvisioned		= "sso_provisioned"
+)
+
+type AuthEvent struct {
+	ID			int64		`json:"id"`
+	Userid		int			`json:"userid"`	// 0 when the email matched no user
+	Email		string		`json:"email"`
+	Event		string		`json:"event"`
+	IPAddress	string		`json:"ip_address"`
+	UserAgent	string		`json:"user_agent"`
+	Detail		string		`json:"detail"`
+	CreatedAt	time.Time	`json:"createdat"`
+}
+
+var (
+	ErrSessionNotFound		= errors.New("session does not exist")
+	ErrSessionExpired		= errors.New("session expired")
+	ErrSessionRevoked		= errors.New("session revoked")
+	ErrRefreshTokenReused	= errors.New("refresh token was already used, all sessions of this login are revoked")
+	ErrInvalidUserToken		= errors.New("link is invalid or has expired")
+)
@@ -5,13 +5,31 @@ import (
 	"fmt"
 	"html"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"reflect"
 	"regexp"
+
+	"github.com/PatrickA727/mikrotik-db-sys/types"
 	"github.com/go-playground/validator/v10"
 )
 
-var Validate = validator.New()	
+var Validate = newValidator()
+
+// newValidator checks Money fields by their minor units, so gt=0 and gte=0 work on amounts
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		if money, ok := field.Interface().(types.Money); ok {
+			return money.Amount
+		}
+		return nil
+	}, types.Money{})
+
+	return v
+}
 
 func ParseJSON(r *http.Request, payload any) error {	
 	if r.Body == nil {
@@ -48,6 +66,91 @@ func GetTokenFromCookie(r *http.Request) string {
     return cookie.Value
 }
 
+// ClientIP is the address the request came from. Behind a reverse proxy set TRUST_PROXY_HEADERS=true and
+// X-Forwarded-For is read from the right, skipping the proxies in TRUSTED_PROXIES, so the client can only
+// write hops to the left of the one that counts. The header is ignored unless the connection itself is from a
+// trusted proxy
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if os.Getenv("TRUST_PROXY_HEADERS") != "true" {
+		return host
+	}
+
+	trusted := trustedProxies()
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break	// Not written by a proxy, keep the nearest address that was
+		}
+
+		client = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+
+	return client
+}
+
+// trustedProxies is TRUSTED_PROXIES, comma separated addresses or CIDR ranges. It defaults to loopback and the
+// private ranges where a reverse proxy usually sits
+func trustedProxies() []*net.IPNet {
+	list := os.Getenv("TRUSTED_PROXIES")
+	if list == "" {
+		list = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+	}
+
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("ignoring invalid TRUSTED_PROXIES entry %q", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+func isTrustedProxy(address string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func SanitizeInput(input string) string {
 	input = strings.TrimSpace(input)
 	input = html.EscapeString(input)	// Changes the HTML characters such as <, >, etc so it cant run a script